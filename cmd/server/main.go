@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -11,7 +12,11 @@ import (
 
 	"github.com/Jasonbourne723/platodb/config"
 	"github.com/Jasonbourne723/platodb/internal/database"
+	"github.com/Jasonbourne723/platodb/internal/database/memorytable"
+	"github.com/Jasonbourne723/platodb/internal/database/sstable"
+	"github.com/Jasonbourne723/platodb/internal/database/wal"
 	"github.com/Jasonbourne723/platodb/internal/network"
+	"github.com/Jasonbourne723/platodb/internal/raft"
 )
 
 func main() {
@@ -20,11 +25,92 @@ func main() {
 		log.Fatal(fmt.Errorf("配置加载失败:%w", err))
 	}
 
-	db, err := database.NewDB(database.Dir(cfg.Database.DataDir, cfg.Database.WalDir), database.SegmentSize(int32(cfg.Database.SegmentSize)))
+	walSyncPolicy, err := wal.ParseSyncPolicy(cfg.Database.WalSync,
+		time.Duration(cfg.Database.WalSyncInterval)*time.Millisecond,
+		int64(cfg.Database.WalSyncBytes),
+	)
+	if err != nil {
+		log.Fatal(fmt.Errorf("配置加载失败:%w", err))
+	}
+
+	newMemoryTable, err := memorytable.ParseType(cfg.MemoryTable.Type)
+	if err != nil {
+		log.Fatal(fmt.Errorf("配置加载失败:%w", err))
+	}
+
+	blockCompression, err := sstable.ParseCompression(cfg.Database.BlockCompression)
+	if err != nil {
+		log.Fatal(fmt.Errorf("配置加载失败:%w", err))
+	}
+
+	options := []database.Options{
+		database.Dir(cfg.Database.DataDir, cfg.Database.WalDir),
+		database.SegmentSize(int32(cfg.Database.SegmentSize)),
+		database.BloomFalsePositiveRate(cfg.Database.BloomFalsePositiveRate),
+		database.MaxLevels(cfg.Compaction.MaxLevels),
+		database.Level0CompactionTrigger(cfg.Compaction.Level0CompactionTrigger),
+		database.LevelSizeRatio(cfg.Compaction.LevelSizeRatio),
+		database.WalSync(walSyncPolicy),
+		database.WalArchive(cfg.Database.WalArchiveDir),
+		database.ValueThreshold(cfg.Database.ValueThreshold),
+		database.ValueLogFileSize(int32(cfg.Database.ValueLogFileSize)),
+		database.ValueLogGC(time.Duration(cfg.Database.ValueLogGCInterval)*time.Second, cfg.Database.ValueLogGCRatio),
+		database.BlockCacheSize(int32(cfg.Database.BlockCacheSize)),
+		database.MemoryTable(newMemoryTable),
+		database.BlockCompression(blockCompression),
+		database.MergeOperator(network.MergeOperator()),
+	}
+	columnFamilies := make(map[string][]database.CFOptions, len(cfg.ColumnFamilies))
+	for _, cf := range cfg.ColumnFamilies {
+		var cfOptions []database.CFOptions
+		if cf.SegmentSize > 0 {
+			cfOptions = append(cfOptions, database.CFSegmentSize(int32(cf.SegmentSize)))
+		}
+		if cf.MemoryTable != "" {
+			newMemoryTable, err := memorytable.ParseType(cf.MemoryTable)
+			if err != nil {
+				log.Fatal(fmt.Errorf("配置加载失败:%w", err))
+			}
+			cfOptions = append(cfOptions, database.CFMemoryTable(newMemoryTable))
+		}
+		if cf.BlockCompression != "" {
+			compression, err := sstable.ParseCompression(cf.BlockCompression)
+			if err != nil {
+				log.Fatal(fmt.Errorf("配置加载失败:%w", err))
+			}
+			cfOptions = append(cfOptions, database.CFBlockCompression(compression))
+		}
+		columnFamilies[cf.Name] = cfOptions
+		// 重新打开数据库时列族沿用同样的选项
+		options = append(options, database.ColumnFamilyOptions(cf.Name, cfOptions...))
+	}
+	db, err := database.NewDB(options...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	processor := network.NewCommandProcessor(db)
+	for name, cfOptions := range columnFamilies {
+		if _, err := db.CreateColumnFamily(name, cfOptions...); err != nil && !errors.Is(err, database.ErrColumnFamilyExists) {
+			log.Fatal(fmt.Errorf("列族 %s 创建失败:%w", name, err))
+		}
+	}
+	// 作为副本全量同步后，用同样的配置重新打开数据库
+	processor := network.NewCommandProcessor(db, network.DatabaseOpener(func() (*database.DB, error) {
+		return database.NewDB(options...)
+	}))
+	if cfg.Raft.ID != "" {
+		servers, err := raft.ParseServers(cfg.Raft.Bootstrap)
+		if err != nil {
+			log.Fatal(fmt.Errorf("配置加载失败:%w", err))
+		}
+		transport, err := raft.NewNetTransport(cfg.Raft.Address)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// 配置了 bootstrap 的服务器在首次启动时初始化集群，其余服务器由领导者通过 CLUSTER ADD 加入
+		if err := processor.StartRaft(cfg.Raft.ID, cfg.Raft.Dir, transport, servers); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	srv, err := network.NewServer(ctx, processor, network.WithAddress(cfg.Network.Address))
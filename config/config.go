@@ -11,12 +11,36 @@ import (
 // Config 结构体，用于映射配置文件
 type Config struct {
 	Database struct {
-		DataDir       string `mapstructure:"data_dir"`
-		WalDir        string `mapstructure:"wal_dir"`
-		SegmentSize   int    `mapstructure:"segment_size"`
-		FlushInterval int    `mapstructure:"flush_interval"`
+		DataDir                string  `mapstructure:"data_dir"`
+		WalDir                 string  `mapstructure:"wal_dir"`
+		SegmentSize            int     `mapstructure:"segment_size"`
+		FlushInterval          int     `mapstructure:"flush_interval"`
+		BloomFalsePositiveRate float64 `mapstructure:"bloom_false_positive_rate"`
+		WalSync                string  `mapstructure:"wal_sync"`
+		WalSyncInterval        int     `mapstructure:"wal_sync_interval"`
+		WalSyncBytes           int     `mapstructure:"wal_sync_bytes"`
+		WalArchiveDir          string  `mapstructure:"wal_archive_dir"`
+		ValueThreshold         int     `mapstructure:"value_threshold"`
+		ValueLogFileSize       int     `mapstructure:"value_log_file_size"`
+		ValueLogGCInterval     int     `mapstructure:"value_log_gc_interval"`
+		ValueLogGCRatio        float64 `mapstructure:"value_log_gc_ratio"`
+		BlockCacheSize         int     `mapstructure:"block_cache_size"`
+		BlockCompression       string  `mapstructure:"block_compression"`
 	} `mapstructure:"database"`
 
+	ColumnFamilies []struct {
+		Name             string `mapstructure:"name"`
+		SegmentSize      int    `mapstructure:"segment_size"`
+		MemoryTable      string `mapstructure:"memory_table"`
+		BlockCompression string `mapstructure:"block_compression"`
+	} `mapstructure:"column_families"`
+
+	Compaction struct {
+		MaxLevels               int `mapstructure:"max_levels"`
+		Level0CompactionTrigger int `mapstructure:"level0_compaction_trigger"`
+		LevelSizeRatio          int `mapstructure:"level_size_ratio"`
+	} `mapstructure:"compaction"`
+
 	MemoryTable struct {
 		MaxSize int    `mapstructure:"max_size"`
 		Type    string `mapstructure:"type"`
@@ -26,6 +50,13 @@ type Config struct {
 		Address string `mapstructure:"address"`
 	} `mapstructure:"network"`
 
+	Raft struct {
+		ID        string   `mapstructure:"id"`
+		Address   string   `mapstructure:"address"`
+		Dir       string   `mapstructure:"dir"`
+		Bootstrap []string `mapstructure:"bootstrap"`
+	} `mapstructure:"raft"`
+
 	Logging struct {
 		Level   string `mapstructure:"level"`
 		LogFile string `mapstructure:"log_file"`
@@ -4,6 +4,9 @@ go 1.21.3
 
 require (
 	github.com/fsnotify/fsnotify v1.7.0
+	github.com/golang/snappy v0.0.4
+	github.com/klauspost/compress v1.17.2
+	github.com/pierrec/lz4/v4 v4.1.21
 	github.com/spf13/cobra v1.8.1
 	github.com/spf13/viper v1.19.0
 	github.com/stretchr/testify v1.9.0
@@ -30,10 +30,11 @@ var rootCommand = &cobra.Command{
 	},
 }
 
-// Execute sets up the root command's persistent flags, specifically the server address and port, and then attempts to execute the root command. If an error occurs during execution, the function logs the error and exits the program. This function is typically used as the entry point for a CLI application.
+// Execute sets up the root command's persistent flags, specifically the server address and port, along with the restore subcommand, and then attempts to execute the root command. If an error occurs during execution, the function logs the error and exits the program. This function is typically used as the entry point for a CLI application.
 func Execute() {
 
 	rootCommand.PersistentFlags().String("server", "127.0.0.1:6399", "服务器地址和端口")
+	addRestoreCommand()
 	if err := rootCommand.Execute(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,269 @@
+package database
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+	"github.com/Jasonbourne723/platodb/internal/database/memorytable"
+)
+
+// WriteBatch collects Set, Del, DeleteRange and Merge operations that DB.Write applies atomically:
+// the whole batch is logged as one WAL record and applied to the memory tables at once,
+// so after a crash either every operation of the batch is recovered or none of them is.
+// Operations apply to the default column family, or to the column family given to their CF variant;
+// a single batch may span several column families.
+// Operations on the same key are applied in the order they were added, the last one winning.
+type WriteBatch struct {
+	chunks []common.Chunk
+}
+
+// NewWriteBatch returns an empty batch.
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{
+		chunks: make([]common.Chunk, 0, 8),
+	}
+}
+
+// Set adds the storage of value under key to the batch.
+func (b *WriteBatch) Set(key string, value []byte) {
+	b.chunks = append(b.chunks, common.Chunk{
+		Key:     key,
+		Value:   value,
+		Deleted: false,
+	})
+}
+
+// SetCF is Set in the column family cf.
+func (b *WriteBatch) SetCF(cf *ColumnFamily, key string, value []byte) {
+	b.Set(key, value)
+	b.setColumnFamily(cf)
+}
+
+// SetWithTTL adds the storage of value under key to the batch, expiring ttl from now.
+func (b *WriteBatch) SetWithTTL(key string, value []byte, ttl time.Duration) {
+	b.chunks = append(b.chunks, common.Chunk{
+		Key:       key,
+		Value:     value,
+		Deleted:   false,
+		ExpiresAt: time.Now().Add(ttl).UnixMilli(),
+	})
+}
+
+// SetWithTTLCF is SetWithTTL in the column family cf.
+func (b *WriteBatch) SetWithTTLCF(cf *ColumnFamily, key string, value []byte, ttl time.Duration) {
+	b.SetWithTTL(key, value, ttl)
+	b.setColumnFamily(cf)
+}
+
+// Del adds the deletion of key to the batch.
+func (b *WriteBatch) Del(key string) {
+	b.chunks = append(b.chunks, common.Chunk{
+		Key:     key,
+		Value:   nil,
+		Deleted: true,
+	})
+}
+
+// DelCF is Del in the column family cf.
+func (b *WriteBatch) DelCF(cf *ColumnFamily, key string) {
+	b.Del(key)
+	b.setColumnFamily(cf)
+}
+
+// DeleteRange adds the deletion of every key in [start, end) to the batch.
+// Keys written to the range afterwards, in this batch or later, are not affected. An empty range is ignored.
+func (b *WriteBatch) DeleteRange(start, end string) {
+	if start >= end {
+		return
+	}
+	b.chunks = append(b.chunks, common.Chunk{
+		Key:         start,
+		Value:       []byte(end),
+		RangeDelete: true,
+	})
+}
+
+// DeleteRangeCF is DeleteRange in the column family cf.
+func (b *WriteBatch) DeleteRangeCF(cf *ColumnFamily, start, end string) {
+	if start >= end {
+		return
+	}
+	b.DeleteRange(start, end)
+	b.setColumnFamily(cf)
+}
+
+// Merge adds the merge operand operand of key to the batch; see DB.Merge.
+// DB.Write does not check that the column family has a merge operator: reading the key fails without one.
+func (b *WriteBatch) Merge(key string, operand []byte) {
+	b.chunks = append(b.chunks, common.Chunk{
+		Key:   key,
+		Value: operand,
+		Merge: true,
+	})
+}
+
+// MergeCF is Merge in the column family cf.
+func (b *WriteBatch) MergeCF(cf *ColumnFamily, key string, operand []byte) {
+	b.Merge(key, operand)
+	b.setColumnFamily(cf)
+}
+
+// setColumnFamily moves the last operation of the batch to the column family cf.
+func (b *WriteBatch) setColumnFamily(cf *ColumnFamily) {
+	b.chunks[len(b.chunks)-1].ColumnFamily = cf.id
+}
+
+// Len returns the number of operations in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.chunks)
+}
+
+// Reset removes every operation from the batch so that it can be reused.
+func (b *WriteBatch) Reset() {
+	b.chunks = b.chunks[:0]
+}
+
+// Write applies every operation of the batch atomically.
+// Every operation gets the next sequence number, in order. The batch is written to the Write-Ahead Log (WAL) as a single
+// record before it is applied to the active memory tables, and writers are serialized so that the order of records in
+// the WAL matches the order they are applied in. Snapshots taken afterwards see the whole batch, earlier ones none of it.
+// Write returns only once the record is durable under the WAL sync policy of the database. The wait happens after
+// the write lock is released, so concurrent writers can share one fsync; in the meantime the batch is already
+// visible to readers.
+// If the in-memory table size of a column family exceeds its segment size afterwards, a flush operation is initiated.
+// Returns an error if the database is shutting down, if a column family of the batch has been dropped or if the WAL
+// write or sync fails; if the write fails nothing is applied.
+func (db *DB) Write(batch *WriteBatch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	return db.write(batch, nil)
+}
+
+// write implements Write. When prepare is not nil, it is called under the write lock before the batch is logged,
+// so that it can fill the batch from the current state of the database without racing other writers;
+// it must not take the memory table lock. Nothing is written if prepare fails or leaves the batch empty.
+func (db *DB) write(batch *WriteBatch, prepare func() error) error {
+
+	if atomic.LoadInt32(&db.isShutdonw) == 1 {
+		return errors.New("database is shutting down")
+	}
+
+	db.memoryTableLock.RLocker().Lock()
+	db.writeLock.Lock()
+	if prepare != nil {
+		if err := prepare(); err != nil || batch.Len() == 0 {
+			db.writeLock.Unlock()
+			db.memoryTableLock.RLocker().Unlock()
+			return err
+		}
+	}
+	memoryTables, err := db.activeMemoryTables(batch.chunks)
+	if err != nil {
+		db.writeLock.Unlock()
+		db.memoryTableLock.RLocker().Unlock()
+		return err
+	}
+
+	walWriter := db.wals[len(db.wals)-1]
+	seq := db.assignSequence(batch.chunks)
+	offset, err := walWriter.WriteBatch(batch.chunks)
+	if err != nil {
+		db.writeLock.Unlock()
+		db.memoryTableLock.RLocker().Unlock()
+		return err
+	}
+	applyBatch(batch.chunks, memoryTables)
+	db.writeStreams.publish(batch.chunks)
+	full := false
+	for id, memoryTable := range memoryTables {
+		full = full || memoryTable.Size() > db.columnFamilies[id].segmentSize
+	}
+	db.publishSequence(seq)
+	db.writeLock.Unlock()
+	db.memoryTableLock.RLocker().Unlock()
+
+	// 内存表被刷盘时 WAL 会在关闭前完成同步，因此这里等待的 WAL 即使已被关闭也不会丢失记录
+	if err := walWriter.WaitDurable(offset); err != nil {
+		return err
+	}
+
+	if full {
+		db.initiateFlush()
+	}
+	return nil
+}
+
+// activeMemoryTables returns the active memory table of every column family chunks belong to, by column family id.
+// Returns ErrColumnFamilyDropped if one of them has been dropped. The caller must hold the memory table lock.
+func (db *DB) activeMemoryTables(chunks []common.Chunk) (map[uint32]memorytable.MemoryTable, error) {
+	memoryTables := make(map[uint32]memorytable.MemoryTable, 1)
+	for i := range chunks {
+		id := chunks[i].ColumnFamily
+		if _, ok := memoryTables[id]; ok {
+			continue
+		}
+		cf, ok := db.columnFamilies[id]
+		if !ok {
+			return nil, ErrColumnFamilyDropped
+		}
+		memoryTables[id] = cf.activeMemoryTable()
+	}
+	return memoryTables, nil
+}
+
+// applyBatch applies chunks, which already carry their sequence numbers, to the memory tables of their column
+// families, given by column family id; the chunks of a column family without memory table are skipped.
+// Range deletions are kept apart from the versions of the keys.
+func applyBatch(chunks []common.Chunk, memoryTables map[uint32]memorytable.MemoryTable) {
+	if len(chunks) == 0 {
+		return
+	}
+	// 绝大多数批次只属于一个列族，此时无需拆分
+	single := true
+	for i := range chunks {
+		single = single && chunks[i].ColumnFamily == chunks[0].ColumnFamily
+	}
+	if single {
+		if memoryTable, ok := memoryTables[chunks[0].ColumnFamily]; ok {
+			applyToMemoryTable(memoryTable, chunks)
+		}
+		return
+	}
+	byColumnFamily := make(map[uint32][]common.Chunk, len(memoryTables))
+	for i := range chunks {
+		id := chunks[i].ColumnFamily
+		byColumnFamily[id] = append(byColumnFamily[id], chunks[i])
+	}
+	for id, chunks := range byColumnFamily {
+		if memoryTable, ok := memoryTables[id]; ok {
+			applyToMemoryTable(memoryTable, chunks)
+		}
+	}
+}
+
+// applyToMemoryTable applies chunks of a single column family to memoryTable.
+func applyToMemoryTable(memoryTable memorytable.MemoryTable, chunks []common.Chunk) {
+	hasRangeDelete := false
+	for i := range chunks {
+		hasRangeDelete = hasRangeDelete || chunks[i].RangeDelete
+	}
+	if !hasRangeDelete {
+		memoryTable.SetBatch(chunks)
+		return
+	}
+
+	points := make([]common.Chunk, 0, len(chunks))
+	for i := range chunks {
+		if chunks[i].RangeDelete {
+			memoryTable.DeleteRange(chunks[i].RangeTombstone())
+		} else {
+			points = append(points, chunks[i])
+		}
+	}
+	if len(points) > 0 {
+		memoryTable.SetBatch(points)
+	}
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jasonbourne723/platodb/internal/database/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_WriteBatch(t *testing.T) {
+	db := newTestDB(t)
+	assert.NoError(t, db.Set("k1", []byte("old")))
+
+	batch := NewWriteBatch()
+	batch.Set("k1", []byte("v1"))
+	batch.Set("k2", []byte("v2"))
+	batch.Del("k2")
+	batch.Set("k3", []byte("v3"))
+	assert.Equal(t, 4, batch.Len())
+	assert.NoError(t, db.Write(batch))
+
+	value, err := db.Get("k1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v1"), value)
+
+	value, err = db.Get("k2")
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+
+	value, err = db.Get("k3")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v3"), value)
+
+	batch.Reset()
+	assert.Equal(t, 0, batch.Len())
+	assert.NoError(t, db.Write(batch))
+}
+
+func TestDB_RecoverSkipsIncompleteBatch(t *testing.T) {
+	dir := t.TempDir()
+	walDir := filepath.Join(dir, "wal")
+
+	// 不调用 Shutdown，模拟进程崩溃后 WAL 文件仍然保留
+	crashed, err := NewDB(Dir(dir, walDir))
+	assert.NoError(t, err)
+	batch := NewWriteBatch()
+	batch.Set("a", []byte("1"))
+	batch.Set("b", []byte("2"))
+	assert.NoError(t, crashed.Write(batch))
+
+	// 追加一个只写了一半的批次：类型、CRC、长度齐全，但负载被截断
+	walFiles, _ := filepath.Glob(filepath.Join(walDir, "*.log"))
+	assert.Len(t, walFiles, 1)
+	f, err := os.OpenFile(walFiles[0], os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{2, 0xde, 0xad, 0xbe, 0xef, 0, 0, 0, 40, 0, 0, 0, 2, 0})
+	assert.NoError(t, err)
+	f.Close()
+
+	db, err := NewDB(Dir(dir, walDir))
+	assert.NoError(t, err)
+	defer db.Shutdown()
+
+	value, err := db.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), value)
+	value, err = db.Get("b")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), value)
+}
+
+func TestDB_WalSyncPolicies(t *testing.T) {
+	policies := map[string]wal.SyncPolicy{
+		"none":   wal.NoSync(),
+		"always": wal.SyncEveryWrite(),
+		"group":  wal.GroupCommit(5*time.Millisecond, 4*1024),
+	}
+	for name, policy := range policies {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			walDir := filepath.Join(dir, "wal")
+
+			// 并发写入后不调用 Shutdown，模拟进程崩溃
+			crashed, err := NewDB(Dir(dir, walDir), WalSync(policy))
+			assert.NoError(t, err)
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 50; j++ {
+						assert.NoError(t, crashed.Set(fmt.Sprintf("k%d-%d", i, j), []byte("v")))
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			db, err := NewDB(Dir(dir, walDir), WalSync(policy))
+			assert.NoError(t, err)
+			defer db.Shutdown()
+			for i := 0; i < 8; i++ {
+				for j := 0; j < 50; j++ {
+					value, err := db.Get(fmt.Sprintf("k%d-%d", i, j))
+					assert.NoError(t, err)
+					assert.Equal(t, []byte("v"), value)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	policy, err := wal.ParseSyncPolicy("group", 0, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, wal.SyncPolicy{Mode: wal.SyncGroup, Interval: wal.DefaultSyncInterval, Bytes: 100}, policy)
+
+	policy, err = wal.ParseSyncPolicy("", time.Second, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, wal.NoSync(), policy)
+
+	_, err = wal.ParseSyncPolicy("sometimes", 0, 0)
+	assert.Error(t, err)
+}
+
+func TestDB_LargeKeysAndValues(t *testing.T) {
+	dir := t.TempDir()
+	walDir := filepath.Join(dir, "wal")
+	longKey := strings.Repeat("k", 300)
+	largeValue := bytes.Repeat([]byte("v"), 70*1024)
+
+	// 先从 WAL 恢复，再从段文件读取
+	crashed, err := NewDB(Dir(dir, walDir))
+	assert.NoError(t, err)
+	assert.NoError(t, crashed.Set(longKey, []byte("long key")))
+	assert.NoError(t, crashed.Set("large", largeValue))
+
+	db, err := NewDB(Dir(dir, walDir))
+	assert.NoError(t, err)
+	defer db.Shutdown()
+	value, err := db.Get(longKey)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("long key"), value)
+	value, err = db.Get("large")
+	assert.NoError(t, err)
+	assert.Equal(t, largeValue, value)
+}
@@ -0,0 +1,223 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// numShards is the number of independently locked parts the cache is split into, to reduce lock contention.
+const numShards = 16
+
+// Key identifies a cached block: the id its owner got from NewId and the offset of the block within the owner.
+type Key struct {
+	Id     uint64
+	Offset int64
+}
+
+// Stats reports the activity and the memory use of a cache.
+type Stats struct {
+	Hits     uint64
+	Misses   uint64
+	Usage    int64
+	Capacity int64
+}
+
+// Handle is a pinned entry of the cache. The entry cannot be evicted until every handle on it has been released.
+type Handle struct {
+	key     Key
+	value   interface{}
+	charge  int64
+	refs    int32
+	inCache bool
+	element *list.Element
+}
+
+// Value returns the value of the entry.
+func (h *Handle) Value() interface{} {
+	return h.value
+}
+
+// Cache is a sharded LRU cache holding up to a byte budget, shared by every segment of a database.
+// Every entry is charged its size in bytes; once the budget is exceeded the least recently used entries
+// that are not pinned by a handle are evicted. Pinned entries still count towards the budget, which may therefore
+// be exceeded while many of them are in use.
+// A Cache is safe for concurrent use.
+type Cache struct {
+	shards   [numShards]*shard
+	capacity int64
+	nextId   uint64
+	hits     uint64
+	misses   uint64
+}
+
+// shard is an independently locked part of the cache.
+// The table holds every cached entry; the lru list only holds the entries no handle pins, most recently used first.
+type shard struct {
+	lock     *sync.Mutex
+	capacity int64
+	usage    int64
+	table    map[Key]*Handle
+	lru      *list.List
+}
+
+// New returns a cache holding up to capacity bytes. A cache with a non-positive capacity keeps nothing:
+// entries only live as long as a handle pins them.
+func New(capacity int64) *Cache {
+	if capacity < 0 {
+		capacity = 0
+	}
+	c := &Cache{capacity: capacity}
+	for i := range c.shards {
+		c.shards[i] = &shard{
+			lock:     &sync.Mutex{},
+			capacity: (capacity + numShards - 1) / numShards,
+			table:    make(map[Key]*Handle),
+			lru:      list.New(),
+		}
+	}
+	return c
+}
+
+// NewId returns an id that no other owner of the cache uses, to build the keys of its entries.
+func (c *Cache) NewId() uint64 {
+	return atomic.AddUint64(&c.nextId, 1)
+}
+
+// Lookup returns a handle pinning the entry of key, or nil if the cache does not hold it.
+// The handle must be released with Release once the value is no longer used.
+func (c *Cache) Lookup(key Key) *Handle {
+	h := c.shardOf(key).lookup(key)
+	if h == nil {
+		atomic.AddUint64(&c.misses, 1)
+	} else {
+		atomic.AddUint64(&c.hits, 1)
+	}
+	return h
+}
+
+// Insert adds value under key, charged charge bytes, replacing any entry already cached under key,
+// and returns a handle pinning it that must be released with Release.
+func (c *Cache) Insert(key Key, value interface{}, charge int64) *Handle {
+	return c.shardOf(key).insert(key, value, charge)
+}
+
+// Release unpins the entry of a handle returned by Lookup or Insert.
+func (c *Cache) Release(h *Handle) {
+	c.shardOf(h.key).release(h)
+}
+
+// Erase removes the entry of key from the cache. Handles still pinning it stay usable.
+func (c *Cache) Erase(key Key) {
+	c.shardOf(key).erase(key)
+}
+
+// Stats returns the hit and miss counters of Lookup and the bytes currently charged to the cache.
+func (c *Cache) Stats() Stats {
+	stats := Stats{
+		Hits:     atomic.LoadUint64(&c.hits),
+		Misses:   atomic.LoadUint64(&c.misses),
+		Capacity: c.capacity,
+	}
+	for _, s := range c.shards {
+		s.lock.Lock()
+		stats.Usage += s.usage
+		s.lock.Unlock()
+	}
+	return stats
+}
+
+// shardOf returns the shard holding key.
+func (c *Cache) shardOf(key Key) *shard {
+	h := key.Id*0x9E3779B97F4A7C15 ^ uint64(key.Offset)*0xC2B2AE3D27D4EB4F
+	return c.shards[h>>60]
+}
+
+func (s *shard) lookup(key Key) *Handle {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	h, ok := s.table[key]
+	if !ok {
+		return nil
+	}
+	s.ref(h)
+	return h
+}
+
+func (s *shard) insert(key Key, value interface{}, charge int64) *Handle {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// 调用方持有一个引用
+	h := &Handle{key: key, value: value, charge: charge, refs: 1}
+	if s.capacity == 0 {
+		return h
+	}
+
+	// 缓存本身也持有一个引用
+	h.refs++
+	h.inCache = true
+	if old, ok := s.table[key]; ok {
+		s.remove(old)
+	}
+	s.table[key] = h
+	s.usage += charge
+	s.evict()
+	return h
+}
+
+func (s *shard) release(h *Handle) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// 固定期间超出的预算在条目可被淘汰后立即收回
+	s.unref(h)
+	s.evict()
+}
+
+// evict removes the least recently used entries that are not pinned until the shard is back within its budget.
+func (s *shard) evict() {
+	for s.usage > s.capacity && s.lru.Len() > 0 {
+		s.remove(s.lru.Back().Value.(*Handle))
+	}
+}
+
+func (s *shard) erase(key Key) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if h, ok := s.table[key]; ok {
+		s.remove(h)
+	}
+}
+
+// ref pins an entry, taking it off the lru list if nothing pinned it yet.
+func (s *shard) ref(h *Handle) {
+	if h.element != nil {
+		s.lru.Remove(h.element)
+		h.element = nil
+	}
+	h.refs++
+}
+
+// unref drops a reference to an entry. An entry left with the sole reference of the cache becomes evictable
+// and goes to the front of the lru list; an entry no longer referenced at all is left to the garbage collector.
+func (s *shard) unref(h *Handle) {
+	h.refs--
+	if h.refs == 1 && h.inCache {
+		h.element = s.lru.PushFront(h)
+	}
+}
+
+// remove takes an entry out of the cache and drops the reference the cache held on it.
+func (s *shard) remove(h *Handle) {
+	delete(s.table, h.key)
+	h.inCache = false
+	s.usage -= h.charge
+	if h.element != nil {
+		s.lru.Remove(h.element)
+		h.element = nil
+	}
+	s.unref(h)
+}
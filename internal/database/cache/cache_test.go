@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache_LookupAndStats(t *testing.T) {
+	c := New(1024)
+	id := c.NewId()
+	assert.NotEqual(t, id, c.NewId())
+
+	assert.Nil(t, c.Lookup(Key{Id: id, Offset: 0}))
+	h := c.Insert(Key{Id: id, Offset: 0}, "block", 10)
+	c.Release(h)
+
+	h = c.Lookup(Key{Id: id, Offset: 0})
+	assert.NotNil(t, h)
+	assert.Equal(t, "block", h.Value())
+	c.Release(h)
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, int64(10), stats.Usage)
+	assert.Equal(t, int64(1024), stats.Capacity)
+
+	c.Erase(Key{Id: id, Offset: 0})
+	assert.Nil(t, c.Lookup(Key{Id: id, Offset: 0}))
+	assert.Zero(t, c.Stats().Usage)
+}
+
+func TestCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	// 所有 key 落在同一个分片，便于验证淘汰顺序
+	c := New(3 * numShards)
+	s := c.shards[0]
+	keys := make([]Key, 0, 4)
+	for offset := int64(0); len(keys) < 4; offset++ {
+		if key := (Key{Id: 1, Offset: offset}); c.shardOf(key) == s {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range keys[:3] {
+		c.Release(c.Insert(key, key.Offset, 1))
+	}
+	// 访问最早插入的 key，使第二个 key 成为最久未使用的
+	c.Release(c.Lookup(keys[0]))
+	c.Release(c.Insert(keys[3], keys[3].Offset, 1))
+
+	assert.Nil(t, c.Lookup(keys[1]))
+	for _, key := range []Key{keys[0], keys[2], keys[3]} {
+		h := c.Lookup(key)
+		if assert.NotNil(t, h) {
+			c.Release(h)
+		}
+	}
+}
+
+func TestCache_PinnedEntriesAreNotEvicted(t *testing.T) {
+	c := New(numShards)
+	key := Key{Id: 1, Offset: 0}
+	pinned := c.Insert(key, "pinned", 1)
+
+	// 被固定的条目超出预算时仍保留，释放后才会被淘汰
+	other := Key{Id: 1, Offset: 1}
+	for c.shardOf(other) != c.shardOf(key) {
+		other.Offset++
+	}
+	c.Release(c.Insert(other, "other", 1))
+	assert.Nil(t, c.Lookup(other))
+	h := c.Lookup(key)
+	assert.NotNil(t, h)
+	c.Release(h)
+	c.Release(pinned)
+
+	c.Release(c.Insert(other, "other", 1))
+	assert.Nil(t, c.Lookup(key))
+	assert.Equal(t, int64(1), c.Stats().Usage)
+}
+
+func TestCache_ZeroCapacityKeepsNothing(t *testing.T) {
+	c := New(0)
+	h := c.Insert(Key{Id: 1}, "block", 10)
+	assert.Equal(t, "block", h.Value())
+	c.Release(h)
+	assert.Nil(t, c.Lookup(Key{Id: 1}))
+	assert.Zero(t, c.Stats().Usage)
+}
@@ -0,0 +1,117 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+var ErrCheckpointExists = errors.New("checkpoint directory is not empty")
+
+// Checkpoint writes a consistent copy of the database to dir while it keeps serving reads and writes.
+// The memory tables are frozen and flushed, so that the copy holds every write made before Checkpoint was called,
+// then the live segments of every column family are hard-linked into dir, or copied where they cannot be linked,
+// along with a manifest listing them, the list of column families and the value log.
+// The copy opens with NewDB(Dir(dir, walDir)) for any empty walDir, given the options the database was opened with.
+// Flushes and value log garbage collection wait until the copy is done; compaction goes on, as the segments are
+// only deleted once the copy no longer uses them.
+// Returns ErrCheckpointExists if dir exists and is not empty. A failed checkpoint removes what it wrote to dir.
+func (db *DB) Checkpoint(dir string) error {
+	return db.checkpoint(dir, nil)
+}
+
+// checkpoint implements Checkpoint. When frozen is not nil, it is called under the memory table lock as the memory
+// tables are frozen, when every write up to the last published sequence number is in the copy and none after it.
+func (db *DB) checkpoint(dir string, frozen func()) (err error) {
+	if atomic.LoadInt32(&db.isShutdonw) == 1 {
+		return errors.New("database is shutting down")
+	}
+	if empty, err := isEmptyDir(dir); err != nil || !empty {
+		if err == nil {
+			err = ErrCheckpointExists
+		}
+		return err
+	}
+
+	// 检查点期间不允许其他刷盘，刷盘会改变内存表与 WAL 的对应关系
+	db.flushLock.Lock()
+	for db.isFlushing {
+		db.flushDone.Wait()
+	}
+	if atomic.LoadInt32(&db.isShutdonw) == 1 {
+		db.flushLock.Unlock()
+		return errors.New("database is shutting down")
+	}
+	db.isFlushing = true
+	db.flushLock.Unlock()
+	defer func() {
+		db.flushLock.Lock()
+		db.isFlushing = false
+		db.flushDone.Broadcast()
+		db.flushLock.Unlock()
+	}()
+
+	// 垃圾回收会删除 value log 文件
+	db.gcLock.Lock()
+	defer db.gcLock.Unlock()
+
+	db.memoryTableLock.Lock()
+	err = db.createMemoryTable()
+	if err == nil && frozen != nil {
+		frozen()
+	}
+	db.memoryTableLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("创建内存表失败，%w", err)
+	}
+	for len(db.wals) > 1 {
+		db.flush()
+	}
+
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	db.columnFamilyLock.Lock()
+	defer db.columnFamilyLock.Unlock()
+	for _, cf := range db.columnFamilies {
+		rel, err := filepath.Rel(db.dataDir, cf.dir)
+		if err != nil {
+			return err
+		}
+		if err := cf.sstable.Checkpoint(filepath.Join(dir, rel)); err != nil {
+			return fmt.Errorf("column family %s 检查点失败:%w", cf.name, err)
+		}
+	}
+	columnFamilyFile := filepath.Join(db.dataDir, columnFamilyFileName)
+	if _, err := os.Stat(columnFamilyFile); err == nil {
+		if err := common.CopyFile(columnFamilyFile, filepath.Join(dir, columnFamilyFileName), -1); err != nil {
+			return err
+		}
+	}
+	if db.valueLog != nil {
+		if err := db.valueLog.Checkpoint(filepath.Join(dir, ValueLogDirName)); err != nil {
+			return fmt.Errorf("value log检查点失败:%w", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ColumnFamilyDirName)); err == nil {
+		if err := common.SyncDir(filepath.Join(dir, ColumnFamilyDirName)); err != nil {
+			return err
+		}
+	}
+	return common.SyncDir(dir)
+}
+
+// isEmptyDir reports whether dir is missing or empty.
+func isEmptyDir(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return len(entries) == 0, nil
+}
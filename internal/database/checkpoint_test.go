@@ -0,0 +1,102 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Checkpoint(t *testing.T) {
+	db := newTestDB(t, ValueThreshold(10), ValueLogFileSize(1))
+	users, err := db.CreateColumnFamily("users")
+	assert.NoError(t, err)
+	large := bytes.Repeat([]byte("v"), 100)
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Set(fmt.Sprintf("k%d", i), large))
+	}
+	forceFlush(t, db)
+	assert.NoError(t, db.DeleteRange("k0", "k5"))
+	assert.NoError(t, db.Set("memory", []byte("only in the memory table")))
+	assert.NoError(t, users.Set("u", []byte("user")))
+
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	assert.NoError(t, db.Checkpoint(dir))
+	assert.ErrorIs(t, db.Checkpoint(dir), ErrCheckpointExists)
+
+	// 检查点之后的写入与垃圾回收不影响检查点
+	assert.NoError(t, db.Set("after", []byte("1")))
+	assert.NoError(t, db.Del("memory"))
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, db.Del(fmt.Sprintf("k%d", i)))
+	}
+	forceFlush(t, db)
+	for db.RunValueLogGC(0.5) == nil {
+	}
+
+	copied, err := NewDB(Dir(dir, filepath.Join(t.TempDir(), "wal")))
+	assert.NoError(t, err)
+	defer copied.Shutdown()
+	for i := 0; i < 10; i++ {
+		value, err := copied.Get(fmt.Sprintf("k%d", i))
+		assert.NoError(t, err)
+		if i < 5 {
+			assert.Nil(t, value)
+		} else {
+			assert.Equal(t, large, value)
+		}
+	}
+	value, err := copied.Get("memory")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("only in the memory table"), value)
+	value, err = copied.Get("after")
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+	copiedUsers, err := copied.ColumnFamily("users")
+	assert.NoError(t, err)
+	value, err = copiedUsers.Get("u")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("user"), value)
+
+	// 检查点中的序列号延续原数据库
+	assert.NoError(t, copied.Set("k9", []byte("new")))
+	value, err = copied.Get("k9")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), value)
+}
+
+func TestDB_CheckpointWhileWriting(t *testing.T) {
+	db := newTestDB(t, ValueThreshold(10))
+	const count = 2000
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < count; i++ {
+			assert.NoError(t, db.Set(fmt.Sprintf("k%05d", i), bytes.Repeat([]byte{byte(i)}, 20)))
+		}
+	}()
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	assert.NoError(t, db.Checkpoint(dir))
+	wg.Wait()
+
+	// 写入依次进行，检查点包含的必须是它们的一个前缀
+	copied, err := NewDB(Dir(dir, filepath.Join(t.TempDir(), "wal")))
+	assert.NoError(t, err)
+	defer copied.Shutdown()
+	it, err := copied.NewIterator("", "")
+	assert.NoError(t, err)
+	defer it.Close()
+	i := 0
+	for ; it.Valid(); it.Next() {
+		assert.Equal(t, fmt.Sprintf("k%05d", i), it.Key())
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 20), it.Value())
+		i++
+	}
+	assert.NoError(t, it.Error())
+}
@@ -0,0 +1,424 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+	"github.com/Jasonbourne723/platodb/internal/database/memorytable"
+	"github.com/Jasonbourne723/platodb/internal/database/sstable"
+)
+
+const (
+	// DefaultColumnFamilyName is the column family the methods of DB operate on. Its segments stay in the data
+	// directory itself, so that databases written before column families existed open unchanged.
+	DefaultColumnFamilyName = "default"
+	// ColumnFamilyDirName is the directory, under the data directory, holding one directory per other column family,
+	// named after its id.
+	ColumnFamilyDirName = "cf"
+	// columnFamilyFileName is the file, in the data directory, listing the column families other than the default one.
+	columnFamilyFileName = "COLUMN_FAMILIES"
+)
+
+var (
+	ErrColumnFamilyExists    = errors.New("column family already exists")
+	ErrColumnFamilyNotFound  = errors.New("column family not found")
+	ErrColumnFamilyDropped   = errors.New("column family has been dropped")
+	ErrColumnFamiliesCorrupt = errors.New("column family list corrupted")
+)
+
+// ColumnFamily is a named keyspace of the database, with its own memory tables, segments and options.
+// Every column family shares the WAL, the sequence numbers, the snapshots and the block cache of the database,
+// so that a write batch spanning several column families is applied atomically and a snapshot sees all of them
+// at the same point. Key-value separation only applies to the default column family: the others always keep
+// their values in their segments.
+type ColumnFamily struct {
+	db   *DB
+	id   uint32
+	name string
+	dir  string
+	// memoryTables 与 db.wals 一一对应，同一位置的内存表共用一个 WAL 文件，一起冻结和刷盘
+	memoryTables      []memorytable.MemoryTable
+	sstable           *sstable.SSTable
+	dropped           bool
+	segmentSize       int64
+	falsePositiveRate float64
+	maxLevels         int
+	level0Trigger     int
+	levelSizeRatio    int
+	blockCompression  sstable.Compression
+	newMemoryTable    memorytable.Factory
+	mergeOperator     common.MergeOperator
+}
+
+// CFOptions defines a function type that accepts a pointer to ColumnFamily and modifies its configuration.
+// A column family starts from the options of the database, which CFOptions then override.
+type CFOptions func(cf *ColumnFamily)
+
+// CFSegmentSize sets, in megabytes, the size at which the memory table of the column family is flushed
+// and the target size of its segments.
+func CFSegmentSize(segmentSize int32) CFOptions {
+	return func(cf *ColumnFamily) {
+		cf.segmentSize = int64(segmentSize) * common.MB
+	}
+}
+
+// CFBloomFalsePositiveRate sets the target false positive rate of the Bloom filters of the column family.
+func CFBloomFalsePositiveRate(rate float64) CFOptions {
+	return func(cf *ColumnFamily) {
+		cf.falsePositiveRate = rate
+	}
+}
+
+// CFMaxLevels sets the number of levels of the column family, level 0 included.
+func CFMaxLevels(levels int) CFOptions {
+	return func(cf *ColumnFamily) {
+		cf.maxLevels = levels
+	}
+}
+
+// CFLevel0CompactionTrigger sets how many segments level 0 of the column family may hold before they are compacted.
+func CFLevel0CompactionTrigger(count int) CFOptions {
+	return func(cf *ColumnFamily) {
+		cf.level0Trigger = count
+	}
+}
+
+// CFLevelSizeRatio sets how many times larger each level of the column family below level 1 may grow
+// compared to the level above it.
+func CFLevelSizeRatio(ratio int) CFOptions {
+	return func(cf *ColumnFamily) {
+		cf.levelSizeRatio = ratio
+	}
+}
+
+// CFMemoryTable sets the factory creating the memory tables of the column family.
+func CFMemoryTable(factory memorytable.Factory) CFOptions {
+	return func(cf *ColumnFamily) {
+		cf.newMemoryTable = factory
+	}
+}
+
+// CFBlockCompression sets the codec the blocks of the new segments of the column family are compressed with.
+func CFBlockCompression(c sstable.Compression) CFOptions {
+	return func(cf *ColumnFamily) {
+		cf.blockCompression = c
+	}
+}
+
+// CFMergeOperator sets the operator that resolves the merge operands of the column family.
+func CFMergeOperator(operator common.MergeOperator) CFOptions {
+	return func(cf *ColumnFamily) {
+		cf.mergeOperator = operator
+	}
+}
+
+// ColumnFamilyOptions sets the options the column family name is opened with when the database starts.
+// Options are not stored with a column family: one missing here opens with the options of the database.
+func ColumnFamilyOptions(name string, options ...CFOptions) Options {
+	return func(db *DB) {
+		db.columnFamilyOptions[name] = options
+	}
+}
+
+// Name returns the name of the column family.
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// activeMemoryTable returns the memory table the column family writes to. The caller must hold the memory table lock.
+func (cf *ColumnFamily) activeMemoryTable() memorytable.MemoryTable {
+	return cf.memoryTables[len(cf.memoryTables)-1]
+}
+
+// openColumnFamily opens the segments of a column family with the options of the database, overridden by options.
+// The default column family keeps its segments in the data directory and alone uses the value log.
+func (db *DB) openColumnFamily(id uint32, name string, options []CFOptions) (*ColumnFamily, error) {
+	cf := &ColumnFamily{
+		db:                db,
+		id:                id,
+		name:              name,
+		dir:               db.dataDir,
+		segmentSize:       db.segmentSize,
+		falsePositiveRate: db.falsePositiveRate,
+		maxLevels:         db.maxLevels,
+		level0Trigger:     db.level0Trigger,
+		levelSizeRatio:    db.levelSizeRatio,
+		blockCompression:  db.blockCompression,
+		newMemoryTable:    db.newMemoryTable,
+		mergeOperator:     db.mergeOperator,
+	}
+	if id != 0 {
+		cf.dir = filepath.Join(db.dataDir, ColumnFamilyDirName, strconv.FormatUint(uint64(id), 10))
+	}
+	for _, option := range options {
+		option(cf)
+	}
+
+	sstableOptions := []sstable.Options{
+		sstable.FalsePositiveRate(cf.falsePositiveRate),
+		sstable.TargetFileSize(cf.segmentSize),
+		sstable.MaxLevels(cf.maxLevels),
+		sstable.Level0CompactionTrigger(cf.level0Trigger),
+		sstable.LevelSizeRatio(cf.levelSizeRatio),
+		sstable.Snapshots(db.snapshotSeqs),
+		sstable.BlockCache(db.blockCache),
+		sstable.BlockCompression(cf.blockCompression),
+		sstable.MergeOperator(cf.mergeOperator),
+	}
+	if id == 0 {
+		sstableOptions = append(sstableOptions, sstable.ValueLog(db.valueLog, db.valueThreshold))
+	}
+	sst, err := sstable.NewSSTable(cf.dir, db.ctx, sstableOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("column family %s 加载失败:%w", name, err)
+	}
+	cf.sstable = sst
+	return cf, nil
+}
+
+// openColumnFamilies opens the default column family and every column family listed in the data directory,
+// and removes the directories of the column families that were dropped or never fully created.
+func (db *DB) openColumnFamilies() error {
+	names, nextId, err := readColumnFamilies(filepath.Join(db.dataDir, columnFamilyFileName))
+	if err != nil {
+		return err
+	}
+	db.nextColumnFamilyId = nextId
+
+	defaultColumnFamily, err := db.openColumnFamily(0, DefaultColumnFamilyName, db.columnFamilyOptions[DefaultColumnFamilyName])
+	if err != nil {
+		return err
+	}
+	db.defaultColumnFamily = defaultColumnFamily
+	db.columnFamilies[0] = defaultColumnFamily
+	for id, name := range names {
+		cf, err := db.openColumnFamily(id, name, db.columnFamilyOptions[name])
+		if err != nil {
+			return err
+		}
+		db.columnFamilies[id] = cf
+	}
+
+	entries, err := os.ReadDir(filepath.Join(db.dataDir, ColumnFamilyDirName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		id, err := strconv.ParseUint(entry.Name(), 10, 32)
+		if _, ok := db.columnFamilies[uint32(id)]; err == nil && id != 0 && ok {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(db.dataDir, ColumnFamilyDirName, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateColumnFamily creates an empty column family named name, with the options of the database overridden by
+// options, and returns it. The column family is recorded in the data directory before CreateColumnFamily returns,
+// but its options are not: pass them again with ColumnFamilyOptions when the database is opened next.
+// Returns ErrColumnFamilyExists if a column family already has that name, or an error if the database is
+// shutting down or the column family cannot be recorded.
+func (db *DB) CreateColumnFamily(name string, options ...CFOptions) (*ColumnFamily, error) {
+	if atomic.LoadInt32(&db.isShutdonw) == 1 {
+		return nil, errors.New("database is shutting down")
+	}
+	if name == "" {
+		return nil, errors.New("column family name must not be empty")
+	}
+
+	db.columnFamilyLock.Lock()
+	defer db.columnFamilyLock.Unlock()
+
+	if _, err := db.ColumnFamily(name); err == nil {
+		return nil, ErrColumnFamilyExists
+	}
+	id := db.nextColumnFamilyId
+	cf, err := db.openColumnFamily(id, name, options)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.saveColumnFamilies(cf, nil); err != nil {
+		cf.sstable.Close()
+		os.RemoveAll(cf.dir)
+		return nil, err
+	}
+
+	db.memoryTableLock.Lock()
+	defer db.memoryTableLock.Unlock()
+	// 每个尚未刷盘的 WAL 都对应一个内存表，新的列族也要对齐
+	for range db.wals {
+		cf.memoryTables = append(cf.memoryTables, cf.newMemoryTable())
+	}
+	db.columnFamilies[id] = cf
+	db.nextColumnFamilyId++
+	return cf, nil
+}
+
+// DropColumnFamily drops the column family named name and deletes its segments.
+// Writes to the column family still in the WAL are ignored from then on, and every later operation on it fails
+// with ErrColumnFamilyDropped; iterators already open on it may fail as well.
+// Returns ErrColumnFamilyNotFound if no column family has that name, or an error if name is the default
+// column family or the database is shutting down.
+func (db *DB) DropColumnFamily(name string) error {
+	if atomic.LoadInt32(&db.isShutdonw) == 1 {
+		return errors.New("database is shutting down")
+	}
+	if name == DefaultColumnFamilyName {
+		return errors.New("the default column family cannot be dropped")
+	}
+
+	db.columnFamilyLock.Lock()
+	defer db.columnFamilyLock.Unlock()
+
+	cf, err := db.ColumnFamily(name)
+	if err != nil {
+		return err
+	}
+	if err := db.saveColumnFamilies(nil, cf); err != nil {
+		return err
+	}
+
+	db.memoryTableLock.Lock()
+	delete(db.columnFamilies, cf.id)
+	cf.dropped = true
+	cf.memoryTables = nil
+	db.memoryTableLock.Unlock()
+
+	cf.sstable.Close()
+	return os.RemoveAll(cf.dir)
+}
+
+// ColumnFamily returns the column family named name, or ErrColumnFamilyNotFound if there is none.
+func (db *DB) ColumnFamily(name string) (*ColumnFamily, error) {
+	db.memoryTableLock.RLocker().Lock()
+	defer db.memoryTableLock.RLocker().Unlock()
+
+	for _, cf := range db.columnFamilies {
+		if cf.name == name {
+			return cf, nil
+		}
+	}
+	return nil, ErrColumnFamilyNotFound
+}
+
+// DefaultColumnFamily returns the column family the methods of DB operate on.
+func (db *DB) DefaultColumnFamily() *ColumnFamily {
+	return db.defaultColumnFamily
+}
+
+// ColumnFamilies returns the names of the column families of the database in ascending order.
+func (db *DB) ColumnFamilies() []string {
+	db.memoryTableLock.RLocker().Lock()
+	defer db.memoryTableLock.RLocker().Unlock()
+
+	names := make([]string, 0, len(db.columnFamilies))
+	for _, cf := range db.columnFamilies {
+		names = append(names, cf.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// saveColumnFamilies records the column families of the database, with added and without dropped, either of which
+// may be nil, and the next column family id. The file is replaced atomically, so that a crash leaves either list.
+// The caller must hold the column family lock.
+func (db *DB) saveColumnFamilies(added, dropped *ColumnFamily) error {
+	nextId := db.nextColumnFamilyId
+	var buf []byte
+	for id, cf := range db.columnFamilies {
+		if id != 0 && cf != dropped {
+			buf = appendColumnFamily(buf, id, cf.name)
+		}
+	}
+	if added != nil {
+		buf = appendColumnFamily(buf, added.id, added.name)
+		nextId = added.id + 1
+	}
+	buf = append(binary.AppendUvarint(nil, uint64(nextId)), buf...)
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	path := filepath.Join(db.dataDir, columnFamilyFileName)
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	dir, err := os.Open(db.dataDir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// appendColumnFamily appends the entry of a column family, uvarint id | uvarint nameLen | name, to buf.
+func appendColumnFamily(buf []byte, id uint32, name string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(id))
+	buf = binary.AppendUvarint(buf, uint64(len(name)))
+	return append(buf, name...)
+}
+
+// readColumnFamilies parses the file written by saveColumnFamilies:
+//
+//	uvarint nextId | entry... | crc32(4)
+//
+// and returns the names of the column families by id and the next column family id.
+// A missing file describes a database holding the default column family alone.
+func readColumnFamilies(path string) (map[uint32]string, uint32, error) {
+	names := make(map[uint32]string)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return names, 1, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < 4 || crc32.ChecksumIEEE(data[:len(data)-4]) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return nil, 0, ErrColumnFamiliesCorrupt
+	}
+	reader := bytes.NewReader(data[:len(data)-4])
+	nextId, err := binary.ReadUvarint(reader)
+	if err != nil || nextId == 0 || nextId > math.MaxUint32 {
+		return nil, 0, ErrColumnFamiliesCorrupt
+	}
+	for reader.Len() > 0 {
+		id, err := binary.ReadUvarint(reader)
+		if err != nil || id == 0 || id >= nextId {
+			return nil, 0, ErrColumnFamiliesCorrupt
+		}
+		length, err := binary.ReadUvarint(reader)
+		if err != nil || length > uint64(reader.Len()) {
+			return nil, 0, ErrColumnFamiliesCorrupt
+		}
+		name := make([]byte, length)
+		reader.Read(name)
+		names[uint32(id)] = string(name)
+	}
+	return names, uint32(nextId), nil
+}
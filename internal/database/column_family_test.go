@@ -0,0 +1,134 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Jasonbourne723/platodb/internal/database/memorytable"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestColumnFamily_IsolatesKeyspaces(t *testing.T) {
+	db := newTestDB(t)
+	btree, err := memorytable.ParseType(memorytable.TypeBTree)
+	assert.NoError(t, err)
+	users, err := db.CreateColumnFamily("users", CFMemoryTable(btree), CFSegmentSize(1))
+	assert.NoError(t, err)
+	_, err = db.CreateColumnFamily("users")
+	assert.ErrorIs(t, err, ErrColumnFamilyExists)
+	assert.Equal(t, []string{DefaultColumnFamilyName, "users"}, db.ColumnFamilies())
+
+	// 跨列族的批次原子写入
+	batch := NewWriteBatch()
+	batch.Set("k", []byte("default"))
+	batch.SetCF(users, "k", []byte("users"))
+	batch.SetCF(users, "u1", []byte("alice"))
+	batch.DelCF(users, "missing")
+	assert.NoError(t, db.Write(batch))
+	snapshot := db.GetSnapshot()
+	defer db.ReleaseSnapshot(snapshot)
+	assert.NoError(t, users.DeleteRange("u", "v"))
+	assert.NoError(t, users.Set("u2", []byte("bob")))
+
+	check := func() {
+		value, err := db.Get("k")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("default"), value)
+		value, err = users.Get("k")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("users"), value)
+		value, err = db.Get("u2")
+		assert.NoError(t, err)
+		assert.Nil(t, value)
+		value, err = users.GetAt(snapshot, "u1")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("alice"), value)
+
+		it, err := users.NewIterator("", "")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"k", "u2"}, collectKeys(it, false))
+		it.Close()
+		it, err = db.NewIterator("", "")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"k"}, collectKeys(it, false))
+		it.Close()
+	}
+	check()
+
+	// 刷盘时每个列族的内存表写入各自的段文件
+	forceFlush(t, db)
+	check()
+	assert.FileExists(t, filepath.Join(users.dir, "MANIFEST"))
+}
+
+func TestColumnFamily_Drop(t *testing.T) {
+	db := newTestDB(t)
+	assert.Error(t, db.DropColumnFamily(DefaultColumnFamilyName))
+	assert.ErrorIs(t, db.DropColumnFamily("missing"), ErrColumnFamilyNotFound)
+
+	cf, err := db.CreateColumnFamily("tmp")
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Set("k", []byte("v")))
+	forceFlush(t, db)
+	assert.NoError(t, db.DropColumnFamily("tmp"))
+
+	_, err = db.ColumnFamily("tmp")
+	assert.ErrorIs(t, err, ErrColumnFamilyNotFound)
+	_, err = cf.Get("k")
+	assert.ErrorIs(t, err, ErrColumnFamilyDropped)
+	assert.ErrorIs(t, cf.Set("k", []byte("v")), ErrColumnFamilyDropped)
+	_, err = cf.NewIterator("", "")
+	assert.ErrorIs(t, err, ErrColumnFamilyDropped)
+	assert.NoDirExists(t, cf.dir)
+
+	// 同名列族重新创建后是空的
+	recreated, err := db.CreateColumnFamily("tmp")
+	assert.NoError(t, err)
+	assert.NotEqual(t, cf.id, recreated.id)
+	value, err := recreated.Get("k")
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+}
+
+func TestColumnFamily_RecoversFromSharedWal(t *testing.T) {
+	dir := t.TempDir()
+	walDir := filepath.Join(dir, "wal")
+
+	// 不调用 Shutdown，模拟进程崩溃后各列族的写入只保存在共享的 WAL 中
+	crashed, err := NewDB(Dir(dir, walDir))
+	assert.NoError(t, err)
+	users, err := crashed.CreateColumnFamily("users")
+	assert.NoError(t, err)
+	dropped, err := crashed.CreateColumnFamily("dropped")
+	assert.NoError(t, err)
+	assert.NoError(t, crashed.Set("k", []byte("default")))
+	assert.NoError(t, users.Set("k", []byte("users")))
+	assert.NoError(t, dropped.Set("k", []byte("dropped")))
+	assert.NoError(t, crashed.DropColumnFamily("dropped"))
+	// 删除列族目录之前崩溃留下的目录在重新打开时被清理
+	stale := filepath.Join(dir, ColumnFamilyDirName, "99")
+	assert.NoError(t, os.MkdirAll(stale, 0755))
+
+	hash, err := memorytable.ParseType(memorytable.TypeHash)
+	assert.NoError(t, err)
+	db, err := NewDB(Dir(dir, walDir), ColumnFamilyOptions("users", CFMemoryTable(hash)))
+	assert.NoError(t, err)
+	defer db.Shutdown()
+
+	assert.Equal(t, []string{DefaultColumnFamilyName, "users"}, db.ColumnFamilies())
+	assert.NoDirExists(t, stale)
+	value, err := db.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("default"), value)
+	reopened, err := db.ColumnFamily("users")
+	assert.NoError(t, err)
+	value, err = reopened.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("users"), value)
+
+	// 新建的列族不会复用已删除列族的 id
+	cf, err := db.CreateColumnFamily("another")
+	assert.NoError(t, err)
+	assert.Greater(t, cf.id, dropped.id)
+}
@@ -1,5 +1,10 @@
 package common
 
+import (
+	"math"
+	"time"
+)
+
 const (
 	_  = iota
 	KB = 1 << (10 * iota)
@@ -7,8 +12,47 @@ const (
 	GB = 1 << (10 * iota)
 )
 
+// MaxSeq is the sequence number that sees every version, used to read the latest state.
+const MaxSeq uint64 = math.MaxUint64
+
+// Chunk is a single version of a key. When ValuePointer is set, Value holds the encoded position of the value
+// in the value log instead of the value itself.
+// Seq is the sequence number of the write that produced the version; versions written before sequence numbers
+// existed have Seq 0 and are older than every other version.
+// ExpiresAt is the Unix time in milliseconds from which the version reads as deleted; 0 means it never expires.
+// When RangeDelete is set, the chunk is the range tombstone of a write batch, from Key to the key held by Value;
+// such chunks are only found in write batches and the WAL.
+// When Merge is set, the chunk is a merge operand: Value holds an operand for the merge operator of the column family,
+// to be applied to the older versions of the key when it is read.
+// ColumnFamily is the id of the column family a chunk of a write batch or of the WAL belongs to, 0 being the default
+// column family; the other chunks leave it unset.
 type Chunk struct {
-	Key     string
-	Value   []byte
-	Deleted bool
+	Key          string
+	Value        []byte
+	Deleted      bool
+	ValuePointer bool
+	RangeDelete  bool
+	Merge        bool
+	Seq          uint64
+	ExpiresAt    int64
+	ColumnFamily uint32
+}
+
+// Expired reports whether the version has expired at now. Tombstones never expire.
+func (c *Chunk) Expired(now time.Time) bool {
+	return !c.Deleted && c.ExpiresAt > 0 && now.UnixMilli() >= c.ExpiresAt
+}
+
+// RangeTombstone returns the range tombstone held by a chunk whose RangeDelete is set.
+func (c *Chunk) RangeTombstone() RangeTombstone {
+	return RangeTombstone{Start: c.Key, End: string(c.Value), Seq: c.Seq}
+}
+
+// Before reports whether c sorts before other: by key ascending, then by sequence number descending,
+// so that the newest version of a key comes first.
+func (c *Chunk) Before(other *Chunk) bool {
+	if c.Key != other.Key {
+		return c.Key < other.Key
+	}
+	return c.Seq > other.Seq
 }
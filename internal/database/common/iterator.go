@@ -0,0 +1,23 @@
+package common
+
+// Iterator walks over chunks ordered by key.
+// Implementations may return tombstones; it is up to the caller to hide them.
+// An Iterator must be positioned with Seek, SeekToFirst or SeekToLast before use.
+type Iterator interface {
+	// Valid reports whether the iterator is positioned at a chunk.
+	Valid() bool
+	// Seek positions the iterator at the first chunk whose key is greater than or equal to key.
+	Seek(key string)
+	// SeekToFirst positions the iterator at the first chunk.
+	SeekToFirst()
+	// SeekToLast positions the iterator at the last chunk.
+	SeekToLast()
+	// Next moves to the next chunk. It must only be called when Valid returns true.
+	Next()
+	// Prev moves to the previous chunk. It must only be called when Valid returns true.
+	Prev()
+	// Chunk returns the current chunk. It must only be called when Valid returns true.
+	Chunk() *Chunk
+	// Error returns the first error encountered while iterating, if any.
+	Error() error
+}
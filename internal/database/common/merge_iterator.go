@@ -0,0 +1,152 @@
+package common
+
+type direction int8
+
+const (
+	forward direction = iota
+	reverse
+)
+
+// MergingIterator merges several sorted iterators into one sorted stream.
+// Chunks are ordered by key, then from the newest version to the oldest by sequence number. Children are ordered
+// from newest to oldest; when two children hold the same version, as versions without a sequence number do,
+// the newer child is yielded first. Moving backwards yields the exact reverse order.
+type MergingIterator struct {
+	children  []Iterator
+	current   int
+	direction direction
+}
+
+// NewMergingIterator returns an unpositioned iterator merging children, which must be ordered newest first.
+func NewMergingIterator(children []Iterator) *MergingIterator {
+	return &MergingIterator{
+		children: children,
+		current:  -1,
+	}
+}
+
+// Valid reports whether any child is positioned at a chunk.
+func (m *MergingIterator) Valid() bool {
+	return m.current >= 0
+}
+
+// Seek positions every child at key and selects the smallest of them.
+func (m *MergingIterator) Seek(key string) {
+	for _, child := range m.children {
+		child.Seek(key)
+	}
+	m.direction = forward
+	m.findSmallest()
+}
+
+// SeekToFirst positions every child at its first chunk and selects the smallest of them.
+func (m *MergingIterator) SeekToFirst() {
+	for _, child := range m.children {
+		child.SeekToFirst()
+	}
+	m.direction = forward
+	m.findSmallest()
+}
+
+// SeekToLast positions every child at its last chunk and selects the largest of them.
+func (m *MergingIterator) SeekToLast() {
+	for _, child := range m.children {
+		child.SeekToLast()
+	}
+	m.direction = reverse
+	m.findLargest()
+}
+
+// Next advances to the next chunk in ascending order.
+// When switching from reverse, every other child is moved past the current chunk first.
+func (m *MergingIterator) Next() {
+	if m.direction != forward {
+		current := *m.Chunk()
+		for i, child := range m.children {
+			if i == m.current {
+				continue
+			}
+			child.Seek(current.Key)
+			for child.Valid() && m.before(child.Chunk(), i, &current, m.current) {
+				child.Next()
+			}
+		}
+		m.direction = forward
+	}
+	m.children[m.current].Next()
+	m.findSmallest()
+}
+
+// Prev moves to the previous chunk in descending order.
+// When switching from forward, every other child is moved before the current chunk first.
+func (m *MergingIterator) Prev() {
+	if m.direction != reverse {
+		current := *m.Chunk()
+		for i, child := range m.children {
+			if i == m.current {
+				continue
+			}
+			child.Seek(current.Key)
+			for child.Valid() && m.before(child.Chunk(), i, &current, m.current) {
+				child.Next()
+			}
+			if child.Valid() {
+				child.Prev()
+			} else {
+				child.SeekToLast()
+			}
+		}
+		m.direction = reverse
+	}
+	m.children[m.current].Prev()
+	m.findLargest()
+}
+
+// Chunk returns the chunk of the selected child.
+func (m *MergingIterator) Chunk() *Chunk {
+	return m.children[m.current].Chunk()
+}
+
+// Error returns the first error reported by a child.
+func (m *MergingIterator) Error() error {
+	for _, child := range m.children {
+		if err := child.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// before reports whether chunk a of child ai sorts before chunk b of child bi in the merged order.
+func (m *MergingIterator) before(a *Chunk, ai int, b *Chunk, bi int) bool {
+	if a.Key != b.Key || a.Seq != b.Seq {
+		return a.Before(b)
+	}
+	return ai < bi
+}
+
+// findSmallest selects the child positioned at the first chunk in the merged order.
+func (m *MergingIterator) findSmallest() {
+	m.current = -1
+	for i, child := range m.children {
+		if !child.Valid() {
+			continue
+		}
+		if m.current < 0 || m.before(child.Chunk(), i, m.children[m.current].Chunk(), m.current) {
+			m.current = i
+		}
+	}
+}
+
+// findLargest selects the child positioned at the last chunk in the merged order.
+func (m *MergingIterator) findLargest() {
+	m.current = -1
+	for i, child := range m.children {
+		if !child.Valid() {
+			continue
+		}
+		if m.current < 0 || m.before(m.children[m.current].Chunk(), m.current, child.Chunk(), i) {
+			m.current = i
+		}
+	}
+}
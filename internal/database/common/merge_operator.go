@@ -0,0 +1,113 @@
+package common
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrNotInteger = errors.New("value is not an integer or out of range")
+
+// MergeOperator combines the merge operands written to a key with the value the key held before them,
+// so that read-modify-write updates, such as incrementing a counter, are written without reading the key first.
+// Operands are stored as versions of their own and only combined when the key is read, when a memory table is flushed
+// and during compaction. An operator must be deterministic and safe for concurrent use.
+type MergeOperator interface {
+	// Name identifies the operator.
+	Name() string
+	// FullMerge applies operands, from the oldest to the newest, to existing, the value of key before them,
+	// which is nil when the key has no live value, and returns the resulting value.
+	FullMerge(key string, existing []byte, operands [][]byte) ([]byte, error)
+	// PartialMerge combines operands, from the oldest to the newest, into a single operand that has the same effect
+	// as applying them in turn. It reports false when they cannot be combined, in which case they are kept as they are.
+	PartialMerge(key string, operands [][]byte) ([]byte, bool)
+}
+
+// Int64Add is the MergeOperator of counters: values and operands are signed 64-bit integers in decimal,
+// and every operand is added to the value, a missing value counting as 0.
+// A value or an operand that is not such an integer, or a sum that overflows, fails the merge with ErrNotInteger.
+type Int64Add struct{}
+
+// Name implements MergeOperator.
+func (Int64Add) Name() string {
+	return "int64add"
+}
+
+// FullMerge implements MergeOperator.
+func (o Int64Add) FullMerge(key string, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum int64
+	if existing != nil {
+		v, err := strconv.ParseInt(string(existing), 10, 64)
+		if err != nil {
+			return nil, ErrNotInteger
+		}
+		sum = v
+	}
+	sum, ok := o.add(sum, operands)
+	if !ok {
+		return nil, ErrNotInteger
+	}
+	return strconv.AppendInt(nil, sum, 10), nil
+}
+
+// PartialMerge implements MergeOperator.
+func (o Int64Add) PartialMerge(key string, operands [][]byte) ([]byte, bool) {
+	sum, ok := o.add(0, operands)
+	if !ok {
+		return nil, false
+	}
+	return strconv.AppendInt(nil, sum, 10), true
+}
+
+// add adds operands to sum and reports false if one of them is not an integer or the sum overflows.
+func (Int64Add) add(sum int64, operands [][]byte) (int64, bool) {
+	for _, operand := range operands {
+		delta, err := strconv.ParseInt(string(operand), 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		if (delta > 0 && sum > math.MaxInt64-delta) || (delta < 0 && sum < math.MinInt64-delta) {
+			return 0, false
+		}
+		sum += delta
+	}
+	return sum, true
+}
+
+// StringAppend is the MergeOperator appending every operand to the value, separated by Delimiter.
+// A missing value counts as empty, and no delimiter precedes the first operand appended to it.
+type StringAppend struct {
+	Delimiter string
+}
+
+// Name implements MergeOperator.
+func (StringAppend) Name() string {
+	return "stringappend"
+}
+
+// FullMerge implements MergeOperator.
+func (o StringAppend) FullMerge(key string, existing []byte, operands [][]byte) ([]byte, error) {
+	size := len(existing) + len(o.Delimiter)*len(operands)
+	for _, operand := range operands {
+		size += len(operand)
+	}
+	value := make([]byte, 0, size)
+	value = append(value, existing...)
+	for i, operand := range operands {
+		if existing != nil || i > 0 {
+			value = append(value, o.Delimiter...)
+		}
+		value = append(value, operand...)
+	}
+	return value, nil
+}
+
+// PartialMerge implements MergeOperator.
+func (o StringAppend) PartialMerge(key string, operands [][]byte) ([]byte, bool) {
+	parts := make([]string, len(operands))
+	for i, operand := range operands {
+		parts[i] = string(operand)
+	}
+	return []byte(strings.Join(parts, o.Delimiter)), true
+}
@@ -0,0 +1,121 @@
+package common
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// RangeTombstone deletes every version of the keys in [Start, End) whose sequence number is lower than Seq.
+// Versions written after it are not affected.
+type RangeTombstone struct {
+	Start string
+	End   string
+	Seq   uint64
+}
+
+// Contains reports whether key falls within the range of the tombstone.
+func (t *RangeTombstone) Contains(key string) bool {
+	return t.Start <= key && key < t.End
+}
+
+// Empty reports whether the range of the tombstone holds no key.
+func (t *RangeTombstone) Empty() bool {
+	return t.Start >= t.End
+}
+
+// RangeDeletions answers which range tombstones cover a key. The tombstones are split into fragments that do not
+// overlap, each listing the sequence numbers of the tombstones covering it from the newest to the oldest,
+// so that a key is looked up with a binary search whatever the number of tombstones.
+type RangeDeletions struct {
+	starts []string
+	ends   []string
+	seqs   [][]uint64
+}
+
+// NewRangeDeletions fragments tombstones. The tombstones are not modified.
+func NewRangeDeletions(tombstones []RangeTombstone) *RangeDeletions {
+	r := &RangeDeletions{}
+	if len(tombstones) == 0 {
+		return r
+	}
+
+	sorted := make([]RangeTombstone, 0, len(tombstones))
+	bounds := make([]string, 0, 2*len(tombstones))
+	for _, t := range tombstones {
+		if t.Empty() {
+			continue
+		}
+		sorted = append(sorted, t)
+		bounds = append(bounds, t.Start, t.End)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+	sort.Strings(bounds)
+
+	// 按边界从小到大扫描，active 中保存覆盖当前片段的墓碑，按结束位置排列以便移除已结束的墓碑
+	active := &tombstoneHeap{}
+	next := 0
+	for i := 0; i+1 < len(bounds); i++ {
+		start, end := bounds[i], bounds[i+1]
+		if start == end {
+			continue
+		}
+		for next < len(sorted) && sorted[next].Start <= start {
+			heap.Push(active, sorted[next])
+			next++
+		}
+		for active.Len() > 0 && (*active)[0].End <= start {
+			heap.Pop(active)
+		}
+		if active.Len() == 0 {
+			continue
+		}
+		seqs := make([]uint64, 0, active.Len())
+		for _, t := range *active {
+			seqs = append(seqs, t.Seq)
+		}
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] > seqs[j] })
+		r.starts = append(r.starts, start)
+		r.ends = append(r.ends, end)
+		r.seqs = append(r.seqs, seqs)
+	}
+	return r
+}
+
+// Covering returns the sequence number of the newest tombstone covering key that a read at seq can see,
+// or 0 if there is none. A version of key whose sequence number is lower than the result is deleted at seq.
+func (r *RangeDeletions) Covering(key string, seq uint64) uint64 {
+	i := sort.Search(len(r.ends), func(i int) bool { return r.ends[i] > key })
+	if i == len(r.ends) || r.starts[i] > key {
+		return 0
+	}
+	for _, s := range r.seqs[i] {
+		if s <= seq {
+			return s
+		}
+	}
+	return 0
+}
+
+// Deletes reports whether chunk is deleted by a tombstone that a read at seq can see.
+func (r *RangeDeletions) Deletes(chunk *Chunk, seq uint64) bool {
+	return chunk.Seq < r.Covering(chunk.Key, seq)
+}
+
+// Empty reports whether no tombstone covers any key.
+func (r *RangeDeletions) Empty() bool {
+	return len(r.starts) == 0
+}
+
+// tombstoneHeap orders tombstones by the end of their range.
+type tombstoneHeap []RangeTombstone
+
+func (h tombstoneHeap) Len() int            { return len(h) }
+func (h tombstoneHeap) Less(i, j int) bool  { return h[i].End < h[j].End }
+func (h tombstoneHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *tombstoneHeap) Push(x interface{}) { *h = append(*h, x.(RangeTombstone)) }
+func (h *tombstoneHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
@@ -0,0 +1,265 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// Records are the on-disk form of a chunk, shared by the Write-Ahead Log (WAL) and the segments.
+//
+// Records written by older versions start with the tombstone byte, 0 or 1, and limit the key to 255 bytes
+// and the value to 64KB:
+//
+//	deleted(1) | crc(4) | keyLen(1) | key | valueLen(2) | value
+//
+// where the value length and the value are left out of tombstones and crc covers the key and the value.
+// Current records start with a header byte holding RecordV2 and the flags, and carry varint lengths:
+//
+//	header(1) | crc(4) | uvarint keyLen | key | [uvarint seq] | [uvarint expiresAt] | [uvarint columnFamily] | uvarint valueLen | value
+//
+// where the value length and the value are left out of tombstones and crc covers everything but itself.
+// The RecordV2ValuePointer flag marks a value that is a pointer into the value log rather than the value itself,
+// the RecordV2Sequence flag marks the presence of the sequence number, left out when it is 0,
+// and the RecordV2Expiry flag marks the presence of the expiry time, left out when the value never expires.
+// The RecordV2RangeDelete flag marks a range tombstone, whose key is the start of the range and whose value its end;
+// range tombstones are only found in the WAL.
+// The RecordV2ColumnFamily flag marks the presence of the column family id, left out for the default column family;
+// only the WAL carries it.
+// The RecordV2Merge flag marks a merge operand, whose value is the operand.
+const (
+	RecordV2             byte = 0x80
+	RecordV2Deleted      byte = 0x01
+	RecordV2ValuePointer byte = 0x02
+	RecordV2Sequence     byte = 0x04
+	RecordV2Expiry       byte = 0x08
+	RecordV2RangeDelete  byte = 0x10
+	RecordV2ColumnFamily byte = 0x20
+	RecordV2Merge        byte = 0x40
+)
+
+var (
+	ErrChecksumMismatch = errors.New("crc check failed")
+	ErrUnknownRecord    = errors.New("unknown record format")
+	ErrRecordCorrupted  = errors.New("record corrupted")
+)
+
+// ByteReader is the reader ReadChunk decodes records from.
+type ByteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// AppendChunk appends the record of chunk in the current format to dst and returns the extended slice.
+func AppendChunk(dst []byte, chunk *Chunk) []byte {
+	header := RecordV2
+	if chunk.Deleted {
+		header |= RecordV2Deleted
+	} else if chunk.ValuePointer {
+		header |= RecordV2ValuePointer
+	} else if chunk.RangeDelete {
+		header |= RecordV2RangeDelete
+	} else if chunk.Merge {
+		header |= RecordV2Merge
+	}
+	if chunk.Seq != 0 {
+		header |= RecordV2Sequence
+	}
+	hasExpiry := !chunk.Deleted && chunk.ExpiresAt > 0
+	if hasExpiry {
+		header |= RecordV2Expiry
+	}
+	if chunk.ColumnFamily != 0 {
+		header |= RecordV2ColumnFamily
+	}
+	start := len(dst)
+	dst = append(dst, header, 0, 0, 0, 0)
+	dst = binary.AppendUvarint(dst, uint64(len(chunk.Key)))
+	dst = append(dst, chunk.Key...)
+	if chunk.Seq != 0 {
+		dst = binary.AppendUvarint(dst, chunk.Seq)
+	}
+	if hasExpiry {
+		dst = binary.AppendUvarint(dst, uint64(chunk.ExpiresAt))
+	}
+	if chunk.ColumnFamily != 0 {
+		dst = binary.AppendUvarint(dst, uint64(chunk.ColumnFamily))
+	}
+	if !chunk.Deleted {
+		dst = binary.AppendUvarint(dst, uint64(len(chunk.Value)))
+		dst = append(dst, chunk.Value...)
+	}
+	binary.BigEndian.PutUint32(dst[start+1:start+5], recordV2Checksum(dst[start], dst[start+5:]))
+	return dst
+}
+
+// DecodeChunk decodes the record at the start of data, in either format, and returns the chunk and the record length.
+// The chunk does not alias data. A record cut short by the end of data yields io.ErrUnexpectedEOF.
+func DecodeChunk(data []byte) (*Chunk, int, error) {
+	reader := bytes.NewReader(data)
+	first, err := reader.ReadByte()
+	if err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	chunk, err := ReadChunk(reader, first)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return chunk, len(data) - reader.Len(), nil
+}
+
+// ReadChunk decodes a record, in either format, whose first byte has already been read from reader,
+// verifying its integrity using the CRC checksum. The value of a tombstone is nil.
+// It returns the error of the reader if the record is cut short, and ErrChecksumMismatch if the checksum does not match.
+func ReadChunk(reader ByteReader, first byte) (*Chunk, error) {
+	switch {
+	case first == 0 || first == 1:
+		return readLegacyChunk(reader, first == 1)
+	case first&^(RecordV2Deleted|RecordV2ValuePointer|RecordV2Sequence|RecordV2Expiry|RecordV2RangeDelete|RecordV2ColumnFamily|RecordV2Merge) == RecordV2:
+		return readChunkV2(reader, first)
+	default:
+		return nil, ErrUnknownRecord
+	}
+}
+
+// readChunkV2 decodes the rest of a record in the current format.
+func readChunkV2(reader ByteReader, header byte) (*Chunk, error) {
+	deleted := header&RecordV2Deleted != 0
+
+	crcBytes := make([]byte, 4)
+	if _, err := io.ReadFull(reader, crcBytes); err != nil {
+		return nil, err
+	}
+
+	// 读取 key，并重建长度的编码用于计算 CRC
+	body := make([]byte, 0, 32)
+	key, body, err := readLengthPrefixed(reader, body)
+	if err != nil {
+		return nil, err
+	}
+	var seq uint64
+	if header&RecordV2Sequence != 0 {
+		if seq, err = binary.ReadUvarint(reader); err != nil {
+			return nil, err
+		}
+		body = binary.AppendUvarint(body, seq)
+	}
+	var expiresAt uint64
+	if header&RecordV2Expiry != 0 {
+		if expiresAt, err = binary.ReadUvarint(reader); err != nil {
+			return nil, err
+		}
+		if expiresAt > math.MaxInt64 {
+			return nil, ErrRecordCorrupted
+		}
+		body = binary.AppendUvarint(body, expiresAt)
+	}
+	var columnFamily uint64
+	if header&RecordV2ColumnFamily != 0 {
+		if columnFamily, err = binary.ReadUvarint(reader); err != nil {
+			return nil, err
+		}
+		if columnFamily > math.MaxUint32 {
+			return nil, ErrRecordCorrupted
+		}
+		body = binary.AppendUvarint(body, columnFamily)
+	}
+	var value []byte
+	if !deleted {
+		if value, body, err = readLengthPrefixed(reader, body); err != nil {
+			return nil, err
+		}
+	}
+
+	if binary.BigEndian.Uint32(crcBytes) != recordV2Checksum(header, body) {
+		return nil, ErrChecksumMismatch
+	}
+	return &Chunk{
+		Key:          string(key),
+		Value:        value,
+		Deleted:      deleted,
+		ValuePointer: !deleted && header&RecordV2ValuePointer != 0,
+		RangeDelete:  !deleted && header&RecordV2RangeDelete != 0,
+		Merge:        !deleted && header&RecordV2Merge != 0,
+		Seq:          seq,
+		ExpiresAt:    int64(expiresAt),
+		ColumnFamily: uint32(columnFamily),
+	}, nil
+}
+
+// readLengthPrefixed reads a uvarint length followed by as many bytes, appending both to body for the checksum.
+func readLengthPrefixed(reader ByteReader, body []byte) ([]byte, []byte, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if length > math.MaxUint32 {
+		return nil, nil, ErrRecordCorrupted
+	}
+	if r, ok := reader.(*bytes.Reader); ok && length > uint64(r.Len()) {
+		// 避免为损坏的长度分配过大的内存
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, nil, err
+	}
+	body = binary.AppendUvarint(body, length)
+	return data, append(body, data...), nil
+}
+
+// recordV2Checksum computes the checksum of a record in the current format from its header and the bytes after the checksum.
+func recordV2Checksum(header byte, body []byte) uint32 {
+	crc := crc32.Update(0, crc32.IEEETable, []byte{header})
+	return crc32.Update(crc, crc32.IEEETable, body)
+}
+
+// readLegacyChunk decodes the rest of a record written by older versions.
+func readLegacyChunk(reader ByteReader, deleted bool) (*Chunk, error) {
+
+	// 读取 CRC 校验
+	crcBytes := make([]byte, 4)
+	if _, err := io.ReadFull(reader, crcBytes); err != nil {
+		return nil, err
+	}
+	crc := binary.BigEndian.Uint32(crcBytes)
+
+	// 读取 key 的长度并读取 key
+	keyLen, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	keyBytes := make([]byte, keyLen)
+	if _, err := io.ReadFull(reader, keyBytes); err != nil {
+		return nil, err
+	}
+
+	// 读取 value 的长度并读取 value
+	var value []byte
+	if !deleted {
+		valueLenBytes := make([]byte, 2)
+		if _, err := io.ReadFull(reader, valueLenBytes); err != nil {
+			return nil, err
+		}
+		value = make([]byte, binary.BigEndian.Uint16(valueLenBytes))
+		if _, err := io.ReadFull(reader, value); err != nil {
+			return nil, err
+		}
+	}
+
+	// 验证 CRC
+	if crc != crc32.ChecksumIEEE(append(keyBytes, value...)) {
+		return nil, ErrChecksumMismatch
+	}
+	return &Chunk{
+		Key:     string(keyBytes),
+		Value:   value,
+		Deleted: deleted,
+	}, nil
+}
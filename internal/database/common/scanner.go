@@ -4,3 +4,9 @@ type Scanner interface {
 	Scan() bool
 	ScanValue() *Chunk
 }
+
+// RangeTombstoneScanner is a Scanner that also holds range tombstones, as memory tables do.
+type RangeTombstoneScanner interface {
+	Scanner
+	RangeTombstones() []RangeTombstone
+}
@@ -1,70 +1,23 @@
 package common
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
-	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
-	"sync"
 )
 
 func NewUtils() *Utils {
-	p := &sync.Pool{}
-	p.New = func() any {
-		return &bytes.Buffer{}
-	}
-
-	return &Utils{
-		pool: p,
-	}
+	return &Utils{}
 }
 
 type Utils struct {
-	pool *sync.Pool
 }
 
+// Encode serializes the chunk in the current record format, described in record.go.
+// The returned slice is freshly allocated and owned by the caller.
 func (u *Utils) Encode(chunk *Chunk) ([]byte, error) {
-
-	buf := u.pool.Get().(*bytes.Buffer)
-	defer u.pool.Put(buf)
-
-	buf.Reset()
-
-	deleted := uint8(0)
-	if chunk.Deleted {
-		deleted = 1
-		chunk.Value = nil
-	}
-	if err := buf.WriteByte(deleted); err != nil {
-		return nil, err
-	}
-
-	keyBytes := []byte(chunk.Key)
-	keyLen := uint8(len(keyBytes))
-
-	crc := crc32.ChecksumIEEE(append(keyBytes, chunk.Value...))
-	if err := binary.Write(buf, binary.BigEndian, crc); err != nil {
-		return nil, err
-	}
-	if err := buf.WriteByte(keyLen); err != nil {
-		return nil, err
-	}
-	if _, err := buf.Write(keyBytes); err != nil {
-		return nil, err
-	}
-	if !chunk.Deleted {
-		valueLen := uint16(len(chunk.Value))
-		if err := binary.Write(buf, binary.BigEndian, valueLen); err != nil {
-			return nil, err
-		}
-		if _, err := buf.Write(chunk.Value); err != nil {
-			return nil, err
-		}
-	}
-
-	return buf.Bytes(), nil
+	return AppendChunk(nil, chunk), nil
 }
 
 func EnsureDirExists(dirPath string) error {
@@ -83,3 +36,48 @@ func EnsureDirExists(dirPath string) error {
 	}
 	return nil
 }
+
+// SyncDir flushes the directory entry changes of dir, such as a rename or a new link, to disk.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// LinkFile makes dst a hard link to src, or a copy of it when src cannot be linked, such as across file systems.
+// It must only be used for files that are never modified in place, since a link shares their content.
+func LinkFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return CopyFile(src, dst, -1)
+}
+
+// CopyFile copies the first n bytes of src, or all of it if n is negative, to a new file dst and syncs it.
+func CopyFile(src, dst string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	var reader io.Reader = in
+	if n >= 0 {
+		reader = io.LimitReader(in, n)
+	}
+	if _, err := io.Copy(out, reader); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -1,34 +1,74 @@
 package database
 
 import (
+	"container/list"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/Jasonbourne723/platodb/internal/database/cache"
 	"github.com/Jasonbourne723/platodb/internal/database/common"
 	"github.com/Jasonbourne723/platodb/internal/database/memorytable"
 	"github.com/Jasonbourne723/platodb/internal/database/sstable"
+	"github.com/Jasonbourne723/platodb/internal/database/vlog"
 	"github.com/Jasonbourne723/platodb/internal/database/wal"
 )
 
+const (
+	ValueLogDirName = "vlog"
+)
+
+var ErrInvalidRange = errors.New("range start must be lower than its end")
+
 type DB struct {
-	memoryTables    []memorytable.MemoryTable
-	sstable         *sstable.SSTable
-	memoryTableLock *sync.RWMutex
-	flushLock       *sync.Mutex
-	isFlushing      bool
-	isShutdonw      int32
-	walMap          map[memorytable.MemoryTable]wal.WriterCloser
-	segmentSize     int64
-	dataDir         string
-	walDir          string
-	ctx             context.Context
-	cancel          context.CancelFunc
+	columnFamilies      map[uint32]*ColumnFamily
+	defaultColumnFamily *ColumnFamily
+	nextColumnFamilyId  uint32
+	columnFamilyOptions map[string][]CFOptions
+	columnFamilyLock    *sync.Mutex
+	memoryTableLock     *sync.RWMutex
+	writeLock           *sync.Mutex
+	flushLock           *sync.Mutex
+	flushDone           *sync.Cond
+	gcLock              *sync.Mutex
+	snapshotLock        *sync.Mutex
+	snapshots           *list.List
+	txnLocks            *lockManager
+	writeStreams        *writeStreams
+	lastSeq             uint64
+	isFlushing          bool
+	isShutdonw          int32
+	// wals 中的每个 WAL 对应每个列族的一个内存表，最后一个是正在写入的 WAL
+	wals               []wal.WriterCloser
+	blockCache         *cache.Cache
+	segmentSize        int64
+	dataDir            string
+	walDir             string
+	falsePositiveRate  float64
+	maxLevels          int
+	level0Trigger      int
+	levelSizeRatio     int
+	walSyncPolicy      wal.SyncPolicy
+	walArchiveDir      string
+	valueLog           *vlog.ValueLog
+	valueThreshold     int
+	valueLogFileSize   int64
+	valueLogGCInterval time.Duration
+	valueLogGCRatio    float64
+	blockCacheSize     int64
+	blockCompression   sstable.Compression
+	newMemoryTable     memorytable.Factory
+	mergeOperator      common.MergeOperator
+	gcStopped          chan struct{}
+	ctx                context.Context
+	cancel             context.CancelFunc
 }
 
 // Options defines a function type that accepts a pointer to DB and modifies its configuration.
@@ -36,42 +76,87 @@ type DB struct {
 type Options func(db *DB)
 
 // NewDB initializes and returns a new instance of DB with optional configuration provided by variadic Options.
-// It sets up the initial memory tables, SSTable, and recovers data from the Write-Ahead Log (WAL) if present.
+// It opens the SSTable of every column family, recovers data from the Write-Ahead Log (WAL) if present
+// and sets up the initial memory tables.
 // Returns a pointer to DB and an error if any occurs during setup or recovery.
 func NewDB(options ...Options) (*DB, error) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 
 	db := DB{
-		memoryTables:    make([]memorytable.MemoryTable, 0, 2),
-		walMap:          make(map[memorytable.MemoryTable]wal.WriterCloser),
-		sstable:         nil,
-		memoryTableLock: &sync.RWMutex{},
-		flushLock:       &sync.Mutex{},
-		isFlushing:      false,
-		segmentSize:     8 * common.MB,
-		dataDir:         "/var/platodb",
-		walDir:          "/var/platodb/wal",
-		ctx:             ctx,
-		cancel:          cancel,
+		columnFamilies:      make(map[uint32]*ColumnFamily),
+		columnFamilyOptions: make(map[string][]CFOptions),
+		columnFamilyLock:    &sync.Mutex{},
+		wals:                make([]wal.WriterCloser, 0, 2),
+		memoryTableLock:     &sync.RWMutex{},
+		writeLock:           &sync.Mutex{},
+		flushLock:           &sync.Mutex{},
+		gcLock:              &sync.Mutex{},
+		snapshotLock:        &sync.Mutex{},
+		snapshots:           list.New(),
+		txnLocks:            newLockManager(),
+		writeStreams:        newWriteStreams(),
+		isFlushing:          false,
+		segmentSize:         8 * common.MB,
+		dataDir:             "/var/platodb",
+		walDir:              "/var/platodb/wal",
+		falsePositiveRate:   sstable.DefaultFalsePositiveRate,
+		maxLevels:           sstable.DefaultMaxLevels,
+		level0Trigger:       sstable.DefaultLevel0CompactionTrigger,
+		levelSizeRatio:      sstable.DefaultLevelSizeRatio,
+		walSyncPolicy:       wal.NoSync(),
+		valueLogFileSize:    vlog.DefaultMaxFileSize,
+		valueLogGCRatio:     DefaultValueLogGCRatio,
+		blockCacheSize:      sstable.DefaultBlockCacheSize,
+		blockCompression:    sstable.DefaultCompression,
+		newMemoryTable:      memorytable.DefaultFactory,
+		ctx:                 ctx,
+		cancel:              cancel,
 	}
 
+	db.flushDone = sync.NewCond(db.flushLock)
+
 	for _, option := range options {
 		option(&db)
 	}
 
-	sst, err := sstable.NewSSTable(db.dataDir, db.ctx)
-	if err != nil {
+	if db.walArchiveDir != "" {
+		if err := common.EnsureDirExists(db.walArchiveDir); err != nil {
+			return nil, fmt.Errorf("wal归档目录创建失败:%w", err)
+		}
+	}
+
+	// 未开启键值分离时，仍需打开已有的 value log 以读取之前写入的值
+	valueLogDir := filepath.Join(db.dataDir, ValueLogDirName)
+	if _, err := os.Stat(valueLogDir); db.valueThreshold > 0 || err == nil {
+		valueLog, err := vlog.Open(valueLogDir, db.valueLogFileSize)
+		if err != nil {
+			return nil, fmt.Errorf("value log加载失败:%w", err)
+		}
+		db.valueLog = valueLog
+	}
+
+	db.blockCache = cache.New(db.blockCacheSize)
+	if err := db.openColumnFamilies(); err != nil {
 		return nil, fmt.Errorf("sstable加载失败:%w", err)
 	}
-	db.sstable = sst
 
 	if err := db.recoverFromWal(db.walDir); err != nil {
 		return nil, err
 	}
+	// 恢复的 WAL 都已写入段文件，各列族清单中记录的最大序列号即为已分配的最大序列号
+	for _, cf := range db.columnFamilies {
+		if seq := cf.sstable.LastSequence(); seq > db.lastSeq {
+			db.lastSeq = seq
+		}
+	}
 	if err := db.createMemoryTable(); err != nil {
 		return nil, err
 	}
+	if db.valueLog != nil && db.valueLogGCInterval > 0 {
+		db.gcStopped = make(chan struct{})
+		go db.startValueLogGC()
+	}
 	return &db, nil
 }
 
@@ -95,87 +180,290 @@ func SegmentSize(segmentSize int32) Options {
 	}
 }
 
-// Get retrieves the value associated with the specified key from the database.
-// It first checks the memory tables in reverse order and then falls back to the SSTable.
-// If the database is shutting down, it returns an error.
-func (db *DB) Get(key string) ([]byte, error) {
+// BloomFalsePositiveRate sets the target false positive rate of the Bloom filter kept for every segment.
+// Values outside (0, 1) fall back to the default of 1%.
+func BloomFalsePositiveRate(rate float64) Options {
+	return func(db *DB) {
+		db.falsePositiveRate = rate
+	}
+}
 
-	if atomic.LoadInt32(&db.isShutdonw) == 1 {
-		return nil, errors.New("database is shutting down")
+// MaxLevels sets the number of levels used by leveled compaction, level 0 included.
+func MaxLevels(levels int) Options {
+	return func(db *DB) {
+		db.maxLevels = levels
 	}
+}
 
-	db.memoryTableLock.RLocker().Lock()
-	defer db.memoryTableLock.RLocker().Unlock()
+// Level0CompactionTrigger sets how many flushed segments level 0 may hold before they are compacted into level 1.
+func Level0CompactionTrigger(count int) Options {
+	return func(db *DB) {
+		db.level0Trigger = count
+	}
+}
+
+// LevelSizeRatio sets how many times larger each level below level 1 may grow compared to the level above it.
+func LevelSizeRatio(ratio int) Options {
+	return func(db *DB) {
+		db.levelSizeRatio = ratio
+	}
+}
+
+// WalSync sets when the Write-Ahead Log (WAL) is synced to disk, and so when Set, Del and Write return:
+// wal.NoSync() leaves syncing to the operating system, wal.SyncEveryWrite() syncs before every write returns,
+// and wal.GroupCommit(interval, bytes) lets the writers of an interval, or of a number of bytes, share one sync.
+// The default is wal.NoSync().
+func WalSync(policy wal.SyncPolicy) Options {
+	return func(db *DB) {
+		db.walSyncPolicy = policy
+	}
+}
+
+// WalArchive makes the database move every Write-Ahead Log (WAL) file it is done with into dir instead of deleting it.
+// Together with a checkpoint taken while archiving, the archived files let Restore rebuild the database as it was at
+// any later point in time. dir is best on the file system of the WAL directory, where files are moved rather than
+// copied. Archived files are never deleted by the database. The default, an empty dir, deletes them.
+func WalArchive(dir string) Options {
+	return func(db *DB) {
+		db.walArchiveDir = dir
+	}
+}
 
-	for i := len(db.memoryTables) - 1; i >= 0; i-- {
-		val := db.memoryTables[i].Get(key)
-		if val != nil {
-			return val, nil
+// ValueThreshold enables key-value separation: values larger than threshold bytes are moved to the value log when
+// their memory table is flushed, and segments only store a pointer to them, so that compaction never rewrites them.
+// A non-positive threshold, the default, keeps every value in the segments.
+func ValueThreshold(threshold int) Options {
+	return func(db *DB) {
+		db.valueThreshold = threshold
+	}
+}
+
+// ValueLogFileSize sets the size in megabytes at which the value log starts a new file.
+func ValueLogFileSize(size int32) Options {
+	return func(db *DB) {
+		db.valueLogFileSize = int64(size) * common.MB
+	}
+}
+
+// ValueLogGC runs the value log garbage collector every interval in the background, rewriting the files
+// whose share of garbage reaches discardRatio. A non-positive interval, the default, leaves garbage collection
+// to explicit calls of RunValueLogGC; a discardRatio outside (0, 1] falls back to DefaultValueLogGCRatio.
+func ValueLogGC(interval time.Duration, discardRatio float64) Options {
+	return func(db *DB) {
+		db.valueLogGCInterval = interval
+		if discardRatio > 0 && discardRatio <= 1 {
+			db.valueLogGCRatio = discardRatio
 		}
 	}
+}
 
-	return db.sstable.Get(key)
+// BlockCacheSize sets the size in megabytes of the cache that keeps the blocks read from the segments.
+// A size of 0 disables caching: every read then decodes its block from disk.
+func BlockCacheSize(size int32) Options {
+	return func(db *DB) {
+		db.blockCacheSize = int64(size) * common.MB
+	}
 }
 
-// Set stores the given value for the specified key in the database.
-// It writes the data to the Write-Ahead Log (WAL) if enabled and updates the in-memory table.
-// If the in-memory table size exceeds the defined segment size, a flush operation is initiated.
-// Returns an error if the database is shutting down.
-func (db *DB) Set(key string, value []byte) error {
+// MemoryTable sets the factory creating the memory tables, both the active ones and the ones replaying the WAL
+// on startup; memorytable.ParseType returns the factory of a named implementation. The default is the skip list.
+func MemoryTable(factory memorytable.Factory) Options {
+	return func(db *DB) {
+		db.newMemoryTable = factory
+	}
+}
 
-	if atomic.LoadInt32(&db.isShutdonw) == 1 {
-		return errors.New("database is shutting down")
+// BlockCompression sets the codec the blocks of new segments are compressed with; sstable.ParseCompression returns
+// the codec of a name. Segments written with another codec, or before blocks were compressed, remain readable.
+// The default is sstable.DefaultCompression.
+func BlockCompression(c sstable.Compression) Options {
+	return func(db *DB) {
+		db.blockCompression = c
 	}
-	db.memoryTableLock.RLocker().Lock()
-	memeryTable := db.memoryTables[len(db.memoryTables)-1]
+}
 
-	if wal, ok := db.walMap[memeryTable]; ok {
-		wal.Write(&common.Chunk{
-			Key:     key,
-			Value:   value,
-			Deleted: false,
-		})
+// MergeOperator sets the operator that resolves the merge operands written by Merge, which column families inherit.
+// Without it Merge fails, as does reading a key that holds merge operands.
+func MergeOperator(operator common.MergeOperator) Options {
+	return func(db *DB) {
+		db.mergeOperator = operator
 	}
-	db.memoryTableLock.RLocker().Unlock()
-	memeryTable.Set(key, value, false)
-	if memeryTable.Size() > db.segmentSize {
-		db.initiateFlush()
+}
+
+// DataDir returns the data directory of the database.
+func (db *DB) DataDir() string {
+	return db.dataDir
+}
+
+// WalDir returns the directory of the WAL files of the database.
+func (db *DB) WalDir() string {
+	return db.walDir
+}
+
+// WalArchiveDir returns the directory closed WAL files are archived to, or "" if they are deleted.
+func (db *DB) WalArchiveDir() string {
+	return db.walArchiveDir
+}
+
+// BlockCacheStats returns the hit and miss counters and the memory use of the block cache.
+func (db *DB) BlockCacheStats() cache.Stats {
+	return db.blockCache.Stats()
+}
+
+// Get retrieves the value associated with the specified key from the default column family.
+// It first checks the memory tables in reverse order and then falls back to the SSTable;
+// the newest version found wins, and a deleted or expired key yields nil.
+// If the database is shutting down, it returns an error.
+func (db *DB) Get(key string) ([]byte, error) {
+	return db.defaultColumnFamily.Get(key)
+}
+
+// Get is DB.Get on the column family.
+func (cf *ColumnFamily) Get(key string) ([]byte, error) {
+	// 只读取已发布的序列号，某些内存表实现中批量写入的各条记录是逐条可见的
+	return cf.get(key, atomic.LoadUint64(&cf.db.lastSeq))
+}
+
+// get retrieves the value of the newest version of key whose sequence number is not greater than seq.
+func (cf *ColumnFamily) get(key string, seq uint64) ([]byte, error) {
+
+	if atomic.LoadInt32(&cf.db.isShutdonw) == 1 {
+		return nil, errors.New("database is shutting down")
 	}
 
-	return nil
+	cf.db.memoryTableLock.RLocker().Lock()
+	defer cf.db.memoryTableLock.RLocker().Unlock()
+
+	if cf.dropped {
+		return nil, ErrColumnFamilyDropped
+	}
+	chunk, err := cf.lookup(key, seq)
+	if err != nil || chunk == nil {
+		return nil, err
+	}
+	return chunk.Value, nil
 }
 
-// Del deletes the entry associated with the provided key from the database.
-// It writes a deletion record to the Write-Ahead Log (WAL), if enabled, and marks the entry as deleted in the in-memory table.
-// An error is returned if the database is in the process of shutting down.
-func (db *DB) Del(key string) error {
+// lookup returns the newest version of key whose sequence number is not greater than seq, with its value read from
+// the value log if needed, or nil if that version is deleted or expired or there is none.
+// When that version is a merge operand, the value it and the older operands resolve to is returned instead.
+// The caller must hold the memory table lock.
+func (cf *ColumnFamily) lookup(key string, seq uint64) (*common.Chunk, error) {
+	chunk, err := cf.version(key, seq)
+	if err != nil || chunk == nil || chunk.Deleted || chunk.Expired(time.Now()) {
+		return nil, err
+	}
+	if chunk.Merge {
+		older := chunk.Seq
+		return resolveMerge(cf.mergeOperator, chunk, func() (*common.Chunk, error) {
+			if older == 0 {
+				return nil, nil
+			}
+			version, err := cf.version(key, older-1)
+			if version != nil {
+				older = version.Seq
+			}
+			return version, err
+		}, cf.sstable.ResolveValue)
+	}
+	if chunk.ValuePointer {
+		if chunk.Value, err = cf.sstable.ResolveValue(chunk); err != nil {
+			return nil, err
+		}
+		chunk.ValuePointer = false
+	}
+	return chunk, nil
+}
 
-	if atomic.LoadInt32(&db.isShutdonw) == 1 {
-		return errors.New("database is shutting down")
+// version returns the newest version of key whose sequence number is not greater than seq, as stored: it may be
+// a tombstone, a merge operand or hold a value pointer. A version deleted by a range tombstone is returned as
+// a tombstone with the sequence number of the range tombstone. Returns nil if there is no such version.
+// The caller must hold the memory table lock.
+func (cf *ColumnFamily) version(key string, seq uint64) (*common.Chunk, error) {
+	deletedAt := cf.rangeDeletedAt(key, seq)
+	for i := len(cf.memoryTables) - 1; i >= 0; i-- {
+		chunk := cf.memoryTables[i].Lookup(key, seq)
+		if chunk == nil {
+			continue
+		}
+		if chunk.Seq < deletedAt {
+			return &common.Chunk{Key: key, Deleted: true, Seq: deletedAt}, nil
+		}
+		return chunk, nil
+	}
+	if deletedAt > 0 {
+		// 段文件中的版本都早于内存表中的范围墓碑
+		return &common.Chunk{Key: key, Deleted: true, Seq: deletedAt}, nil
 	}
+	return cf.sstable.Lookup(key, seq)
+}
 
-	db.memoryTableLock.RLocker().Lock()
-	defer db.memoryTableLock.RLocker().Unlock()
-	memoryTable := db.memoryTables[len(db.memoryTables)-1]
-
-	if walWriter, ok := db.walMap[memoryTable]; ok {
-		err := walWriter.Write(&common.Chunk{
-			Key:     key,
-			Value:   nil,
-			Deleted: true,
-		})
-		if err != nil {
-			return err
+// rangeDeletedAt returns the sequence number of the newest range tombstone of the memory tables that covers key
+// and is visible at seq, or 0 if there is none. The caller must hold the memory table lock.
+func (cf *ColumnFamily) rangeDeletedAt(key string, seq uint64) uint64 {
+	var deletedAt uint64
+	for _, memoryTable := range cf.memoryTables {
+		for _, t := range memoryTable.RangeTombstones() {
+			if t.Seq <= seq && t.Seq > deletedAt && t.Contains(key) {
+				deletedAt = t.Seq
+			}
 		}
 	}
+	return deletedAt
+}
 
-	memoryTable.Set(key, nil, true)
-	return nil
+// Set stores the given value for the specified key in the default column family.
+// It is a single-operation WriteBatch: the data is written to the Write-Ahead Log (WAL) and then to the in-memory table,
+// and Set returns once the record is durable under the WAL sync policy.
+// If the in-memory table size exceeds the defined segment size, a flush operation is initiated.
+// Returns an error if the database is shutting down or the WAL write fails.
+func (db *DB) Set(key string, value []byte) error {
+	return db.defaultColumnFamily.Set(key, value)
+}
+
+// Set is DB.Set on the column family.
+func (cf *ColumnFamily) Set(key string, value []byte) error {
+	batch := NewWriteBatch()
+	batch.SetCF(cf, key, value)
+	return cf.db.Write(batch)
+}
+
+// Del deletes the entry associated with the provided key from the default column family.
+// It is a single-operation WriteBatch: a deletion record is written to the Write-Ahead Log (WAL) and the entry is marked as deleted in the in-memory table.
+// An error is returned if the database is in the process of shutting down or the WAL write fails.
+func (db *DB) Del(key string) error {
+	return db.defaultColumnFamily.Del(key)
+}
+
+// Del is DB.Del on the column family.
+func (cf *ColumnFamily) Del(key string) error {
+	batch := NewWriteBatch()
+	batch.DelCF(cf, key)
+	return cf.db.Write(batch)
+}
+
+// DeleteRange deletes every key in [start, end) from the default column family.
+// It is a single-operation WriteBatch: one range tombstone is written to the Write-Ahead Log (WAL) and the memory table
+// whatever the number of keys it deletes, and it hides the older versions of those keys until compaction drops them.
+// Returns an error if start is not lower than end, if the database is shutting down or if the WAL write fails.
+func (db *DB) DeleteRange(start, end string) error {
+	return db.defaultColumnFamily.DeleteRange(start, end)
+}
+
+// DeleteRange is DB.DeleteRange on the column family.
+func (cf *ColumnFamily) DeleteRange(start, end string) error {
+	if start >= end {
+		return ErrInvalidRange
+	}
+	batch := NewWriteBatch()
+	batch.DeleteRangeCF(cf, start, end)
+	return cf.db.Write(batch)
 }
 
 // Shutdown initiates the shutdown process for the database.
-// It prevents new operations by setting the shutdown flag and flushes remaining memory tables to disk.
-// Afterward, it closes the SSTable to finalize the shutdown sequence.
+// It prevents new operations by setting the shutdown flag, waits for the value log garbage collector to stop
+// and flushes remaining memory tables to disk.
+// Afterward, it closes the SSTable of every column family and the value log to finalize the shutdown sequence.
 // This method is idempotent and will return immediately if called again after the shutdown has been initiated.
 func (db *DB) Shutdown() {
 	db.cancel()
@@ -183,41 +471,66 @@ func (db *DB) Shutdown() {
 		return
 	}
 
+	if db.gcStopped != nil {
+		<-db.gcStopped
+	}
+	db.writeStreams.closeAll(errors.New("database is shutting down"))
+
 	db.flushLock.Lock()
 	defer db.flushLock.Unlock()
+	// 等待进行中的刷盘或检查点结束
+	for db.isFlushing {
+		db.flushDone.Wait()
+	}
 
-	for len(db.memoryTables) > 0 {
+	for len(db.wals) > 0 {
 		db.flush()
 	}
 
-	db.sstable.Close()
+	for _, cf := range db.columnFamilies {
+		cf.sstable.Close()
+	}
+	if db.valueLog != nil {
+		db.valueLog.Close()
+	}
 }
 
-// createMemoryTable initializes a new memory table, appends it to the database's memoryTables slice,
-// and associates a new Write-Ahead Log (WAL) writer with it.
+// createMemoryTable creates a new Write-Ahead Log (WAL) writer and a new memory table for every column family
+// to write to from now on, alongside it.
 // Returns an error if the WAL writer creation fails.
 func (db *DB) createMemoryTable() error {
-	memoryTable := memorytable.NewMemoryTable()
-	db.memoryTables = append(db.memoryTables, memoryTable)
-	walWriterCloser, err := wal.NewWriterCloser(db.walDir)
+	walWriterCloser, err := wal.NewWriterCloser(db.walDir, db.walSyncPolicy, db.walOptions()...)
 	if err != nil {
 		return err
 	}
-	db.walMap[memoryTable] = walWriterCloser
+	db.wals = append(db.wals, walWriterCloser)
+	for _, cf := range db.columnFamilies {
+		cf.memoryTables = append(cf.memoryTables, cf.newMemoryTable())
+	}
 	return nil
 }
 
-// removeMemoryTable removes the first memory table from the database, closes its associated WAL writer,
-// and updates the memoryTables slice accordingly. This is typically done after successfully flushing
-// the memory table's contents to the SSTable.
+// walOptions returns the options the WAL files of the database are opened with.
+func (db *DB) walOptions() []wal.Options {
+	if db.walArchiveDir == "" {
+		return nil
+	}
+	return []wal.Options{wal.Archive(db.walArchiveDir)}
+}
+
+// removeMemoryTable removes the first memory table of every column family, closes the WAL writer they share
+// and updates the wals slice accordingly. This is typically done after successfully flushing
+// the memory tables' contents to the SSTables.
 func (db *DB) removeMemoryTable() {
-	db.walMap[db.memoryTables[0]].Close()
-	delete(db.walMap, db.memoryTables[0])
-	db.memoryTables = db.memoryTables[1:]
+	db.wals[0].Close()
+	db.wals = db.wals[1:]
+	for _, cf := range db.columnFamilies {
+		cf.memoryTables = cf.memoryTables[1:]
+	}
 }
 
 // initiateFlush starts the process of flushing the in-memory data to disk if not already flushing.
-// It creates a new memory table, acquires necessary locks, and triggers the flush routine.
+// It creates new memory tables, acquires necessary locks, and triggers the flush routine.
 func (db *DB) initiateFlush() {
 	db.flushLock.Lock()
 	defer db.flushLock.Unlock()
@@ -237,16 +550,30 @@ func (db *DB) initiateFlush() {
 		db.flush()
 		db.flushLock.Lock()
 		db.isFlushing = false
+		db.flushDone.Broadcast()
 		db.flushLock.Unlock()
 	}()
 }
 
-// flush persists the first memory table to the SSTable, removes it from memory,
-// and updates internal state accordingly. This function should be called when a memory table is ready to be flushed to disk.
-// It acquires a write lock on the memory table to ensure thread safety during the flush operation.
+// flush persists the first memory table of every column family to its SSTable, removes them from memory,
+// and updates internal state accordingly. This function should be called when the memory tables are ready to be flushed to disk.
+// It holds the column family lock throughout, so that no column family is created or dropped meanwhile,
+// and acquires a write lock on the memory tables to ensure thread safety when removing them.
 func (db *DB) flush() {
-	if err := db.sstable.Write(db.memoryTables[0]); err != nil {
-		log.Fatal(fmt.Errorf("内存表持久化异常：%w", err))
+	db.columnFamilyLock.Lock()
+	defer db.columnFamilyLock.Unlock()
+
+	db.memoryTableLock.RLocker().Lock()
+	memoryTables := make(map[*ColumnFamily]memorytable.MemoryTable, len(db.columnFamilies))
+	for _, cf := range db.columnFamilies {
+		memoryTables[cf] = cf.memoryTables[0]
+	}
+	db.memoryTableLock.RLocker().Unlock()
+
+	for cf, memoryTable := range memoryTables {
+		if err := cf.sstable.Write(memoryTable); err != nil {
+			log.Fatal(fmt.Errorf("内存表持久化异常：%w", err))
+		}
 	}
 	db.memoryTableLock.Lock()
 	defer db.memoryTableLock.Unlock()
@@ -254,8 +581,7 @@ func (db *DB) flush() {
 }
 
 // recoverFromWal recovers the database state from Write-Ahead Log (WAL) files in the specified directory.
-// It ensures the directory exists, iterates through each WAL file, reads chunks,
-// applies them to a memory table, and writes the memory table to the SSTable if non-empty.
+// It ensures the directory exists and replays every WAL file in full with replayWal, then closes it.
 // Returns an error if any step fails, such as I/O issues or failures during recovery.
 func (db *DB) recoverFromWal(walDir string) error {
 
@@ -263,39 +589,67 @@ func (db *DB) recoverFromWal(walDir string) error {
 		return err
 	}
 
-	files, err := filepath.Glob(filepath.Join(walDir, "*.log"))
+	files, err := filepath.Glob(filepath.Join(walDir, "*"+wal.SUFFIX))
 	if err != nil {
 		return err
 	}
 	for _, walFilePath := range files {
 
-		walReaderCloser, err := wal.NewReaderCloser(walFilePath)
+		walReaderCloser, err := wal.NewReaderCloser(walFilePath, db.walOptions()...)
 		if err != nil {
 			return err
 		}
-		memoryTable := memorytable.NewMemoryTable()
-		for {
-			chunk, err := walReaderCloser.Read()
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
+		if _, err := db.replayWal(walReaderCloser, walFilePath, nil); err != nil {
+			return err
+		}
+		if err := walReaderCloser.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replayWal reads the records of the WAL file walFilePath batch by batch, applies them to a memory table per column
+// family, and writes every non-empty memory table to the SSTable of its column family.
+// Records of column families that have been dropped are skipped.
+// When accept is not nil, only the records it accepts are applied, and reading stops before the first record for
+// which it reports that no more are wanted; the boolean result is false if it did.
+// A batch that was only partly written before a crash ends the file and is skipped as a whole.
+func (db *DB) replayWal(reader wal.Reader, walFilePath string, accept func(record *wal.Record) (apply, more bool)) (bool, error) {
+	memoryTables := make(map[uint32]memorytable.MemoryTable, len(db.columnFamilies))
+	for id, cf := range db.columnFamilies {
+		memoryTables[id] = cf.newMemoryTable()
+	}
+	more := true
+	for more {
+		record, err := reader.ReadRecord()
+		if err != nil {
+			if err == io.EOF {
+				break
 			}
-			if chunk == nil {
+			if errors.Is(err, wal.ErrIncompleteRecord) {
+				log.Printf("wal %s ends with an incomplete batch, skipped\n", walFilePath)
 				break
 			}
-			memoryTable.Set(chunk.Key, chunk.Value, chunk.Deleted)
+			return false, err
 		}
-		if memoryTable.Size() > 0 {
-			if err := db.sstable.Write(memoryTable); err != nil {
-				return err
+		apply := true
+		if accept != nil {
+			if apply, more = accept(record); !more {
+				break
 			}
 		}
-		if err := walReaderCloser.Close(); err != nil {
-			return err
+		if apply {
+			applyBatch(record.Chunks, memoryTables)
 		}
 	}
-
-	return nil
+	for id, memoryTable := range memoryTables {
+		if memoryTable.Size() > 0 {
+			if err := db.columnFamilies[id].sstable.Write(memoryTable); err != nil {
+				return false, err
+			}
+		}
+	}
+	return more, nil
 }
@@ -1,8 +1,10 @@
 package database
 
 import (
+	"path/filepath"
 	"testing"
 
+	"github.com/Jasonbourne723/platodb/internal/database/memorytable"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -29,3 +31,104 @@ func TestDB_SetAndGet(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Nil(t, retrievedValue)
 }
+
+func TestDB_MemoryTableTypes(t *testing.T) {
+	for _, typ := range []string{memorytable.TypeSkipList, memorytable.TypeLockFree, memorytable.TypeBTree, memorytable.TypeHash} {
+		t.Run(typ, func(t *testing.T) {
+			factory, err := memorytable.ParseType(typ)
+			assert.NoError(t, err)
+			db := newTestDB(t, MemoryTable(factory))
+
+			batch := NewWriteBatch()
+			batch.Set("a", []byte("a1"))
+			batch.Set("b", []byte("b1"))
+			batch.Set("c", []byte("c1"))
+			assert.NoError(t, db.Write(batch))
+			assert.NoError(t, db.Del("b"))
+			assert.NoError(t, db.Set("a", []byte("a2")))
+
+			check := func() {
+				value, err := db.Get("a")
+				assert.NoError(t, err)
+				assert.Equal(t, []byte("a2"), value)
+				value, err = db.Get("b")
+				assert.NoError(t, err)
+				assert.Nil(t, value)
+
+				it, err := db.NewIterator("", "")
+				assert.NoError(t, err)
+				assert.Equal(t, []string{"a", "c"}, collectKeys(it, false))
+				it.Close()
+			}
+			check()
+
+			// 刷盘后段文件中的内容与内存表一致
+			forceFlush(t, db)
+			check()
+		})
+	}
+}
+
+func TestDB_DeleteRange(t *testing.T) {
+	db := newTestDB(t)
+	for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+		assert.NoError(t, db.Set(key, []byte(key+"1")))
+	}
+	// 一部分旧版本在段文件中，另一部分在内存表中
+	forceFlush(t, db)
+	assert.NoError(t, db.Set("d", []byte("d2")))
+	snapshot := db.GetSnapshot()
+	defer db.ReleaseSnapshot(snapshot)
+
+	assert.NoError(t, db.DeleteRange("b", "e"))
+	assert.NoError(t, db.Set("c", []byte("c3")))
+	assert.ErrorIs(t, db.DeleteRange("e", "e"), ErrInvalidRange)
+
+	check := func() {
+		for key, expected := range map[string][]byte{"a": []byte("a1"), "b": nil, "c": []byte("c3"), "d": nil, "e": []byte("e1")} {
+			value, err := db.Get(key)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, value, key)
+		}
+		value, err := db.GetAt(snapshot, "d")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("d2"), value)
+
+		it, err := db.NewIterator("", "")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a", "c", "e", "f"}, collectKeys(it, false))
+		it.SeekToLast()
+		assert.Equal(t, []string{"f", "e", "c", "a"}, collectKeys(it, true))
+		it.Close()
+	}
+	check()
+
+	// 范围墓碑随内存表写入段文件
+	forceFlush(t, db)
+	check()
+}
+
+func TestDB_DeleteRangeRecoversFromWal(t *testing.T) {
+	dir := t.TempDir()
+	walDir := filepath.Join(dir, "wal")
+
+	// 不调用 Shutdown，模拟进程崩溃后范围墓碑只保存在 WAL 中
+	crashed, err := NewDB(Dir(dir, walDir))
+	assert.NoError(t, err)
+	batch := NewWriteBatch()
+	batch.Set("a", []byte("a1"))
+	batch.Set("b", []byte("b1"))
+	batch.DeleteRange("a", "b")
+	batch.Set("c", []byte("c1"))
+	assert.NoError(t, crashed.Write(batch))
+
+	db, err := NewDB(Dir(dir, walDir))
+	assert.NoError(t, err)
+	defer db.Shutdown()
+
+	for key, expected := range map[string][]byte{"a": nil, "b": []byte("b1"), "c": []byte("c1")} {
+		value, err := db.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, value, key)
+	}
+}
@@ -0,0 +1,316 @@
+package database
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+	"github.com/Jasonbourne723/platodb/internal/database/sstable"
+)
+
+type direction int8
+
+const (
+	forward direction = iota
+	reverse
+)
+
+// Iterator walks the live keys of a column family in ascending or descending order.
+// Every memory table and segment of the column family is merged, the newest version of a key wins and deleted or expired keys are hidden,
+// as are the keys deleted by a range tombstone newer than their newest version.
+// A key whose newest version is a merge operand reads as the value its operands resolve to.
+// The iterator reads the writes published when it was created, so that it sees every chunk of a batch or none of them,
+// even with a memory table whose batches become visible chunk by chunk.
+// Keys are restricted to the half-open range [lower, upper); an empty bound means unbounded.
+// Values kept in the value log are read when the iterator stops on their key; a value log file removed by the
+// garbage collector while the iterator is open may stop the iteration with an error.
+// The segments the iterator reads are kept on disk until it is closed, so every iterator must be closed once done.
+type Iterator struct {
+	iter      *common.MergingIterator
+	rangeDels *common.RangeDeletions
+	seq       uint64
+	release   func()
+	sstable   *sstable.SSTable
+	operator  common.MergeOperator
+	versions  []common.Chunk
+	err       error
+	lower     string
+	upper     string
+	chunk     common.Chunk
+	valid     bool
+	direction direction
+}
+
+// NewIterator returns an iterator over the keys of the default column family in [lower, upper), positioned at
+// the first key of the range. An empty lower or upper bound leaves that side of the range open.
+// Returns an error if the database is shutting down.
+func (db *DB) NewIterator(lower, upper string) (*Iterator, error) {
+	return db.defaultColumnFamily.NewIterator(lower, upper)
+}
+
+// NewIterator is DB.NewIterator on the column family.
+func (cf *ColumnFamily) NewIterator(lower, upper string) (*Iterator, error) {
+
+	if atomic.LoadInt32(&cf.db.isShutdonw) == 1 {
+		return nil, errors.New("database is shutting down")
+	}
+
+	cf.db.memoryTableLock.RLocker().Lock()
+	if cf.dropped {
+		cf.db.memoryTableLock.RLocker().Unlock()
+		return nil, ErrColumnFamilyDropped
+	}
+	// 只读取已发布的序列号，某些内存表实现中批量写入的各条记录是逐条可见的
+	seq := atomic.LoadUint64(&cf.db.lastSeq)
+	children := make([]common.Iterator, 0, len(cf.memoryTables))
+	var tombstones []common.RangeTombstone
+	for i := len(cf.memoryTables) - 1; i >= 0; i-- {
+		children = append(children, cf.memoryTables[i].NewIterator())
+		tombstones = append(tombstones, cf.memoryTables[i].RangeTombstones()...)
+	}
+	segmentIterators, segmentTombstones, release := cf.sstable.NewIterators()
+	children = append(children, segmentIterators...)
+	tombstones = append(tombstones, segmentTombstones...)
+	cf.db.memoryTableLock.RLocker().Unlock()
+
+	it := &Iterator{
+		iter:      common.NewMergingIterator(children),
+		rangeDels: common.NewRangeDeletions(tombstones),
+		seq:       seq,
+		release:   release,
+		sstable:   cf.sstable,
+		operator:  cf.mergeOperator,
+		lower:     lower,
+		upper:     upper,
+	}
+	it.SeekToFirst()
+	return it, nil
+}
+
+// Scan returns an iterator over every key of the default column family that starts with prefix,
+// positioned at the first such key.
+func (db *DB) Scan(prefix string) (*Iterator, error) {
+	return db.defaultColumnFamily.Scan(prefix)
+}
+
+// Scan is DB.Scan on the column family.
+func (cf *ColumnFamily) Scan(prefix string) (*Iterator, error) {
+	return cf.NewIterator(prefix, prefixUpperBound(prefix))
+}
+
+// prefixUpperBound returns the smallest key greater than every key that starts with prefix,
+// or an empty string if no such key exists.
+func prefixUpperBound(prefix string) string {
+	upper := []byte(prefix)
+	for i := len(upper) - 1; i >= 0; i-- {
+		if upper[i] < 0xff {
+			upper[i]++
+			return string(upper[:i+1])
+		}
+	}
+	return ""
+}
+
+// Valid reports whether the iterator is positioned at a live key inside the range.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the key at the current position. It must only be called when Valid returns true.
+func (it *Iterator) Key() string {
+	return it.chunk.Key
+}
+
+// Value returns the value at the current position. It must only be called when Valid returns true.
+func (it *Iterator) Value() []byte {
+	return it.chunk.Value
+}
+
+// Error returns the first error encountered by any of the underlying iterators or while reading a value from the value log.
+func (it *Iterator) Error() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.iter.Error()
+}
+
+// Close releases the segments held by the iterator. The iterator must not be used afterwards.
+// Closing an iterator more than once has no effect.
+func (it *Iterator) Close() {
+	it.release()
+	it.valid = false
+}
+
+// Seek positions the iterator at the first live key greater than or equal to key.
+// Keys below the lower bound are clamped to it.
+func (it *Iterator) Seek(key string) {
+	if key < it.lower {
+		key = it.lower
+	}
+	it.direction = forward
+	it.iter.Seek(key)
+	it.findNextUserEntry("", false)
+}
+
+// SeekToFirst positions the iterator at the first live key of the range.
+func (it *Iterator) SeekToFirst() {
+	if it.lower != "" {
+		it.Seek(it.lower)
+		return
+	}
+	it.direction = forward
+	it.iter.SeekToFirst()
+	it.findNextUserEntry("", false)
+}
+
+// SeekToLast positions the iterator at the last live key of the range.
+func (it *Iterator) SeekToLast() {
+	it.direction = reverse
+	if it.upper != "" {
+		it.iter.Seek(it.upper)
+		if it.iter.Valid() {
+			it.iter.Prev()
+		} else {
+			it.iter.SeekToLast()
+		}
+	} else {
+		it.iter.SeekToLast()
+	}
+	it.findPrevUserEntry()
+}
+
+// Next moves to the next live key. It must only be called when Valid returns true.
+func (it *Iterator) Next() {
+	key := it.chunk.Key
+	if it.direction == reverse {
+		// 反向遍历时底层迭代器停在当前 key 之前，需要重新定位
+		it.direction = forward
+		it.iter.Seek(key)
+	}
+	it.findNextUserEntry(key, true)
+}
+
+// Prev moves to the previous live key. It must only be called when Valid returns true.
+func (it *Iterator) Prev() {
+	key := it.chunk.Key
+	if it.direction == forward {
+		// 正向遍历时底层迭代器停在当前 key 的最新版本上，需要越过它的所有版本
+		it.direction = reverse
+		for it.iter.Valid() && it.iter.Chunk().Key >= key {
+			it.iter.Prev()
+		}
+	}
+	it.findPrevUserEntry()
+}
+
+// findNextUserEntry advances the merged iterator to the newest version of the next live key.
+// Versions of skip are passed over when hasSkip is true, as are tombstones, expired versions and every older version they shadow.
+// Versions written after the iterator was created are passed over too; they come before the older versions of their key.
+func (it *Iterator) findNextUserEntry(skip string, hasSkip bool) {
+	for ; it.iter.Valid(); it.iter.Next() {
+		chunk := it.iter.Chunk()
+		if hasSkip && chunk.Key <= skip || chunk.Seq > it.seq {
+			continue
+		}
+		if it.upper != "" && chunk.Key >= it.upper {
+			break
+		}
+		if chunk.Deleted || chunk.Expired(time.Now()) || it.rangeDels.Deletes(chunk, it.seq) {
+			skip, hasSkip = chunk.Key, true
+			continue
+		}
+		if chunk.Merge {
+			newest := *chunk
+			it.setMerged(&newest, func() (*common.Chunk, error) {
+				it.iter.Next()
+				if !it.iter.Valid() || it.iter.Chunk().Key != newest.Key {
+					return nil, it.iter.Error()
+				}
+				return it.visible(it.iter.Chunk()), nil
+			})
+			// 回到该 key 的最新版本，与其他 key 的位置约定一致
+			it.iter.Seek(newest.Key)
+			return
+		}
+		it.setChunk(*chunk)
+		return
+	}
+	it.valid = false
+}
+
+// findPrevUserEntry moves the merged iterator backwards to the previous live key.
+// On return the merged iterator is positioned before every version of the key it returned.
+func (it *Iterator) findPrevUserEntry() {
+	for it.iter.Valid() {
+		chunk := it.iter.Chunk()
+		if chunk.Key < it.lower {
+			break
+		}
+		// 同一个 key 反向遍历时最后遇到的是最新版本
+		key := chunk.Key
+		it.versions = it.versions[:0]
+		for it.iter.Valid() && it.iter.Chunk().Key == key {
+			if it.iter.Chunk().Seq <= it.seq {
+				it.versions = append(it.versions, *it.iter.Chunk())
+			}
+			it.iter.Prev()
+		}
+		if len(it.versions) == 0 {
+			continue
+		}
+		newest := &it.versions[len(it.versions)-1]
+		if newest.Deleted || newest.Expired(time.Now()) || it.rangeDels.Deletes(newest, it.seq) {
+			continue
+		}
+		if newest.Merge {
+			i := len(it.versions) - 1
+			it.setMerged(newest, func() (*common.Chunk, error) {
+				if i--; i < 0 {
+					return nil, nil
+				}
+				return it.visible(&it.versions[i]), nil
+			})
+			return
+		}
+		it.setChunk(*newest)
+		return
+	}
+	it.valid = false
+}
+
+// setMerged positions the iterator at the value the merge operand newest resolves to, older returning the older versions
+// of its key. A failed merge invalidates the iterator and is reported by Error.
+func (it *Iterator) setMerged(newest *common.Chunk, older func() (*common.Chunk, error)) {
+	chunk, err := resolveMerge(it.operator, newest, older, it.sstable.ResolveValue)
+	if err != nil {
+		it.err = err
+		it.valid = false
+		return
+	}
+	it.setChunk(*chunk)
+}
+
+// visible returns chunk, or a tombstone in its place if a range tombstone deletes it.
+func (it *Iterator) visible(chunk *common.Chunk) *common.Chunk {
+	if it.rangeDels.Deletes(chunk, it.seq) {
+		return &common.Chunk{Key: chunk.Key, Deleted: true, Seq: chunk.Seq}
+	}
+	return chunk
+}
+
+// setChunk positions the iterator at chunk, reading its value from the value log if the chunk only holds a pointer.
+// A failed read invalidates the iterator and is reported by Error.
+func (it *Iterator) setChunk(chunk common.Chunk) {
+	if chunk.ValuePointer {
+		value, err := it.sstable.ResolveValue(&chunk)
+		if err != nil {
+			it.err = err
+			it.valid = false
+			return
+		}
+		chunk.Value, chunk.ValuePointer = value, false
+	}
+	it.chunk = chunk
+	it.valid = true
+}
@@ -0,0 +1,181 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Jasonbourne723/platodb/internal/database/memorytable"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestDB opens a database in a temporary directory that is removed when the test ends.
+func newTestDB(t *testing.T, options ...Options) *DB {
+	dir := t.TempDir()
+	options = append([]Options{Dir(dir, filepath.Join(dir, "wal"))}, options...)
+	db, err := NewDB(options...)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(db.Shutdown)
+	return db
+}
+
+// forceFlush freezes the active memory table and writes it to a new segment.
+func forceFlush(t *testing.T, db *DB) {
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+
+	db.memoryTableLock.Lock()
+	err := db.createMemoryTable()
+	db.memoryTableLock.Unlock()
+	if err != nil {
+		t.Fatalf("Failed to create memory table: %v", err)
+	}
+	db.flush()
+}
+
+func collectKeys(it *Iterator, reverse bool) []string {
+	keys := make([]string, 0)
+	for ; it.Valid(); func() {
+		if reverse {
+			it.Prev()
+		} else {
+			it.Next()
+		}
+	}() {
+		keys = append(keys, it.Key())
+	}
+	return keys
+}
+
+func TestIterator_MergesMemoryTablesAndSegments(t *testing.T) {
+	db := newTestDB(t)
+
+	// 第一个 segment
+	assert.NoError(t, db.Set("a", []byte("a1")))
+	assert.NoError(t, db.Set("c", []byte("c1")))
+	assert.NoError(t, db.Set("e", []byte("e1")))
+	forceFlush(t, db)
+
+	// 第二个 segment 覆盖并删除部分 key
+	assert.NoError(t, db.Set("c", []byte("c2")))
+	assert.NoError(t, db.Del("e"))
+	assert.NoError(t, db.Set("b", []byte("b2")))
+	forceFlush(t, db)
+
+	// 内存表
+	assert.NoError(t, db.Set("d", []byte("d3")))
+	assert.NoError(t, db.Del("a"))
+	assert.NoError(t, db.Set("c", []byte("c3")))
+
+	it, err := db.NewIterator("", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c", "d"}, collectKeys(it, false))
+	assert.NoError(t, it.Error())
+
+	it.Seek("c")
+	assert.True(t, it.Valid())
+	assert.Equal(t, []byte("c3"), it.Value())
+
+	it.SeekToLast()
+	assert.Equal(t, []string{"d", "c", "b"}, collectKeys(it, true))
+}
+
+func TestIterator_ChangeDirection(t *testing.T) {
+	db := newTestDB(t)
+
+	for _, key := range []string{"k1", "k3", "k5"} {
+		assert.NoError(t, db.Set(key, []byte(key)))
+	}
+	forceFlush(t, db)
+	for _, key := range []string{"k2", "k4"} {
+		assert.NoError(t, db.Set(key, []byte(key)))
+	}
+
+	it, err := db.NewIterator("", "")
+	assert.NoError(t, err)
+	it.Seek("k3")
+	assert.Equal(t, "k3", it.Key())
+	it.Next()
+	assert.Equal(t, "k4", it.Key())
+	it.Prev()
+	assert.Equal(t, "k3", it.Key())
+	it.Prev()
+	assert.Equal(t, "k2", it.Key())
+	it.Next()
+	assert.Equal(t, "k3", it.Key())
+}
+
+func TestIterator_Bounds(t *testing.T) {
+	db := newTestDB(t)
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		assert.NoError(t, db.Set(key, []byte(key)))
+	}
+
+	it, err := db.NewIterator("b", "d")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, collectKeys(it, false))
+
+	it.SeekToLast()
+	assert.Equal(t, []string{"c", "b"}, collectKeys(it, true))
+
+	it.Seek("a")
+	assert.Equal(t, "b", it.Key())
+}
+
+func TestIterator_UnpublishedBatch(t *testing.T) {
+	db := newTestDB(t, MemoryTable(func() memorytable.MemoryTable { return memorytable.NewLockFreeMemoryTable() }))
+	for _, key := range []string{"a", "c", "e"} {
+		assert.NoError(t, db.Set(key, []byte("1")))
+	}
+
+	// 无锁内存表中批次的记录逐条可见，序列号发布前迭代器看不到其中任何一条
+	batch := NewWriteBatch()
+	batch.Set("a", []byte("2"))
+	batch.Set("b", []byte("2"))
+	batch.DeleteRange("c", "d")
+	db.writeLock.Lock()
+	seq := db.assignSequence(batch.chunks)
+	applyToMemoryTable(db.defaultColumnFamily.activeMemoryTable(), batch.chunks)
+	it, err := db.NewIterator("", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), it.Value())
+	assert.Equal(t, []string{"a", "c", "e"}, collectKeys(it, false))
+	it.SeekToLast()
+	assert.Equal(t, []string{"e", "c", "a"}, collectKeys(it, true))
+	it.Close()
+
+	db.publishSequence(seq)
+	db.writeLock.Unlock()
+	it, err = db.NewIterator("", "")
+	assert.NoError(t, err)
+	defer it.Close()
+	assert.Equal(t, []byte("2"), it.Value())
+	assert.Equal(t, []string{"a", "b", "e"}, collectKeys(it, false))
+	it.SeekToLast()
+	assert.Equal(t, []string{"e", "b", "a"}, collectKeys(it, true))
+}
+
+func TestDB_Scan(t *testing.T) {
+	db := newTestDB(t)
+
+	for _, key := range []string{"tenant1:a", "tenant1:b", "tenant2:a", "tenant10:a"} {
+		assert.NoError(t, db.Set(key, []byte(key)))
+	}
+	forceFlush(t, db)
+	assert.NoError(t, db.Del("tenant1:b"))
+	assert.NoError(t, db.Set("tenant1:c", []byte("c")))
+
+	it, err := db.Scan("tenant1:")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tenant1:a", "tenant1:c"}, collectKeys(it, false))
+}
+
+func TestPrefixUpperBound(t *testing.T) {
+	assert.Equal(t, "b", prefixUpperBound("a"))
+	assert.Equal(t, "ab", prefixUpperBound("aa"))
+	assert.Equal(t, "b", prefixUpperBound("a\xff"))
+	assert.Equal(t, "", prefixUpperBound("\xff\xff"))
+	assert.Equal(t, "", prefixUpperBound(""))
+}
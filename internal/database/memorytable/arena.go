@@ -0,0 +1,42 @@
+package memorytable
+
+import (
+	"sync/atomic"
+)
+
+// arena hands out slices of T carved from large blocks with an atomic bump offset, so that a table makes a few
+// large allocations instead of one per node, tower, key and value. Memory is only reclaimed along with the whole
+// arena, once the table it belongs to is dropped. An arena is safe for concurrent use.
+type arena[T any] struct {
+	blockSize int
+	current   atomic.Pointer[arenaBlock[T]]
+}
+
+type arenaBlock[T any] struct {
+	items []T
+	used  int64
+}
+
+// newArena returns an arena allocating blocks of blockSize items.
+func newArena[T any](blockSize int) *arena[T] {
+	return &arena[T]{blockSize: blockSize}
+}
+
+// alloc returns a zeroed slice of n items. Requests larger than a quarter of a block get a slice of their own,
+// so that a large value does not waste the rest of the current block.
+func (a *arena[T]) alloc(n int) []T {
+	if n > a.blockSize/4 {
+		return make([]T, n)
+	}
+	for {
+		b := a.current.Load()
+		if b != nil {
+			end := atomic.AddInt64(&b.used, int64(n))
+			if end <= int64(len(b.items)) {
+				return b.items[end-int64(n) : end : end]
+			}
+		}
+		// 当前块已用完，由一个写入者换上新块，其余写入者重试
+		a.current.CompareAndSwap(b, &arenaBlock[T]{items: make([]T, a.blockSize)})
+	}
+}
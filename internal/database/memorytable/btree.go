@@ -0,0 +1,300 @@
+package memorytable
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+const btreeDegree = 32
+
+// BTreeMemoryTable keeps the versions in a B-tree ordered like the skip list tables.
+// Nodes hold up to 2*btreeDegree-1 versions next to each other, so searches touch far fewer nodes,
+// and far fewer cache lines, than a skip list of the same size.
+type BTreeMemoryTable struct {
+	*rangeTombstoneList
+	root    *btreeNode
+	size    int64
+	scanPos *common.Chunk
+	lock    *sync.RWMutex
+}
+
+// btreeNode is a node of the B-tree: a leaf has no children, an inner node one more child than chunks.
+// Every chunk in children[i] sorts between chunks[i-1] and chunks[i].
+type btreeNode struct {
+	chunks   []*common.Chunk
+	children []*btreeNode
+}
+
+// NewBTreeMemoryTable returns an empty B-tree memory table.
+func NewBTreeMemoryTable() *BTreeMemoryTable {
+	return &BTreeMemoryTable{
+		rangeTombstoneList: newRangeTombstoneList(),
+		root:               &btreeNode{},
+		lock:               &sync.RWMutex{},
+	}
+}
+
+// Set adds or updates a key-value pair without a sequence number.
+func (s *BTreeMemoryTable) Set(key string, value []byte, deleted bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.set(&common.Chunk{Key: key, Value: value, Deleted: deleted})
+}
+
+// SetBatch applies every chunk in order while holding the write lock once,
+// so that readers observe either none or all of the batch.
+func (s *BTreeMemoryTable) SetBatch(chunks []common.Chunk) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := range chunks {
+		s.set(&chunks[i])
+	}
+}
+
+// set inserts a version of a key, or replaces the version holding the same key and sequence number.
+// Full nodes are split on the way down, so that there is always room for the chunk in the leaf reached.
+// The caller must hold the write lock.
+func (s *BTreeMemoryTable) set(chunk *common.Chunk) {
+	c := &common.Chunk{Key: chunk.Key, Value: chunk.Value, Deleted: chunk.Deleted, Merge: chunk.Merge, Seq: chunk.Seq, ExpiresAt: chunk.ExpiresAt}
+	s.size += int64(len(chunk.Key) + len(chunk.Value))
+
+	if len(s.root.chunks) == 2*btreeDegree-1 {
+		s.root = &btreeNode{children: []*btreeNode{s.root}}
+		s.root.split(0)
+	}
+	node := s.root
+	for {
+		i := node.search(c)
+		// 相同版本已存在时直接替换，已返回给迭代器的 chunk 不受影响
+		if i < len(node.chunks) && node.chunks[i].Key == c.Key && node.chunks[i].Seq == c.Seq {
+			node.chunks[i] = c
+			return
+		}
+		if len(node.children) == 0 {
+			node.chunks = append(node.chunks, nil)
+			copy(node.chunks[i+1:], node.chunks[i:])
+			node.chunks[i] = c
+			return
+		}
+		if len(node.children[i].chunks) == 2*btreeDegree-1 {
+			node.split(i)
+			if !c.Before(node.chunks[i]) {
+				if node.chunks[i].Key == c.Key && node.chunks[i].Seq == c.Seq {
+					node.chunks[i] = c
+					return
+				}
+				i++
+			}
+		}
+		node = node.children[i]
+	}
+}
+
+// search returns the index of the first chunk of the node that does not sort before c.
+func (n *btreeNode) search(c *common.Chunk) int {
+	return sort.Search(len(n.chunks), func(i int) bool {
+		return !n.chunks[i].Before(c)
+	})
+}
+
+// split splits the full child i around its middle chunk, which moves up into n.
+func (n *btreeNode) split(i int) {
+	child := n.children[i]
+	middle := child.chunks[btreeDegree-1]
+	right := &btreeNode{chunks: append([]*common.Chunk(nil), child.chunks[btreeDegree:]...)}
+	if len(child.children) > 0 {
+		right.children = append([]*btreeNode(nil), child.children[btreeDegree:]...)
+		child.children = child.children[:btreeDegree:btreeDegree]
+	}
+	child.chunks = child.chunks[: btreeDegree-1 : btreeDegree-1]
+
+	n.chunks = append(n.chunks, nil)
+	copy(n.chunks[i+1:], n.chunks[i:])
+	n.chunks[i] = middle
+	n.children = append(n.children, nil)
+	copy(n.children[i+2:], n.children[i+1:])
+	n.children[i+1] = right
+}
+
+// ceiling returns the first chunk of the subtree that does not sort before c, or nil if there is none.
+func (n *btreeNode) ceiling(c *common.Chunk) *common.Chunk {
+	i := n.search(c)
+	if i < len(n.chunks) && n.chunks[i].Key == c.Key && n.chunks[i].Seq == c.Seq {
+		return n.chunks[i]
+	}
+	if len(n.children) > 0 {
+		if found := n.children[i].ceiling(c); found != nil {
+			return found
+		}
+	}
+	if i < len(n.chunks) {
+		return n.chunks[i]
+	}
+	return nil
+}
+
+// after returns the first chunk of the subtree that sorts after c, or the first chunk of all if c is nil.
+func (n *btreeNode) after(c *common.Chunk) *common.Chunk {
+	i := 0
+	if c != nil {
+		i = sort.Search(len(n.chunks), func(i int) bool {
+			return c.Before(n.chunks[i])
+		})
+	}
+	if len(n.children) > 0 {
+		if found := n.children[i].after(c); found != nil {
+			return found
+		}
+	}
+	if i < len(n.chunks) {
+		return n.chunks[i]
+	}
+	return nil
+}
+
+// before returns the last chunk of the subtree that sorts before c, or the last chunk of all if c is nil.
+func (n *btreeNode) before(c *common.Chunk) *common.Chunk {
+	i := len(n.chunks)
+	if c != nil {
+		i = n.search(c)
+	}
+	if len(n.children) > 0 {
+		if found := n.children[i].before(c); found != nil {
+			return found
+		}
+	}
+	if i > 0 {
+		return n.chunks[i-1]
+	}
+	return nil
+}
+
+// Get returns the value of the newest version of key, or nil if the key is missing, deleted or expired.
+func (s *BTreeMemoryTable) Get(key string) []byte {
+	chunk := s.Lookup(key, common.MaxSeq)
+	if chunk == nil || chunk.Deleted || chunk.Expired(time.Now()) {
+		return nil
+	}
+	return chunk.Value
+}
+
+// Lookup returns a copy of the newest version of key whose sequence number is not greater than seq,
+// tombstones included, or nil if the table holds no such version.
+func (s *BTreeMemoryTable) Lookup(key string, seq uint64) *common.Chunk {
+	s.lock.RLocker().Lock()
+	defer s.lock.RLocker().Unlock()
+
+	found := s.root.ceiling(&common.Chunk{Key: key, Seq: seq})
+	if found == nil || found.Key != key {
+		return nil
+	}
+	chunk := *found
+	return &chunk
+}
+
+// Size returns the total size in bytes of all the keys and values written to the table.
+func (s *BTreeMemoryTable) Size() int64 {
+	s.lock.RLocker().Lock()
+	defer s.lock.RLocker().Unlock()
+
+	return s.size + s.rangeSize()
+}
+
+// Scan advances the scanner to the next version in the table and reports whether there was one.
+func (s *BTreeMemoryTable) Scan() bool {
+	s.lock.RLocker().Lock()
+	defer s.lock.RLocker().Unlock()
+
+	next := s.root.after(s.scanPos)
+	if next == nil {
+		return false
+	}
+	s.scanPos = next
+	return true
+}
+
+// ScanValue returns the chunk at the scanner's position.
+func (s *BTreeMemoryTable) ScanValue() *common.Chunk {
+	return s.scanPos
+}
+
+type btreeIterator struct {
+	table *BTreeMemoryTable
+	chunk common.Chunk
+	valid bool
+}
+
+// NewIterator returns an iterator over the B-tree, tombstones included.
+// Nodes split under inserts, so the iterator does not keep a position in the tree: every move searches
+// from the root for the version next to the one it returned last, under the table's read lock.
+func (s *BTreeMemoryTable) NewIterator() common.Iterator {
+	return &btreeIterator{table: s}
+}
+
+// Valid reports whether the iterator is positioned at a version.
+func (it *btreeIterator) Valid() bool {
+	return it.valid
+}
+
+// Seek positions the iterator at the first version whose key is greater than or equal to key.
+func (it *btreeIterator) Seek(key string) {
+	it.table.lock.RLocker().Lock()
+	defer it.table.lock.RLocker().Unlock()
+
+	it.setChunk(it.table.root.ceiling(&common.Chunk{Key: key, Seq: common.MaxSeq}))
+}
+
+// SeekToFirst positions the iterator at the smallest key in the table.
+func (it *btreeIterator) SeekToFirst() {
+	it.table.lock.RLocker().Lock()
+	defer it.table.lock.RLocker().Unlock()
+
+	it.setChunk(it.table.root.after(nil))
+}
+
+// SeekToLast positions the iterator at the largest key in the table.
+func (it *btreeIterator) SeekToLast() {
+	it.table.lock.RLocker().Lock()
+	defer it.table.lock.RLocker().Unlock()
+
+	it.setChunk(it.table.root.before(nil))
+}
+
+// Next moves to the version following the current one.
+func (it *btreeIterator) Next() {
+	it.table.lock.RLocker().Lock()
+	defer it.table.lock.RLocker().Unlock()
+
+	it.setChunk(it.table.root.after(&it.chunk))
+}
+
+// Prev moves to the version preceding the current one.
+func (it *btreeIterator) Prev() {
+	it.table.lock.RLocker().Lock()
+	defer it.table.lock.RLocker().Unlock()
+
+	it.setChunk(it.table.root.before(&it.chunk))
+}
+
+// Chunk returns a copy of the chunk taken when the iterator was last positioned.
+func (it *btreeIterator) Chunk() *common.Chunk {
+	return &it.chunk
+}
+
+// Error always returns nil, as iterating an in-memory table cannot fail.
+func (it *btreeIterator) Error() error {
+	return nil
+}
+
+// setChunk moves the iterator to chunk and snapshots it. The caller must hold the table's read lock.
+func (it *btreeIterator) setChunk(chunk *common.Chunk) {
+	it.valid = chunk != nil
+	if chunk != nil {
+		it.chunk = *chunk
+	}
+}
@@ -0,0 +1,39 @@
+package memorytable
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Names of the memory table implementations, as set by memory_table.type in the configuration.
+const (
+	TypeSkipList = "skiplist"
+	TypeLockFree = "lockfree"
+	TypeBTree    = "btree"
+	TypeHash     = "hash"
+)
+
+// Factory creates an empty memory table.
+type Factory func() MemoryTable
+
+// DefaultFactory creates the skip list memory table.
+func DefaultFactory() MemoryTable {
+	return NewMemoryTable()
+}
+
+// ParseType returns the factory of the memory table implementation named typ.
+// An empty name selects the skip list.
+func ParseType(typ string) (Factory, error) {
+	switch strings.ToLower(typ) {
+	case "", TypeSkipList:
+		return DefaultFactory, nil
+	case TypeLockFree:
+		return func() MemoryTable { return NewLockFreeMemoryTable() }, nil
+	case TypeBTree:
+		return func() MemoryTable { return NewBTreeMemoryTable() }, nil
+	case TypeHash:
+		return func() MemoryTable { return NewHashMemoryTable() }, nil
+	default:
+		return nil, fmt.Errorf("unknown memory table type %q", typ)
+	}
+}
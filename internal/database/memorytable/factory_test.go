@@ -0,0 +1,126 @@
+package memorytable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+func TestParseType(t *testing.T) {
+	for _, typ := range []string{"", TypeSkipList, TypeLockFree, TypeBTree, "HASH"} {
+		if _, err := ParseType(typ); err != nil {
+			t.Errorf("Expected type %q to be accepted, but got %v", typ, err)
+		}
+	}
+	if _, err := ParseType("rbtree"); err == nil {
+		t.Errorf("Expected an unknown type to be rejected")
+	}
+}
+
+// TestMemoryTables_Versions checks that every implementation orders, updates and looks up versions the same way.
+func TestMemoryTables_Versions(t *testing.T) {
+	for _, typ := range []string{TypeSkipList, TypeLockFree, TypeBTree, TypeHash} {
+		t.Run(typ, func(t *testing.T) {
+			factory, _ := ParseType(typ)
+			st := factory()
+
+			// 足够多的版本让 B 树发生多次分裂
+			for i := 0; i < 500; i++ {
+				st.SetBatch([]common.Chunk{
+					{Key: fmt.Sprintf("key%03d", i%100), Value: []byte(fmt.Sprintf("v%d", i)), Seq: uint64(i + 1)},
+				})
+			}
+			st.SetBatch([]common.Chunk{{Key: "key042", Deleted: true, Seq: 1000}})
+			// 相同版本被原地替换
+			st.SetBatch([]common.Chunk{{Key: "key007", Value: []byte("replaced"), Seq: 408}})
+
+			if value := st.Get("key007"); string(value) != "replaced" {
+				t.Errorf("Expected the replaced value, but got %s", value)
+			}
+			if value := st.Get("key042"); value != nil {
+				t.Errorf("Expected nil value for deleted key, but got %s", value)
+			}
+			if chunk := st.Lookup("key042", 999); chunk == nil || string(chunk.Value) != "v442" {
+				t.Errorf("Expected v442 below the tombstone, but got %v", chunk)
+			}
+			if chunk := st.Lookup("key042", 42); chunk != nil {
+				t.Errorf("Expected no version before the first write, but got %v", chunk)
+			}
+
+			forward := make([]*common.Chunk, 0)
+			it := st.NewIterator()
+			for it.SeekToFirst(); it.Valid(); it.Next() {
+				chunk := *it.Chunk()
+				if len(forward) > 0 && !forward[len(forward)-1].Before(&chunk) {
+					t.Fatalf("Versions out of order: %s@%d after %s@%d", chunk.Key, chunk.Seq, forward[len(forward)-1].Key, forward[len(forward)-1].Seq)
+				}
+				forward = append(forward, &chunk)
+			}
+			if len(forward) != 501 {
+				t.Errorf("Expected 501 versions, but iterated %d", len(forward))
+			}
+
+			backward := 0
+			for it.SeekToLast(); it.Valid(); it.Prev() {
+				if it.Chunk().Key != forward[len(forward)-1-backward].Key || it.Chunk().Seq != forward[len(forward)-1-backward].Seq {
+					t.Fatalf("Backward iteration differs at %d", backward)
+				}
+				backward++
+			}
+			if backward != len(forward) {
+				t.Errorf("Expected %d versions backwards, but iterated %d", len(forward), backward)
+			}
+
+			it.Seek("key050")
+			if !it.Valid() || it.Chunk().Key != "key050" || it.Chunk().Seq != 451 {
+				t.Errorf("Expected seek to land on key050@451, but got %v", it.Chunk())
+			}
+
+			scanned := 0
+			for st.Scan() {
+				if st.ScanValue().Key != forward[scanned].Key || st.ScanValue().Seq != forward[scanned].Seq {
+					t.Fatalf("Scan differs from the iterator at %d", scanned)
+				}
+				scanned++
+			}
+			if scanned != len(forward) {
+				t.Errorf("Expected %d scanned versions, but got %d", len(forward), scanned)
+			}
+		})
+	}
+}
+
+func TestMemoryTables_RangeTombstones(t *testing.T) {
+	for _, typ := range []string{TypeSkipList, TypeLockFree, TypeBTree, TypeHash} {
+		t.Run(typ, func(t *testing.T) {
+			factory, _ := ParseType(typ)
+			st := factory()
+			st.SetBatch([]common.Chunk{{Key: "a", Value: []byte("1"), Seq: 1}})
+			size := st.Size()
+
+			st.DeleteRange(common.RangeTombstone{Start: "a", End: "m", Seq: 2})
+			st.DeleteRange(common.RangeTombstone{Start: "k", End: "z", Seq: 3})
+			tombstones := st.RangeTombstones()
+			if len(tombstones) != 2 || tombstones[0].End != "m" || tombstones[1].Seq != 3 {
+				t.Errorf("Expected both range tombstones in order, but got %v", tombstones)
+			}
+			if st.Size() <= size {
+				t.Errorf("Expected range tombstones to count in the size of the table")
+			}
+
+			// 范围墓碑不是某个 key 的版本，不会出现在点查询和迭代中
+			if chunk := st.Lookup("b", common.MaxSeq); chunk != nil {
+				t.Errorf("Expected no version of b, but got %v", chunk)
+			}
+			it := st.NewIterator()
+			count := 0
+			for it.SeekToFirst(); it.Valid(); it.Next() {
+				count++
+			}
+			if count != 1 {
+				t.Errorf("Expected 1 version, but iterated %d", count)
+			}
+		})
+	}
+}
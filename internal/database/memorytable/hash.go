@@ -0,0 +1,211 @@
+package memorytable
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+// HashMemoryTable keeps the versions of every key in a hash map, which makes writes and point lookups
+// independent of the size of the table. Ordering is only paid for when it is needed: the versions are sorted
+// the first time the table is scanned or iterated after a write, typically once, when the table is flushed.
+type HashMemoryTable struct {
+	*rangeTombstoneList
+	versions map[string][]*common.Chunk
+	sorted   []*common.Chunk
+	size     int64
+	scanPos  int
+	lock     *sync.RWMutex
+}
+
+// NewHashMemoryTable returns an empty hash memory table.
+func NewHashMemoryTable() *HashMemoryTable {
+	return &HashMemoryTable{
+		rangeTombstoneList: newRangeTombstoneList(),
+		versions:           make(map[string][]*common.Chunk),
+		scanPos:            -1,
+		lock:               &sync.RWMutex{},
+	}
+}
+
+// Set adds or updates a key-value pair without a sequence number.
+func (s *HashMemoryTable) Set(key string, value []byte, deleted bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.set(&common.Chunk{Key: key, Value: value, Deleted: deleted})
+}
+
+// SetBatch applies every chunk in order while holding the write lock once,
+// so that readers observe either none or all of the batch.
+func (s *HashMemoryTable) SetBatch(chunks []common.Chunk) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := range chunks {
+		s.set(&chunks[i])
+	}
+}
+
+// set inserts a version of a key, or replaces the version holding the same sequence number.
+// The versions of a key are kept from the newest to the oldest. The caller must hold the write lock.
+func (s *HashMemoryTable) set(chunk *common.Chunk) {
+	c := &common.Chunk{Key: chunk.Key, Value: chunk.Value, Deleted: chunk.Deleted, Merge: chunk.Merge, Seq: chunk.Seq, ExpiresAt: chunk.ExpiresAt}
+	s.size += int64(len(chunk.Key) + len(chunk.Value))
+	s.sorted = nil
+
+	versions := s.versions[c.Key]
+	i := sort.Search(len(versions), func(i int) bool {
+		return versions[i].Seq <= c.Seq
+	})
+	if i < len(versions) && versions[i].Seq == c.Seq {
+		versions[i] = c
+		return
+	}
+	versions = append(versions, nil)
+	copy(versions[i+1:], versions[i:])
+	versions[i] = c
+	s.versions[c.Key] = versions
+}
+
+// Get returns the value of the newest version of key, or nil if the key is missing, deleted or expired.
+func (s *HashMemoryTable) Get(key string) []byte {
+	chunk := s.Lookup(key, common.MaxSeq)
+	if chunk == nil || chunk.Deleted || chunk.Expired(time.Now()) {
+		return nil
+	}
+	return chunk.Value
+}
+
+// Lookup returns a copy of the newest version of key whose sequence number is not greater than seq,
+// tombstones included, or nil if the table holds no such version.
+func (s *HashMemoryTable) Lookup(key string, seq uint64) *common.Chunk {
+	s.lock.RLocker().Lock()
+	defer s.lock.RLocker().Unlock()
+
+	versions := s.versions[key]
+	i := sort.Search(len(versions), func(i int) bool {
+		return versions[i].Seq <= seq
+	})
+	if i == len(versions) {
+		return nil
+	}
+	chunk := *versions[i]
+	return &chunk
+}
+
+// Size returns the total size in bytes of all the keys and values written to the table.
+func (s *HashMemoryTable) Size() int64 {
+	s.lock.RLocker().Lock()
+	defer s.lock.RLocker().Unlock()
+
+	return s.size + s.rangeSize()
+}
+
+// sortedChunks returns every version in order, sorting them if the table was written since the last call.
+// The returned slice is never modified afterwards: a write makes the next call build a new one.
+func (s *HashMemoryTable) sortedChunks() []*common.Chunk {
+	s.lock.RLocker().Lock()
+	sorted := s.sorted
+	s.lock.RLocker().Unlock()
+	if sorted != nil {
+		return sorted
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.sorted == nil {
+		keys := make([]string, 0, len(s.versions))
+		for key := range s.versions {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		sorted = make([]*common.Chunk, 0, len(keys))
+		for _, key := range keys {
+			sorted = append(sorted, s.versions[key]...)
+		}
+		s.sorted = sorted
+	}
+	return s.sorted
+}
+
+// Scan advances the scanner to the next version in the table and reports whether there was one.
+// Scanning is meant for a table that no longer receives writes, such as one being flushed.
+func (s *HashMemoryTable) Scan() bool {
+	sorted := s.sortedChunks()
+	if s.scanPos+1 >= len(sorted) {
+		return false
+	}
+	s.scanPos++
+	return true
+}
+
+// ScanValue returns the chunk at the scanner's position.
+func (s *HashMemoryTable) ScanValue() *common.Chunk {
+	return s.sortedChunks()[s.scanPos]
+}
+
+type hashIterator struct {
+	chunks []*common.Chunk
+	pos    int
+	chunk  common.Chunk
+}
+
+// NewIterator returns an iterator over the versions the table holds when it is created, tombstones included.
+// Versions written afterwards are not visible to the iterator.
+func (s *HashMemoryTable) NewIterator() common.Iterator {
+	return &hashIterator{chunks: s.sortedChunks(), pos: -1}
+}
+
+// Valid reports whether the iterator is positioned at a version.
+func (it *hashIterator) Valid() bool {
+	return it.pos >= 0 && it.pos < len(it.chunks)
+}
+
+// Seek positions the iterator at the first version whose key is greater than or equal to key.
+func (it *hashIterator) Seek(key string) {
+	it.setPos(sort.Search(len(it.chunks), func(i int) bool {
+		return it.chunks[i].Key >= key
+	}))
+}
+
+// SeekToFirst positions the iterator at the smallest key in the table.
+func (it *hashIterator) SeekToFirst() {
+	it.setPos(0)
+}
+
+// SeekToLast positions the iterator at the largest key in the table.
+func (it *hashIterator) SeekToLast() {
+	it.setPos(len(it.chunks) - 1)
+}
+
+// Next moves to the version following the current one.
+func (it *hashIterator) Next() {
+	it.setPos(it.pos + 1)
+}
+
+// Prev moves to the version preceding the current one.
+func (it *hashIterator) Prev() {
+	it.setPos(it.pos - 1)
+}
+
+// Chunk returns a copy of the chunk at the iterator's position.
+func (it *hashIterator) Chunk() *common.Chunk {
+	return &it.chunk
+}
+
+// Error always returns nil, as iterating an in-memory table cannot fail.
+func (it *hashIterator) Error() error {
+	return nil
+}
+
+// setPos moves the iterator to pos and snapshots the chunk there.
+func (it *hashIterator) setPos(pos int) {
+	it.pos = pos
+	if it.Valid() {
+		it.chunk = *it.chunks[pos]
+	}
+}
@@ -0,0 +1,113 @@
+package memorytable
+
+import (
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+type memoryTableIterator struct {
+	table *DefaultMemoryTable
+	node  *Node
+	chunk common.Chunk
+}
+
+// NewIterator returns an iterator over the skip list, tombstones included.
+// Every positioning call takes the table's read lock, so the iterator may be used while writers keep inserting;
+// the chunk is copied at positioning time so that in-place updates do not leak into a chunk already returned.
+func (s *DefaultMemoryTable) NewIterator() common.Iterator {
+	return &memoryTableIterator{table: s}
+}
+
+// Valid reports whether the iterator is positioned at a node.
+func (it *memoryTableIterator) Valid() bool {
+	return it.node != nil
+}
+
+// Seek positions the iterator at the first node whose key is greater than or equal to key.
+func (it *memoryTableIterator) Seek(key string) {
+	it.table.lock.RLocker().Lock()
+	defer it.table.lock.RLocker().Unlock()
+
+	it.setNode(it.table.findLessThan(key).next[0])
+}
+
+// SeekToFirst positions the iterator at the smallest key in the table.
+func (it *memoryTableIterator) SeekToFirst() {
+	it.table.lock.RLocker().Lock()
+	defer it.table.lock.RLocker().Unlock()
+
+	it.setNode(it.table.head.next[0])
+}
+
+// SeekToLast positions the iterator at the largest key in the table.
+func (it *memoryTableIterator) SeekToLast() {
+	it.table.lock.RLocker().Lock()
+	defer it.table.lock.RLocker().Unlock()
+
+	node := it.table.head
+	for i := it.table.level - 1; i >= 0; i-- {
+		for node.next[i] != nil {
+			node = node.next[i]
+		}
+	}
+	if node == it.table.head {
+		node = nil
+	}
+	it.setNode(node)
+}
+
+// Next advances to the following node on the bottom level.
+func (it *memoryTableIterator) Next() {
+	it.table.lock.RLocker().Lock()
+	defer it.table.lock.RLocker().Unlock()
+
+	it.setNode(it.node.next[0])
+}
+
+// Prev moves to the node preceding the current version.
+// The skip list only has forward links, so the predecessor is found by searching from the head again.
+func (it *memoryTableIterator) Prev() {
+	it.table.lock.RLocker().Lock()
+	defer it.table.lock.RLocker().Unlock()
+
+	node := it.table.findBefore(&it.chunk)
+	if node == it.table.head {
+		node = nil
+	}
+	it.setNode(node)
+}
+
+// Chunk returns a copy of the chunk taken when the iterator was last positioned.
+func (it *memoryTableIterator) Chunk() *common.Chunk {
+	return &it.chunk
+}
+
+// Error always returns nil, as iterating an in-memory table cannot fail.
+func (it *memoryTableIterator) Error() error {
+	return nil
+}
+
+// setNode moves the iterator to node and snapshots its chunk. The caller must hold the table's read lock.
+func (it *memoryTableIterator) setNode(node *Node) {
+	it.node = node
+	if node != nil {
+		it.chunk = *node.chunk
+	}
+}
+
+// findLessThan returns the last node whose key is strictly less than key, or the head if there is none.
+// The caller must hold the table's lock.
+func (s *DefaultMemoryTable) findLessThan(key string) *Node {
+	return s.findBefore(&common.Chunk{Key: key, Seq: common.MaxSeq})
+}
+
+// findBefore returns the last node that sorts strictly before chunk, or the head if there is none.
+// The caller must hold the table's lock.
+func (s *DefaultMemoryTable) findBefore(chunk *common.Chunk) *Node {
+	node := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].chunk.Before(chunk) {
+			node = node.next[i]
+		}
+	}
+	return node
+}
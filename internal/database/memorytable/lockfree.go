@@ -0,0 +1,234 @@
+package memorytable
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+const (
+	lockFreeMaxHeight = 12
+	lockFreeBranching = 4
+)
+
+// LockFreeMemoryTable is a skip list that writers insert into concurrently without taking any lock.
+// Nodes are linked with atomic pointers: a new node is published on the bottom level with a compare-and-swap,
+// then on every level above it, and a writer that loses a race searches its position again from the node it
+// had found. Nodes are never removed, so readers simply follow the links.
+// Nodes, towers, chunks, keys and values are allocated from arenas that live as long as the table.
+// Chunks of the same batch become visible one by one; readers that must not observe part of a batch have to
+// filter versions by sequence number. Range tombstones, rare in comparison, are kept behind a lock.
+type LockFreeMemoryTable struct {
+	*rangeTombstoneList
+	head    *lockFreeNode
+	height  int32
+	size    int64
+	nodes   *arena[lockFreeNode]
+	links   *arena[atomic.Pointer[lockFreeNode]]
+	chunks  *arena[common.Chunk]
+	bytes   *arena[byte]
+	scanPos *lockFreeNode
+}
+
+// lockFreeNode holds a version of a key. The key and the sequence number that order the node never change,
+// while the chunk may be replaced atomically by a write of the same version.
+type lockFreeNode struct {
+	key   string
+	seq   uint64
+	chunk atomic.Pointer[common.Chunk]
+	next  []atomic.Pointer[lockFreeNode]
+}
+
+// NewLockFreeMemoryTable returns an empty lock-free memory table.
+func NewLockFreeMemoryTable() *LockFreeMemoryTable {
+	t := &LockFreeMemoryTable{
+		rangeTombstoneList: newRangeTombstoneList(),
+		height:             1,
+		nodes:              newArena[lockFreeNode](1024),
+		links:              newArena[atomic.Pointer[lockFreeNode]](4096),
+		chunks:             newArena[common.Chunk](1024),
+		bytes:              newArena[byte](64 * common.KB),
+	}
+	t.head = &lockFreeNode{next: make([]atomic.Pointer[lockFreeNode], lockFreeMaxHeight)}
+	t.head.chunk.Store(&common.Chunk{})
+	t.scanPos = t.head
+	return t
+}
+
+// before reports whether the node sorts before the version of key with sequence number seq.
+func (n *lockFreeNode) before(key string, seq uint64) bool {
+	if n.key != key {
+		return n.key < key
+	}
+	return n.seq > seq
+}
+
+// Set adds or updates a key-value pair without a sequence number. It may be called concurrently with any other method
+// but Scan and ScanValue.
+func (s *LockFreeMemoryTable) Set(key string, value []byte, deleted bool) {
+	s.set(&common.Chunk{Key: key, Value: value, Deleted: deleted})
+}
+
+// SetBatch inserts every chunk in order, each as a new version of its key. Concurrent readers may observe
+// the first chunks of the batch before the last ones.
+func (s *LockFreeMemoryTable) SetBatch(chunks []common.Chunk) {
+	for i := range chunks {
+		s.set(&chunks[i])
+	}
+}
+
+// set inserts a version of a key, or replaces the chunk of the node holding the same version.
+// The key and the value are copied into the arena, so the caller may reuse them afterwards.
+func (s *LockFreeMemoryTable) set(chunk *common.Chunk) {
+	var prev, next [lockFreeMaxHeight]*lockFreeNode
+	before := s.head
+	for level := lockFreeMaxHeight - 1; level >= 0; level-- {
+		prev[level], next[level] = s.findSpliceForLevel(chunk.Key, chunk.Seq, level, before)
+		before = prev[level]
+	}
+	if n := next[0]; n != nil && n.key == chunk.Key && n.seq == chunk.Seq {
+		s.update(n, chunk)
+		return
+	}
+
+	height := s.randomHeight()
+	node := s.newNode(chunk, height)
+	for {
+		current := atomic.LoadInt32(&s.height)
+		if int32(height) <= current || atomic.CompareAndSwapInt32(&s.height, current, int32(height)) {
+			break
+		}
+	}
+
+	for level := 0; level < height; level++ {
+		for {
+			node.next[level].Store(next[level])
+			if prev[level].next[level].CompareAndSwap(next[level], node) {
+				break
+			}
+			// 并发插入改变了该层的链接，从原来的前驱开始重新查找位置
+			prev[level], next[level] = s.findSpliceForLevel(node.key, node.seq, level, prev[level])
+			if n := next[0]; level == 0 && n != nil && n.key == node.key && n.seq == node.seq {
+				s.update(n, chunk)
+				return
+			}
+		}
+	}
+	atomic.AddInt64(&s.size, int64(len(chunk.Key)+len(chunk.Value)))
+}
+
+// update replaces the chunk of node with a copy of chunk, which holds the same version.
+func (s *LockFreeMemoryTable) update(node *lockFreeNode, chunk *common.Chunk) {
+	node.chunk.Store(s.newChunk(node.key, chunk))
+	atomic.AddInt64(&s.size, int64(len(chunk.Key)+len(chunk.Value)))
+}
+
+// newNode allocates a node of the given height holding a copy of chunk.
+func (s *LockFreeMemoryTable) newNode(chunk *common.Chunk, height int) *lockFreeNode {
+	node := &s.nodes.alloc(1)[0]
+	node.key = s.copyString(chunk.Key)
+	node.seq = chunk.Seq
+	node.next = s.links.alloc(height)
+	node.chunk.Store(s.newChunk(node.key, chunk))
+	return node
+}
+
+// newChunk allocates a copy of chunk under key, which must already live in the arena.
+func (s *LockFreeMemoryTable) newChunk(key string, chunk *common.Chunk) *common.Chunk {
+	c := &s.chunks.alloc(1)[0]
+	c.Key = key
+	if chunk.Value != nil {
+		c.Value = s.bytes.alloc(len(chunk.Value))
+		copy(c.Value, chunk.Value)
+	}
+	c.Deleted = chunk.Deleted
+	c.Merge = chunk.Merge
+	c.Seq = chunk.Seq
+	c.ExpiresAt = chunk.ExpiresAt
+	return c
+}
+
+// copyString copies str into the arena.
+func (s *LockFreeMemoryTable) copyString(str string) string {
+	if len(str) == 0 {
+		return ""
+	}
+	buf := s.bytes.alloc(len(str))
+	copy(buf, str)
+	return unsafe.String(&buf[0], len(buf))
+}
+
+// findSpliceForLevel returns the nodes between which the version of key with sequence number seq belongs on level,
+// searching forward from before, which must sort before that version.
+func (s *LockFreeMemoryTable) findSpliceForLevel(key string, seq uint64, level int, before *lockFreeNode) (*lockFreeNode, *lockFreeNode) {
+	for {
+		next := before.next[level].Load()
+		if next == nil || !next.before(key, seq) {
+			return before, next
+		}
+		before = next
+	}
+}
+
+// findBefore returns the last node that sorts strictly before the version of key with sequence number seq,
+// or the head if there is none.
+func (s *LockFreeMemoryTable) findBefore(key string, seq uint64) *lockFreeNode {
+	node := s.head
+	for level := int(atomic.LoadInt32(&s.height)) - 1; level >= 0; level-- {
+		node, _ = s.findSpliceForLevel(key, seq, level, node)
+	}
+	return node
+}
+
+// randomHeight returns the height of a new node: every level above the first is reached with probability 1/lockFreeBranching.
+func (s *LockFreeMemoryTable) randomHeight() int {
+	height := 1
+	for height < lockFreeMaxHeight && rand.Intn(lockFreeBranching) == 0 {
+		height++
+	}
+	return height
+}
+
+// Get returns the value of the newest version of key, or nil if the key is missing, deleted or expired.
+func (s *LockFreeMemoryTable) Get(key string) []byte {
+	chunk := s.Lookup(key, common.MaxSeq)
+	if chunk == nil || chunk.Deleted || chunk.Expired(time.Now()) {
+		return nil
+	}
+	return chunk.Value
+}
+
+// Lookup returns a copy of the newest version of key whose sequence number is not greater than seq,
+// tombstones included, or nil if the table holds no such version.
+func (s *LockFreeMemoryTable) Lookup(key string, seq uint64) *common.Chunk {
+	node := s.findBefore(key, seq).next[0].Load()
+	if node == nil || node.key != key {
+		return nil
+	}
+	chunk := *node.chunk.Load()
+	return &chunk
+}
+
+// Size returns the total size in bytes of all the keys and values written to the table.
+func (s *LockFreeMemoryTable) Size() int64 {
+	return atomic.LoadInt64(&s.size) + s.rangeSize()
+}
+
+// Scan advances the scanner to the next version in the table and reports whether there was one.
+// Scanning is meant for a table that no longer receives writes, such as one being flushed.
+func (s *LockFreeMemoryTable) Scan() bool {
+	next := s.scanPos.next[0].Load()
+	if next == nil {
+		return false
+	}
+	s.scanPos = next
+	return true
+}
+
+// ScanValue returns the chunk at the scanner's position.
+func (s *LockFreeMemoryTable) ScanValue() *common.Chunk {
+	return s.scanPos.chunk.Load()
+}
@@ -0,0 +1,79 @@
+package memorytable
+
+import (
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+type lockFreeIterator struct {
+	table *LockFreeMemoryTable
+	node  *lockFreeNode
+	chunk common.Chunk
+}
+
+// NewIterator returns an iterator over the skip list, tombstones included.
+// It may be used while writers keep inserting: it never blocks them, and the chunk is copied at positioning time.
+func (s *LockFreeMemoryTable) NewIterator() common.Iterator {
+	return &lockFreeIterator{table: s}
+}
+
+// Valid reports whether the iterator is positioned at a node.
+func (it *lockFreeIterator) Valid() bool {
+	return it.node != nil
+}
+
+// Seek positions the iterator at the first node whose key is greater than or equal to key.
+func (it *lockFreeIterator) Seek(key string) {
+	it.setNode(it.table.findBefore(key, common.MaxSeq).next[0].Load())
+}
+
+// SeekToFirst positions the iterator at the smallest key in the table.
+func (it *lockFreeIterator) SeekToFirst() {
+	it.setNode(it.table.head.next[0].Load())
+}
+
+// SeekToLast positions the iterator at the largest key in the table.
+func (it *lockFreeIterator) SeekToLast() {
+	node := it.table.head
+	for level := lockFreeMaxHeight - 1; level >= 0; level-- {
+		for next := node.next[level].Load(); next != nil; next = node.next[level].Load() {
+			node = next
+		}
+	}
+	if node == it.table.head {
+		node = nil
+	}
+	it.setNode(node)
+}
+
+// Next advances to the following node on the bottom level.
+func (it *lockFreeIterator) Next() {
+	it.setNode(it.node.next[0].Load())
+}
+
+// Prev moves to the node preceding the current version.
+// The skip list only has forward links, so the predecessor is found by searching from the head again.
+func (it *lockFreeIterator) Prev() {
+	node := it.table.findBefore(it.node.key, it.node.seq)
+	if node == it.table.head {
+		node = nil
+	}
+	it.setNode(node)
+}
+
+// Chunk returns a copy of the chunk taken when the iterator was last positioned.
+func (it *lockFreeIterator) Chunk() *common.Chunk {
+	return &it.chunk
+}
+
+// Error always returns nil, as iterating an in-memory table cannot fail.
+func (it *lockFreeIterator) Error() error {
+	return nil
+}
+
+// setNode moves the iterator to node and snapshots its chunk.
+func (it *lockFreeIterator) setNode(node *lockFreeNode) {
+	it.node = node
+	if node != nil {
+		it.chunk = *node.chunk.Load()
+	}
+}
@@ -0,0 +1,145 @@
+package memorytable
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+func TestLockFreeTable_Set_Get(t *testing.T) {
+	st := NewLockFreeMemoryTable()
+
+	st.Set("key1", []byte("value1"), false)
+	st.Set("key2", []byte("value2"), false)
+
+	// 覆盖同一版本，并删除另一个键
+	st.Set("key1", []byte("updated_value1"), false)
+	st.Set("key2", nil, true)
+
+	if value := st.Get("key1"); string(value) != "updated_value1" {
+		t.Errorf("Expected value 'updated_value1', but got %s", value)
+	}
+	if value := st.Get("key2"); value != nil {
+		t.Errorf("Expected nil value for deleted key, but got %s", value)
+	}
+	if value := st.Get("key3"); value != nil {
+		t.Errorf("Expected nil value for missing key, but got %s", value)
+	}
+}
+
+func TestLockFreeTable_CopiesKeyAndValue(t *testing.T) {
+	st := NewLockFreeMemoryTable()
+
+	value := []byte("value1")
+	st.Set("key1", value, false)
+	copy(value, "VALUE1")
+
+	if got := st.Get("key1"); string(got) != "value1" {
+		t.Errorf("Expected value 'value1', but got %s", got)
+	}
+}
+
+func TestLockFreeTable_Lookup(t *testing.T) {
+	st := NewLockFreeMemoryTable()
+
+	st.SetBatch([]common.Chunk{
+		{Key: "a", Value: []byte("a1"), Seq: 1},
+		{Key: "a", Value: []byte("a3"), Seq: 3},
+		{Key: "a", Deleted: true, Seq: 5},
+	})
+
+	expected := map[uint64]string{0: "", 1: "a1", 2: "a1", 3: "a3", 4: "a3"}
+	for seq, value := range expected {
+		chunk := st.Lookup("a", seq)
+		if value == "" {
+			if chunk != nil {
+				t.Errorf("Expected no version at %d, but got %s", seq, chunk.Value)
+			}
+			continue
+		}
+		if chunk == nil || string(chunk.Value) != value {
+			t.Errorf("Expected %s at %d, but got %v", value, seq, chunk)
+		}
+	}
+	if chunk := st.Lookup("a", common.MaxSeq); chunk == nil || !chunk.Deleted {
+		t.Errorf("Expected the tombstone as the newest version, but got %v", chunk)
+	}
+}
+
+func TestLockFreeTable_Iterator(t *testing.T) {
+	st := NewLockFreeMemoryTable()
+
+	st.SetBatch([]common.Chunk{
+		{Key: "b", Value: []byte("b1"), Seq: 1},
+		{Key: "a", Value: []byte("a2"), Seq: 2},
+		{Key: "b", Value: []byte("b3"), Seq: 3},
+		{Key: "c", Value: []byte("c4"), Seq: 4},
+	})
+
+	versions := make([]string, 0)
+	it := st.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		versions = append(versions, fmt.Sprintf("%s@%d", it.Chunk().Key, it.Chunk().Seq))
+	}
+	if fmt.Sprint(versions) != "[a@2 b@3 b@1 c@4]" {
+		t.Errorf("Unexpected forward order %v", versions)
+	}
+
+	versions = versions[:0]
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		versions = append(versions, fmt.Sprintf("%s@%d", it.Chunk().Key, it.Chunk().Seq))
+	}
+	if fmt.Sprint(versions) != "[c@4 b@1 b@3 a@2]" {
+		t.Errorf("Unexpected backward order %v", versions)
+	}
+
+	it.Seek("b")
+	if !it.Valid() || it.Chunk().Key != "b" || it.Chunk().Seq != 3 {
+		t.Errorf("Expected seek to land on b@3, but got %v", it.Chunk())
+	}
+	it.Seek("d")
+	if it.Valid() {
+		t.Errorf("Expected seek past the last key to be invalid")
+	}
+}
+
+func TestLockFreeTable_ConcurrentSet(t *testing.T) {
+	st := NewLockFreeMemoryTable()
+
+	const writers, perWriter = 8, 2000
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				key := fmt.Sprintf("key%06d", i*writers+w)
+				st.Set(key, []byte(key), false)
+				// 所有写入者还会并发写入同一批共享的键
+				st.SetBatch([]common.Chunk{{Key: fmt.Sprintf("shared%04d", i), Value: []byte("v"), Seq: uint64(w + 1)}})
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	count, previous := 0, ""
+	for st.Scan() {
+		chunk := st.ScanValue()
+		if chunk.Key < previous {
+			t.Fatalf("Keys out of order: %s after %s", chunk.Key, previous)
+		}
+		previous = chunk.Key
+		count++
+	}
+	if count != writers*perWriter*2 {
+		t.Errorf("Expected %d versions, but scanned %d", writers*perWriter*2, count)
+	}
+	for i := 0; i < writers*perWriter; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		if value := st.Get(key); string(value) != key {
+			t.Fatalf("Expected value %s, but got %s", key, value)
+		}
+	}
+}
@@ -3,18 +3,26 @@ package memorytable
 import (
 	"math/rand"
 	"sync"
+	"time"
 
 	"github.com/Jasonbourne723/platodb/internal/database/common"
 )
 
+// MemoryTable keeps every version of a key, ordered by key and then from the newest sequence number to the oldest.
 type MemoryTable interface {
 	Set(key string, value []byte, deleted bool)
+	SetBatch(chunks []common.Chunk)
 	Get(key string) []byte
+	Lookup(key string, seq uint64) *common.Chunk
 	Size() int64
+	NewIterator() common.Iterator
+	DeleteRange(tombstone common.RangeTombstone)
+	RangeTombstones() []common.RangeTombstone
 	common.Scanner
 }
 
 type DefaultMemoryTable struct {
+	*rangeTombstoneList
 	maxLevel int32
 	head     *Node
 	level    int32
@@ -32,10 +40,11 @@ type Node struct {
 func NewMemoryTable() *DefaultMemoryTable {
 	var maxLevel int32 = 10
 	t := &DefaultMemoryTable{
-		maxLevel: maxLevel,
-		level:    1,
-		head:     NewNode(maxLevel),
-		lock:     &sync.RWMutex{},
+		rangeTombstoneList: newRangeTombstoneList(),
+		maxLevel:           maxLevel,
+		level:              1,
+		head:               NewNode(maxLevel),
+		lock:               &sync.RWMutex{},
 	}
 	t.scanPos = t.head
 	return t
@@ -60,7 +69,8 @@ func NewNode(level int32) *Node {
 	}
 }
 
-// Set adds or updates a key-value pair in the DefaultMemoryTable. It also handles deletion by setting the 'deleted' flag.
+// Set adds or updates a key-value pair without a sequence number in the DefaultMemoryTable.
+// It also handles deletion by setting the 'deleted' flag.
 // It dynamically adjusts the skip list levels based on randomness up to the maxLevel defined for the table.
 // The method is thread-safe and ensures concurrent access is properly managed.
 // Parameters:
@@ -73,6 +83,45 @@ func (s *DefaultMemoryTable) Set(key string, value []byte, deleted bool) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	s.set(&common.Chunk{Key: key, Value: value, Deleted: deleted})
+}
+
+// SetBatch applies every chunk in order while holding the write lock once,
+// so that readers observe either none or all of the batch. Every chunk is inserted as a new version of its key.
+func (s *DefaultMemoryTable) SetBatch(chunks []common.Chunk) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := range chunks {
+		s.set(&chunks[i])
+	}
+}
+
+// set inserts a version of a key in the skip list, or updates it in place if the table already holds the same key
+// with the same sequence number. The caller must hold the write lock.
+func (s *DefaultMemoryTable) set(chunk *common.Chunk) {
+
+	update := make([]*Node, s.maxLevel)
+	node := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].chunk.Before(chunk) {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+	key, value := chunk.Key, chunk.Value
+
+	// 相同版本已存在时直接原地更新，避免在高层留下重复节点
+	if next := node.next[0]; next != nil && next.chunk.Key == key && next.chunk.Seq == chunk.Seq {
+		next.chunk.Value = value
+		next.chunk.Deleted = chunk.Deleted
+		next.chunk.Merge = chunk.Merge
+		next.chunk.ExpiresAt = chunk.ExpiresAt
+		s.allSize = s.allSize + int64(len(key)) + int64(len(value))
+		return
+	}
+
 	var level int32
 	if s.head.next[0] == nil {
 		level = 1
@@ -83,64 +132,53 @@ func (s *DefaultMemoryTable) Set(key string, value []byte, deleted bool) {
 	if level > s.level {
 		if s.level < s.maxLevel {
 			s.level++
-			level = s.level
+			update[s.level-1] = s.head
 		}
+		level = s.level
 	}
 
 	var newNode = NewNode(level)
 	newNode.chunk.Key = key
 	newNode.chunk.Value = value
-	newNode.chunk.Deleted = deleted
-
-	node := s.head
-	for i := s.level - 1; i >= 0; i-- {
-		for node.next[i] != nil && key >= node.next[i].chunk.Key {
-			node = node.next[i]
-		}
-		if level > i {
-			if node.chunk.Key == key {
-				node.chunk.Value = value
-				node.chunk.Deleted = deleted
-			} else {
-				if node.next[i] == nil {
-					node.next[i] = newNode
-				} else {
-					next := node.next[i]
-					node.next[i] = newNode
-					newNode.next[i] = next
-				}
-			}
-		}
+	newNode.chunk.Deleted = chunk.Deleted
+	newNode.chunk.Merge = chunk.Merge
+	newNode.chunk.Seq = chunk.Seq
+	newNode.chunk.ExpiresAt = chunk.ExpiresAt
+
+	for i := int32(0); i < level; i++ {
+		newNode.next[i] = update[i].next[i]
+		update[i].next[i] = newNode
 	}
 	s.allSize = s.allSize + int64(len(key)) + int64(len(value))
 }
 
-// Get retrieves the value associated with the provided key from the DefaultMemoryTable. If the key exists and is not marked as deleted, the corresponding value is returned. Otherwise, nil is returned.
+// Get retrieves the value of the newest version of the provided key from the DefaultMemoryTable. If the key exists and is neither marked as deleted nor expired, the corresponding value is returned. Otherwise, nil is returned.
 // This method is designed to be thread-safe, allowing concurrent reads while write operations are in progress.
 // Parameters:
 // key (string): The key to look up in the table.
 // Returns:
-// []byte: The value associated with the key if found and not deleted, otherwise nil.
+// []byte: The value associated with the key if found and live, otherwise nil.
 func (s *DefaultMemoryTable) Get(key string) []byte {
+	chunk := s.Lookup(key, common.MaxSeq)
+	if chunk == nil || chunk.Deleted || chunk.Expired(time.Now()) {
+		return nil
+	}
+	return chunk.Value
+}
+
+// Lookup returns a copy of the newest version of key whose sequence number is not greater than seq,
+// tombstones included, or nil if the table holds no such version.
+func (s *DefaultMemoryTable) Lookup(key string, seq uint64) *common.Chunk {
 
 	s.lock.RLocker().Lock()
 	defer s.lock.RLocker().Unlock()
 
-	node := s.head
-	for i := s.level - 1; i >= 0; i-- {
-		for node.next[i] != nil && node.next[i].chunk.Key <= key {
-			if node.next[i].chunk.Key == key {
-				if node.next[i].chunk.Deleted {
-					return nil
-				}
-				return node.next[i].chunk.Value
-			} else {
-				node = node.next[i]
-			}
-		}
+	node := s.findBefore(&common.Chunk{Key: key, Seq: seq}).next[0]
+	if node == nil || node.chunk.Key != key {
+		return nil
 	}
-
-	return nil
+	chunk := *node.chunk
+	return &chunk
 }
 
 // randomLevel generates a random level for a new node in the skip list.
@@ -168,7 +206,7 @@ func (s *DefaultMemoryTable) Size() int64 {
 	s.lock.RLocker().Lock()
 	defer s.lock.RLocker().Unlock()
 
-	return s.allSize
+	return s.allSize + s.rangeSize()
 }
 
 // Scan advances the scanner to the next entry in the DefaultMemoryTable and reports whether there was a value to scan.
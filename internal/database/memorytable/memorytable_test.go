@@ -1,7 +1,11 @@
 package memorytable
 
 import (
+	"fmt"
+	"sync/atomic"
 	"testing"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
 )
 
 func TestSkipTable_Set_Get(t *testing.T) {
@@ -123,3 +127,98 @@ func TestSkipTable_Scan_End(t *testing.T) {
 		t.Errorf("Scan should return false at the end")
 	}
 }
+
+// benchmarkTables lists the memory table implementations compared by the benchmarks below.
+var benchmarkTables = []struct {
+	name string
+	new  func() MemoryTable
+}{
+	{"Default", func() MemoryTable { return NewMemoryTable() }},
+	{"LockFree", func() MemoryTable { return NewLockFreeMemoryTable() }},
+	{"BTree", func() MemoryTable { return NewBTreeMemoryTable() }},
+	{"Hash", func() MemoryTable { return NewHashMemoryTable() }},
+}
+
+func benchmarkKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%08d", (i*7919)%n)
+	}
+	return keys
+}
+
+func BenchmarkMemoryTable_Set(b *testing.B) {
+	keys := benchmarkKeys(1 << 16)
+	value := make([]byte, 100)
+	for _, table := range benchmarkTables {
+		b.Run(table.name, func(b *testing.B) {
+			st := table.new()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				st.SetBatch([]common.Chunk{{Key: keys[i%len(keys)], Value: value, Seq: uint64(i + 1)}})
+			}
+		})
+	}
+}
+
+func BenchmarkMemoryTable_ParallelSet(b *testing.B) {
+	keys := benchmarkKeys(1 << 16)
+	value := make([]byte, 100)
+	for _, table := range benchmarkTables {
+		b.Run(table.name, func(b *testing.B) {
+			st := table.new()
+			var seq uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					s := atomic.AddUint64(&seq, 1)
+					st.SetBatch([]common.Chunk{{Key: keys[s%uint64(len(keys))], Value: value, Seq: s}})
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMemoryTable_ParallelGet(b *testing.B) {
+	keys := benchmarkKeys(1 << 16)
+	value := make([]byte, 100)
+	for _, table := range benchmarkTables {
+		b.Run(table.name, func(b *testing.B) {
+			st := table.new()
+			for i, key := range keys {
+				st.SetBatch([]common.Chunk{{Key: key, Value: value, Seq: uint64(i + 1)}})
+			}
+			var next uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					st.Get(keys[atomic.AddUint64(&next, 1)%uint64(len(keys))])
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkMemoryTable_MixedReadWrite runs one writer per eight readers, which is closer to a memory table under load.
+func BenchmarkMemoryTable_MixedReadWrite(b *testing.B) {
+	keys := benchmarkKeys(1 << 16)
+	value := make([]byte, 100)
+	for _, table := range benchmarkTables {
+		b.Run(table.name, func(b *testing.B) {
+			st := table.new()
+			var next uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					n := atomic.AddUint64(&next, 1)
+					key := keys[n%uint64(len(keys))]
+					if n%8 == 0 {
+						st.SetBatch([]common.Chunk{{Key: key, Value: value, Seq: n}})
+					} else {
+						st.Get(key)
+					}
+				}
+			})
+		})
+	}
+}
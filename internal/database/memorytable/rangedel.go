@@ -0,0 +1,46 @@
+package memorytable
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+// rangeTombstoneList keeps the range tombstones written to a memory table, in the order they were written.
+// Every implementation embeds one: range tombstones are few and are only read as a whole, so they are kept apart
+// from the versions of the keys.
+type rangeTombstoneList struct {
+	tombstones []common.RangeTombstone
+	size       int64
+	lock       *sync.RWMutex
+}
+
+func newRangeTombstoneList() *rangeTombstoneList {
+	return &rangeTombstoneList{lock: &sync.RWMutex{}}
+}
+
+// DeleteRange adds a range tombstone to the table.
+func (l *rangeTombstoneList) DeleteRange(tombstone common.RangeTombstone) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.tombstones = append(l.tombstones, tombstone)
+	l.size += int64(len(tombstone.Start) + len(tombstone.End) + int(unsafe.Sizeof(tombstone.Seq)))
+}
+
+// RangeTombstones returns the range tombstones of the table. The returned slice must not be modified.
+func (l *rangeTombstoneList) RangeTombstones() []common.RangeTombstone {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	return l.tombstones[:len(l.tombstones):len(l.tombstones)]
+}
+
+// rangeSize returns the total size in bytes of the range tombstones, counted in the size of the table.
+func (l *rangeTombstoneList) rangeSize() int64 {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	return l.size
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+var ErrNoMergeOperator = errors.New("no merge operator configured")
+
+// Merge adds operand to the value of key in the default column family, as the merge operator of the database defines:
+// the operand is written as a version of its own without reading the key, and applied to the value when the key is
+// read, when its memory table is flushed or during compaction, whichever comes first.
+// It is a single-operation WriteBatch. Returns ErrNoMergeOperator if the database has no merge operator, or an error if
+// the database is shutting down or the WAL write fails.
+func (db *DB) Merge(key string, operand []byte) error {
+	return db.defaultColumnFamily.Merge(key, operand)
+}
+
+// Merge is DB.Merge on the column family, with the merge operator of the column family.
+func (cf *ColumnFamily) Merge(key string, operand []byte) error {
+	if cf.mergeOperator == nil {
+		return ErrNoMergeOperator
+	}
+	batch := NewWriteBatch()
+	batch.MergeCF(cf, key, operand)
+	return cf.db.Write(batch)
+}
+
+// MergeChecked is Merge on the default column family, except that the operand is first applied to the current value
+// of key, under the write lock, and only written if that succeeds. It returns the resulting value, or the error of
+// the merge operator, in which case nothing is written.
+func (db *DB) MergeChecked(key string, operand []byte) ([]byte, error) {
+	return db.defaultColumnFamily.MergeChecked(key, operand)
+}
+
+// MergeChecked is DB.MergeChecked on the column family, with the merge operator of the column family.
+func (cf *ColumnFamily) MergeChecked(key string, operand []byte) ([]byte, error) {
+	if cf.mergeOperator == nil {
+		return nil, ErrNoMergeOperator
+	}
+	batch := NewWriteBatch()
+	var value []byte
+	err := cf.db.write(batch, func() error {
+		if cf.dropped {
+			return ErrColumnFamilyDropped
+		}
+		chunk, err := cf.lookup(key, atomic.LoadUint64(&cf.db.lastSeq))
+		if err != nil {
+			return err
+		}
+		var existing []byte
+		if chunk != nil {
+			existing = chunk.Value
+		}
+		if value, err = cf.mergeOperator.FullMerge(key, existing, [][]byte{operand}); err != nil {
+			return err
+		}
+		batch.MergeCF(cf, key, operand)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// resolveMerge applies the merge operand newest, and the older operands of its key, to the value they apply to.
+// older returns the next older version of the key on every call, nil once there is none; the first version that is
+// not an operand ends the walk, and is read as no value if it is deleted or expired. resolveValue reads the value of
+// a version that holds a value pointer.
+// The result has the sequence number of newest and never expires.
+func resolveMerge(operator common.MergeOperator, newest *common.Chunk, older func() (*common.Chunk, error),
+	resolveValue func(*common.Chunk) ([]byte, error)) (*common.Chunk, error) {
+
+	if operator == nil {
+		return nil, ErrNoMergeOperator
+	}
+	now := time.Now()
+	// operands 从新到旧收集，合并前再反转
+	operands := [][]byte{newest.Value}
+	var existing []byte
+	for {
+		chunk, err := older()
+		if err != nil {
+			return nil, err
+		}
+		if chunk == nil || chunk.Deleted || chunk.Expired(now) {
+			break
+		}
+		if chunk.Merge {
+			operands = append(operands, chunk.Value)
+			continue
+		}
+		if existing, err = resolveValue(chunk); err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			// 空值与不存在的值不同
+			existing = []byte{}
+		}
+		break
+	}
+	for i, j := 0, len(operands)-1; i < j; i, j = i+1, j-1 {
+		operands[i], operands[j] = operands[j], operands[i]
+	}
+
+	value, err := operator.FullMerge(newest.Key, existing, operands)
+	if err != nil {
+		return nil, err
+	}
+	return &common.Chunk{Key: newest.Key, Value: value, Seq: newest.Seq}, nil
+}
@@ -0,0 +1,160 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Merge(t *testing.T) {
+	db := newTestDB(t, MergeOperator(common.Int64Add{}))
+
+	get := func(key string) string {
+		value, err := db.Get(key)
+		assert.NoError(t, err)
+		return string(value)
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, db.Merge("counter", []byte("1")))
+	}
+	assert.Equal(t, "3", get("counter"))
+	assert.NoError(t, db.Set("base", []byte("10")))
+	assert.NoError(t, db.Merge("base", []byte("5")))
+	assert.NoError(t, db.Set("deleted", []byte("7")))
+	assert.NoError(t, db.Del("deleted"))
+	assert.NoError(t, db.Merge("deleted", []byte("-2")))
+	assert.Equal(t, "15", get("base"))
+	assert.Equal(t, "-2", get("deleted"))
+
+	snapshot := db.GetSnapshot()
+	defer db.ReleaseSnapshot(snapshot)
+	assert.NoError(t, db.Merge("base", []byte("100")))
+
+	check := func() {
+		assert.Equal(t, "3", get("counter"))
+		assert.Equal(t, "115", get("base"))
+		assert.Equal(t, "-2", get("deleted"))
+		value, err := db.GetAt(snapshot, "base")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("15"), value)
+
+		it, err := db.NewIterator("", "")
+		assert.NoError(t, err)
+		var values []string
+		for ; it.Valid(); it.Next() {
+			values = append(values, it.Key()+"="+string(it.Value()))
+		}
+		assert.NoError(t, it.Error())
+		assert.Equal(t, []string{"base=115", "counter=3", "deleted=-2"}, values)
+		values = values[:0]
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			values = append(values, it.Key()+"="+string(it.Value()))
+		}
+		assert.Equal(t, []string{"deleted=-2", "counter=3", "base=115"}, values)
+		it.Close()
+	}
+	check()
+
+	// 刷盘时同一 stripe 的操作数与它们作用的版本合并，没有这样的版本时操作数合并为一个
+	forceFlush(t, db)
+	check()
+	chunk, err := db.defaultColumnFamily.sstable.Lookup("counter", common.MaxSeq)
+	assert.NoError(t, err)
+	assert.True(t, chunk.Merge)
+	assert.Equal(t, []byte("3"), chunk.Value)
+	chunk, err = db.defaultColumnFamily.sstable.Lookup("base", snapshot.seq)
+	assert.NoError(t, err)
+	assert.False(t, chunk.Merge)
+	assert.Equal(t, []byte("15"), chunk.Value)
+	assert.NoError(t, db.Merge("counter", []byte("4")))
+	assert.Equal(t, "7", get("counter"))
+
+	// 无法合并的值在读取时报错
+	assert.NoError(t, db.Set("text", []byte("abc")))
+	assert.NoError(t, db.Merge("text", []byte("1")))
+	_, err = db.Get("text")
+	assert.ErrorIs(t, err, common.ErrNotInteger)
+}
+
+func TestDB_MergeWithoutOperator(t *testing.T) {
+	db := newTestDB(t)
+	assert.ErrorIs(t, db.Merge("k", []byte("1")), ErrNoMergeOperator)
+
+	// 批次写入的操作数在读取时才会失败
+	batch := NewWriteBatch()
+	batch.Merge("k", []byte("1"))
+	assert.NoError(t, db.Write(batch))
+	_, err := db.Get("k")
+	assert.ErrorIs(t, err, ErrNoMergeOperator)
+}
+
+func TestColumnFamily_MergeOperator(t *testing.T) {
+	db := newTestDB(t, MergeOperator(common.Int64Add{}))
+	lists, err := db.CreateColumnFamily("lists", CFMergeOperator(common.StringAppend{Delimiter: ","}))
+	assert.NoError(t, err)
+
+	batch := NewWriteBatch()
+	batch.Merge("k", []byte("2"))
+	batch.MergeCF(lists, "k", []byte("a"))
+	batch.MergeCF(lists, "k", []byte("b"))
+	assert.NoError(t, db.Write(batch))
+	assert.NoError(t, db.Merge("k", []byte("3")))
+
+	value, err := db.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("5"), value)
+	value, err = lists.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a,b"), value)
+}
+
+func TestDB_MergeRecoversFromWal(t *testing.T) {
+	dir := t.TempDir()
+	walDir := filepath.Join(dir, "wal")
+	operator := MergeOperator(common.StringAppend{})
+
+	// 不调用 Shutdown，模拟进程崩溃后操作数只保存在 WAL 中
+	crashed, err := NewDB(Dir(dir, walDir), operator)
+	assert.NoError(t, err)
+	assert.NoError(t, crashed.Set("k", []byte("a")))
+	assert.NoError(t, crashed.Merge("k", []byte("b")))
+	assert.NoError(t, crashed.Merge("k", []byte("c")))
+
+	db, err := NewDB(Dir(dir, walDir), operator)
+	assert.NoError(t, err)
+	defer db.Shutdown()
+	value, err := db.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abc"), value)
+}
+
+func TestDB_MergeKeepsValueLogEntries(t *testing.T) {
+	db := newTestDB(t, MergeOperator(common.StringAppend{}), ValueThreshold(10), ValueLogFileSize(1))
+	large := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%d.", i)), 4096)
+	}
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Set(fmt.Sprintf("k%03d", i), large(i)))
+	}
+	forceFlush(t, db)
+	// 值只剩 k000 仍在使用，它被之后的操作数引用
+	for i := 1; i < 100; i++ {
+		assert.NoError(t, db.Del(fmt.Sprintf("k%03d", i)))
+	}
+	assert.NoError(t, db.Merge("k000", []byte("!")))
+	forceFlush(t, db)
+
+	files := db.valueLog.Files()
+	assert.NoError(t, db.RunValueLogGC(0.5))
+	assert.NotContains(t, db.valueLog.Files(), files[0])
+
+	value, err := db.Get("k000")
+	assert.NoError(t, err)
+	assert.Equal(t, append(large(0), '!'), value)
+}
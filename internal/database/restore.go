@@ -0,0 +1,120 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+	"github.com/Jasonbourne723/platodb/internal/database/wal"
+)
+
+var ErrRestoreExists = errors.New("restore directory is not empty")
+
+// RestoreTarget selects the last write a point-in-time restore applies. With both fields set, the restore stops at
+// whichever comes first; the zero RestoreTarget applies every archived write.
+type RestoreTarget struct {
+	// Time, unless zero, keeps the batches written at or before it.
+	Time time.Time
+	// Seq, unless zero, keeps the batches whose sequence numbers are all at most Seq.
+	Seq uint64
+}
+
+// Restore rebuilds in dir the database as it was at target, from a checkpoint written by Checkpoint to checkpointDir
+// and the WAL files the database archived to archiveDir with WalArchive since then.
+// The files of the checkpoint are hard-linked into dir, or copied where they cannot be linked, and are never modified,
+// so the checkpoint can be restored again. The archived batches written after the checkpoint are then replayed in
+// order, up to the first one beyond target, so that the restored database holds a prefix of the writes.
+// Batches of column families created after the checkpoint are skipped.
+// options are the options the database is opened with to replay the batches, such as its merge operator; its
+// directories, WAL archiving and background garbage collection are overridden. The restored database opens with
+// NewDB(Dir(dir, walDir)) for any empty walDir.
+// Returns ErrRestoreExists if dir exists and is not empty. A failed restore removes what it wrote to dir.
+func Restore(checkpointDir, archiveDir, dir string, target RestoreTarget, options ...Options) (err error) {
+	if empty, err := isEmptyDir(dir); err != nil || !empty {
+		if err == nil {
+			err = ErrRestoreExists
+		}
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	if err := linkTree(checkpointDir, dir); err != nil {
+		return fmt.Errorf("检查点复制失败:%w", err)
+	}
+
+	walDir, err := os.MkdirTemp("", "platodb-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(walDir)
+	options = append(options, Dir(dir, walDir), WalArchive(""), ValueLogGC(0, 0))
+	db, err := NewDB(options...)
+	if err != nil {
+		return err
+	}
+	defer db.Shutdown()
+	return db.replayArchive(archiveDir, target)
+}
+
+// replayArchive writes the batches of the WAL files in archiveDir that are newer than the SSTables to them,
+// in the order they were written, until the first batch beyond target.
+func (db *DB) replayArchive(archiveDir string, target RestoreTarget) error {
+	files, err := filepath.Glob(filepath.Join(archiveDir, "*"+wal.SUFFIX))
+	if err != nil {
+		return err
+	}
+	// 序列号不大于检查点最大序列号的写入都已在检查点的段文件中
+	restoredSeq := db.lastSeq
+	accept := func(record *wal.Record) (bool, bool) {
+		if len(record.Chunks) == 0 {
+			return false, true
+		}
+		seq := record.Chunks[len(record.Chunks)-1].Seq
+		if seq <= restoredSeq {
+			return false, true
+		}
+		if (target.Seq > 0 && seq > target.Seq) || (!target.Time.IsZero() && record.Time.After(target.Time)) {
+			return false, false
+		}
+		return true, true
+	}
+	for _, walFilePath := range files {
+		reader, err := wal.NewReader(walFilePath)
+		if err != nil {
+			return err
+		}
+		more, err := db.replayWal(reader, walFilePath, accept)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("wal %s 重放失败:%w", walFilePath, err)
+		}
+		if !more {
+			break
+		}
+	}
+	return nil
+}
+
+// linkTree hard-links every file under src to the same path under dst, or copies it where it cannot be linked.
+func linkTree(src, dst string) error {
+	return filepath.WalkDir(src, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, filePath)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return common.EnsureDirExists(filepath.Join(dst, rel))
+		}
+		return common.LinkFile(filePath, filepath.Join(dst, rel))
+	})
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_WalArchive(t *testing.T) {
+	dir := t.TempDir()
+	walDir := filepath.Join(dir, "wal")
+	archiveDir := filepath.Join(dir, "archive")
+
+	// 不调用 Shutdown，模拟进程崩溃后恢复的 WAL 同样被归档
+	crashed, err := NewDB(Dir(dir, walDir), WalArchive(archiveDir))
+	assert.NoError(t, err)
+	assert.NoError(t, crashed.Set("k", []byte("v")))
+
+	db, err := NewDB(Dir(dir, walDir), WalArchive(archiveDir))
+	assert.NoError(t, err)
+	value, err := db.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), value)
+	forceFlush(t, db)
+	db.Shutdown()
+
+	archived, err := filepath.Glob(filepath.Join(archiveDir, "*.log"))
+	assert.NoError(t, err)
+	assert.Len(t, archived, 3)
+	remaining, err := filepath.Glob(filepath.Join(walDir, "*.log"))
+	assert.NoError(t, err)
+	assert.Empty(t, remaining)
+}
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+	archiveDir := filepath.Join(dir, "archive")
+	checkpointDir := filepath.Join(dir, "checkpoint")
+
+	db, err := NewDB(Dir(filepath.Join(dir, "data"), filepath.Join(dir, "wal")), WalArchive(archiveDir))
+	assert.NoError(t, err)
+	users, err := db.CreateColumnFamily("users")
+	assert.NoError(t, err)
+	assert.NoError(t, db.Set("a", []byte("1")))
+	assert.NoError(t, db.Checkpoint(checkpointDir))
+
+	assert.NoError(t, db.Set("a", []byte("2")))
+	assert.NoError(t, users.Set("u", []byte("user")))
+	forceFlush(t, db)
+	assert.NoError(t, db.Set("b", []byte("2")))
+	seq := atomic.LoadUint64(&db.lastSeq)
+	time.Sleep(10 * time.Millisecond)
+	before := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, db.Set("c", []byte("3")))
+	// 错误的写入之前的状态可以恢复
+	assert.NoError(t, db.Set("a", []byte("bad")))
+	db.Shutdown()
+
+	restore := func(target RestoreTarget) *DB {
+		restoreDir := filepath.Join(t.TempDir(), "restore")
+		assert.NoError(t, Restore(checkpointDir, archiveDir, restoreDir, target))
+		restored, err := NewDB(Dir(restoreDir, filepath.Join(t.TempDir(), "wal")))
+		assert.NoError(t, err)
+		t.Cleanup(restored.Shutdown)
+		return restored
+	}
+	check := func(db *DB, expected map[string]string) {
+		for key, value := range expected {
+			actual, err := db.Get(key)
+			assert.NoError(t, err)
+			if value == "" {
+				assert.Nil(t, actual, key)
+			} else {
+				assert.Equal(t, []byte(value), actual, key)
+			}
+		}
+		users, err := db.ColumnFamily("users")
+		assert.NoError(t, err)
+		actual, err := users.Get("u")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("user"), actual)
+	}
+
+	check(restore(RestoreTarget{Seq: seq}), map[string]string{"a": "2", "b": "2", "c": ""})
+	check(restore(RestoreTarget{Time: before}), map[string]string{"a": "2", "b": "2", "c": ""})
+	check(restore(RestoreTarget{Seq: seq + 1}), map[string]string{"a": "2", "b": "2", "c": "3"})
+	check(restore(RestoreTarget{}), map[string]string{"a": "bad", "b": "2", "c": "3"})
+
+	// 恢复目录必须为空，已有的内容不受影响
+	restoreDir := filepath.Join(t.TempDir(), "restore")
+	assert.NoError(t, os.MkdirAll(filepath.Join(restoreDir, "other"), 0755))
+	assert.ErrorIs(t, Restore(checkpointDir, archiveDir, restoreDir, RestoreTarget{}), ErrRestoreExists)
+	assert.DirExists(t, filepath.Join(restoreDir, "other"))
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"container/list"
+	"errors"
+	"sync/atomic"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+// Snapshot is a consistent point-in-time view of the database: reads through it only see the writes whose
+// sequence number is not greater than its own, whatever is written afterwards.
+// A snapshot keeps compaction from discarding the versions it can see until it is released.
+type Snapshot struct {
+	seq     uint64
+	element *list.Element
+}
+
+// Seq returns the sequence number of the last write visible through the snapshot.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// GetSnapshot returns a snapshot of the current state of the database.
+// Every snapshot must be released with ReleaseSnapshot once it is no longer needed.
+func (db *DB) GetSnapshot() *Snapshot {
+	db.snapshotLock.Lock()
+	defer db.snapshotLock.Unlock()
+
+	snapshot := &Snapshot{seq: atomic.LoadUint64(&db.lastSeq)}
+	snapshot.element = db.snapshots.PushBack(snapshot)
+	return snapshot
+}
+
+// ReleaseSnapshot releases a snapshot, letting compaction discard the versions only it could see.
+// Releasing a snapshot more than once has no effect.
+func (db *DB) ReleaseSnapshot(snapshot *Snapshot) {
+	db.snapshotLock.Lock()
+	defer db.snapshotLock.Unlock()
+
+	if snapshot.element != nil {
+		db.snapshots.Remove(snapshot.element)
+		snapshot.element = nil
+	}
+}
+
+// GetAt retrieves the value the key had in the default column family when the snapshot was taken,
+// ignoring every newer version. It returns nil if the key did not exist or was deleted at that point.
+// Returns an error if the database is shutting down or the snapshot has been released.
+func (db *DB) GetAt(snapshot *Snapshot, key string) ([]byte, error) {
+	return db.defaultColumnFamily.GetAt(snapshot, key)
+}
+
+// GetAt is DB.GetAt on the column family. A snapshot covers every column family of the database.
+func (cf *ColumnFamily) GetAt(snapshot *Snapshot, key string) ([]byte, error) {
+	cf.db.snapshotLock.Lock()
+	released := snapshot.element == nil
+	cf.db.snapshotLock.Unlock()
+	if released {
+		return nil, errors.New("snapshot has been released")
+	}
+	return cf.get(key, snapshot.seq)
+}
+
+// snapshotSeqs returns the sequence numbers of the live snapshots in ascending order.
+// Snapshots are appended as they are taken and sequence numbers never decrease, so the list is already sorted.
+func (db *DB) snapshotSeqs() []uint64 {
+	db.snapshotLock.Lock()
+	defer db.snapshotLock.Unlock()
+
+	seqs := make([]uint64, 0, db.snapshots.Len())
+	for e := db.snapshots.Front(); e != nil; e = e.Next() {
+		seqs = append(seqs, e.Value.(*Snapshot).seq)
+	}
+	return seqs
+}
+
+// LastSequence returns the sequence number of the last write visible to reads.
+func (db *DB) LastSequence() uint64 {
+	return atomic.LoadUint64(&db.lastSeq)
+}
+
+// assignSequence gives every chunk the next sequence number, in order, and returns the last one.
+// The caller must hold the write lock, and must only publish the returned number with publishSequence
+// once the chunks are visible in the memory table.
+func (db *DB) assignSequence(chunks []common.Chunk) uint64 {
+	seq := atomic.LoadUint64(&db.lastSeq)
+	for i := range chunks {
+		seq++
+		chunks[i].Seq = seq
+	}
+	return seq
+}
+
+// publishSequence makes the writes up to seq visible to new snapshots. The caller must hold the write lock.
+func (db *DB) publishSequence(seq uint64) {
+	atomic.StoreUint64(&db.lastSeq, seq)
+}
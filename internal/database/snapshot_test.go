@@ -0,0 +1,78 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_SnapshotGetAt(t *testing.T) {
+	db := newTestDB(t)
+	assert.NoError(t, db.Set("k", []byte("v1")))
+	assert.NoError(t, db.Set("deleted", []byte("d1")))
+	snapshot := db.GetSnapshot()
+
+	assert.NoError(t, db.Set("k", []byte("v2")))
+	assert.NoError(t, db.Del("deleted"))
+	assert.NoError(t, db.Set("new", []byte("n1")))
+
+	check := func() {
+		value, err := db.GetAt(snapshot, "k")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v1"), value)
+		value, err = db.GetAt(snapshot, "deleted")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("d1"), value)
+		value, err = db.GetAt(snapshot, "new")
+		assert.NoError(t, err)
+		assert.Nil(t, value)
+
+		value, err = db.Get("k")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v2"), value)
+		value, err = db.Get("deleted")
+		assert.NoError(t, err)
+		assert.Nil(t, value)
+	}
+	check()
+
+	// 刷盘后旧版本保存在段文件中，快照仍能读到
+	forceFlush(t, db)
+	check()
+
+	db.ReleaseSnapshot(snapshot)
+	db.ReleaseSnapshot(snapshot)
+	_, err := db.GetAt(snapshot, "k")
+	assert.Error(t, err)
+	assert.Empty(t, db.snapshotSeqs())
+}
+
+func TestDB_SequencePersistsAcrossReopen(t *testing.T) {
+	dir := t.TempDir()
+	walDir := filepath.Join(dir, "wal")
+
+	db, err := NewDB(Dir(dir, walDir))
+	assert.NoError(t, err)
+	assert.NoError(t, db.Set("k", []byte("v1")))
+	assert.NoError(t, db.Set("k", []byte("v2")))
+	seq := db.GetSnapshot().Seq()
+	assert.Equal(t, uint64(2), seq)
+	db.Shutdown()
+
+	// WAL 恢复写入的段文件记录了最大序列号，重新打开后的新写入不会复用旧序列号
+	reopened, err := NewDB(Dir(dir, walDir))
+	assert.NoError(t, err)
+	defer reopened.Shutdown()
+	snapshot := reopened.GetSnapshot()
+	assert.Equal(t, seq, snapshot.Seq())
+
+	assert.NoError(t, reopened.Set("k", []byte("v3")))
+	value, err := reopened.GetAt(snapshot, "k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), value)
+	value, err = reopened.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v3"), value)
+	reopened.ReleaseSnapshot(snapshot)
+}
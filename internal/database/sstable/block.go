@@ -1,25 +1,41 @@
 package sstable
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
 	"io"
+	"sort"
+	"unsafe"
 
+	"github.com/Jasonbourne723/platodb/internal/database/cache"
 	"github.com/Jasonbourne723/platodb/internal/database/common"
 )
 
 var IndexErr = errors.New("index error")
 
+// block is a run of records of a segment. The chunks of a block being written are kept in the block until its
+// segment is finished; afterwards they are read from disk on demand and kept in the block cache of the segment.
+// The records of a block being written are collected in data and only reach the file once the block is complete,
+// so that it can be compressed as a whole. Until then size counts the bytes of those records; once written,
+// the bytes the block takes in the file.
 type block struct {
 	seg      *segment
 	posBegin int64
 	chunks   []common.Chunk
+	data     []byte
+	restarts []uint32
 	size     int64
-	min      string
-	max      string
 }
 
+// blockTrailerSize is the size of the trailer following every block of a V3 or later segment:
+// the codec of the block and a CRC of the stored block and the codec.
+const blockTrailerSize = 5
+
+var ErrBlockCorrupted = errors.New("segment block corrupted")
+
 // enough checks if adding a chunk of specified size would not exceed the BlockSize limit for the block.
 func (b *block) enough(size int64) bool {
 	return b.size+size <= BlockSize
@@ -41,155 +57,215 @@ func newBlock(seg *segment, pos int64) block {
 	}
 }
 
-// addChunk appends a chunk to the block and writes the associated data to the segment file.
-// It updates the block's size and maintains the list of chunks.
+// encodeEntry encodes chunk as the next entry of a block of a V4 or later segment: every restartInterval entries
+// the entry is a restart point storing its key whole, otherwise it only stores the part of its key
+// that it does not share with the previous entry.
+func (b *block) encodeEntry(chunk *common.Chunk) []byte {
+	shared := 0
+	if n := len(b.chunks); n%restartInterval != 0 {
+		shared = sharedPrefixLen(b.chunks[n-1].Key, chunk.Key)
+	}
+	return appendEntry(nil, chunk, shared)
+}
+
+// addChunk appends a chunk to the block and its encoded record, or entry, to the data the block will write.
+// It updates the block's size and maintains the list of chunks and, in a V4 or later segment, of restart points.
 // Parameters:
 // - chunk (*common.Chunk): The chunk to be added.
-// - data ([]byte): The data corresponding to the chunk to be written to the file.
+// - data ([]byte): The record or the entry encoding the chunk.
 // Returns:
-// - error: If there is an error writing the data to the file.
+// - error: Always nil; the record is only written to the file by write.
 func (b *block) addChunk(chunk *common.Chunk, data []byte) error {
 
+	if b.seg.format >= segmentFormatV4 && len(b.chunks)%restartInterval == 0 {
+		b.restarts = append(b.restarts, uint32(len(b.data)))
+	}
 	b.chunks = append(b.chunks, *chunk)
+	b.data = append(b.data, data...)
 	b.size += int64(len(data))
+	return nil
+}
 
-	_, err := b.seg.file.Write(data)
-	return err
+// write appends the records of a complete block to the segment file. In a V4 or later segment the entries are
+// followed by the restart array; in a V3 or later segment the block is then compressed with the codec of the segment and followed by the trailer recording the codec
+// actually used; older formats only ever held raw records. Afterwards size is the number of bytes the block takes
+// in the file.
+func (b *block) write() error {
+	data := b.data
+	if b.seg.format >= segmentFormatV4 {
+		data = appendRestarts(data, b.restarts)
+	}
+	if b.seg.format >= segmentFormatV3 {
+		data = encodeStoredBlock(b.seg.compression, data)
+	}
+	if _, err := b.seg.file.Write(data); err != nil {
+		return err
+	}
+	b.size = int64(len(data))
+	b.data, b.restarts = nil, nil
+	return nil
 }
 
-// get retrieves a Chunk from the block based on the provided key. It first ensures the block data is loaded into memory, then performs a binary search to find the chunk.
+// pending reports whether the block holds records that are not written to the file yet.
+func (b *block) pending() bool {
+	return len(b.data) > 0
+}
+
+// get retrieves the newest version of the provided key from the block.
 // If the chunk is found, it returns the chunk and nil error; otherwise, it returns nil and nil error indicating the key was not found.
 func (b *block) get(key string) (*common.Chunk, error) {
+	return b.getAt(key, common.MaxSeq)
+}
 
-	if len(b.chunks) == 0 { //块数据还未加载到内存
-		if err := b.loadDataFromDisk(); err != nil {
-			return nil, err
-		}
-	}
+// getAt retrieves the newest version of key whose sequence number is not greater than seq.
+// It pins the contents of the block for the duration of the search and returns a copy of the chunk it finds.
+// Returns nil and nil error if the block holds no such version; older versions may still follow in the next block.
+func (b *block) getAt(key string, seq uint64) (*common.Chunk, error) {
 
-	chunk, ok := b.middleSearch(key, 0, int64(len(b.chunks))-1)
-	if ok {
-		return chunk, nil
+	contents, release, err := b.acquire()
+	if err != nil {
+		return nil, err
 	}
-	return nil, nil
+	defer release()
+
+	return contents.getAt(key, seq)
 }
 
-// loadDataFromDisk reads the block data from disk into memory, populating the 'chunks' slice with decoded data entries.
-// It verifies each entry's integrity using CRC checks and handles cases where the block data is incomplete or corrupt.
-// Returns an error if reading from disk fails or CRC validation fails.
-func (b *block) loadDataFromDisk() error {
-	buf := make([]byte, BlockSize)
-	n, err := b.seg.file.ReadAt(buf, b.posBegin)
-	if err != nil {
-		if err != io.EOF {
-			return err
-		}
-		if n == 0 {
-			return nil
-		}
+// acquire returns the contents of the block and a function to call once they are no longer used.
+// The contents of a block being written are its chunks. Otherwise they come from the block cache of the
+// segment, pinned there until release is called, and are read from disk and added to the cache on a miss;
+// without a block cache they are read from disk on every call.
+// The returned contents must not be modified.
+func (b *block) acquire() (*blockContents, func(), error) {
+	if len(b.chunks) > 0 {
+		return &blockContents{chunks: b.chunks}, func() {}, nil
 	}
-	buf = buf[:n]
-	pos := 0
 
-	for pos < len(buf) {
-		// 检查剩余字节是否足够读取特定数据
-		checkRemaining := func(required int) bool {
-			return pos+required <= len(buf)
+	c := b.seg.cache
+	if c == nil {
+		contents, err := b.readContents()
+		return contents, func() {}, err
+	}
+	key := cache.Key{Id: b.seg.cacheId, Offset: b.posBegin}
+	h := c.Lookup(key)
+	if h == nil {
+		contents, err := b.readContents()
+		if err != nil {
+			return nil, nil, err
 		}
+		h = c.Insert(key, contents, contents.charge())
+	}
+	return h.Value().(*blockContents), func() { c.Release(h) }, nil
+}
 
-		// 读取墓碑标志
-		if !checkRemaining(1) {
-			break
-		}
-		deleted := buf[pos]
-		pos++
+// chunksCharge estimates the memory held by decoded chunks, as charged to the block cache.
+func chunksCharge(chunks []common.Chunk) int64 {
+	charge := int64(cap(chunks)) * int64(unsafe.Sizeof(common.Chunk{}))
+	for i := range chunks {
+		charge += int64(len(chunks[i].Key) + cap(chunks[i].Value))
+	}
+	return charge
+}
 
-		// 读取 CRC 校验
-		if !checkRemaining(4) {
-			break
-		}
-		crc := binary.BigEndian.Uint32(buf[pos : pos+4])
-		if crc == 0 {
-			break
-		}
-		pos += 4
+// loadDataFromDisk reads the block data from disk and returns its decoded chunks.
+// Returns an error if reading from disk fails or the block is corrupted.
+func (b *block) loadDataFromDisk() ([]common.Chunk, error) {
+	contents, err := b.readContents()
+	if err != nil {
+		return nil, err
+	}
+	return contents.allChunks()
+}
 
-		// 获取 key 的长度并读取 key
-		if !checkRemaining(1) {
-			break
-		}
-		keyLen := buf[pos]
-		if keyLen == 0 {
-			break
+// readContents reads the block data from disk.
+// A block of a V3 or later segment is first checked against its trailer and decompressed; the block of a V4 or later
+// segment is then kept as is, to be searched through its restart points. The records of older blocks are decoded,
+// verifying each record's integrity using CRC checks: a block of a legacy segment ends at the zero padding that fills
+// it up to BlockSize or at the end of the file, while a block of a later segment must decode exactly.
+// Returns an error if reading from disk fails or the block is corrupted.
+func (b *block) readContents() (*blockContents, error) {
+	length := b.size
+	if b.seg.format == segmentFormatLegacy {
+		length = BlockSize
+	}
+	buf := make([]byte, length)
+	n, err := b.seg.file.ReadAt(buf, b.posBegin)
+	if err != nil && (err != io.EOF || b.seg.format != segmentFormatLegacy) {
+		return nil, err
+	}
+	buf = buf[:n]
+	if b.seg.format >= segmentFormatV3 {
+		if buf, err = decodeBlock(buf); err != nil {
+			return nil, fmt.Errorf("segment %d block at %d: %w", b.seg.id, b.posBegin, err)
 		}
-		pos++
-
-		if !checkRemaining(int(keyLen)) {
-			break
+	}
+	if b.seg.format >= segmentFormatV4 {
+		contents, err := newBlockContents(buf)
+		if err != nil {
+			return nil, fmt.Errorf("segment %d block at %d: %w", b.seg.id, b.posBegin, err)
 		}
-		key := string(buf[pos : pos+int(keyLen)])
-		pos += int(keyLen)
-
-		// 如果未删除，则读取 value
-		var value []byte
-		if deleted == 0 {
-			// 读取 value 的长度
-			if !checkRemaining(2) {
-				break
-			}
-			valueLen := binary.BigEndian.Uint16(buf[pos : pos+2])
-			pos += 2
+		return contents, nil
+	}
 
-			// 读取 value 数据
-			if !checkRemaining(int(valueLen)) {
+	chunks := make([]common.Chunk, 0, 100)
+	end := len(buf)
+	if b.seg.format == segmentFormatLegacy {
+		end = legacyDataEnd(buf)
+	}
+	for pos := 0; pos < end; {
+		chunk, l, err := common.DecodeChunk(buf[pos:])
+		if err != nil {
+			if err == io.ErrUnexpectedEOF && b.seg.format == segmentFormatLegacy {
 				break
 			}
-			value = buf[pos : pos+int(valueLen)]
-			pos += int(valueLen)
+			return nil, fmt.Errorf("segment %d block at %d: %w", b.seg.id, b.posBegin, err)
 		}
-		// 校验 CRC
-		if crc != crc32.ChecksumIEEE(append([]byte(key), value...)) {
-			return errors.New("crc check failed")
-		}
-
-		// 将解码后的数据添加到 chunks
-		b.chunks = append(b.chunks, common.Chunk{
-			Key:     key,
-			Value:   value,
-			Deleted: deleted == 1,
-		})
+		chunks = append(chunks, *chunk)
+		pos += l
 	}
-	if len(b.chunks) > 0 {
-		b.min = b.chunks[0].Key
-		b.max = b.chunks[len(b.chunks)-1].Key
-	}
-	return nil
+	return &blockContents{chunks: chunks}, nil
 }
 
-// middleSearch performs a binary search within the chunks of a block to find a chunk with a matching key.
-// It takes a key to search for, and the beginning and end positions (inclusive) of the search range within the chunks slice.
-// Returns the pointer to the found Chunk and true if the key is found; otherwise, returns nil and false.
-// The search range is halved in each recursive call until the key is found or the range is exhausted.
-func (b *block) middleSearch(key string, posBegin int64, posEnd int64) (c *common.Chunk, ok bool) {
+// encodeStoredBlock compresses raw with c and appends the trailer recording the codec actually used and a CRC.
+func encodeStoredBlock(c Compression, raw []byte) []byte {
+	codec, payload := compressBlock(c, raw)
+	data := append(payload, byte(codec))
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+}
 
-	if key < b.chunks[posBegin].Key || key > b.chunks[posEnd].Key {
-		return nil, false
+// decodeBlock checks a block of a V3 or later segment against its trailer and returns its records, decompressed.
+func decodeBlock(data []byte) ([]byte, error) {
+	if len(data) < blockTrailerSize {
+		return nil, ErrBlockCorrupted
 	}
-	if key == b.chunks[posBegin].Key {
-		return &b.chunks[posBegin], true
+	n := len(data) - 4
+	if crc32.ChecksumIEEE(data[:n]) != binary.BigEndian.Uint32(data[n:]) {
+		return nil, ErrBlockCorrupted
 	}
-	if key == b.chunks[posEnd].Key {
-		return &b.chunks[posEnd], true
-	}
-	if posEnd == posBegin || posEnd == posBegin+1 {
-		return nil, false
-	}
-	posMiddle := (posBegin + posEnd) / 2
-	if key == b.chunks[posMiddle].Key {
-		return &b.chunks[posMiddle], true
+	raw, err := decompressBlock(Compression(data[n-1]), data[:n-1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBlockCorrupted, err)
 	}
-	if key < b.chunks[posMiddle].Key {
-		return b.middleSearch(key, posBegin, posMiddle)
+	return raw, nil
+}
+
+// legacyDataEnd returns where the zero padding that fills a legacy block up to BlockSize starts, taken to be after
+// the last non-zero byte of the block: records may hold zero bytes, but a last record made only of them, an empty key
+// with an empty value, cannot be told from the padding.
+func legacyDataEnd(data []byte) int {
+	return len(bytes.TrimRight(data, "\x00"))
+}
+
+// search performs a binary search within the chunks of a block, ordered by key and then by descending sequence number,
+// for the first version of key whose sequence number is not greater than seq.
+// Returns the pointer to the found Chunk and true if there is one; otherwise, returns nil and false.
+func search(chunks []common.Chunk, key string, seq uint64) (c *common.Chunk, ok bool) {
+	target := &common.Chunk{Key: key, Seq: seq}
+	i := sort.Search(len(chunks), func(i int) bool {
+		return !chunks[i].Before(target)
+	})
+	if i < len(chunks) && chunks[i].Key == key {
+		return &chunks[i], true
 	}
-	return b.middleSearch(key, posMiddle, posEnd)
+	return nil, false
 }
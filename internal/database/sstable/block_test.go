@@ -84,13 +84,16 @@ func TestBlock_LoadDataFromDisk(t *testing.T) {
 	}
 	data, _ := common.NewUtils().Encode(chunk)
 	block.addChunk(chunk, data)
+	// 块写满或段完成时记录才写入文件
+	assert.NoError(t, block.write())
 
 	// 模拟从磁盘读取数据
 	// 需要重新打开文件并读取
 	seg.file.Seek(0, 0)
 	block2 := newBlock(seg, 0)
-	err = block2.loadDataFromDisk()
+	chunks, err := block2.loadDataFromDisk()
 	assert.NoError(t, err)
+	assert.Len(t, chunks, 1)
 
 	// 验证加载的数据
 	retrievedChunk, err := block2.get("key1")
@@ -100,7 +103,7 @@ func TestBlock_LoadDataFromDisk(t *testing.T) {
 	assert.Equal(t, []byte("value1"), retrievedChunk.Value)
 }
 
-func TestBlock_MiddleSearch(t *testing.T) {
+func TestBlock_Search(t *testing.T) {
 	// 创建临时文件
 	tempFile, err := os.CreateTemp("", "test_segment_")
 	if err != nil {
@@ -123,12 +126,12 @@ func TestBlock_MiddleSearch(t *testing.T) {
 	}
 
 	// 查找已存在的 key
-	chunk, ok := block.middleSearch("key2", 0, int64(len(block.chunks))-1)
+	chunk, ok := search(block.chunks, "key2", common.MaxSeq)
 	assert.True(t, ok)
 	assert.Equal(t, "key2", chunk.Key)
 
 	// 查找不存在的 key
-	chunk, ok = block.middleSearch("key4", 0, int64(len(block.chunks))-1)
+	chunk, ok = search(block.chunks, "key4", common.MaxSeq)
 	assert.False(t, ok)
 	assert.Nil(t, chunk)
 }
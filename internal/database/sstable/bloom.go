@@ -0,0 +1,120 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hash/fnv"
+	"math"
+	"os"
+)
+
+const (
+	DefaultFalsePositiveRate = 0.01
+	maxBloomHashCount        = 30
+)
+
+var ErrBloomCorrupted = errors.New("bloom filter corrupted")
+
+// bloomFilter is a fixed-size bit array answering "definitely absent" or "maybe present" for a key.
+type bloomFilter struct {
+	bits      []byte
+	hashCount uint8
+}
+
+// bloomHash returns the 64-bit hash from which every probe position of key is derived.
+func bloomHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// newBloomFilter sizes a filter for the given key hashes so that it reaches falsePositiveRate, then adds every hash.
+// The bit count is -n*ln(p)/ln(2)^2 and the probe count is bits/n*ln(2), as usual for Bloom filters.
+func newBloomFilter(keyHashes []uint64, falsePositiveRate float64) *bloomFilter {
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = DefaultFalsePositiveRate
+	}
+	n := float64(len(keyHashes))
+	if n < 1 {
+		n = 1
+	}
+	bitCount := math.Ceil(-n * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	if bitCount < 64 {
+		bitCount = 64
+	}
+	hashCount := math.Round(bitCount / n * math.Ln2)
+	if hashCount < 1 {
+		hashCount = 1
+	}
+	if hashCount > maxBloomHashCount {
+		hashCount = maxBloomHashCount
+	}
+
+	f := &bloomFilter{
+		bits:      make([]byte, (int(bitCount)+7)/8),
+		hashCount: uint8(hashCount),
+	}
+	for _, h := range keyHashes {
+		f.add(h)
+	}
+	return f
+}
+
+// add sets the probe bits of a key hash. Probes are generated with double hashing from a single 64-bit hash.
+func (f *bloomFilter) add(h uint64) {
+	bitCount := uint64(len(f.bits) * 8)
+	delta := h>>33 | h<<31
+	for i := uint8(0); i < f.hashCount; i++ {
+		pos := h % bitCount
+		f.bits[pos/8] |= 1 << (pos % 8)
+		h += delta
+	}
+}
+
+// mayContain reports whether key may have been added to the filter. A false result is always correct.
+func (f *bloomFilter) mayContain(key string) bool {
+	h := bloomHash(key)
+	bitCount := uint64(len(f.bits) * 8)
+	delta := h>>33 | h<<31
+	for i := uint8(0); i < f.hashCount; i++ {
+		pos := h % bitCount
+		if f.bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// encode serializes the filter as hashCount(1) | bits | crc32(4).
+func (f *bloomFilter) encode() []byte {
+	buf := make([]byte, 0, 1+len(f.bits)+4)
+	buf = append(buf, f.hashCount)
+	buf = append(buf, f.bits...)
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// decodeBloomFilter parses a filter produced by encode and verifies its checksum.
+func decodeBloomFilter(data []byte) (*bloomFilter, error) {
+	if len(data) < 1+8+4 {
+		return nil, ErrBloomCorrupted
+	}
+	body := data[:len(data)-4]
+	if binary.BigEndian.Uint32(data[len(data)-4:]) != crc32.ChecksumIEEE(body) {
+		return nil, ErrBloomCorrupted
+	}
+	return &bloomFilter{
+		bits:      body[1:],
+		hashCount: body[0],
+	}, nil
+}
+
+// readBloomFilter loads the filter stored at filePath, the filter file of a segment of an older format.
+func readBloomFilter(filePath string) (*bloomFilter, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBloomFilter(data)
+}
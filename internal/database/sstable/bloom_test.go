@@ -0,0 +1,81 @@
+package sstable
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloomFilter_NoFalseNegatives(t *testing.T) {
+	hashes := make([]uint64, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		hashes = append(hashes, bloomHash("key"+strconv.Itoa(i)))
+	}
+	f := newBloomFilter(hashes, 0.01)
+
+	for i := 0; i < 1000; i++ {
+		assert.True(t, f.mayContain("key"+strconv.Itoa(i)))
+	}
+}
+
+func TestBloomFilter_FalsePositiveRate(t *testing.T) {
+	hashes := make([]uint64, 0, 10000)
+	for i := 0; i < 10000; i++ {
+		hashes = append(hashes, bloomHash("key"+strconv.Itoa(i)))
+	}
+	f := newBloomFilter(hashes, 0.01)
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.mayContain("missing" + strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	// 允许一定的统计波动
+	assert.Less(t, falsePositives, 300)
+}
+
+func TestBloomFilter_EncodeDecode(t *testing.T) {
+	f := newBloomFilter([]uint64{bloomHash("a"), bloomHash("b")}, 0.01)
+
+	decoded, err := decodeBloomFilter(f.encode())
+	assert.NoError(t, err)
+	assert.Equal(t, f.hashCount, decoded.hashCount)
+	assert.True(t, decoded.mayContain("a"))
+	assert.True(t, decoded.mayContain("b"))
+
+	data := f.encode()
+	data[1] ^= 0xff
+	_, err = decodeBloomFilter(data)
+	assert.ErrorIs(t, err, ErrBloomCorrupted)
+}
+
+func TestSSTable_FilterPersisted(t *testing.T) {
+	tempDir := t.TempDir()
+
+	sst, err := NewSSTable(tempDir, context.Background(), FalsePositiveRate(0.001))
+	assert.NoError(t, err)
+	err = sst.Write(&MockScanner{data: []common.Chunk{
+		{Key: "key1", Value: []byte("value1")},
+		{Key: "key2", Value: []byte("value2")},
+	}})
+	assert.NoError(t, err)
+	// 过滤器保存在段文件内部
+	assert.FileExists(t, filepath.Join(tempDir, "000001"+SegSuffix))
+	assert.NoFileExists(t, filepath.Join(tempDir, "000001"+FilterSuffix))
+	sst.Close()
+
+	reloaded, err := NewSSTable(tempDir, context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, reloaded.current.levels[0], 1)
+	assert.NotNil(t, reloaded.current.levels[0][0].filter)
+	assert.True(t, reloaded.current.levels[0][0].filter.mayContain("key1"))
+
+	value, err := reloaded.Get("key2")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value2"), value)
+}
@@ -0,0 +1,133 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compression identifies the codec of a block, as stored in the block trailer.
+type Compression byte
+
+const (
+	NoCompression Compression = iota
+	SnappyCompression
+	LZ4Compression
+	ZstdCompression
+)
+
+// DefaultCompression is the codec of new segments unless configured otherwise.
+const DefaultCompression = SnappyCompression
+
+var ErrUnknownCompression = errors.New("unknown block compression")
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// ParseCompression returns the codec named by name: none, snappy, lz4 or zstd.
+// An empty name selects DefaultCompression.
+func ParseCompression(name string) (Compression, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return DefaultCompression, nil
+	case "none":
+		return NoCompression, nil
+	case "snappy":
+		return SnappyCompression, nil
+	case "lz4":
+		return LZ4Compression, nil
+	case "zstd":
+		return ZstdCompression, nil
+	default:
+		return 0, fmt.Errorf("unknown block compression %q", name)
+	}
+}
+
+// String returns the name of the codec, as accepted by ParseCompression.
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case SnappyCompression:
+		return "snappy"
+	case LZ4Compression:
+		return "lz4"
+	case ZstdCompression:
+		return "zstd"
+	default:
+		return fmt.Sprintf("compression(%d)", byte(c))
+	}
+}
+
+// compressBlock compresses the records of a block with c and returns the codec actually used with the payload.
+// A block that does not shrink by at least an eighth is stored uncompressed, so that reading it costs no decompression.
+// The LZ4 block format does not record the uncompressed length, so the LZ4 payload starts with it as a uvarint.
+func compressBlock(c Compression, raw []byte) (Compression, []byte) {
+	var payload []byte
+	switch c {
+	case SnappyCompression:
+		payload = snappy.Encode(nil, raw)
+	case LZ4Compression:
+		payload = binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+lz4.CompressBlockBound(len(raw))), uint64(len(raw)))
+		n, err := lz4.CompressBlock(raw, payload[len(payload):cap(payload)], nil)
+		if err != nil || n == 0 {
+			return NoCompression, raw
+		}
+		payload = payload[:len(payload)+n]
+	case ZstdCompression:
+		initZstd()
+		payload = zstdEncoder.EncodeAll(raw, nil)
+	default:
+		return NoCompression, raw
+	}
+	if len(payload) >= len(raw)-len(raw)/8 {
+		return NoCompression, raw
+	}
+	return c, payload
+}
+
+// decompressBlock returns the records of a block stored with codec c.
+func decompressBlock(c Compression, payload []byte) ([]byte, error) {
+	switch c {
+	case NoCompression:
+		return payload, nil
+	case SnappyCompression:
+		return snappy.Decode(nil, payload)
+	case LZ4Compression:
+		length, n := binary.Uvarint(payload)
+		if n <= 0 || length > uint64(len(payload))*255 {
+			return nil, lz4.ErrInvalidSourceShortBuffer
+		}
+		raw := make([]byte, length)
+		m, err := lz4.UncompressBlock(payload[n:], raw)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(m) != length {
+			return nil, lz4.ErrInvalidSourceShortBuffer
+		}
+		return raw, nil
+	case ZstdCompression:
+		initZstd()
+		return zstdDecoder.DecodeAll(payload, nil)
+	default:
+		return nil, ErrUnknownCompression
+	}
+}
+
+// initZstd creates the Zstandard encoder and decoder shared by all segments; both are safe for concurrent use.
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil)
+		zstdDecoder, _ = zstd.NewReader(nil)
+	})
+}
@@ -0,0 +1,59 @@
+package sstable
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCompression(t *testing.T) {
+	for name, expected := range map[string]Compression{
+		"":       DefaultCompression,
+		"none":   NoCompression,
+		"snappy": SnappyCompression,
+		"LZ4":    LZ4Compression,
+		"zstd":   ZstdCompression,
+	} {
+		c, err := ParseCompression(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, c)
+		if name != "" {
+			assert.Equal(t, expected, mustParseCompression(t, c.String()))
+		}
+	}
+	_, err := ParseCompression("gzip")
+	assert.Error(t, err)
+}
+
+func mustParseCompression(t *testing.T, name string) Compression {
+	c, err := ParseCompression(name)
+	assert.NoError(t, err)
+	return c
+}
+
+func TestCompressBlock_RoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 1000)
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, c := range []Compression{NoCompression, SnappyCompression, LZ4Compression, ZstdCompression} {
+		codec, payload := compressBlock(c, text)
+		assert.Equal(t, c, codec)
+		if c != NoCompression {
+			assert.Less(t, len(payload), len(text)/4)
+		}
+		raw, err := decompressBlock(codec, payload)
+		assert.NoError(t, err)
+		assert.Equal(t, text, raw)
+
+		// 压缩收益不足时按原样存储
+		codec, payload = compressBlock(c, random)
+		assert.Equal(t, NoCompression, codec)
+		assert.Equal(t, random, payload)
+	}
+
+	_, err := decompressBlock(Compression(42), text)
+	assert.ErrorIs(t, err, ErrUnknownCompression)
+}
@@ -0,0 +1,276 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+	"unsafe"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+// Blocks of V4 and later segments store their chunks as entries sharing the prefix of their key with the previous entry:
+//
+//	flags(1) | uvarint shared | uvarint unshared | key[shared:] | [uvarint seq] | [uvarint expiresAt] | [uvarint valueLen | value]
+//
+// where flags are the common.RecordV2 flags, without RecordV2 itself, and mark the presence of the optional fields
+// as in a record, RecordV2Merge marking a merge operand. Every restartInterval entries the key is stored whole,
+// so that the entry can be decoded on its own: the block ends with the offset of every such restart point and their
+// count, each a 4-byte big-endian integer. Entries carry no checksum of their own, as the trailer of the block covers
+// all of them.
+const (
+	restartInterval = 16
+	entryFlags      = common.RecordV2Deleted | common.RecordV2ValuePointer | common.RecordV2Sequence | common.RecordV2Expiry | common.RecordV2Merge
+)
+
+// appendEntry appends the entry of chunk to dst, leaving out the first shared bytes of its key.
+func appendEntry(dst []byte, chunk *common.Chunk, shared int) []byte {
+	var flags byte
+	if chunk.Deleted {
+		flags |= common.RecordV2Deleted
+	} else if chunk.ValuePointer {
+		flags |= common.RecordV2ValuePointer
+	} else if chunk.Merge {
+		flags |= common.RecordV2Merge
+	}
+	if chunk.Seq != 0 {
+		flags |= common.RecordV2Sequence
+	}
+	hasExpiry := !chunk.Deleted && chunk.ExpiresAt > 0
+	if hasExpiry {
+		flags |= common.RecordV2Expiry
+	}
+	dst = append(dst, flags)
+	dst = binary.AppendUvarint(dst, uint64(shared))
+	dst = binary.AppendUvarint(dst, uint64(len(chunk.Key)-shared))
+	dst = append(dst, chunk.Key[shared:]...)
+	if chunk.Seq != 0 {
+		dst = binary.AppendUvarint(dst, chunk.Seq)
+	}
+	if hasExpiry {
+		dst = binary.AppendUvarint(dst, uint64(chunk.ExpiresAt))
+	}
+	if !chunk.Deleted {
+		dst = binary.AppendUvarint(dst, uint64(len(chunk.Value)))
+		dst = append(dst, chunk.Value...)
+	}
+	return dst
+}
+
+// entrySizeBound returns the largest size the entry of chunk can take, whatever the prefix it shares.
+func entrySizeBound(chunk *common.Chunk) int64 {
+	return int64(1 + 5*binary.MaxVarintLen64 + len(chunk.Key) + len(chunk.Value))
+}
+
+// sharedPrefixLen returns the length of the longest common prefix of a and b.
+func sharedPrefixLen(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// appendRestarts appends the restart array of a block to its entries.
+func appendRestarts(dst []byte, restarts []uint32) []byte {
+	for _, offset := range restarts {
+		dst = binary.BigEndian.AppendUint32(dst, offset)
+	}
+	return binary.BigEndian.AppendUint32(dst, uint32(len(restarts)))
+}
+
+// blockEntry is an entry decoded in place: value aliases the block, and key is only valid until the next entry
+// is decoded into the same buffer.
+type blockEntry struct {
+	key       []byte
+	flags     byte
+	seq       uint64
+	expiresAt int64
+	value     []byte
+}
+
+// before reports whether the entry sorts before the version of key with sequence number seq.
+func (e *blockEntry) before(key string, seq uint64) bool {
+	if c := bytes.Compare(e.key, unsafe.Slice(unsafe.StringData(key), len(key))); c != 0 {
+		return c < 0
+	}
+	return e.seq > seq
+}
+
+// chunk returns the entry as a chunk that does not alias the block.
+func (e *blockEntry) chunk() common.Chunk {
+	deleted := e.flags&common.RecordV2Deleted != 0
+	var value []byte
+	if !deleted {
+		value = append(make([]byte, 0, len(e.value)), e.value...)
+	}
+	return common.Chunk{
+		Key:          string(e.key),
+		Value:        value,
+		Deleted:      deleted,
+		ValuePointer: e.flags&common.RecordV2ValuePointer != 0,
+		Merge:        e.flags&common.RecordV2Merge != 0,
+		Seq:          e.seq,
+		ExpiresAt:    e.expiresAt,
+	}
+}
+
+// blockContents is the content of a block as kept in the block cache. The block of a V4 or later segment is kept as its
+// decompressed bytes, searched through its restart points without decoding the entries it skips;
+// the records of a block of an older segment, or of a block being written, are decoded up front.
+type blockContents struct {
+	chunks   []common.Chunk
+	entries  []byte
+	restarts []byte
+}
+
+// newBlockContents splits the decompressed bytes of a block of a V4 or later segment into its entries and restart array.
+func newBlockContents(data []byte) (*blockContents, error) {
+	if len(data) < 4 {
+		return nil, ErrBlockCorrupted
+	}
+	count := uint64(binary.BigEndian.Uint32(data[len(data)-4:]))
+	if count == 0 || count*4+4 > uint64(len(data)) {
+		return nil, ErrBlockCorrupted
+	}
+	end := len(data) - 4 - int(count)*4
+	return &blockContents{entries: data[:end], restarts: data[end : len(data)-4]}, nil
+}
+
+// numRestarts returns the number of restart points of the block.
+func (c *blockContents) numRestarts() int {
+	return len(c.restarts) / 4
+}
+
+// restartOffset returns the offset of restart point i within the entries.
+func (c *blockContents) restartOffset(i int) int {
+	return int(binary.BigEndian.Uint32(c.restarts[i*4:]))
+}
+
+// decodeEntry decodes the entry at offset into e, rebuilding its key from the key of the previous entry already in e.key.
+// It returns the offset of the next entry.
+func (c *blockContents) decodeEntry(offset int, e *blockEntry) (int, error) {
+	data := c.entries
+	if offset < 0 || offset >= len(data) {
+		return 0, ErrBlockCorrupted
+	}
+	e.flags = data[offset]
+	if e.flags&^entryFlags != 0 {
+		return 0, ErrBlockCorrupted
+	}
+	pos := offset + 1
+	readUvarint := func() (uint64, bool) {
+		v, n := binary.Uvarint(data[pos:])
+		if n <= 0 {
+			return 0, false
+		}
+		pos += n
+		return v, true
+	}
+
+	shared, ok1 := readUvarint()
+	unshared, ok2 := readUvarint()
+	if !ok1 || !ok2 || shared > uint64(len(e.key)) || unshared > uint64(len(data)-pos) {
+		return 0, ErrBlockCorrupted
+	}
+	e.key = append(e.key[:shared], data[pos:pos+int(unshared)]...)
+	pos += int(unshared)
+
+	e.seq, e.expiresAt, e.value = 0, 0, nil
+	if e.flags&common.RecordV2Sequence != 0 {
+		seq, ok := readUvarint()
+		if !ok {
+			return 0, ErrBlockCorrupted
+		}
+		e.seq = seq
+	}
+	if e.flags&common.RecordV2Expiry != 0 {
+		expiresAt, ok := readUvarint()
+		if !ok || expiresAt > math.MaxInt64 {
+			return 0, ErrBlockCorrupted
+		}
+		e.expiresAt = int64(expiresAt)
+	}
+	if e.flags&common.RecordV2Deleted == 0 {
+		length, ok := readUvarint()
+		if !ok || length > uint64(len(data)-pos) {
+			return 0, ErrBlockCorrupted
+		}
+		e.value = data[pos : pos+int(length)]
+		pos += int(length)
+	}
+	return pos, nil
+}
+
+// getAt returns a copy of the newest version of key whose sequence number is not greater than seq,
+// or nil if the block holds no such version.
+// A binary search over the restart points finds the last one whose entry sorts before the version looked for,
+// then the entries are decoded from there until one no longer does.
+func (c *blockContents) getAt(key string, seq uint64) (*common.Chunk, error) {
+	if c.chunks != nil {
+		if chunk, ok := search(c.chunks, key, seq); ok {
+			found := *chunk
+			return &found, nil
+		}
+		return nil, nil
+	}
+
+	var (
+		e   blockEntry
+		err error
+	)
+	n := sort.Search(c.numRestarts(), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		e.key = e.key[:0]
+		if _, err = c.decodeEntry(c.restartOffset(i), &e); err != nil {
+			return true
+		}
+		return !e.before(key, seq)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		n--
+	}
+
+	e.key = e.key[:0]
+	for offset := c.restartOffset(n); offset < len(c.entries); {
+		if offset, err = c.decodeEntry(offset, &e); err != nil {
+			return nil, err
+		}
+		if !e.before(key, seq) {
+			if string(e.key) != key {
+				return nil, nil
+			}
+			chunk := e.chunk()
+			return &chunk, nil
+		}
+	}
+	return nil, nil
+}
+
+// allChunks returns every chunk of the block, in order. Chunks decoded from the entries do not alias the block.
+func (c *blockContents) allChunks() ([]common.Chunk, error) {
+	if c.chunks != nil {
+		return c.chunks, nil
+	}
+	chunks := make([]common.Chunk, 0, c.numRestarts()*restartInterval)
+	var e blockEntry
+	for offset := 0; offset < len(c.entries); {
+		var err error
+		if offset, err = c.decodeEntry(offset, &e); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, e.chunk())
+	}
+	return chunks, nil
+}
+
+// charge estimates the memory held by the contents, as charged to the block cache.
+func (c *blockContents) charge() int64 {
+	return int64(unsafe.Sizeof(*c)) + int64(cap(c.entries)) + chunksCharge(c.chunks)
+}
@@ -0,0 +1,263 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+// A V5 or current segment is a single file holding everything needed to read it:
+//
+//	data block... | index block | filter block | properties block | [range deletion block] | footer
+//
+// The data blocks are laid out as in a V4 segment. The index block lists the offset, the size and the key range of
+// every data block, the filter block holds the Bloom filter of the keys, the properties block describes the
+// segment as a whole and the range deletion block, which V5 segments lack, holds the range tombstones;
+// each of them is followed by the trailer of a data block. The footer is read from the end of the file:
+//
+//	index handle(16) | filter handle(16) | properties handle(16) | [range deletion handle(16)] | format(4) | crc32(4) | magic(8)
+//
+// where a handle is the offset and the size of a block, each an 8-byte big-endian integer, and the CRC covers
+// the bytes of the footer before it. The format, at a fixed distance from the end, tells the size of the footer.
+// A file missing its footer was never finished and holds no segment.
+const (
+	footerTailSize = 4 + 4 + len(footerMagic)
+	maxFooterSize  = 4*blockHandleSize + footerTailSize
+	footerMagic    = "platoseg"
+)
+
+var (
+	ErrFooterCorrupted          = errors.New("segment footer corrupted")
+	ErrUnsupportedSegmentFormat = errors.New("unsupported segment format")
+)
+
+const blockHandleSize = 16
+
+// blockHandle locates a block, trailer included, in a segment file.
+type blockHandle struct {
+	offset int64
+	size   int64
+}
+
+type footer struct {
+	index      blockHandle
+	filter     blockHandle
+	properties blockHandle
+	rangeDel   blockHandle
+	format     uint32
+}
+
+// hasFooter reports whether data, the end of a segment file, ends with the magic of a footer.
+func hasFooter(data []byte) bool {
+	return len(data) >= footerTailSize && string(data[len(data)-len(footerMagic):]) == footerMagic
+}
+
+// handles returns the handles recorded by a footer of the given format, in order.
+func (f *footer) handles() []*blockHandle {
+	if f.format == segmentFormatV5 {
+		return []*blockHandle{&f.index, &f.filter, &f.properties}
+	}
+	return []*blockHandle{&f.index, &f.filter, &f.properties, &f.rangeDel}
+}
+
+// encode serializes the footer.
+func (f *footer) encode() []byte {
+	buf := make([]byte, 0, maxFooterSize)
+	for _, h := range f.handles() {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(h.offset))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(h.size))
+	}
+	buf = binary.BigEndian.AppendUint32(buf, f.format)
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	return append(buf, footerMagic...)
+}
+
+// decodeFooter parses the footer at the end of data, the end of a segment file of fileSize bytes, and checks that
+// the blocks it locates lie within the file, before the footer. data must hold the whole footer, which takes
+// at most maxFooterSize bytes.
+func decodeFooter(data []byte, fileSize int64) (*footer, error) {
+	if !hasFooter(data) {
+		return nil, ErrFooterCorrupted
+	}
+	f := &footer{format: binary.BigEndian.Uint32(data[len(data)-footerTailSize:])}
+	if f.format != segmentFormatV5 && f.format != segmentFormatV6 {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedSegmentFormat, f.format)
+	}
+	handles := f.handles()
+	size := len(handles)*blockHandleSize + footerTailSize
+	if len(data) < size {
+		return nil, ErrFooterCorrupted
+	}
+	data = data[len(data)-size:]
+	n := len(handles)*blockHandleSize + 4
+	if crc32.ChecksumIEEE(data[:n]) != binary.BigEndian.Uint32(data[n:]) {
+		return nil, ErrFooterCorrupted
+	}
+	end := uint64(fileSize - int64(size))
+	for i, h := range handles {
+		offset := binary.BigEndian.Uint64(data[i*blockHandleSize:])
+		size := binary.BigEndian.Uint64(data[i*blockHandleSize+8:])
+		if offset > end || size > end-offset {
+			return nil, ErrFooterCorrupted
+		}
+		h.offset, h.size = int64(offset), int64(size)
+	}
+	return f, nil
+}
+
+// encodeRangeTombstones serializes range tombstones as a list of
+// uvarint startLen | start | uvarint endLen | end | uvarint seq.
+func encodeRangeTombstones(tombstones []common.RangeTombstone) []byte {
+	var buf []byte
+	for _, t := range tombstones {
+		buf = binary.AppendUvarint(buf, uint64(len(t.Start)))
+		buf = append(buf, t.Start...)
+		buf = binary.AppendUvarint(buf, uint64(len(t.End)))
+		buf = append(buf, t.End...)
+		buf = binary.AppendUvarint(buf, t.Seq)
+	}
+	return buf
+}
+
+// decodeRangeTombstones parses a range deletion block produced by encodeRangeTombstones.
+func decodeRangeTombstones(data []byte) ([]common.RangeTombstone, error) {
+	var tombstones []common.RangeTombstone
+	reader := bytes.NewReader(data)
+	for reader.Len() > 0 {
+		start, err := readSnapshotKey(reader)
+		if err != nil {
+			return nil, ErrBlockCorrupted
+		}
+		end, err := readSnapshotKey(reader)
+		if err != nil {
+			return nil, ErrBlockCorrupted
+		}
+		seq, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, ErrBlockCorrupted
+		}
+		tombstones = append(tombstones, common.RangeTombstone{Start: start, End: end, Seq: seq})
+	}
+	return tombstones, nil
+}
+
+// segmentProperties describes a segment as a whole, as recorded by its properties block.
+type segmentProperties struct {
+	numEntries        uint64
+	numDeletions      uint64
+	minSeq            uint64
+	maxSeq            uint64
+	rawKeySize        uint64
+	rawValueSize      uint64
+	dataSize          uint64
+	numBlocks         uint64
+	numRangeDeletions uint64
+	compression       Compression
+}
+
+// add accounts for a chunk written to the segment.
+func (p *segmentProperties) add(chunk *common.Chunk) {
+	if p.numEntries+p.numRangeDeletions == 0 || chunk.Seq < p.minSeq {
+		p.minSeq = chunk.Seq
+	}
+	if chunk.Seq > p.maxSeq {
+		p.maxSeq = chunk.Seq
+	}
+	p.numEntries++
+	if chunk.Deleted {
+		p.numDeletions++
+	}
+	p.rawKeySize += uint64(len(chunk.Key))
+	p.rawValueSize += uint64(len(chunk.Value))
+}
+
+// addRangeTombstone accounts for a range tombstone written to the segment.
+func (p *segmentProperties) addRangeTombstone(t *common.RangeTombstone) {
+	if p.numEntries+p.numRangeDeletions == 0 || t.Seq < p.minSeq {
+		p.minSeq = t.Seq
+	}
+	if t.Seq > p.maxSeq {
+		p.maxSeq = t.Seq
+	}
+	p.numRangeDeletions++
+}
+
+// Names of the properties. Properties are stored by name, so that a reader skips those it does not know.
+const (
+	propNumEntries   = "num.entries"
+	propNumDeletions = "num.deletions"
+	propMinSeq       = "min.seq"
+	propMaxSeq       = "max.seq"
+	propRawKeySize   = "raw.key.size"
+	propRawValueSize = "raw.value.size"
+	propDataSize     = "data.size"
+	propNumBlocks    = "num.blocks"
+	propNumRangeDels = "num.range.deletions"
+	propCompression  = "compression"
+)
+
+// fields returns the properties by name, for encoding and decoding alike.
+func (p *segmentProperties) fields() map[string]*uint64 {
+	return map[string]*uint64{
+		propNumEntries:   &p.numEntries,
+		propNumDeletions: &p.numDeletions,
+		propMinSeq:       &p.minSeq,
+		propMaxSeq:       &p.maxSeq,
+		propRawKeySize:   &p.rawKeySize,
+		propRawValueSize: &p.rawValueSize,
+		propDataSize:     &p.dataSize,
+		propNumBlocks:    &p.numBlocks,
+		propNumRangeDels: &p.numRangeDeletions,
+	}
+}
+
+// encode serializes the properties as a list of uvarint nameLen | name | uvarint value, sorted by name.
+func (p *segmentProperties) encode() []byte {
+	fields := p.fields()
+	compression := uint64(p.compression)
+	fields[propCompression] = &compression
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf []byte
+	for _, name := range names {
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		buf = binary.AppendUvarint(buf, *fields[name])
+	}
+	return buf
+}
+
+// decodeProperties parses a properties block produced by encode.
+func decodeProperties(data []byte) (*segmentProperties, error) {
+	p := &segmentProperties{}
+	fields := p.fields()
+	for pos := 0; pos < len(data); {
+		length, n := binary.Uvarint(data[pos:])
+		if n <= 0 || length > uint64(len(data)-pos-n) {
+			return nil, ErrBlockCorrupted
+		}
+		pos += n
+		name := string(data[pos : pos+int(length)])
+		pos += int(length)
+		value, n := binary.Uvarint(data[pos:])
+		if n <= 0 {
+			return nil, ErrBlockCorrupted
+		}
+		pos += n
+		if name == propCompression {
+			p.compression = Compression(value)
+		} else if field, ok := fields[name]; ok {
+			*field = value
+		}
+	}
+	return p, nil
+}
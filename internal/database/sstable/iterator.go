@@ -0,0 +1,145 @@
+package sstable
+
+import (
+	"sort"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+// segmentIterator walks the chunks of a segment. It holds on to the chunks of its current block,
+// which stay readable even if the block cache evicts the block meanwhile.
+type segmentIterator struct {
+	seg      *segment
+	blockPos int
+	chunkPos int
+	chunks   []common.Chunk
+	chunksOf int
+	err      error
+}
+
+// newIterator returns an unpositioned iterator over the chunks of the segment.
+func (s *segment) newIterator() *segmentIterator {
+	return &segmentIterator{
+		seg:      s,
+		blockPos: -1,
+		chunksOf: -1,
+	}
+}
+
+// Valid reports whether the iterator is positioned at a chunk.
+func (it *segmentIterator) Valid() bool {
+	if it.err != nil || it.blockPos < 0 || it.blockPos >= len(it.seg.blocks) {
+		return false
+	}
+	return it.chunkPos >= 0 && it.chunkPos < len(it.chunks)
+}
+
+// Seek positions the iterator at the first chunk whose key is greater than or equal to key.
+// The snapshot index is used to skip the blocks whose max key is smaller than key.
+func (it *segmentIterator) Seek(key string) {
+	start := 0
+	if len(it.seg.snapshots) == len(it.seg.blocks) {
+		start = sort.Search(len(it.seg.snapshots), func(i int) bool {
+			return it.seg.snapshots[i].max >= key
+		})
+	}
+	for it.blockPos = start; it.blockPos < len(it.seg.blocks); it.blockPos++ {
+		if !it.loadBlock() {
+			return
+		}
+		chunks := it.chunks
+		it.chunkPos = sort.Search(len(chunks), func(i int) bool {
+			return chunks[i].Key >= key
+		})
+		if it.chunkPos < len(chunks) {
+			return
+		}
+	}
+}
+
+// SeekToFirst positions the iterator at the first chunk of the segment.
+func (it *segmentIterator) SeekToFirst() {
+	it.blockPos = 0
+	it.chunkPos = 0
+	it.skipForward()
+}
+
+// SeekToLast positions the iterator at the last chunk of the segment.
+func (it *segmentIterator) SeekToLast() {
+	it.blockPos = len(it.seg.blocks)
+	it.chunkPos = -1
+	it.skipBackward()
+}
+
+// Next moves to the next chunk, crossing into the following block when needed.
+func (it *segmentIterator) Next() {
+	it.chunkPos++
+	it.skipForward()
+}
+
+// Prev moves to the previous chunk, crossing into the preceding block when needed.
+func (it *segmentIterator) Prev() {
+	it.chunkPos--
+	it.skipBackward()
+}
+
+// Chunk returns the chunk at the current position.
+func (it *segmentIterator) Chunk() *common.Chunk {
+	return &it.chunks[it.chunkPos]
+}
+
+// Error returns the error that stopped the iteration, if any.
+func (it *segmentIterator) Error() error {
+	return it.err
+}
+
+// skipForward moves past exhausted or empty blocks until the position points at a chunk or the end is reached.
+func (it *segmentIterator) skipForward() {
+	for it.blockPos < len(it.seg.blocks) {
+		if !it.loadBlock() {
+			return
+		}
+		if it.chunkPos < len(it.chunks) {
+			return
+		}
+		it.blockPos++
+		it.chunkPos = 0
+	}
+}
+
+// skipBackward moves back over exhausted or empty blocks until the position points at a chunk or the start is reached.
+func (it *segmentIterator) skipBackward() {
+	for it.chunkPos < 0 {
+		it.blockPos--
+		if it.blockPos < 0 {
+			return
+		}
+		if !it.loadBlock() {
+			return
+		}
+		it.chunkPos = len(it.chunks) - 1
+	}
+}
+
+// loadBlock makes the chunks of the current block the ones the iterator walks.
+// The block is only pinned in the block cache while it is fetched: an iterator may be abandoned without being closed,
+// so it keeps its own reference to the chunks rather than a pin that would never be released.
+// It records the error and returns false if the block cannot be read.
+func (it *segmentIterator) loadBlock() bool {
+	if it.chunksOf == it.blockPos {
+		return true
+	}
+	contents, release, err := it.seg.blocks[it.blockPos].acquire()
+	if err != nil {
+		it.err = err
+		return false
+	}
+	chunks, err := contents.allChunks()
+	release()
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.chunks, it.chunksOf = chunks, it.blockPos
+	return true
+}
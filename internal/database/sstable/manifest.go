@@ -0,0 +1,256 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path"
+	"sync/atomic"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+const (
+	ManifestFileName = "MANIFEST"
+)
+
+const (
+	tagLastSegmentId byte = iota + 1
+	tagAddSegment
+	tagDeleteSegment
+	tagLastSequence
+)
+
+var ErrManifestCorrupted = errors.New("manifest corrupted")
+
+// manifestEntry identifies a segment and the level it lives in.
+type manifestEntry struct {
+	level int
+	id    int64
+}
+
+// versionEdit is one atomic change to the set of live segments.
+// A flush adds a single level 0 segment; a compaction deletes its inputs and adds its outputs in the same edit,
+// so after a crash either all of its changes or none of them are visible.
+// Every edit also records the last allocated segment id so that ids are never reused, even for deleted files,
+// and the greatest sequence number written to a segment so that sequence numbers keep growing across restarts.
+type versionEdit struct {
+	added         []manifestEntry
+	deleted       []manifestEntry
+	lastSegmentId int64
+	lastSequence  uint64
+}
+
+// encode serializes the edit as a sequence of tagged fields with varint payloads.
+func (e *versionEdit) encode() []byte {
+	buf := make([]byte, 0, 16+len(e.added)*8+len(e.deleted)*8)
+	if e.lastSegmentId > 0 {
+		buf = append(buf, tagLastSegmentId)
+		buf = binary.AppendUvarint(buf, uint64(e.lastSegmentId))
+	}
+	if e.lastSequence > 0 {
+		buf = append(buf, tagLastSequence)
+		buf = binary.AppendUvarint(buf, e.lastSequence)
+	}
+	for _, entry := range e.deleted {
+		buf = append(buf, tagDeleteSegment)
+		buf = binary.AppendUvarint(buf, uint64(entry.level))
+		buf = binary.AppendUvarint(buf, uint64(entry.id))
+	}
+	for _, entry := range e.added {
+		buf = append(buf, tagAddSegment)
+		buf = binary.AppendUvarint(buf, uint64(entry.level))
+		buf = binary.AppendUvarint(buf, uint64(entry.id))
+	}
+	return buf
+}
+
+// decodeVersionEdit parses an edit produced by encode.
+func decodeVersionEdit(data []byte) (*versionEdit, error) {
+	e := &versionEdit{}
+	readUvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, ErrManifestCorrupted
+		}
+		data = data[n:]
+		return v, nil
+	}
+	for len(data) > 0 {
+		tag := data[0]
+		data = data[1:]
+		switch tag {
+		case tagLastSegmentId:
+			v, err := readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			e.lastSegmentId = int64(v)
+		case tagLastSequence:
+			v, err := readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			e.lastSequence = v
+		case tagAddSegment, tagDeleteSegment:
+			level, err := readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			id, err := readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			entry := manifestEntry{level: int(level), id: int64(id)}
+			if tag == tagAddSegment {
+				e.added = append(e.added, entry)
+			} else {
+				e.deleted = append(e.deleted, entry)
+			}
+		default:
+			return nil, ErrManifestCorrupted
+		}
+	}
+	return e, nil
+}
+
+// manifest is the append-only log of version edits describing the live segments.
+// Every record is framed as crc32(4) | length(4) | edit and is synced before the edit takes effect in memory.
+type manifest struct {
+	file *os.File
+}
+
+// createManifest atomically replaces the manifest of root with one holding a single edit describing the whole
+// current state, and returns it opened for appending further edits.
+// Rewriting the log on every open keeps it from growing without bound and drops any torn record left by a crash.
+func createManifest(root string, snapshot *versionEdit) (*manifest, error) {
+	manifestPath := path.Join(root, ManifestFileName)
+	tmpPath := manifestPath + TmpSuffix
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, FileModePerm)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{file: f}
+	if err := m.append(snapshot); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, manifestPath); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := common.SyncDir(root); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// append writes an edit to the end of the manifest and syncs it to disk.
+func (m *manifest) append(edit *versionEdit) error {
+	payload := edit.encode()
+	record := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(payload)))
+	record = append(record, payload...)
+
+	if _, err := m.file.Write(record); err != nil {
+		return err
+	}
+	return m.file.Sync()
+}
+
+// close closes the manifest file.
+func (m *manifest) close() error {
+	return m.file.Close()
+}
+
+// manifestState is the state rebuilt by replaying a manifest.
+type manifestState struct {
+	// live holds the level of every live segment keyed by id.
+	live          map[int64]int
+	lastSegmentId int64
+	lastSequence  uint64
+}
+
+// replayManifest rebuilds the live segment set of root by applying every edit of its manifest in order,
+// along with the last segment id ever allocated and the greatest sequence number written to a segment.
+// The boolean result is false when the directory has no manifest yet.
+// A torn record at the end of the log, left by a crash in the middle of an append, is ignored:
+// the edit it carried was never acknowledged.
+func replayManifest(root string) (*manifestState, bool, error) {
+	data, err := os.ReadFile(path.Join(root, ManifestFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &manifestState{}, false, nil
+		}
+		return nil, false, err
+	}
+
+	state := &manifestState{live: make(map[int64]int)}
+	for len(data) > 0 {
+		if len(data) < 8 {
+			break
+		}
+		crc := binary.BigEndian.Uint32(data[0:4])
+		length := int(binary.BigEndian.Uint32(data[4:8]))
+		if len(data) < 8+length {
+			break
+		}
+		payload := data[8 : 8+length]
+		if crc != crc32.ChecksumIEEE(payload) {
+			if len(data) == 8+length {
+				break
+			}
+			return nil, false, ErrManifestCorrupted
+		}
+		data = data[8+length:]
+
+		edit, err := decodeVersionEdit(payload)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, entry := range edit.deleted {
+			delete(state.live, entry.id)
+		}
+		for _, entry := range edit.added {
+			state.live[entry.id] = entry.level
+		}
+		if edit.lastSegmentId > state.lastSegmentId {
+			state.lastSegmentId = edit.lastSegmentId
+		}
+		if edit.lastSequence > state.lastSequence {
+			state.lastSequence = edit.lastSequence
+		}
+	}
+	return state, true, nil
+}
+
+// snapshotEdit returns a single edit that recreates the current level layout from an empty state.
+// The caller must hold the lock.
+func (s *SSTable) snapshotEdit() *versionEdit {
+	edit := &versionEdit{lastSegmentId: atomic.LoadInt64(&s.lastSegmentId), lastSequence: s.lastSequence}
+	for level, segs := range s.current.levels {
+		for _, seg := range segs {
+			edit.added = append(edit.added, manifestEntry{level: level, id: seg.id})
+		}
+	}
+	return edit
+}
+
+// logEdit durably appends an edit to the manifest. The caller must hold the write lock,
+// and must only apply the edit to the in-memory layout once logEdit has succeeded.
+// A sequence number set on the edit by the caller only becomes the last sequence once the edit is logged.
+func (s *SSTable) logEdit(edit *versionEdit) error {
+	edit.lastSegmentId = atomic.LoadInt64(&s.lastSegmentId)
+	if edit.lastSequence < s.lastSequence {
+		edit.lastSequence = s.lastSequence
+	}
+	if err := s.manifest.append(edit); err != nil {
+		return err
+	}
+	s.lastSequence = edit.lastSequence
+	return nil
+}
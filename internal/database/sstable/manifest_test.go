@@ -0,0 +1,92 @@
+package sstable
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionEdit_EncodeDecode(t *testing.T) {
+	edit := &versionEdit{
+		added:         []manifestEntry{{level: 1, id: 7}, {level: 1, id: 300}},
+		deleted:       []manifestEntry{{level: 0, id: 3}},
+		lastSegmentId: 300,
+		lastSequence:  1 << 40,
+	}
+
+	decoded, err := decodeVersionEdit(edit.encode())
+	assert.NoError(t, err)
+	assert.Equal(t, edit, decoded)
+
+	_, err = decodeVersionEdit([]byte{0xee})
+	assert.ErrorIs(t, err, ErrManifestCorrupted)
+}
+
+func TestManifest_RecoverRemovesOrphans(t *testing.T) {
+	tempDir := t.TempDir()
+	sst := newStoppedSSTable(t, tempDir)
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{{Key: "a", Value: []byte("a")}}}))
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{{Key: "b", Value: []byte("b")}}}))
+	sst.Close()
+
+	// 模拟崩溃遗留的文件：未记录的合并输出、临时文件以及写了一半的清单记录
+	for _, name := range []string{"000099.seg", "000099.sp", "000099.bf", "000005.seg.tmp"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(tempDir, name), []byte("orphan"), FileModePerm))
+	}
+	f, err := os.OpenFile(filepath.Join(tempDir, ManifestFileName), os.O_APPEND|os.O_WRONLY, FileModePerm)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 1, 0, 0, 0, 9, 2})
+	assert.NoError(t, err)
+	f.Close()
+
+	reloaded := newStoppedSSTable(t, tempDir)
+	defer reloaded.Close()
+	assert.Len(t, reloaded.current.levels[0], 2)
+	for _, name := range []string{"000099.seg", "000099.sp", "000099.bf", "000005.seg.tmp"} {
+		assert.NoFileExists(t, filepath.Join(tempDir, name))
+	}
+	assert.Greater(t, reloaded.newSegmentId(), int64(99))
+
+	value, err := reloaded.Get("b")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("b"), value)
+}
+
+func TestManifest_MissingLiveSegmentFails(t *testing.T) {
+	tempDir := t.TempDir()
+	sst := newStoppedSSTable(t, tempDir)
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{{Key: "a", Value: []byte("a")}}}))
+	sst.Close()
+
+	assert.NoError(t, os.Remove(filepath.Join(tempDir, "000001"+SegSuffix)))
+
+	_, err := NewSSTable(tempDir, context.Background())
+	assert.Error(t, err)
+}
+
+func TestManifest_CompactionSurvivesReopen(t *testing.T) {
+	tempDir := t.TempDir()
+	sst := newStoppedSSTable(t, tempDir, Level0CompactionTrigger(2))
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{{Key: "a", Value: []byte("a1")}}}))
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{{Key: "a", Value: []byte("a2")}}}))
+	done, err := sst.compact()
+	assert.NoError(t, err)
+	assert.True(t, done)
+	sst.Close()
+
+	// 合并的输入已被删除，只剩输出段
+	segFiles, _ := filepath.Glob(filepath.Join(tempDir, "*"+SegSuffix))
+	assert.Len(t, segFiles, 1)
+
+	reloaded := newStoppedSSTable(t, tempDir)
+	defer reloaded.Close()
+	assert.Empty(t, reloaded.current.levels[0])
+	assert.Len(t, reloaded.current.levels[1], 1)
+	value, err := reloaded.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a2"), value)
+}
@@ -1,100 +1,399 @@
 package sstable
 
 import (
-	"errors"
 	"fmt"
 	"log"
 	"time"
-)
 
-const (
-	SegmentSize = 8*1024 ^ 2
+	"github.com/Jasonbourne723/platodb/internal/database/common"
 )
 
-func (s *SSTable) searchAndMergeSegments() {
+// compaction describes one unit of leveled compaction:
+// the inputs picked from level are merged with the overlapping segments of level+1 into new segments of level+1.
+// The version the inputs were picked from is held until the compaction is done.
+type compaction struct {
+	level   int
+	inputs  [2][]*segment
+	version *version
+}
 
-	l := len(s.Segments)
-	if l < 3 {
-		return
+// maybeScheduleCompaction wakes the compaction goroutine without blocking.
+func (s *SSTable) maybeScheduleCompaction() {
+	select {
+	case s.compactCh <- struct{}{}:
+	default:
 	}
-	for i := 1; i < l; i++ {
-
-		//将文件大小不足额定大小一半的文件合并到其上一个文件中
-		if s.Segments[i].size < SegmentSize/2 {
+}
 
-			err := s.merge(i-1, i)
+// startMergeMonitor runs compactions in the background until the SSTable is closed or its context is cancelled.
+// It wakes up when a new segment is flushed and every 5 seconds, and keeps compacting while any level is over its limit.
+func (s *SSTable) startMergeMonitor() {
+	defer close(s.stopped)
+	for {
+		select {
+		case <-s.compactCh:
+		case <-time.After(time.Duration(5) * time.Second):
+		case <-s.ctx.Done():
+			return
+		case <-s.stop:
+			return
+		}
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-s.stop:
+				return
+			default:
+			}
+			done, err := s.compact()
 			if err != nil {
 				log.Println(fmt.Errorf("merge failed,%w", err))
-				continue
+				break
+			}
+			if !done {
+				break
 			}
 		}
 	}
+}
 
+// levelMaxBytes returns the size limit of a level below level 0.
+// Level 1 may hold as much as level 0 does when it triggers a compaction; every further level is levelSizeRatio times larger.
+func (s *SSTable) levelMaxBytes(level int) int64 {
+	size := int64(s.level0Trigger) * s.targetFileSize
+	for i := 1; i < level; i++ {
+		size *= int64(s.levelSizeRatio)
+	}
+	return size
 }
 
-func (s *SSTable) merge(firstIndex, secondIndex int) error {
+// pickCompaction selects the level that most exceeds its limit and the segments to compact from it.
+// Level 0 is scored by its segment count, the other levels by their size. The last level is never compacted.
+// For level 0 all segments are picked since their ranges overlap; for the other levels one segment is picked,
+// rotating through the key space so that every segment eventually moves down.
+// Returns nil when no level needs compaction; otherwise the caller must release the version of the compaction.
+func (s *SSTable) pickCompaction() *compaction {
+	v := s.acquireVersion()
 
-	newSeg, err := newTmpSegment(s.Root, s.Segments[secondIndex].id)
-	if err != nil {
-		return err
+	bestLevel, bestScore := -1, 1.0
+	for level := 0; level < len(v.levels)-1; level++ {
+		var score float64
+		if level == 0 {
+			score = float64(len(v.levels[0])) / float64(s.level0Trigger)
+		} else {
+			score = float64(v.levelSize(level)) / float64(s.levelMaxBytes(level))
+		}
+		if score >= bestScore {
+			bestLevel, bestScore = level, score
+		}
+	}
+	if bestLevel < 0 {
+		v.release()
+		return nil
 	}
 
-	fSeg := s.Segments[firstIndex]
-	sSeg := s.Segments[secondIndex]
+	c := &compaction{level: bestLevel, version: v}
+	if bestLevel == 0 {
+		c.inputs[0] = append([]*segment(nil), v.levels[0]...)
+	} else {
+		segs := v.levels[bestLevel]
+		picked := segs[0]
+		for _, seg := range segs {
+			if seg.minKey() > s.compactPointer(bestLevel) {
+				picked = seg
+				break
+			}
+		}
+		c.inputs[0] = []*segment{picked}
+	}
 
-	fSeg.newscanner()
-	sSeg.newscanner()
+	min, max := keyRange(c.inputs[0])
+	for _, seg := range v.levels[bestLevel+1] {
+		if seg.overlaps(min, max) {
+			c.inputs[1] = append(c.inputs[1], seg)
+		}
+	}
+	return c
+}
 
-	firstScan := fSeg.scan()
-	secondScan := sSeg.scan()
+// keyRange returns the smallest and largest key covered by segs.
+func keyRange(segs []*segment) (string, string) {
+	min, max := segs[0].minKey(), segs[0].maxKey()
+	for _, seg := range segs[1:] {
+		if seg.minKey() < min {
+			min = seg.minKey()
+		}
+		if seg.maxKey() > max {
+			max = seg.maxKey()
+		}
+	}
+	return min, max
+}
 
-	for firstScan || secondScan {
-		firstChunk := fSeg.scanValue()
-		secondChunk := sSeg.scanValue()
+// compact runs a single compaction if one is needed and reports whether it did.
+// A lone input without overlap in the next level is moved down without being rewritten.
+// Input segments are deleted only once the manifest has recorded the edit that replaces them
+// and no version lists them any more; if the edit cannot be recorded the outputs are discarded and the inputs stay live.
+func (s *SSTable) compact() (bool, error) {
+	c := s.pickCompaction()
+	if c == nil {
+		return false, nil
+	}
+	defer c.version.release()
 
-		if !firstScan || secondChunk.Key < firstChunk.Key {
-			if err := newSeg.write(secondChunk); err != nil {
-				return errors.New("merge failed")
+	trivialMove := len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0
+	var outputs []*segment
+	if trivialMove {
+		outputs = c.inputs[0]
+	} else {
+		var err error
+		if outputs, err = s.merge(c); err != nil {
+			return false, err
+		}
+	}
+
+	if err := s.install(c, outputs); err != nil {
+		if !trivialMove {
+			for _, seg := range outputs {
+				seg.delete()
 			}
-			secondScan = sSeg.scan()
-			continue
 		}
+		return false, err
+	}
+	return true, nil
+}
+
+// merge performs a k-way merge of the compaction inputs into new segments of the output level.
+// The live snapshots split the sequence numbers into stripes: a stripe holds the versions seen by the same snapshots.
+// Only the newest version of every key in every stripe is kept, which is the one its snapshots read; with no snapshot,
+// only the newest version of every key is kept. Values separated into the value log stay there: only their pointers
+// are copied into the outputs. A tombstone seen by every snapshot is dropped, along with the older versions it hides,
+// when no deeper level can hold an older version of its key, which is always the case once it reaches the bottom level.
+// An expired version is rewritten as a tombstone, so that it keeps hiding the older versions until it can be dropped.
+// A version deleted by a range tombstone of the inputs is dropped when both belong to the same stripe, as no snapshot
+// can then see the version without the range tombstone; a range tombstone is dropped like a tombstone, once every
+// snapshot sees it and no deeper level intersects its range.
+// A new output segment is started at the first new key once the current one reaches the target file size.
+// With a merge operator, the merge operands of a key in a stripe are combined with the version they apply to when
+// the stripe holds it, with no value when no older version of the key remains anywhere, and with each other otherwise.
+// The range tombstones kept are split between the outputs at the same keys, so that the outputs never overlap.
+func (s *SSTable) merge(c *compaction) ([]*segment, error) {
 
-		if !secondScan || firstChunk.Key < secondChunk.Key {
-			if err := newSeg.write(firstChunk); err != nil {
-				return errors.New("merge failed")
+	// 子迭代器按从新到旧排列：level 0 中 id 越大越新，上层比下层新
+	children := make([]common.Iterator, 0, len(c.inputs[0])+len(c.inputs[1]))
+	var tombstones []common.RangeTombstone
+	for i := len(c.inputs[0]) - 1; i >= 0; i-- {
+		children = append(children, c.inputs[0][i].newIterator())
+		tombstones = append(tombstones, c.inputs[0][i].tombstones...)
+	}
+	for _, seg := range c.inputs[1] {
+		children = append(children, seg.newIterator())
+		tombstones = append(tombstones, seg.tombstones...)
+	}
+	iter := common.NewMergingIterator(children)
+	rangeDels := common.NewRangeDeletions(tombstones)
+
+	outputLevel := c.level + 1
+	outputs := make([]*segment, 0, 1)
+	var out *segment
+	abort := func(err error) ([]*segment, error) {
+		if out != nil {
+			out.delete()
+		}
+		for _, seg := range outputs {
+			seg.delete()
+		}
+		return nil, err
+	}
+
+	stripeOf := s.stripeFunc()
+	var kept []common.RangeTombstone
+	for _, t := range tombstones {
+		if stripeOf(t.Seq) != 0 || !c.version.isBaseLevelForRange(outputLevel, t.Start, rangeTombstoneMax(t.End)) {
+			kept = append(kept, t)
+		}
+	}
+	// lower 是当前输出段的起始边界，之前的输出段只保存该边界之前的范围墓碑
+	lower := ""
+	writeTombstones := func(seg *segment, upper string) {
+		for _, t := range kept {
+			if t.Start < lower {
+				t.Start = lower
+			}
+			if upper != "" && t.End > upper {
+				t.End = upper
+			}
+			if !t.Empty() {
+				seg.writeRangeTombstone(t)
 			}
-			firstScan = fSeg.scan()
-			continue
 		}
+		lower = upper
+	}
 
-		if firstChunk.Key == secondChunk.Key {
-			if err := newSeg.write(secondChunk); err != nil {
-				return errors.New("merge failed")
+	// 同一个 key 的所有版本必须写入同一个段文件，因此只在 key 变化时切换输出
+	var lastWritten string
+	emit := func(chunk *common.Chunk) error {
+		if out != nil && out.size >= s.targetFileSize && chunk.Key != lastWritten {
+			// 紧跟 lastWritten 之后的 key 是两个输出段的分界
+			writeTombstones(out, lastWritten+"\x00")
+			if err := out.finish(s.falsePositiveRate); err != nil {
+				return err
+			}
+			outputs = append(outputs, out)
+			out = nil
+		}
+		if out == nil {
+			var err error
+			if out, err = s.createSegment(); err != nil {
+				return err
+			}
+		}
+		if err := out.write(chunk); err != nil {
+			return err
+		}
+		lastWritten = chunk.Key
+		return nil
+	}
+	// 同一 stripe 中的合并操作数与它们作用的版本合并为一个版本；输入中没有更旧的版本且更深的层不含该 key 时，
+	// 操作数直接作用于空值
+	var pending *pendingMerge
+	emitPending := func(bottom bool) error {
+		versions := pending.resolve(bottom, s.ResolveValue)
+		pending = nil
+		for i := range versions {
+			if err := emit(&versions[i]); err != nil {
+				return err
 			}
-			firstScan = fSeg.scan()
-			secondScan = sSeg.scan()
 		}
+		return nil
 	}
-	newSeg.sync()
 
-	//todo: lock
-	s.Segments[firstIndex].delete()
-	s.Segments[secondIndex].delete()
-	newSeg.turnToNormal()
-	s.Segments[secondIndex] = newSeg
-	s.Segments = append(s.Segments[:firstIndex], s.Segments[secondIndex:]...)
+	now := time.Now()
+	var lastKey string
+	lastStripe, hasLast := 0, false
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		chunk := iter.Chunk()
+		stripe := stripeOf(chunk.Seq)
+		if pending != nil {
+			if pending.accepts(chunk, stripe) {
+				pending.add(chunk, now)
+				if pending.complete {
+					if err := emitPending(false); err != nil {
+						return abort(err)
+					}
+				}
+				continue
+			}
+			bottom := chunk.Key != lastKey && c.version.isBaseLevelForKey(outputLevel, lastKey)
+			if err := emitPending(bottom); err != nil {
+				return abort(err)
+			}
+		}
+		if hasLast && chunk.Key == lastKey && stripe == lastStripe {
+			continue
+		}
+		lastKey, lastStripe, hasLast = chunk.Key, stripe, true
+
+		if deletedAt := rangeDels.Covering(chunk.Key, common.MaxSeq); chunk.Seq < deletedAt && stripeOf(deletedAt) == stripe {
+			continue
+		}
 
+		if chunk.Expired(now) {
+			// 直接丢弃过期版本会让更旧的版本重新可见，因此将其转换为墓碑
+			chunk = &common.Chunk{Key: chunk.Key, Deleted: true, Seq: chunk.Seq}
+		}
+		if chunk.Deleted && stripe == 0 && c.version.isBaseLevelForKey(outputLevel, chunk.Key) {
+			continue
+		}
+		if chunk.Merge && s.mergeOperator != nil {
+			pending = newPendingMerge(s.mergeOperator, rangeDels, chunk, stripe)
+			continue
+		}
+		if err := emit(chunk); err != nil {
+			return abort(err)
+		}
+	}
+	if pending != nil {
+		if err := emitPending(c.version.isBaseLevelForKey(outputLevel, lastKey)); err != nil {
+			return abort(err)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return abort(err)
+	}
+	if out == nil && len(kept) > 0 {
+		var err error
+		if out, err = s.createSegment(); err != nil {
+			return abort(err)
+		}
+	}
+	if out != nil {
+		writeTombstones(out, "")
+		if err := out.finish(s.falsePositiveRate); err != nil {
+			return abort(err)
+		}
+		outputs = append(outputs, out)
+	}
+	return outputs, nil
+}
+
+// compactPointer returns the largest key of the last compaction of level, where the next one resumes.
+func (s *SSTable) compactPointer(level int) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.compactPointers[level]
+}
+
+// install records the compaction as a single edit in the manifest,
+// then installs a version where the compaction outputs replace its inputs.
+// Only compaction removes segments, so the inputs are still part of the current version.
+func (s *SSTable) install(c *compaction, outputs []*segment) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	edit := &versionEdit{}
+	for i, inputs := range c.inputs {
+		for _, seg := range inputs {
+			edit.deleted = append(edit.deleted, manifestEntry{level: c.level + i, id: seg.id})
+		}
+	}
+	for _, seg := range outputs {
+		edit.added = append(edit.added, manifestEntry{level: c.level + 1, id: seg.id})
+	}
+	if err := s.logEdit(edit); err != nil {
+		return err
+	}
+
+	levels := s.current.cloneLevels()
+	for i, inputs := range c.inputs {
+		level := c.level + i
+		levels[level] = removeSegments(levels[level], inputs)
+	}
+	outputLevel := c.level + 1
+	levels[outputLevel] = append(levels[outputLevel], outputs...)
+	sortLevel(levels, outputLevel)
+	s.installVersion(levels)
+
+	_, max := keyRange(c.inputs[0])
+	s.compactPointers[c.level] = max
 	return nil
 }
 
-func (s *SSTable) startMergeMonitor() {
-	for {
-		select {
-		case <-time.After(time.Duration(5) * time.Second):
-			s.searchAndMergeSegments()
-		case <-s.ctx.Done():
-			return
+// removeSegments returns segs without the segments listed in removed.
+func removeSegments(segs []*segment, removed []*segment) []*segment {
+	kept := make([]*segment, 0, len(segs))
+	for _, seg := range segs {
+		isRemoved := false
+		for _, r := range removed {
+			if seg == r {
+				isRemoved = true
+				break
+			}
+		}
+		if !isRemoved {
+			kept = append(kept, seg)
 		}
 	}
+	return kept
 }
@@ -0,0 +1,93 @@
+package sstable
+
+import (
+	"time"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+// pendingMerge gathers the merge operands of a key that belong to the same stripe, from the newest to the oldest,
+// followed by the version they apply to when the stripe holds one, so that they are written as a single version.
+type pendingMerge struct {
+	operator  common.MergeOperator
+	rangeDels *common.RangeDeletions
+	stripe    int
+	// versions 从新到旧排列，complete 时最后一个可能是操作数作用的版本
+	versions []common.Chunk
+	complete bool
+}
+
+// newPendingMerge starts gathering the operands of the stripe from chunk, the newest of them.
+func newPendingMerge(operator common.MergeOperator, rangeDels *common.RangeDeletions, chunk *common.Chunk, stripe int) *pendingMerge {
+	return &pendingMerge{
+		operator:  operator,
+		rangeDels: rangeDels,
+		stripe:    stripe,
+		versions:  []common.Chunk{*chunk},
+	}
+}
+
+// accepts reports whether chunk is an older version of the key within the stripe, which the operands may still need.
+func (p *pendingMerge) accepts(chunk *common.Chunk, stripe int) bool {
+	return !p.complete && chunk.Key == p.versions[0].Key && stripe == p.stripe
+}
+
+// add appends the next older version of the key within the stripe. Gathering is complete once the version is not
+// an operand: a value, a tombstone, an expired version or a version deleted by a range tombstone newer than it.
+func (p *pendingMerge) add(chunk *common.Chunk, now time.Time) {
+	switch {
+	case p.rangeDels.Deletes(chunk, p.versions[0].Seq):
+		// 范围墓碑与操作数属于同一 stripe，被它删除的版本可以直接丢弃
+		p.complete = true
+	case chunk.Merge:
+		p.versions = append(p.versions, *chunk)
+	case chunk.Expired(now):
+		p.versions = append(p.versions, common.Chunk{Key: chunk.Key, Deleted: true, Seq: chunk.Seq})
+		p.complete = true
+	default:
+		p.versions = append(p.versions, *chunk)
+		p.complete = true
+	}
+}
+
+// resolve returns the versions to write in place of the gathered ones. Once gathering is complete, or when bottom
+// reports that no older version of the key exists anywhere, the operands are applied to the version they apply to,
+// or to no value, and replaced by a value with the sequence number of the newest operand. Otherwise they are combined
+// into a single operand when the operator can. If the merge fails, the gathered versions are written as they are,
+// leaving the failure to the reads.
+// resolveValue reads the value of a version that holds a value pointer.
+func (p *pendingMerge) resolve(bottom bool, resolveValue func(*common.Chunk) ([]byte, error)) []common.Chunk {
+	newest := &p.versions[0]
+	operands := make([][]byte, 0, len(p.versions))
+	var base *common.Chunk
+	for i := len(p.versions) - 1; i >= 0; i-- {
+		if v := &p.versions[i]; v.Merge {
+			operands = append(operands, v.Value)
+		} else {
+			base = v
+		}
+	}
+
+	if p.complete || bottom {
+		var existing []byte
+		if base != nil && !base.Deleted {
+			value, err := resolveValue(base)
+			if err != nil {
+				return p.versions
+			}
+			existing = value
+		}
+		value, err := p.operator.FullMerge(newest.Key, existing, operands)
+		if err != nil {
+			return p.versions
+		}
+		return []common.Chunk{{Key: newest.Key, Value: value, Seq: newest.Seq}}
+	}
+
+	if len(operands) > 1 {
+		if operand, ok := p.operator.PartialMerge(newest.Key, operands); ok {
+			return []common.Chunk{{Key: newest.Key, Value: operand, Merge: true, Seq: newest.Seq}}
+		}
+	}
+	return p.versions
+}
@@ -0,0 +1,376 @@
+package sstable
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// newStoppedSSTable opens an SSTable whose background compaction has already stopped,
+// so that tests can drive compactions by hand.
+func newStoppedSSTable(t *testing.T, root string, options ...Options) *SSTable {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sst, err := NewSSTable(root, ctx, options...)
+	assert.NoError(t, err)
+	return sst
+}
+
+func TestCompact_Level0IntoLevel1(t *testing.T) {
+	tempDir := t.TempDir()
+	sst := newStoppedSSTable(t, tempDir, Level0CompactionTrigger(2))
+
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{
+		{Key: "a", Value: []byte("a1")},
+		{Key: "b", Value: []byte("b1")},
+		{Key: "c", Value: []byte("c1")},
+	}}))
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{
+		{Key: "b", Deleted: true},
+		{Key: "c", Value: []byte("c2")},
+	}}))
+
+	done, err := sst.compact()
+	assert.NoError(t, err)
+	assert.True(t, done)
+	assert.Empty(t, sst.current.levels[0])
+	assert.Len(t, sst.current.levels[1], 1)
+
+	// 最底层的墓碑被丢弃
+	it := sst.current.levels[1][0].newIterator()
+	keys := make([]string, 0)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		keys = append(keys, it.Chunk().Key)
+	}
+	assert.Equal(t, []string{"a", "c"}, keys)
+
+	value, err := sst.Get("c")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("c2"), value)
+
+	done, err = sst.compact()
+	assert.NoError(t, err)
+	assert.False(t, done)
+	sst.Close()
+
+	// 重新加载后层级布局保持不变
+	reloaded := newStoppedSSTable(t, tempDir)
+	assert.Empty(t, reloaded.current.levels[0])
+	assert.Len(t, reloaded.current.levels[1], 1)
+	value, err = reloaded.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a1"), value)
+	reloaded.Close()
+}
+
+func TestCompact_SplitsOutputAndKeepsRangesDisjoint(t *testing.T) {
+	sst := newStoppedSSTable(t, t.TempDir(), Level0CompactionTrigger(2), TargetFileSize(BlockSize/4))
+
+	for round := 0; round < 2; round++ {
+		chunks := make([]common.Chunk, 0, 5000)
+		for i := 0; i < 5000; i++ {
+			chunks = append(chunks, common.Chunk{
+				Key:   fmt.Sprintf("key%05d", i),
+				Value: []byte(fmt.Sprintf("value%d-%d", round, i)),
+			})
+		}
+		assert.NoError(t, sst.Write(&MockScanner{data: chunks}))
+	}
+
+	done, err := sst.compact()
+	assert.NoError(t, err)
+	assert.True(t, done)
+	assert.Greater(t, len(sst.current.levels[1]), 1)
+	for i := 1; i < len(sst.current.levels[1]); i++ {
+		assert.Less(t, sst.current.levels[1][i-1].maxKey(), sst.current.levels[1][i].minKey())
+	}
+
+	value, err := sst.Get("key04321")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value1-4321"), value)
+	sst.Close()
+}
+
+func TestCompact_KeepsTombstoneAboveOlderData(t *testing.T) {
+	sst := newStoppedSSTable(t, t.TempDir(), Level0CompactionTrigger(1))
+
+	// 把包含旧版本的段直接放到 level 2
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{
+		{Key: "k", Value: []byte("old")},
+	}}))
+	sst.current.levels[2], sst.current.levels[0] = sst.current.levels[0], nil
+
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{
+		{Key: "j", Value: []byte("j")},
+		{Key: "k", Deleted: true},
+	}}))
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{
+		{Key: "l", Value: []byte("l")},
+	}}))
+
+	done, err := sst.compact()
+	assert.NoError(t, err)
+	assert.True(t, done)
+
+	value, err := sst.Get("k")
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+	sst.Close()
+}
+
+func TestCompact_KeepsVersionsVisibleToSnapshots(t *testing.T) {
+	snapshots := []uint64{2}
+	tempDir := t.TempDir()
+	sst := newStoppedSSTable(t, tempDir, Level0CompactionTrigger(2), Snapshots(func() []uint64 { return snapshots }))
+
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{
+		{Key: "a", Value: []byte("a1"), Seq: 1},
+		{Key: "b", Value: []byte("b2"), Seq: 2},
+	}}))
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{
+		{Key: "a", Value: []byte("a4"), Seq: 4},
+		{Key: "a", Value: []byte("a3"), Seq: 3},
+		{Key: "b", Deleted: true, Seq: 5},
+	}}))
+	assert.Equal(t, uint64(5), sst.LastSequence())
+
+	done, err := sst.compact()
+	assert.NoError(t, err)
+	assert.True(t, done)
+
+	// a3 对任何快照都不可见而被丢弃，快照 2 仍能看到 a1 和 b2
+	versions := make([]string, 0)
+	it := sst.current.levels[1][0].newIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		versions = append(versions, fmt.Sprintf("%s@%d", it.Chunk().Key, it.Chunk().Seq))
+	}
+	assert.Equal(t, []string{"a@4", "a@1", "b@5", "b@2"}, versions)
+
+	value, err := sst.GetAt("a", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a1"), value)
+	value, err = sst.GetAt("b", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("b2"), value)
+	value, err = sst.Get("b")
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+
+	// 快照释放后，只有快照可见的旧版本在下一次合并中被丢弃
+	snapshots = nil
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{{Key: "b", Value: []byte("b6"), Seq: 6}}}))
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{{Key: "c", Value: []byte("c7"), Seq: 7}}}))
+	done, err = sst.compact()
+	assert.NoError(t, err)
+	assert.True(t, done)
+	assert.Len(t, sst.current.levels[1], 1)
+
+	versions = versions[:0]
+	it = sst.current.levels[1][0].newIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		versions = append(versions, fmt.Sprintf("%s@%d", it.Chunk().Key, it.Chunk().Seq))
+	}
+	assert.Equal(t, []string{"a@4", "b@6", "c@7"}, versions)
+	sst.Close()
+
+	// 重新加载后序列号不会回退
+	reloaded := newStoppedSSTable(t, tempDir)
+	assert.Equal(t, uint64(7), reloaded.LastSequence())
+	reloaded.Close()
+}
+
+func TestCompact_DropsExpiredVersions(t *testing.T) {
+	sst := newStoppedSSTable(t, t.TempDir(), Level0CompactionTrigger(2))
+	defer sst.Close()
+
+	expired := time.Now().Add(-time.Second).UnixMilli()
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{
+		{Key: "a", Value: []byte("a1"), Seq: 1},
+		{Key: "b", Value: []byte("b2"), Seq: 2, ExpiresAt: time.Now().Add(time.Hour).UnixMilli()},
+	}}))
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{
+		{Key: "a", Value: []byte("a3"), Seq: 3, ExpiresAt: expired},
+		{Key: "c", Value: []byte("c4"), Seq: 4, ExpiresAt: expired},
+	}}))
+
+	done, err := sst.compact()
+	assert.NoError(t, err)
+	assert.True(t, done)
+
+	// 过期版本与它遮蔽的旧版本都在最底层被物理删除
+	versions := make([]string, 0)
+	it := sst.current.levels[1][0].newIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		versions = append(versions, fmt.Sprintf("%s@%d", it.Chunk().Key, it.Chunk().Seq))
+	}
+	assert.Equal(t, []string{"b@2"}, versions)
+
+	value, err := sst.Get("b")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("b2"), value)
+}
+
+func TestCompact_RangeTombstones(t *testing.T) {
+	var snapshots []uint64
+	sst := newStoppedSSTable(t, t.TempDir(), Level0CompactionTrigger(2), Snapshots(func() []uint64 { return snapshots }))
+	defer sst.Close()
+
+	write := func() {
+		assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{
+			{Key: "a", Value: []byte("a1"), Seq: 1},
+			{Key: "b", Value: []byte("b2"), Seq: 2},
+			{Key: "c", Value: []byte("c3"), Seq: 3},
+			{Key: "d", Value: []byte("d4"), Seq: 4},
+		}}))
+		assert.NoError(t, sst.Write(&MockScanner{
+			data:       []common.Chunk{{Key: "e", Value: []byte("e6"), Seq: 6}},
+			tombstones: []common.RangeTombstone{{Start: "b", End: "d", Seq: 5}},
+		}))
+	}
+	versions := func() []string {
+		versions := make([]string, 0)
+		for _, seg := range sst.current.levels[1] {
+			it := seg.newIterator()
+			for it.SeekToFirst(); it.Valid(); it.Next() {
+				versions = append(versions, fmt.Sprintf("%s@%d", it.Chunk().Key, it.Chunk().Seq))
+			}
+		}
+		return versions
+	}
+
+	// 没有快照时被覆盖的版本和最底层的范围墓碑一起被丢弃
+	write()
+	done, err := sst.compact()
+	assert.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, []string{"a@1", "d@4", "e@6"}, versions())
+	assert.Empty(t, sst.current.levels[1][0].tombstones)
+
+	// 快照 3 能看到 b2 和 c3，它们与范围墓碑一起保留
+	sst.current.levels[1] = nil
+	snapshots = []uint64{3}
+	write()
+	done, err = sst.compact()
+	assert.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, []string{"a@1", "b@2", "c@3", "d@4", "e@6"}, versions())
+	assert.Equal(t, []common.RangeTombstone{{Start: "b", End: "d", Seq: 5}}, sst.current.levels[1][0].tombstones)
+
+	value, err := sst.Get("b")
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+	value, err = sst.GetAt("b", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("b2"), value)
+}
+
+func TestCompact_SplitsRangeTombstonesBetweenOutputs(t *testing.T) {
+	sst := newStoppedSSTable(t, t.TempDir(), Level0CompactionTrigger(2), TargetFileSize(BlockSize/4),
+		Snapshots(func() []uint64 { return []uint64{15000} }))
+	defer sst.Close()
+
+	// 快照 15000 能看到被删除范围内的大部分版本，它们与范围墓碑一起保留在多个输出段中
+	chunks := make([]common.Chunk, 0, 20000)
+	for i := 0; i < 20000; i++ {
+		chunks = append(chunks, common.Chunk{
+			Key:   fmt.Sprintf("key%05d", i),
+			Value: []byte(fmt.Sprintf("value%d", i)),
+			Seq:   uint64(i + 2),
+		})
+	}
+	assert.NoError(t, sst.Write(&MockScanner{data: chunks}))
+	assert.NoError(t, sst.Write(&MockScanner{
+		tombstones: []common.RangeTombstone{{Start: "key04000", End: "key16000", Seq: 30000}},
+	}))
+
+	done, err := sst.compact()
+	assert.NoError(t, err)
+	assert.True(t, done)
+	outputs := sst.current.levels[1]
+	assert.Greater(t, len(outputs), 2)
+	for i := 1; i < len(outputs); i++ {
+		assert.Less(t, outputs[i-1].maxKey(), outputs[i].minKey())
+	}
+	withTombstones := 0
+	for _, seg := range outputs {
+		if len(seg.tombstones) > 0 {
+			withTombstones++
+		}
+		for _, tombstone := range seg.tombstones {
+			assert.GreaterOrEqual(t, tombstone.Start, seg.minKey())
+			assert.LessOrEqual(t, rangeTombstoneMax(tombstone.End), seg.maxKey())
+		}
+	}
+
+	assert.Greater(t, withTombstones, 1)
+
+	for key, expected := range map[string][]byte{
+		"key03999": []byte("value3999"),
+		"key04000": nil,
+		"key10000": nil,
+		"key15999": nil,
+		"key16000": []byte("value16000"),
+	} {
+		value, err := sst.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, value, key)
+	}
+	value, err := sst.GetAt("key10000", 15000)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value10000"), value)
+}
+
+func TestCompact_ResolvesMergeOperands(t *testing.T) {
+	snapshots := []uint64{3}
+	sst := newStoppedSSTable(t, t.TempDir(), Level0CompactionTrigger(2), MergeOperator(common.Int64Add{}),
+		Snapshots(func() []uint64 { return snapshots }))
+	defer sst.Close()
+
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{
+		{Key: "a", Value: []byte("10"), Seq: 1},
+		{Key: "b", Value: []byte("2"), Merge: true, Seq: 2},
+		{Key: "c", Value: []byte("1"), Seq: 3},
+		{Key: "f", Value: []byte("100"), Seq: 1},
+	}, tombstones: []common.RangeTombstone{{Start: "f", End: "g", Seq: 2}}}))
+	// 刷盘时同一 stripe 中没有作用对象的操作数合并为一个
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{
+		{Key: "a", Value: []byte("1"), Merge: true, Seq: 5},
+		{Key: "a", Value: []byte("5"), Merge: true, Seq: 4},
+		{Key: "b", Value: []byte("3"), Merge: true, Seq: 6},
+		{Key: "c", Value: []byte("7"), Merge: true, Seq: 7},
+		{Key: "f", Value: []byte("4"), Merge: true, Seq: 4},
+	}}))
+
+	versions := func() []string {
+		versions := make([]string, 0)
+		it := sst.current.levels[1][0].newIterator()
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			chunk := it.Chunk()
+			kind := "="
+			if chunk.Merge {
+				kind = "+"
+			}
+			versions = append(versions, fmt.Sprintf("%s@%d%s%s", chunk.Key, chunk.Seq, kind, chunk.Value))
+		}
+		return versions
+	}
+
+	// 快照 3 隔开的操作数保持独立；更深的层中没有 b，它最旧的操作数直接作用于空值
+	done, err := sst.compact()
+	assert.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, []string{"a@5+6", "a@1=10", "b@6+3", "b@2=2", "c@7+7", "c@3=1", "f@4+4"}, versions())
+
+	// 快照释放后，操作数与它们作用的版本合并
+	snapshots = nil
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{{Key: "d", Value: []byte("8"), Seq: 8}}}))
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{{Key: "e", Value: []byte("9"), Seq: 9}}}))
+	done, err = sst.compact()
+	assert.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, []string{"a@5=16", "b@6=5", "c@7=8", "d@8=8", "e@9=9", "f@4=4"}, versions())
+}
@@ -5,13 +5,17 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
 
+	"github.com/Jasonbourne723/platodb/internal/database/cache"
 	"github.com/Jasonbourne723/platodb/internal/database/common"
 )
 
@@ -21,32 +25,72 @@ const (
 	SegSuffix    = ".seg"
 	SpSuffix     = ".sp"
 	TmpSuffix    = ".tmp"
+	FilterSuffix = ".bf"
 )
 
+// Segment formats. Legacy segments hold records of the legacy format in blocks padded to BlockSize,
+// so block i starts at i*BlockSize, and their snapshot file only lists the key range of every block.
+// V2 segments hold records of the current format in blocks written back to back, and their snapshot file
+// starts with snapshotMagicV2 and also records the offset and the size of every block.
+// V3 segments are laid out like V2 segments, but every block may be compressed and is followed by a trailer
+// holding its codec and a CRC; their snapshot file starts with snapshotMagicV3.
+// V4 segments are laid out like V3 segments, but their blocks hold prefix-compressed entries followed by
+// restart points instead of records; their snapshot file starts with snapshotMagicV4.
+// V5 segments hold blocks like V4 segments, followed by their index, filter and properties in the same file,
+// which ends with a footer locating them (see footer.go): they have neither snapshot nor filter file.
+// Current segments are laid out like V5 segments, but also hold the range tombstones written to them.
+// A V5 or current segment is written under a temporary name and only takes its own once finished.
+// A record or an entry larger than BlockSize is written alone in an overflow block, the only kind of block that holds more
+// than BlockSize bytes of records.
+const (
+	segmentFormatLegacy = iota
+	segmentFormatV2
+	segmentFormatV3
+	segmentFormatV4
+	segmentFormatV5
+	segmentFormatV6
+)
+
+const (
+	snapshotMagicV2 = "PSP2"
+	snapshotMagicV3 = "PSP3"
+	snapshotMagicV4 = "PSP4"
+)
+
+var ErrSnapshotCorrupted = errors.New("segment snapshot corrupted")
+
 type snapshotBlock struct {
-	min string
-	max string
+	min    string
+	max    string
+	offset int64
+	size   int64
 }
 
 type segment struct {
-	id        int64
-	file      *os.File
-	filePath  string
-	closed    int32
-	blocks    []block
-	snapshots []snapshotBlock
-	size      int64
-	utils     *common.Utils
-	scanPos   scanPos
-}
-
-type scanPos struct {
-	blockPos int
-	chunkPos int
+	id          int64
+	file        *os.File
+	filePath    string
+	closed      int32
+	refs        int32
+	blocks      []block
+	snapshots   []snapshotBlock
+	size        int64
+	format      int
+	filter      *bloomFilter
+	keyHashes   []uint64
+	writing     bool
+	properties  segmentProperties
+	tombstones  []common.RangeTombstone
+	rangeDels   *common.RangeDeletions
+	smallest    string
+	largest     string
+	compression Compression
+	cache       *cache.Cache
+	cacheId     uint64
 }
 
 // newSegment creates a new segment with the specified root directory and ID.
-// It opens a file for the segment, initializes block and snapshot slices, and returns a pointer to the segment.
+// It opens a temporary file for the segment, initializes block and snapshot slices, and returns a pointer to the segment.
 // If there's an error opening the file, it returns an error.
 // Parameters:
 //   - root: The directory where the segment file will be stored.
@@ -59,45 +103,22 @@ func newSegment(root string, id int64) (*segment, error) {
 	name := fmt.Sprintf("%06d%s", id, SegSuffix)
 	filePath := path.Join(root, name)
 
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_APPEND|os.O_CREATE, FileModePerm)
-	if err != nil {
-		return nil, fmt.Errorf("segment文件打开失败:%w", err)
-	}
-	return &segment{
-		id:        id,
-		file:      file,
-		filePath:  filePath,
-		blocks:    make([]block, 0, 50),
-		snapshots: make([]snapshotBlock, 0, 50),
-		utils:     common.NewUtils(),
-	}, nil
-}
-
-func newTmpSegment(root string, id int64) (*segment, error) {
-
-	name := fmt.Sprintf("%06d%s%s", id, SegSuffix, TmpSuffix)
-	filePath := path.Join(root, name)
-
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_APPEND|os.O_CREATE, FileModePerm)
+	file, err := os.OpenFile(filePath+TmpSuffix, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC, FileModePerm)
 	if err != nil {
 		return nil, fmt.Errorf("segment文件打开失败:%w", err)
 	}
 	return &segment{
-		id:        id,
-		file:      file,
-		filePath:  filePath,
-		blocks:    make([]block, 0, 50),
-		snapshots: make([]snapshotBlock, 0, 50),
-		utils:     common.NewUtils(),
+		id:          id,
+		file:        file,
+		filePath:    filePath,
+		blocks:      make([]block, 0, 50),
+		snapshots:   make([]snapshotBlock, 0, 50),
+		format:      segmentFormatV6,
+		compression: DefaultCompression,
+		writing:     true,
 	}, nil
 }
 
-func (s *segment) turnToNormal() {
-	newFilePath := s.filePath[len(s.filePath)-len(TmpSuffix)-1:]
-	os.Rename(s.filePath, newFilePath)
-	s.filePath = newFilePath
-}
-
 // loadSegment loads a segment from the given root directory and segment name.
 // It validates the file format, extracts segment ID, opens the file, and initializes blocks.
 // Returns a pointer to the segment and an error if any occurs during loading.
@@ -129,53 +150,149 @@ func loadSegment(root string, name string) (*segment, error) {
 	}
 	err = seg.initBlocks()
 	if err != nil {
+		file.Close()
 		return nil, err
 	}
-
 	return seg, nil
 }
 
+// useCache makes the segment keep the blocks it reads in c, under an id of its own.
+func (s *segment) useCache(c *cache.Cache) {
+	s.cache = c
+	s.cacheId = c.NewId()
+}
+
 // getSnapshotFilePath returns the file path for the snapshot file associated with the segment.
 // It constructs the path by removing the Segment suffix from the filePath and appending the Snapshot suffix.
 func (s *segment) getSnapshotFilePath() string {
 	return strings.TrimSuffix(s.filePath, SegSuffix) + SpSuffix
 }
 
+// getFilterFilePath returns the file path for the Bloom filter file stored next to the snapshot file.
+func (s *segment) getFilterFilePath() string {
+	return strings.TrimSuffix(s.filePath, SegSuffix) + FilterSuffix
+}
+
+// files returns the paths of the files the segment is stored in: its segment file, along with the snapshot and
+// filter files of a segment written before they were stored in the segment file.
+func (s *segment) files() []string {
+	files := []string{s.filePath}
+	for _, filePath := range []string{s.getSnapshotFilePath(), s.getFilterFilePath()} {
+		if _, err := os.Stat(filePath); err == nil {
+			files = append(files, filePath)
+		}
+	}
+	return files
+}
+
 // write encodes the provided chunk and adds it to the latest suitable block within the segment.
-// It returns an error if the encoded chunk exceeds the block size or if there's an issue with block retrieval or data addition.
+// A chunk whose entry may not fit in a block is written alone in an overflow block.
+// While the last block is being filled, the size of the segment counts its entries uncompressed.
+// It returns an error if there's an issue with data addition or with writing the previous block.
 func (s *segment) write(chunk *common.Chunk) error {
-	data, err := s.utils.Encode(chunk)
+	block, err := s.getLatestEnonghBlock(entrySizeBound(chunk))
 	if err != nil {
 		return err
 	}
+	s.keyHashes = append(s.keyHashes, bloomHash(chunk.Key))
+	if err := block.addChunk(chunk, block.encodeEntry(chunk)); err != nil {
+		return err
+	}
+	s.size = block.posBegin + block.size
+	s.properties.add(chunk)
+	return nil
+}
+
+// writeRangeTombstone adds a range tombstone to a segment being written. Tombstones are written by finish.
+func (s *segment) writeRangeTombstone(t common.RangeTombstone) {
+	s.tombstones = append(s.tombstones, t)
+	s.properties.addRangeTombstone(&t)
+}
+
+// minKey returns the smallest key stored in the segment or covered by one of its range tombstones.
+// It must only be called on a finished or loaded segment holding at least one chunk or range tombstone.
+func (s *segment) minKey() string {
+	return s.smallest
+}
+
+// maxKey returns the largest key stored in the segment or covered by one of its range tombstones; as the end of
+// a range is excluded from it, the end of a range tombstone is usually taken as a bound that may not be reached.
+// It must only be called on a finished or loaded segment holding at least one chunk or range tombstone.
+func (s *segment) maxKey() string {
+	return s.largest
+}
 
-	l := int64(len(data))
+// initKeyRange computes the key range of the segment from its blocks and its range tombstones,
+// and indexes the range tombstones.
+func (s *segment) initKeyRange() {
+	first := true
+	extend := func(min, max string) {
+		if first || min < s.smallest {
+			s.smallest = min
+		}
+		if first || max > s.largest {
+			s.largest = max
+		}
+		first = false
+	}
+	if len(s.snapshots) > 0 {
+		extend(s.snapshots[0].min, s.snapshots[len(s.snapshots)-1].max)
+	}
+	for _, t := range s.tombstones {
+		extend(t.Start, rangeTombstoneMax(t.End))
+	}
+	s.rangeDels = common.NewRangeDeletions(s.tombstones)
+}
 
-	if l > BlockSize {
-		return errors.New("too large")
+// rangeTombstoneMax returns the largest key a range tombstone ending at end may cover. An end made of a key followed
+// by a zero byte is the key right after it, which is then the largest key covered; any other end is taken as the bound,
+// as no key sorts right before it.
+func rangeTombstoneMax(end string) string {
+	if strings.HasSuffix(end, "\x00") {
+		return end[:len(end)-1]
 	}
+	return end
+}
 
-	block, err := s.getLatestEnonghBlock(l)
-	if err != nil {
-		return err
+// rangeTombstoneSeq returns the sequence number of the newest range tombstone of the segment covering key
+// that a read at seq can see, or 0 if there is none.
+func (s *segment) rangeTombstoneSeq(key string, seq uint64) uint64 {
+	if s.rangeDels == nil || s.rangeDels.Empty() {
+		return 0
 	}
-	return block.addChunk(chunk, data)
+	return s.rangeDels.Covering(key, seq)
 }
 
-// get searches for a chunk with the specified key within the segment's blocks.
-// It uses a binary search on the snapshots to find the potential block containing the key.
-// If the key is found, the corresponding chunk and nil error are returned.
-// If the key is not found or an error occurs, nil and the respective error are returned.
-// If there are no snapshots, it implies no data, hence immediately returns nil, nil.
+// overlaps reports whether the key range of the segment intersects [min, max].
+func (s *segment) overlaps(min, max string) bool {
+	return s.maxKey() >= min && s.minKey() <= max
+}
+
+// get returns the newest version of the specified key within the segment's blocks, or nil if the segment does not hold the key.
 func (s *segment) get(key string) (chunk *common.Chunk, err error) {
+	return s.getAt(key, common.MaxSeq)
+}
+
+// getAt returns the newest version of key whose sequence number is not greater than seq.
+// The versions of a key are stored next to each other, newest first, and may span several blocks:
+// a binary search on the snapshots finds the first block that can hold the key, then the following blocks
+// are searched as long as their range still starts at or before the key.
+// If there are no snapshots, it implies no data, hence immediately returns nil, nil.
+func (s *segment) getAt(key string, seq uint64) (*common.Chunk, error) {
 
 	if len(s.snapshots) == 0 {
 		return nil, nil
 	}
 
-	pos, ok := s.middleSearch(key, 0, int64(len(s.snapshots)-1))
-	if ok {
-		chunk, err := s.blocks[pos].get(key)
+	if s.filter != nil && !s.filter.mayContain(key) {
+		return nil, nil
+	}
+
+	start := sort.Search(len(s.snapshots), func(i int) bool {
+		return s.snapshots[i].max >= key
+	})
+	for i := start; i < len(s.snapshots) && s.snapshots[i].min <= key; i++ {
+		chunk, err := s.blocks[i].getAt(key, seq)
 		if err != nil || chunk != nil {
 			return chunk, err
 		}
@@ -183,134 +300,305 @@ func (s *segment) get(key string) (chunk *common.Chunk, err error) {
 	return nil, nil
 }
 
-// middleSearch performs a binary search within the segment to find the position of a given key.
-// It returns the position and a boolean indicating whether the key was found.
-// If the key is not found, position returned is -1.
-// The search is conducted recursively between posBegin and posEnd indices of the snapshots slice.
-func (s *segment) middleSearch(key string, posBegin int64, posEnd int64) (pos int64, ok bool) {
+// loadFooter reads the footer ending the file of a V5 or current segment, then its index, Bloom filter, properties
+// and range tombstones.
+// It reports false, without error, if the file has no footer: the segment is then of an older format.
+func (s *segment) loadFooter() (bool, error) {
+	tailSize := int64(maxFooterSize)
+	if s.size < tailSize {
+		tailSize = s.size
+	}
+	tail := make([]byte, tailSize)
+	if _, err := s.file.ReadAt(tail, s.size-tailSize); err != nil {
+		return false, err
+	}
+	if !hasFooter(tail) {
+		return false, nil
+	}
+	f, err := decodeFooter(tail, s.size)
+	if err != nil {
+		return true, err
+	}
+	s.format = int(f.format)
+
+	data, err := s.readMetaBlock(f.properties)
+	if err != nil {
+		return true, err
+	}
+	properties, err := decodeProperties(data)
+	if err != nil {
+		return true, err
+	}
+	s.properties = *properties
 
-	if key < s.snapshots[posBegin].min || key > s.snapshots[posEnd].max {
-		return -1, false
+	if data, err = s.readMetaBlock(f.index); err != nil {
+		return true, err
 	}
-	if key >= s.snapshots[posBegin].min && key <= s.snapshots[posBegin].max {
-		return posBegin, true
+	if s.snapshots, err = decodeIndex(data); err != nil {
+		return true, err
+	}
+	for _, snapshot := range s.snapshots {
+		if snapshot.offset+snapshot.size > int64(s.properties.dataSize) || int64(s.properties.dataSize) > f.index.offset {
+			return true, ErrSnapshotCorrupted
+		}
 	}
-	if key >= s.snapshots[posEnd].min && key <= s.snapshots[posEnd].max {
-		return posEnd, true
+
+	if s.format >= segmentFormatV6 {
+		if data, err = s.readMetaBlock(f.rangeDel); err != nil {
+			return true, err
+		}
+		if s.tombstones, err = decodeRangeTombstones(data); err != nil {
+			return true, err
+		}
 	}
-	if posEnd == posBegin || posEnd == posBegin+1 {
-		return -1, false
+
+	// 布隆过滤器只用于加速查询，损坏时退化为逐块查找
+	if data, err = s.readMetaBlock(f.filter); err == nil {
+		if filter, err := decodeBloomFilter(data); err == nil {
+			s.filter = filter
+		}
 	}
-	posMiddle := (posBegin + posEnd) / 2
-	if key >= s.snapshots[posMiddle].min && key <= s.snapshots[posMiddle].max {
-		return posMiddle, true
+	return true, nil
+}
+
+// readMetaBlock reads the block located by h and returns its content, checked against its trailer and decompressed.
+func (s *segment) readMetaBlock(h blockHandle) ([]byte, error) {
+	buf := make([]byte, h.size)
+	if _, err := s.file.ReadAt(buf, h.offset); err != nil {
+		return nil, err
 	}
-	if key < s.snapshots[posMiddle].min {
-		return s.middleSearch(key, posBegin, posMiddle)
+	data, err := decodeBlock(buf)
+	if err != nil {
+		return nil, fmt.Errorf("segment %d block at %d: %w", s.id, h.offset, err)
 	}
-	return s.middleSearch(key, posMiddle, posEnd)
+	return data, nil
 }
 
-// loadSnapshot reads snapshot data from a file and populates the segment's snapshots slice with the parsed key ranges.
-// It opens the snapshot file in read-only mode, iterates through the file to decode and construct snapshotBlock structs,
-// and appends them to the segment's snapshots. The process stops when the end of the file is reached.
-// An error is returned if there are issues reading the file.
+// loadSnapshot reads the snapshot file of a segment of an older format and populates the segment's snapshots slice
+// with the parsed key ranges, then loads its Bloom filter file.
+// A snapshot file starting with snapshotMagicV2, snapshotMagicV3 or snapshotMagicV4 belongs to a V2, a V3 or a V4
+// segment and also holds the position of every block, protected by a trailing CRC; any other snapshot file belongs to
+// a legacy segment.
+// An error is returned if there are issues reading the file or if it is corrupted.
 func (s *segment) loadSnapshot() error {
 
-	spFilePath := s.getSnapshotFilePath()
-	f, err := os.OpenFile(spFilePath, os.O_RDONLY, 0644)
+	data, err := os.ReadFile(s.getSnapshotFilePath())
+	if err != nil {
+		return err
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte(snapshotMagicV4)):
+		s.format = segmentFormatV4
+	case bytes.HasPrefix(data, []byte(snapshotMagicV3)):
+		s.format = segmentFormatV3
+	case bytes.HasPrefix(data, []byte(snapshotMagicV2)):
+		s.format = segmentFormatV2
+	default:
+		s.format = segmentFormatLegacy
+		err = s.decodeLegacySnapshot(data)
+	}
+	if s.format != segmentFormatLegacy {
+		if len(data) < len(snapshotMagicV4)+4 {
+			return ErrSnapshotCorrupted
+		}
+		body, crc := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+		if crc32.ChecksumIEEE(body) != crc {
+			return ErrSnapshotCorrupted
+		}
+		s.snapshots, err = decodeIndex(body[len(snapshotMagicV4):])
+	}
 	if err != nil {
 		return err
 	}
 
-	for {
+	// 布隆过滤器只用于加速查询，缺失或损坏时退化为逐块查找
+	if filter, err := readBloomFilter(s.getFilterFilePath()); err == nil {
+		s.filter = filter
+	}
+	return nil
+}
+
+// decodeIndex parses the position and the key range of every block, as recorded by the index block of a current
+// segment or the snapshot file of a V2 to V4 segment: each block is
+// uvarint offset | uvarint size | uvarint minKeyLen | minKey | uvarint maxKeyLen | maxKey.
+func decodeIndex(data []byte) ([]snapshotBlock, error) {
+	snapshots := make([]snapshotBlock, 0, 50)
+	reader := bytes.NewReader(data)
+	for reader.Len() > 0 {
+		offset, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, ErrSnapshotCorrupted
+		}
+		size, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, ErrSnapshotCorrupted
+		}
+		minKey, err := readSnapshotKey(reader)
+		if err != nil {
+			return nil, err
+		}
+		maxKey, err := readSnapshotKey(reader)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshotBlock{
+			min:    minKey,
+			max:    maxKey,
+			offset: int64(offset),
+			size:   int64(size),
+		})
+	}
+	return snapshots, nil
+}
+
+// appendIndex appends the entry of a block to an index, as parsed by decodeIndex.
+func appendIndex(dst []byte, snapshot snapshotBlock) []byte {
+	dst = binary.AppendUvarint(dst, uint64(snapshot.offset))
+	dst = binary.AppendUvarint(dst, uint64(snapshot.size))
+	dst = binary.AppendUvarint(dst, uint64(len(snapshot.min)))
+	dst = append(dst, snapshot.min...)
+	dst = binary.AppendUvarint(dst, uint64(len(snapshot.max)))
+	return append(dst, snapshot.max...)
+}
+
+// readSnapshotKey reads a key prefixed with its uvarint length from an index.
+func readSnapshotKey(reader *bytes.Reader) (string, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil || length > uint64(reader.Len()) {
+		return "", ErrSnapshotCorrupted
+	}
+	key := make([]byte, length)
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return "", ErrSnapshotCorrupted
+	}
+	return string(key), nil
+}
+
+// decodeLegacySnapshot parses the snapshot file of a legacy segment: the key range of every block,
+// each key prefixed with its length as a 4-byte big-endian integer.
+func (s *segment) decodeLegacySnapshot(data []byte) error {
+
+	reader := bytes.NewReader(data)
+	for i := int64(0); reader.Len() > 0; i++ {
 		minKeyLen := make([]byte, 4)
-		if _, err := io.ReadFull(f, minKeyLen); err != nil {
-			if err == io.EOF {
-				break
-			}
+		if _, err := io.ReadFull(reader, minKeyLen); err != nil {
 			return err
 		}
-		minKeyLenUint32 := binary.BigEndian.Uint32(minKeyLen)
-		minKeyBuf := make([]byte, minKeyLenUint32)
-		if _, err := io.ReadFull(f, minKeyBuf); err != nil {
+		minKeyBuf := make([]byte, binary.BigEndian.Uint32(minKeyLen))
+		if _, err := io.ReadFull(reader, minKeyBuf); err != nil {
 			return err
 		}
-		minKey := string(minKeyBuf)
 
 		maxKeyLen := make([]byte, 4)
-		if _, err := io.ReadFull(f, maxKeyLen); err != nil {
+		if _, err := io.ReadFull(reader, maxKeyLen); err != nil {
 			return err
 		}
-		maxKeyLenUint32 := binary.BigEndian.Uint32(maxKeyLen)
-		maxKeyBuf := make([]byte, maxKeyLenUint32)
-		if _, err := io.ReadFull(f, maxKeyBuf); err != nil {
+		maxKeyBuf := make([]byte, binary.BigEndian.Uint32(maxKeyLen))
+		if _, err := io.ReadFull(reader, maxKeyBuf); err != nil {
 			return err
 		}
-		maxKey := string(maxKeyBuf)
 
 		s.snapshots = append(s.snapshots, snapshotBlock{
-			minKey, maxKey,
+			min:    string(minKeyBuf),
+			max:    string(maxKeyBuf),
+			offset: i * BlockSize,
+			size:   BlockSize,
 		})
 	}
 	return nil
 }
 
-// generateSnapshot creates a snapshot file for the segment by serializing the minimum and maximum keys of each block.
-// It opens the snapshot file for writing, encodes the key length and keys into a buffer, writes the buffer content to the file,
-// and updates the segment's snapshots slice with the block boundaries. The method ensures the file is synced to disk before returning.
-// Returns an error if any I/O operation fails during the process.
-func (s *segment) generateSnapshot() error {
+// finish completes a freshly written segment: it writes its last block, then the index, the Bloom filter, the properties,
+// the range tombstones sorted by start and the footer, syncs the file and gives it its own name.
+// The chunks kept by the blocks while they were written are released: from then on they are read through the block cache.
+func (s *segment) finish(falsePositiveRate float64) error {
+	if last := len(s.blocks) - 1; last >= 0 && s.blocks[last].pending() {
+		if err := s.blocks[last].write(); err != nil {
+			return err
+		}
+		s.size = s.blocks[last].posBegin + s.blocks[last].size
+	}
 
-	spFilePath := s.getSnapshotFilePath()
-	f, err := os.OpenFile(spFilePath, os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
+	var index []byte
+	for i := range s.blocks {
+		b := &s.blocks[i]
+		snapshot := snapshotBlock{
+			min:    b.chunks[0].Key,
+			max:    b.chunks[len(b.chunks)-1].Key,
+			offset: b.posBegin,
+			size:   b.size,
+		}
+		index = appendIndex(index, snapshot)
+		s.snapshots = append(s.snapshots, snapshot)
+	}
+	s.filter = newBloomFilter(s.keyHashes, falsePositiveRate)
+	s.keyHashes = nil
+	s.properties.dataSize = uint64(s.size)
+	s.properties.numBlocks = uint64(len(s.blocks))
+	s.properties.compression = s.compression
+	sort.SliceStable(s.tombstones, func(i, j int) bool { return s.tombstones[i].Start < s.tombstones[j].Start })
+	s.initKeyRange()
+
+	f := footer{format: uint32(s.format)}
+	metas := []struct {
+		handle *blockHandle
+		codec  Compression
+		data   []byte
+	}{
+		{&f.index, s.compression, index},
+		{&f.filter, NoCompression, s.filter.encode()},
+		{&f.properties, NoCompression, s.properties.encode()},
+		{&f.rangeDel, NoCompression, encodeRangeTombstones(s.tombstones)},
+	}
+	buf := make([]byte, 0, len(index)+len(s.filter.bits)+256)
+	// 元数据块按页脚中句柄的顺序写入，V5 格式没有范围删除块
+	for _, meta := range metas[:len(f.handles())] {
+		stored := encodeStoredBlock(meta.codec, meta.data)
+		*meta.handle = blockHandle{offset: s.size + int64(len(buf)), size: int64(len(stored))}
+		buf = append(buf, stored...)
+	}
+	buf = append(buf, f.encode()...)
+	if _, err := s.file.Write(buf); err != nil {
 		return err
 	}
-	defer f.Close()
-
-	buf := &bytes.Buffer{}
+	s.size += int64(len(buf))
 	for i := range s.blocks {
-		chunks := s.blocks[i].chunks
-		firstChunk := chunks[0]
-		minKeyLen := make([]byte, 4)
-		binary.BigEndian.PutUint32(minKeyLen, uint32(len(firstChunk.Key)))
-		buf.Write(minKeyLen)
-		buf.Write([]byte(firstChunk.Key))
-
-		lastChunk := chunks[len(chunks)-1]
-		maxKeyLen := make([]byte, 4)
-		binary.BigEndian.PutUint32(maxKeyLen, uint32(len(lastChunk.Key)))
-		buf.Write(maxKeyLen)
-		buf.Write([]byte(lastChunk.Key))
-		s.snapshots = append(s.snapshots, snapshotBlock{
-			min: firstChunk.Key,
-			max: lastChunk.Key,
-		})
+		s.blocks[i].chunks = nil
+	}
+	if err := s.sync(); err != nil {
+		return err
 	}
 
-	_, err = f.Write(buf.Bytes())
-	if err != nil {
+	// 数据落盘后再改名，目录中的段文件总是完整的
+	if err := os.Rename(s.filePath+TmpSuffix, s.filePath); err != nil {
 		return err
 	}
-	return f.Sync()
+	s.writing = false
+	return common.SyncDir(path.Dir(s.filePath))
 }
 
 // initBlocks initializes the blocks for the segment based on loaded snapshots.
-// It first loads the snapshot data, then creates a slice of blocks accordingly.
-// Each block is associated with a segment and has a starting offset.
+// It first loads the footer or, for a segment of an older format, the snapshot file, then creates a slice of blocks accordingly.
+// Each block is associated with a segment and has the starting offset and size recorded by its snapshot.
 func (s *segment) initBlocks() error {
 
-	if err := s.loadSnapshot(); err != nil {
-		return err
+	ok, err := s.loadFooter()
+	if err != nil {
+		return fmt.Errorf("segment %d: %w", s.id, err)
+	}
+	if !ok {
+		if err := s.loadSnapshot(); err != nil {
+			return err
+		}
 	}
 
-	//blockCount := int(math.Ceil(float64(s.size) / float64(BLOCK_SIZE)))
 	s.blocks = make([]block, 0, len(s.snapshots))
-
-	for i := 0; i < len(s.snapshots); i++ {
-		s.blocks = append(s.blocks, newBlock(s, int64(i*BlockSize)))
+	for _, snapshot := range s.snapshots {
+		b := newBlock(s, snapshot.offset)
+		b.size = snapshot.size
+		s.blocks = append(s.blocks, b)
 	}
+	s.initKeyRange()
 	return nil
 }
 
@@ -321,6 +609,22 @@ func (s *segment) sync() error {
 	return s.file.Sync()
 }
 
+// ref adds a reference to the segment on behalf of a version listing it.
+func (s *segment) ref() {
+	atomic.AddInt32(&s.refs, 1)
+}
+
+// unref drops a reference to the segment. Once no version lists it, no reader can reach it any more:
+// the segment is closed and its files are deleted.
+func (s *segment) unref() {
+	if atomic.AddInt32(&s.refs, -1) > 0 {
+		return
+	}
+	if err := s.delete(); err != nil {
+		log.Println(fmt.Errorf("delete segment %d failed,%w", s.id, err))
+	}
+}
+
 // 关闭文件流
 func (s *segment) close() error {
 	if atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
@@ -329,58 +633,39 @@ func (s *segment) close() error {
 	return nil
 }
 
-// 删除文件
+// 删除文件，包括旧格式的快照和布隆过滤器文件，并从块缓存中移除该段的所有块；未完成的段只有临时文件
 func (s *segment) delete() error {
 	if atomic.LoadInt32(&s.closed) == 0 {
 		s.close()
 	}
+	if s.cache != nil {
+		for i := range s.blocks {
+			s.cache.Erase(cache.Key{Id: s.cacheId, Offset: s.blocks[i].posBegin})
+		}
+	}
+	if s.writing {
+		return os.Remove(s.filePath + TmpSuffix)
+	}
+	for _, filePath := range []string{s.getSnapshotFilePath(), s.getFilterFilePath()} {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return os.Remove(s.filePath)
 }
 
 // getLatestEnoughBlock returns the latest block in the segment that can accommodate a chunk of size l.
-// If no such block exists, a new block is appended to the segment.
-// The block is guaranteed to have enough space for the chunk.
-// It adjusts the block size by writing empty bytes if necessary.
+// If no such block exists, the latest block is complete: it is written to the file, and a new block is appended
+// to the segment, starting right after it. A chunk larger than BlockSize always gets a new block of its own.
 func (s *segment) getLatestEnonghBlock(l int64) (*block, error) {
 	length := len(s.blocks)
 	if length == 0 {
 		s.blocks = append(s.blocks, newBlock(s, 0))
-	} else if !s.blocks[length-1].enough(l) {
-		_, err := s.file.Write(make([]byte, BlockSize-s.blocks[length-1].size))
-		if err != nil {
+	} else if last := &s.blocks[length-1]; !last.enough(l) {
+		if err := last.write(); err != nil {
 			return nil, err
 		}
-		s.blocks = append(s.blocks, newBlock(s, int64(length*BlockSize)))
+		s.blocks = append(s.blocks, newBlock(s, last.posBegin+last.size))
 	}
 	return &s.blocks[len(s.blocks)-1], nil
 }
-
-func (s *segment) newscanner() {
-	s.scanPos = scanPos{
-		blockPos: 0,
-		chunkPos: -1,
-	}
-}
-
-func (s *segment) scan() bool {
-
-	for {
-		if s.scanPos.blockPos >= len(s.blocks) {
-			return false
-		}
-		if len(s.blocks[s.scanPos.blockPos].chunks) == 0 {
-			s.blocks[s.scanPos.blockPos].loadDataFromDisk()
-		}
-		if s.scanPos.chunkPos == len(s.blocks[s.scanPos.blockPos].chunks)-1 {
-			s.scanPos.blockPos++
-			s.scanPos.chunkPos = -1
-		} else {
-			s.scanPos.chunkPos++
-			return true
-		}
-	}
-}
-
-func (s *segment) scanValue() *common.Chunk {
-	return &s.blocks[s.scanPos.blockPos].chunks[s.scanPos.chunkPos]
-}
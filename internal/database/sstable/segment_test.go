@@ -1,8 +1,14 @@
 package sstable
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
 	"path"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/Jasonbourne723/platodb/internal/database/common"
@@ -127,3 +133,421 @@ func TestLoadSegment(t *testing.T) {
 	assert.NoError(t, err, "Failed to load segment")
 	assert.Equal(t, segment.id, loadedSegment.id, "Loaded segment ID should match")
 }
+
+func TestSegment_LargeRecords(t *testing.T) {
+	tempDir := t.TempDir()
+	seg, err := newSegment(tempDir, 1)
+	assert.NoError(t, err)
+
+	longKey := "b" + strings.Repeat("k", 300)
+	chunks := []common.Chunk{
+		{Key: "a", Value: []byte("small")},
+		{Key: longKey, Value: bytes.Repeat([]byte("v"), 70*common.KB)},
+		{Key: "c", Value: bytes.Repeat([]byte("w"), 3*BlockSize)},
+		{Key: "d", Value: []byte("small")},
+	}
+	for i := range chunks {
+		assert.NoError(t, seg.write(&chunks[i]))
+	}
+	assert.NoError(t, seg.finish(DefaultFalsePositiveRate))
+	assert.NoError(t, seg.close())
+
+	loaded, err := loadSegment(tempDir, "000001.seg")
+	assert.NoError(t, err)
+	defer loaded.close()
+	for _, chunk := range chunks {
+		found, err := loaded.get(chunk.Key)
+		assert.NoError(t, err)
+		if assert.NotNil(t, found) {
+			assert.Equal(t, chunk.Value, found.Value)
+		}
+	}
+
+	iter := loaded.newIterator()
+	keys := make([]string, 0, len(chunks))
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Chunk().Key)
+	}
+	assert.NoError(t, iter.Error())
+	assert.Equal(t, []string{"a", longKey, "c", "d"}, keys)
+}
+
+// encodeLegacyChunk encodes a chunk the way segments and WAL files were written before the record format was versioned.
+func encodeLegacyChunk(chunk *common.Chunk) []byte {
+	buf := []byte{0}
+	if chunk.Deleted {
+		buf[0] = 1
+	}
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(append([]byte(chunk.Key), chunk.Value...)))
+	buf = append(buf, byte(len(chunk.Key)))
+	buf = append(buf, chunk.Key...)
+	if !chunk.Deleted {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(chunk.Value)))
+		buf = append(buf, chunk.Value...)
+	}
+	return buf
+}
+
+// writeLegacySegment writes the blocks of chunks as segment 1 of dir in the legacy format: every block but the last
+// is padded with zeros up to BlockSize, and the snapshot file only records the key range of every block.
+func writeLegacySegment(t *testing.T, dir string, blocks [][]common.Chunk) {
+	var data, snapshot []byte
+	for i, chunks := range blocks {
+		if i > 0 {
+			data = append(data, make([]byte, BlockSize-len(data)%BlockSize)...)
+		}
+		for j := range chunks {
+			data = append(data, encodeLegacyChunk(&chunks[j])...)
+		}
+		for _, key := range []string{chunks[0].Key, chunks[len(chunks)-1].Key} {
+			snapshot = binary.BigEndian.AppendUint32(snapshot, uint32(len(key)))
+			snapshot = append(snapshot, key...)
+		}
+	}
+	assert.NoError(t, os.WriteFile(path.Join(dir, "000001"+SegSuffix), data, FileModePerm))
+	assert.NoError(t, os.WriteFile(path.Join(dir, "000001"+SpSuffix), snapshot, FileModePerm))
+}
+
+func TestSegment_LoadLegacyFormat(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// 旧格式：每个块补零填满 BlockSize，快照文件只记录每个块的键范围
+	writeLegacySegment(t, tempDir, [][]common.Chunk{
+		{{Key: "a", Value: []byte("1")}, {Key: "b", Deleted: true}},
+		{{Key: "c", Value: bytes.Repeat([]byte("x"), 1000)}},
+	})
+
+	seg, err := loadSegment(tempDir, "000001"+SegSuffix)
+	assert.NoError(t, err)
+	defer seg.close()
+	assert.Len(t, seg.blocks, 2)
+
+	chunk, err := seg.get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), chunk.Value)
+	chunk, err = seg.get("b")
+	assert.NoError(t, err)
+	assert.True(t, chunk.Deleted)
+	chunk, err = seg.get("c")
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("x"), 1000), chunk.Value)
+}
+
+func TestSegment_LoadLegacyEmptyKey(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// 空键与以零结尾的 value 不会被当作块末尾的填充
+	writeLegacySegment(t, tempDir, [][]common.Chunk{
+		{{Key: "", Value: []byte("empty")}, {Key: "a", Value: []byte{1, 0, 0}}, {Key: "b", Value: []byte("2")}},
+		{{Key: "c", Value: []byte("3")}},
+	})
+
+	seg, err := loadSegment(tempDir, "000001"+SegSuffix)
+	assert.NoError(t, err)
+	defer seg.close()
+	for key, value := range map[string][]byte{"": []byte("empty"), "a": {1, 0, 0}, "b": []byte("2"), "c": []byte("3")} {
+		chunk, err := seg.get(key)
+		assert.NoError(t, err, key)
+		if assert.NotNil(t, chunk, key) {
+			assert.Equal(t, value, chunk.Value, key)
+		}
+	}
+}
+
+func TestSegment_BlockCompression(t *testing.T) {
+	chunks := make([]common.Chunk, 0, 3000)
+	for i := 0; i < 3000; i++ {
+		chunks = append(chunks, common.Chunk{
+			Key:   fmt.Sprintf("key%05d", i),
+			Value: []byte(strings.Repeat("text-heavy value ", 8)),
+			Seq:   uint64(i + 1),
+		})
+	}
+	raw := int64(0)
+	for i := range chunks {
+		raw += int64(len(common.AppendChunk(nil, &chunks[i])))
+	}
+
+	for _, c := range []Compression{NoCompression, SnappyCompression, LZ4Compression, ZstdCompression} {
+		t.Run(c.String(), func(t *testing.T) {
+			tempDir := t.TempDir()
+			seg, err := newSegment(tempDir, 1)
+			assert.NoError(t, err)
+			seg.compression = c
+			for i := range chunks {
+				assert.NoError(t, seg.write(&chunks[i]))
+			}
+			assert.NoError(t, seg.finish(DefaultFalsePositiveRate))
+			assert.NoError(t, seg.close())
+
+			info, err := os.Stat(seg.filePath)
+			assert.NoError(t, err)
+			assert.Equal(t, info.Size(), seg.size)
+			// 即使不压缩，共享前缀的键也比完整记录更小
+			if c == NoCompression {
+				assert.Less(t, info.Size(), raw)
+			} else {
+				assert.Less(t, info.Size(), raw/2)
+			}
+
+			loaded, err := loadSegment(tempDir, "000001.seg")
+			assert.NoError(t, err)
+			defer loaded.close()
+			assert.Greater(t, len(loaded.blocks), 1)
+			for _, i := range []int{0, 1234, 2999} {
+				found, err := loaded.get(chunks[i].Key)
+				assert.NoError(t, err)
+				if assert.NotNil(t, found) {
+					assert.Equal(t, chunks[i].Value, found.Value)
+				}
+			}
+			count := 0
+			iter := loaded.newIterator()
+			for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+				count++
+			}
+			assert.NoError(t, iter.Error())
+			assert.Equal(t, len(chunks), count)
+		})
+	}
+}
+
+func TestSegment_CorruptedBlock(t *testing.T) {
+	tempDir := t.TempDir()
+	seg, err := newSegment(tempDir, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, seg.write(&common.Chunk{Key: "a", Value: bytes.Repeat([]byte("x"), 1000)}))
+	assert.NoError(t, seg.finish(DefaultFalsePositiveRate))
+	assert.NoError(t, seg.close())
+
+	data, err := os.ReadFile(seg.filePath)
+	assert.NoError(t, err)
+	data[seg.blocks[0].size/2] ^= 0xff
+	assert.NoError(t, os.WriteFile(seg.filePath, data, FileModePerm))
+
+	loaded, err := loadSegment(tempDir, "000001.seg")
+	assert.NoError(t, err)
+	defer loaded.close()
+	_, err = loaded.get("a")
+	assert.ErrorIs(t, err, ErrBlockCorrupted)
+}
+
+func TestSegment_LoadV2Format(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// V2 格式：块首尾相连且不压缩，没有块尾，快照文件以 PSP2 开头
+	blocks := [][]common.Chunk{
+		{{Key: "a", Value: []byte("1"), Seq: 1}, {Key: "b", Deleted: true, Seq: 2}},
+		{{Key: "c", Value: bytes.Repeat([]byte("x"), 1000), Seq: 3}},
+	}
+	var data []byte
+	snapshot := []byte(snapshotMagicV2)
+	for _, chunks := range blocks {
+		offset := len(data)
+		for j := range chunks {
+			data = common.AppendChunk(data, &chunks[j])
+		}
+		snapshot = binary.AppendUvarint(snapshot, uint64(offset))
+		snapshot = binary.AppendUvarint(snapshot, uint64(len(data)-offset))
+		for _, key := range []string{chunks[0].Key, chunks[len(chunks)-1].Key} {
+			snapshot = binary.AppendUvarint(snapshot, uint64(len(key)))
+			snapshot = append(snapshot, key...)
+		}
+	}
+	snapshot = binary.BigEndian.AppendUint32(snapshot, crc32.ChecksumIEEE(snapshot))
+	assert.NoError(t, os.WriteFile(path.Join(tempDir, "000001"+SegSuffix), data, FileModePerm))
+	assert.NoError(t, os.WriteFile(path.Join(tempDir, "000001"+SpSuffix), snapshot, FileModePerm))
+
+	seg, err := loadSegment(tempDir, "000001"+SegSuffix)
+	assert.NoError(t, err)
+	defer seg.close()
+	assert.Equal(t, segmentFormatV2, seg.format)
+
+	chunk, err := seg.get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), chunk.Value)
+	chunk, err = seg.get("b")
+	assert.NoError(t, err)
+	assert.True(t, chunk.Deleted)
+	chunk, err = seg.get("c")
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("x"), 1000), chunk.Value)
+}
+
+func TestSegment_LoadV3Format(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// V3 格式：块内是完整的记录，块尾记录压缩算法与 CRC，快照文件以 PSP3 开头
+	blocks := [][]common.Chunk{
+		{{Key: "a", Value: []byte("1"), Seq: 1}, {Key: "b", Deleted: true, Seq: 2}},
+		{{Key: "c", Value: bytes.Repeat([]byte("x"), 1000), Seq: 3}},
+	}
+	var data []byte
+	snapshot := []byte(snapshotMagicV3)
+	for _, chunks := range blocks {
+		var records []byte
+		for j := range chunks {
+			records = common.AppendChunk(records, &chunks[j])
+		}
+		codec, payload := compressBlock(SnappyCompression, records)
+		stored := append(payload, byte(codec))
+		stored = binary.BigEndian.AppendUint32(stored, crc32.ChecksumIEEE(stored))
+
+		snapshot = binary.AppendUvarint(snapshot, uint64(len(data)))
+		snapshot = binary.AppendUvarint(snapshot, uint64(len(stored)))
+		for _, key := range []string{chunks[0].Key, chunks[len(chunks)-1].Key} {
+			snapshot = binary.AppendUvarint(snapshot, uint64(len(key)))
+			snapshot = append(snapshot, key...)
+		}
+		data = append(data, stored...)
+	}
+	snapshot = binary.BigEndian.AppendUint32(snapshot, crc32.ChecksumIEEE(snapshot))
+	assert.NoError(t, os.WriteFile(path.Join(tempDir, "000001"+SegSuffix), data, FileModePerm))
+	assert.NoError(t, os.WriteFile(path.Join(tempDir, "000001"+SpSuffix), snapshot, FileModePerm))
+
+	seg, err := loadSegment(tempDir, "000001"+SegSuffix)
+	assert.NoError(t, err)
+	defer seg.close()
+	assert.Equal(t, segmentFormatV3, seg.format)
+
+	chunk, err := seg.get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), chunk.Value)
+	chunk, err = seg.get("b")
+	assert.NoError(t, err)
+	assert.True(t, chunk.Deleted)
+	chunk, err = seg.get("c")
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("x"), 1000), chunk.Value)
+
+	keys := make([]string, 0)
+	iter := seg.newIterator()
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Chunk().Key)
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+}
+
+func TestSegment_SingleFileWithFooter(t *testing.T) {
+	tempDir := t.TempDir()
+	seg, err := newSegment(tempDir, 1)
+	assert.NoError(t, err)
+	chunks := []common.Chunk{
+		{Key: "a", Value: []byte("1"), Seq: 4},
+		{Key: "b", Deleted: true, Seq: 7},
+		{Key: "c", Value: bytes.Repeat([]byte("x"), BlockSize), Seq: 2},
+	}
+	for i := range chunks {
+		assert.NoError(t, seg.write(&chunks[i]))
+	}
+
+	// 写完之前段只以临时文件存在
+	assert.NoFileExists(t, seg.filePath)
+	assert.FileExists(t, seg.filePath+TmpSuffix)
+	assert.NoError(t, seg.finish(DefaultFalsePositiveRate))
+	assert.NoError(t, seg.close())
+	files, err := os.ReadDir(tempDir)
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, "000001"+SegSuffix, files[0].Name())
+	}
+
+	loaded, err := loadSegment(tempDir, "000001.seg")
+	assert.NoError(t, err)
+	defer loaded.close()
+	assert.Equal(t, segmentFormatV6, loaded.format)
+	assert.NotNil(t, loaded.filter)
+	assert.Equal(t, seg.snapshots, loaded.snapshots)
+	assert.Equal(t, segmentProperties{
+		numEntries:   3,
+		numDeletions: 1,
+		minSeq:       2,
+		maxSeq:       7,
+		rawKeySize:   3,
+		rawValueSize: 1 + BlockSize,
+		dataSize:     uint64(seg.blocks[1].posBegin + seg.blocks[1].size),
+		numBlocks:    2,
+		compression:  DefaultCompression,
+	}, loaded.properties)
+	for _, chunk := range chunks {
+		found, err := loaded.get(chunk.Key)
+		assert.NoError(t, err)
+		assert.Equal(t, &chunk, found)
+	}
+}
+
+func TestSegment_CorruptedFooter(t *testing.T) {
+	tempDir := t.TempDir()
+	seg, err := newSegment(tempDir, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, seg.write(&common.Chunk{Key: "a", Value: []byte("1")}))
+	assert.NoError(t, seg.finish(DefaultFalsePositiveRate))
+	assert.NoError(t, seg.close())
+	data, err := os.ReadFile(seg.filePath)
+	assert.NoError(t, err)
+
+	corrupt := func(pos int) error {
+		corrupted := bytes.Clone(data)
+		corrupted[pos] ^= 0xff
+		assert.NoError(t, os.WriteFile(seg.filePath, corrupted, FileModePerm))
+		loaded, err := loadSegment(tempDir, "000001.seg")
+		if err == nil {
+			loaded.close()
+		}
+		return err
+	}
+	// 页脚中的块位置、页脚之前的索引块损坏都会导致加载失败
+	assert.ErrorIs(t, corrupt(len(data)-maxFooterSize), ErrFooterCorrupted)
+	assert.ErrorIs(t, corrupt(len(data)-maxFooterSize-1), ErrBlockCorrupted)
+
+	// 没有页脚的文件是未写完的段
+	assert.NoError(t, os.WriteFile(seg.filePath, data[:len(data)-maxFooterSize], FileModePerm))
+	_, err = loadSegment(tempDir, "000001.seg")
+	assert.Error(t, err)
+}
+
+func TestSegment_RangeTombstones(t *testing.T) {
+	tempDir := t.TempDir()
+	seg, err := newSegment(tempDir, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, seg.write(&common.Chunk{Key: "b", Value: []byte("1"), Seq: 1}))
+	seg.writeRangeTombstone(common.RangeTombstone{Start: "m", End: "p\x00", Seq: 5})
+	seg.writeRangeTombstone(common.RangeTombstone{Start: "a", End: "c", Seq: 3})
+	assert.NoError(t, seg.finish(DefaultFalsePositiveRate))
+	assert.NoError(t, seg.close())
+
+	loaded, err := loadSegment(tempDir, "000001.seg")
+	assert.NoError(t, err)
+	defer loaded.close()
+	assert.Equal(t, []common.RangeTombstone{{Start: "a", End: "c", Seq: 3}, {Start: "m", End: "p\x00", Seq: 5}}, loaded.tombstones)
+	assert.Equal(t, uint64(2), loaded.properties.numRangeDeletions)
+	assert.Equal(t, uint64(5), loaded.properties.maxSeq)
+
+	// 段的键范围包含范围墓碑覆盖的键
+	assert.Equal(t, "a", loaded.minKey())
+	assert.Equal(t, "p", loaded.maxKey())
+	assert.Equal(t, uint64(3), loaded.rangeTombstoneSeq("b", common.MaxSeq))
+	assert.Equal(t, uint64(0), loaded.rangeTombstoneSeq("b", 2))
+	assert.Equal(t, uint64(5), loaded.rangeTombstoneSeq("p", common.MaxSeq))
+	assert.Equal(t, uint64(0), loaded.rangeTombstoneSeq("p\x00", common.MaxSeq))
+	assert.Equal(t, uint64(0), loaded.rangeTombstoneSeq("c", common.MaxSeq))
+}
+
+func TestSegment_LoadV5Format(t *testing.T) {
+	tempDir := t.TempDir()
+	seg, err := newSegment(tempDir, 1)
+	assert.NoError(t, err)
+	seg.format = segmentFormatV5
+	assert.NoError(t, seg.write(&common.Chunk{Key: "a", Value: []byte("1"), Seq: 1}))
+	assert.NoError(t, seg.finish(DefaultFalsePositiveRate))
+	assert.NoError(t, seg.close())
+
+	loaded, err := loadSegment(tempDir, "000001.seg")
+	assert.NoError(t, err)
+	defer loaded.close()
+	assert.Equal(t, segmentFormatV5, loaded.format)
+	assert.Empty(t, loaded.tombstones)
+	chunk, err := loaded.get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), chunk.Value)
+}
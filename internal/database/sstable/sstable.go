@@ -2,26 +2,90 @@ package sstable
 
 import (
 	"context"
+	"fmt"
+	"log"
 	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Jasonbourne723/platodb/internal/database/cache"
 	"github.com/Jasonbourne723/platodb/internal/database/common"
+	"github.com/Jasonbourne723/platodb/internal/database/vlog"
 )
 
+const (
+	DefaultMaxLevels               = 7
+	DefaultLevel0CompactionTrigger = 4
+	DefaultLevelSizeRatio          = 10
+	DefaultTargetFileSize          = 8 * common.MB
+	DefaultBlockCacheSize          = 8 * common.MB
+)
+
+// SSTable keeps the segments on disk organised in levels.
+// Level 0 holds the segments flushed from memory tables, ordered from oldest to newest, and their key ranges may overlap.
+// From level 1 onward every level is sorted by key and its segments never overlap.
+// The layout is published as immutable versions: the lock only guards the switch to a new current version,
+// while readers work on the version they acquired.
 type SSTable struct {
-	Segments []*segment
-	Root     string
-	ctx      context.Context
+	current           *version
+	Root              string
+	ctx               context.Context
+	lock              *sync.RWMutex
+	lastSegmentId     int64
+	lastSequence      uint64
+	snapshots         func() []uint64
+	mergeOperator     common.MergeOperator
+	falsePositiveRate float64
+	maxLevels         int
+	level0Trigger     int
+	levelSizeRatio    int
+	targetFileSize    int64
+	compactPointers   []string
+	valueLog          *vlog.ValueLog
+	valueThreshold    int
+	blockCache        *cache.Cache
+	compression       Compression
+	manifest          *manifest
+	compactCh         chan struct{}
+	stop              chan struct{}
+	stopped           chan struct{}
+	closeOnce         sync.Once
 }
 
+// Options defines a function type that accepts a pointer to SSTable and modifies its configuration.
+type Options func(s *SSTable)
+
 // NewSSTable initializes a new SSTable instance with the given root directory.
-// It loads existing segments from the root directory and appends them to the SSTable.
+// It loads existing segments from the root directory into their levels and starts the background compaction.
 // Returns a pointer to the SSTable and an error if any occurs during initialization or loading.
-func NewSSTable(root string, ctx context.Context) (*SSTable, error) {
+func NewSSTable(root string, ctx context.Context, options ...Options) (*SSTable, error) {
 	sst := &SSTable{
-		Root:     root,
-		Segments: make([]*segment, 0, 10),
-		ctx:      ctx,
+		Root:              root,
+		ctx:               ctx,
+		lock:              &sync.RWMutex{},
+		falsePositiveRate: DefaultFalsePositiveRate,
+		maxLevels:         DefaultMaxLevels,
+		level0Trigger:     DefaultLevel0CompactionTrigger,
+		levelSizeRatio:    DefaultLevelSizeRatio,
+		targetFileSize:    DefaultTargetFileSize,
+		compression:       DefaultCompression,
+		compactCh:         make(chan struct{}, 1),
+		stop:              make(chan struct{}),
+		stopped:           make(chan struct{}),
+	}
+	for _, option := range options {
+		option(sst)
+	}
+	if sst.blockCache == nil {
+		sst.blockCache = cache.New(DefaultBlockCacheSize)
 	}
+	sst.compactPointers = make([]string, sst.maxLevels)
+
 	err := sst.load()
 	if err != nil {
 		return nil, err
@@ -30,90 +94,482 @@ func NewSSTable(root string, ctx context.Context) (*SSTable, error) {
 	return sst, nil
 }
 
-// load reads all segment files from the SSTable's root directory and adds them to the SSTable's Segments slice.
-// It ensures the root directory exists before attempting to read files.
-// Any error encountered during file reading or segment loading is returned.
+// FalsePositiveRate sets the target false positive rate of the Bloom filter built for every new segment.
+// Lower rates avoid more block reads for absent keys at the cost of larger segments.
+func FalsePositiveRate(rate float64) Options {
+	return func(s *SSTable) {
+		s.falsePositiveRate = rate
+	}
+}
+
+// MaxLevels sets the number of levels, level 0 included. Values below 2 are ignored.
+func MaxLevels(levels int) Options {
+	return func(s *SSTable) {
+		if levels >= 2 {
+			s.maxLevels = levels
+		}
+	}
+}
+
+// Level0CompactionTrigger sets how many segments level 0 may hold before they are compacted into level 1.
+// Non-positive values are ignored.
+func Level0CompactionTrigger(count int) Options {
+	return func(s *SSTable) {
+		if count > 0 {
+			s.level0Trigger = count
+		}
+	}
+}
+
+// LevelSizeRatio sets how many times larger each level may grow compared to the level above it.
+// Values below 2 are ignored.
+func LevelSizeRatio(ratio int) Options {
+	return func(s *SSTable) {
+		if ratio >= 2 {
+			s.levelSizeRatio = ratio
+		}
+	}
+}
+
+// TargetFileSize sets the size in bytes at which compaction starts a new output segment.
+// Non-positive values are ignored.
+func TargetFileSize(size int64) Options {
+	return func(s *SSTable) {
+		if size > 0 {
+			s.targetFileSize = size
+		}
+	}
+}
+
+// ValueLog separates the values larger than threshold bytes from the keys: they are appended to valueLog when a
+// segment is written from a memory table, and the segment only stores a pointer to them.
+// Compaction carries the pointers over without rewriting the values. With a non-positive threshold new values all
+// stay in the segments, while the pointers written earlier can still be read.
+func ValueLog(valueLog *vlog.ValueLog, threshold int) Options {
+	return func(s *SSTable) {
+		s.valueLog = valueLog
+		s.valueThreshold = threshold
+	}
+}
+
+// Snapshots sets the function compaction calls to learn the sequence numbers of the live snapshots, in ascending order.
+// Compaction keeps, for every snapshot, the newest version of each key that the snapshot can see.
+func Snapshots(snapshots func() []uint64) Options {
+	return func(s *SSTable) {
+		s.snapshots = snapshots
+	}
+}
+
+// MergeOperator sets the operator that combines the merge operands of a key when a memory table is flushed and
+// during compaction. Without it, operands are written as they are.
+func MergeOperator(operator common.MergeOperator) Options {
+	return func(s *SSTable) {
+		s.mergeOperator = operator
+	}
+}
+
+// BlockCache sets the cache the segments keep the blocks they read in, which may be shared with other SSTables.
+// Without this option every SSTable gets a cache of its own holding up to DefaultBlockCacheSize bytes.
+func BlockCache(c *cache.Cache) Options {
+	return func(s *SSTable) {
+		s.blockCache = c
+	}
+}
+
+// BlockCompression sets the codec the blocks of new segments are compressed with. Segments already written keep
+// their codec, recorded in every block, so changing it never prevents reading them.
+func BlockCompression(c Compression) Options {
+	return func(s *SSTable) {
+		s.compression = c
+	}
+}
+
+// BlockCacheStats returns the statistics of the block cache.
+func (s *SSTable) BlockCacheStats() cache.Stats {
+	return s.blockCache.Stats()
+}
+
+// load rebuilds the level layout from the manifest in the SSTable's root directory.
+// Every segment listed by the manifest must load successfully; a missing or unreadable live segment is an error.
+// Files that belong to no live segment, such as the outputs of a compaction interrupted before it was recorded
+// or the inputs of one interrupted before they were deleted, are removed along with leftover temporary files.
+// A directory without a manifest, written before the manifest existed, has all its segments adopted into level 0.
+// In every case a fresh manifest describing the recovered layout is written before returning.
 func (s *SSTable) load() error {
 	if err := common.EnsureDirExists(s.Root); err != nil {
 		return err
 	}
+	state, hasManifest, err := replayManifest(s.Root)
+	if err != nil {
+		return err
+	}
+	s.lastSegmentId = state.lastSegmentId
+	s.lastSequence = state.lastSequence
+	live := state.live
+
 	files, err := os.ReadDir(s.Root)
 	if err != nil {
 		return err
 	}
 	for _, file := range files {
 		name := file.Name()
-		seg, err := loadSegment(s.Root, name)
-		if err != nil {
+		id, ok := parseSegmentFileId(name)
+		if ok && id > s.lastSegmentId {
+			// 新分配的 id 必须大于目录中已有的所有 id，避免追加写入遗留文件
+			s.lastSegmentId = id
+		}
+		if !hasManifest {
 			continue
 		}
-		s.Segments = append(s.Segments, seg)
+		_, isLive := live[id]
+		if strings.HasSuffix(name, TmpSuffix) || (ok && !isLive) {
+			if err := os.Remove(path.Join(s.Root, name)); err != nil {
+				return err
+			}
+		}
 	}
-	return nil
+
+	levels := make([][]*segment, s.maxLevels)
+	if hasManifest {
+		for id, level := range live {
+			if level >= s.maxLevels {
+				return fmt.Errorf("segment %d is recorded at level %d, beyond the %d configured levels", id, level, s.maxLevels)
+			}
+			seg, err := s.openSegment(fmt.Sprintf("%06d%s", id, SegSuffix))
+			if err != nil {
+				return fmt.Errorf("live segment %d failed to load: %w", id, err)
+			}
+			levels[level] = append(levels[level], seg)
+		}
+	} else {
+		for _, file := range files {
+			name := file.Name()
+			if !strings.HasSuffix(name, SegSuffix) {
+				continue
+			}
+			seg, err := s.openSegment(name)
+			if err != nil {
+				log.Printf("segment %s failed to load and is left untouched: %v\n", name, err)
+				continue
+			}
+			levels[0] = append(levels[0], seg)
+		}
+	}
+	for level := range levels {
+		sortLevel(levels, level)
+	}
+	s.installVersion(levels)
+
+	s.manifest, err = createManifest(s.Root, s.snapshotEdit())
+	return err
 }
 
-// generateSegmentId returns the next segment ID for the SSTable by incrementing the ID of the last segment in the Segments slice.
-// If the slice is empty, it returns 1.
-func (s *SSTable) generateSegmentId() int64 {
-	if len(s.Segments) == 0 {
-		return 1
+// parseSegmentFileId extracts the segment id from the name of a segment, snapshot or filter file.
+func parseSegmentFileId(name string) (int64, bool) {
+	ext := path.Ext(name)
+	if ext != SegSuffix && ext != SpSuffix && ext != FilterSuffix {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(strings.TrimSuffix(name, ext), 10, 64)
+	if err != nil {
+		return 0, false
 	}
-	return s.Segments[len(s.Segments)-1].id + 1
+	return id, true
 }
 
-// Write reads data from the provided Scanner and writes it into a new segment within the SSTable.
-// It creates a new segment, iterates over the Scanner, writes each chunk, generates a snapshot for the segment,
-// appends the segment to the SSTable's segments, and syncs the segment to disk.
+// newSegmentId allocates a unique, monotonically increasing segment id.
+// Level 0 relies on the ordering: a segment with a greater id always holds newer data.
+func (s *SSTable) newSegmentId() int64 {
+	return atomic.AddInt64(&s.lastSegmentId, 1)
+}
+
+// createSegment creates a new segment with a fresh id, reading through the block cache.
+func (s *SSTable) createSegment() (*segment, error) {
+	seg, err := newSegment(s.Root, s.newSegmentId())
+	if err != nil {
+		return nil, err
+	}
+	seg.useCache(s.blockCache)
+	seg.compression = s.compression
+	return seg, nil
+}
+
+// openSegment loads the segment stored under name in the root directory, reading through the block cache.
+func (s *SSTable) openSegment(name string) (*segment, error) {
+	seg, err := loadSegment(s.Root, name)
+	if err != nil {
+		return nil, err
+	}
+	seg.useCache(s.blockCache)
+	return seg, nil
+}
+
+// sortLevel restores the ordering of a level of a layout: by id for level 0, by smallest key for the others.
+func sortLevel(levels [][]*segment, level int) {
+	segs := levels[level]
+	if level == 0 {
+		sort.Slice(segs, func(i, j int) bool { return segs[i].id < segs[j].id })
+		return
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].minKey() < segs[j].minKey() })
+}
+
+// Write reads data from the provided Scanner and writes it into a new level 0 segment within the SSTable.
+// It creates a new segment, iterates over the Scanner, writes each chunk, writes the index and Bloom filter
+// for the segment and syncs the segment to disk. The segment only joins level 0 once the manifest records it.
+// With a value log, values above the threshold are appended to it and the value log is synced before the segment
+// that points to them is finished.
+// The range tombstones of a common.RangeTombstoneScanner, such as a memory table, are written to the segment as well.
+// With a merge operator, the merge operands of a key that the same snapshots see are combined with the version they
+// apply to when the scanner holds it, and with each other otherwise.
+// An empty Scanner without range tombstones produces no segment.
 // Returns an error if any occurs during segment creation, writing, or syncing.
 func (s *SSTable) Write(scanner common.Scanner) error {
 
-	seg, err := newSegment(s.Root, s.generateSegmentId())
+	seg, err := s.createSegment()
 	if err != nil {
 		return err
 	}
 
+	var tombstones []common.RangeTombstone
+	if rs, ok := scanner.(common.RangeTombstoneScanner); ok {
+		tombstones = rs.RangeTombstones()
+	}
+	rangeDels := common.NewRangeDeletions(tombstones)
+	stripeOf := s.stripeFunc()
+	now := time.Now()
+
+	separated := false
+	var lastSequence uint64
+	write := func(chunk *common.Chunk) error {
+		if s.valueThreshold > 0 && s.valueLog != nil && !chunk.Deleted && !chunk.ValuePointer && !chunk.Merge && len(chunk.Value) > s.valueThreshold {
+			ptr, err := s.valueLog.Append(chunk.Key, chunk.Value)
+			if err != nil {
+				return err
+			}
+			// 不修改扫描器返回的 chunk，它可能仍被内存表引用
+			chunk = &common.Chunk{Key: chunk.Key, Value: ptr.Encode(), ValuePointer: true, Seq: chunk.Seq, ExpiresAt: chunk.ExpiresAt}
+			separated = true
+		}
+		return seg.write(chunk)
+	}
+	// 同一 stripe 中的合并操作数与它们作用的版本合并为一个版本写入
+	var pending *pendingMerge
+	writePending := func() error {
+		versions := pending.resolve(false, s.ResolveValue)
+		pending = nil
+		for i := range versions {
+			if err := write(&versions[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 	for scanner.Scan() {
 		chunk := scanner.ScanValue()
-		err := seg.write(chunk)
-		if err != nil {
+		if chunk.Seq > lastSequence {
+			lastSequence = chunk.Seq
+		}
+		stripe := stripeOf(chunk.Seq)
+		if pending != nil {
+			if pending.accepts(chunk, stripe) {
+				pending.add(chunk, now)
+				if pending.complete {
+					if err := writePending(); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := writePending(); err != nil {
+				return err
+			}
+		}
+		if chunk.Merge && s.mergeOperator != nil {
+			pending = newPendingMerge(s.mergeOperator, rangeDels, chunk, stripe)
+			continue
+		}
+		if err := write(chunk); err != nil {
 			return err
 		}
 	}
-	err = seg.generateSnapshot()
+	if pending != nil {
+		if err := writePending(); err != nil {
+			return err
+		}
+	}
+	for _, t := range tombstones {
+		if t.Seq > lastSequence {
+			lastSequence = t.Seq
+		}
+		seg.writeRangeTombstone(t)
+	}
+	if len(seg.blocks) == 0 && len(seg.tombstones) == 0 {
+		return seg.delete()
+	}
+	if separated {
+		if err := s.valueLog.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := seg.finish(s.falsePositiveRate); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	err = s.logEdit(&versionEdit{added: []manifestEntry{{level: 0, id: seg.id}}, lastSequence: lastSequence})
+	if err == nil {
+		levels := s.current.cloneLevels()
+		levels[0] = append(levels[0], seg)
+		s.installVersion(levels)
+	}
+	s.lock.Unlock()
 	if err != nil {
 		return err
 	}
-	s.Segments = append(s.Segments, seg)
-	return seg.sync()
+
+	s.maybeScheduleCompaction()
+	return nil
+}
+
+// stripeFunc returns the function mapping a sequence number to its stripe under the live snapshots: the stripe is
+// the index of the oldest snapshot that sees it, and the versions in the same stripe are seen by the same snapshots.
+// Without snapshots every version belongs to stripe 0.
+func (s *SSTable) stripeFunc() func(seq uint64) int {
+	var snapshots []uint64
+	if s.snapshots != nil {
+		snapshots = s.snapshots()
+	}
+	return func(seq uint64) int {
+		return sort.Search(len(snapshots), func(i int) bool { return snapshots[i] >= seq })
+	}
 }
 
 // Get retrieves the value associated with the given key from the SSTable.
-// It iterates through the segments in reverse order to find the latest value for the key.
-// If the key is found and not marked as deleted, it returns the corresponding value; otherwise, it returns nil.
+// If the key is found and neither marked as deleted nor expired, it returns the corresponding value, read from the value log
+// when the segment only holds a pointer to it; otherwise, it returns nil.
 // If an error occurs during the retrieval process, it is returned along with the nil value.
 func (s *SSTable) Get(key string) ([]byte, error) {
+	return s.GetAt(key, common.MaxSeq)
+}
+
+// GetAt is like Get but ignores the versions whose sequence number is greater than seq.
+func (s *SSTable) GetAt(key string, seq uint64) ([]byte, error) {
+	chunk, err := s.Lookup(key, seq)
+	if err != nil || chunk == nil || chunk.Deleted || chunk.Expired(time.Now()) {
+		return nil, err
+	}
+	return s.ResolveValue(chunk)
+}
+
+// Lookup returns the newest version of key stored in the segments whose sequence number is not greater than seq,
+// which may be a tombstone or hold a value pointer, or nil if no segment holds such a version.
+// A version deleted by a range tombstone that seq can see is returned as a tombstone with the sequence number of
+// the range tombstone.
+// The current version is held for the duration of the search.
+func (s *SSTable) Lookup(key string, seq uint64) (*common.Chunk, error) {
+	v := s.acquireVersion()
+	defer v.release()
+	return v.lookup(key, seq)
+}
+
+// LastSequence returns the greatest sequence number written to a segment, as recorded by the manifest.
+func (s *SSTable) LastSequence() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.lastSequence
+}
+
+// ResolveValue returns the value of a chunk read from the segments, following its pointer into the value log if it has one.
+func (s *SSTable) ResolveValue(chunk *common.Chunk) ([]byte, error) {
+	if !chunk.ValuePointer {
+		return chunk.Value, nil
+	}
+	if s.valueLog == nil {
+		return nil, fmt.Errorf("key %q points into the value log, which is not enabled", chunk.Key)
+	}
+	ptr, err := vlog.DecodePointer(chunk.Value)
+	if err != nil {
+		return nil, err
+	}
+	return s.valueLog.Read(ptr)
+}
 
-	//布隆过滤器，确认key是否存在
+// NewIterators returns one iterator per segment of the current version, ordered from the newest data to the oldest:
+// level 0 from its newest segment, then every deeper level in order, along with the range tombstones of those
+// segments, which the iterators do not apply.
+// The order matters to callers that merge the iterators and let the newest version of a key win.
+// The version is held until the returned release function is called, which must happen once the iterators are no
+// longer used; until then compaction cannot delete their segments.
+func (s *SSTable) NewIterators() ([]common.Iterator, []common.RangeTombstone, func()) {
+	v := s.acquireVersion()
 
-	for i := len(s.Segments) - 1; i >= 0; i-- {
-		chunk, err := s.Segments[i].get(key)
-		if err != nil {
-			return nil, err
+	iterators := make([]common.Iterator, 0, len(v.levels[0]))
+	var tombstones []common.RangeTombstone
+	for i := len(v.levels[0]) - 1; i >= 0; i-- {
+		iterators = append(iterators, v.levels[0][i].newIterator())
+		tombstones = append(tombstones, v.levels[0][i].tombstones...)
+	}
+	for level := 1; level < len(v.levels); level++ {
+		for _, seg := range v.levels[level] {
+			iterators = append(iterators, seg.newIterator())
+			tombstones = append(tombstones, seg.tombstones...)
 		}
-		if chunk != nil {
-			if chunk.Deleted {
-				return nil, nil
+	}
+	var once sync.Once
+	return iterators, tombstones, func() { once.Do(v.release) }
+}
+
+// Checkpoint writes a copy of the current version to dir, which must not hold an SSTable already: every live segment
+// is hard-linked into dir, or copied where it cannot be linked, and a manifest listing them at their levels is written
+// next to them, so that opening dir yields the SSTable as it is now.
+// The version is held meanwhile, so compaction may go on but cannot delete the segments being linked.
+func (s *SSTable) Checkpoint(dir string) error {
+	if err := common.EnsureDirExists(dir); err != nil {
+		return err
+	}
+	s.lock.RLock()
+	v := s.current
+	v.ref()
+	edit := s.snapshotEdit()
+	s.lock.RUnlock()
+	defer v.release()
+
+	for _, segs := range v.levels {
+		for _, seg := range segs {
+			for _, filePath := range seg.files() {
+				if err := common.LinkFile(filePath, path.Join(dir, path.Base(filePath))); err != nil {
+					return err
+				}
 			}
-			return chunk.Value, nil
 		}
 	}
-	return nil, nil
+	m, err := createManifest(dir, edit)
+	if err != nil {
+		return err
+	}
+	return m.close()
 }
 
-// Close shuts down all the segments in the SSTable by calling the close method on each one.
+// Close stops the background compaction, waiting for a running one to finish,
+// then shuts down all the segments of the current version by calling the close method on each one and closes the manifest.
+// The current version keeps its references, so that closing never deletes a live segment.
 func (s *SSTable) Close() {
 
-	for i := range s.Segments {
-		s.Segments[i].close()
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.stopped
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, segs := range s.current.levels {
+		for i := range segs {
+			segs[i].close()
+		}
+	}
+	if s.manifest != nil {
+		s.manifest.close()
+		s.manifest = nil
 	}
 }
@@ -6,14 +6,16 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/Jasonbourne723/platodb/internal/database/cache"
 	"github.com/Jasonbourne723/platodb/internal/database/common"
 	"github.com/stretchr/testify/assert"
 )
 
 // Mock Scanner 实现
 type MockScanner struct {
-	data     []common.Chunk
-	position int
+	data       []common.Chunk
+	tombstones []common.RangeTombstone
+	position   int
 }
 
 func (m *MockScanner) Scan() bool {
@@ -31,6 +33,10 @@ func (m *MockScanner) ScanValue() *common.Chunk {
 	return nil
 }
 
+func (m *MockScanner) RangeTombstones() []common.RangeTombstone {
+	return m.tombstones
+}
+
 func TestSSTable(t *testing.T) {
 	// Setup
 	tempDir := "D://platodb//"
@@ -84,7 +90,11 @@ func TestLoadSSTable(t *testing.T) {
 	segfiles, _ := filepath.Glob(path.Join("D://platodb", "*.seg"))
 
 	// Check that the segments are loaded
-	assert.Len(t, sstable.Segments, len(segfiles), "Should have 1 segment loaded")
+	loaded := 0
+	for _, segs := range sstable.current.levels {
+		loaded += len(segs)
+	}
+	assert.Equal(t, len(segfiles), loaded, "Should have 1 segment loaded")
 }
 
 func TestGenerateSegmentId(t *testing.T) {
@@ -94,12 +104,76 @@ func TestGenerateSegmentId(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Generate new segment ID
-	newID := sstable.generateSegmentId()
-	assert.Equal(t, sstable.Segments[len(sstable.Segments)-1].id+1, newID, "The first segment ID should be 1")
-
-	// Add a segment and generate again
-	segment := &segment{id: 1}
-	sstable.Segments = append(sstable.Segments, segment)
-	newID = sstable.generateSegmentId()
-	assert.Equal(t, int64(2), newID, "The second segment ID should be 2")
+	newID := sstable.newSegmentId()
+	assert.Greater(t, newID, int64(0), "Segment IDs should start at 1")
+
+	// Generate again
+	assert.Equal(t, newID+1, sstable.newSegmentId(), "Segment IDs should increase by 1")
+}
+
+func TestSSTable_BlockCache(t *testing.T) {
+	blockCache := cache.New(common.MB)
+	sst := newStoppedSSTable(t, t.TempDir(), BlockCache(blockCache), Level0CompactionTrigger(2))
+	defer sst.Close()
+
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{
+		{Key: "a", Value: []byte("1")},
+		{Key: "b", Value: []byte("2")},
+	}}))
+
+	// 第一次读取从磁盘加载块，之后命中缓存
+	for i := 0; i < 3; i++ {
+		value, err := sst.Get("a")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("1"), value)
+	}
+	stats := sst.BlockCacheStats()
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Positive(t, stats.Usage)
+
+	// 段文件被合并删除后，它的块也从缓存中移除
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{{Key: "c", Value: []byte("3")}}}))
+	done, err := sst.compact()
+	assert.NoError(t, err)
+	assert.True(t, done)
+	assert.Zero(t, sst.BlockCacheStats().Usage)
+
+	value, err := sst.Get("b")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), value)
+}
+
+func TestSSTable_Checkpoint(t *testing.T) {
+	sst := newStoppedSSTable(t, t.TempDir(), Level0CompactionTrigger(2))
+	defer sst.Close()
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{{Key: "a", Value: []byte("1"), Seq: 1}}}))
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{{Key: "b", Value: []byte("2"), Seq: 2}}}))
+	done, err := sst.compact()
+	assert.NoError(t, err)
+	assert.True(t, done)
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{{Key: "a", Value: []byte("3"), Seq: 3}}}))
+
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	assert.NoError(t, sst.Checkpoint(dir))
+
+	// 检查点之后的合并删除原目录中的段文件，不影响检查点
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{{Key: "c", Value: []byte("4"), Seq: 4}}}))
+	done, err = sst.compact()
+	assert.NoError(t, err)
+	assert.True(t, done)
+
+	copied := newStoppedSSTable(t, dir, Level0CompactionTrigger(2))
+	defer copied.Close()
+	assert.Len(t, copied.current.levels[0], 1)
+	assert.Len(t, copied.current.levels[1], 1)
+	assert.Equal(t, uint64(3), copied.LastSequence())
+	for key, expected := range map[string]string{"a": "3", "b": "2"} {
+		value, err := copied.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(expected), value)
+	}
+	value, err := copied.Get("c")
+	assert.NoError(t, err)
+	assert.Nil(t, value)
 }
@@ -0,0 +1,174 @@
+package sstable
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+// version is an immutable level layout of the SSTable. Readers acquire the current version and release it once done,
+// so that the segments they read are neither closed nor deleted under them; every change to the layout installs
+// a new version rather than modifying the current one.
+// A segment is referenced by every version listing it, and is closed and deleted once the last of them is released,
+// by which time the current version no longer lists it.
+type version struct {
+	levels [][]*segment
+	refs   int32
+}
+
+// newVersion returns a version of the given layout, referenced once by the caller.
+func newVersion(levels [][]*segment) *version {
+	for _, segs := range levels {
+		for _, seg := range segs {
+			seg.ref()
+		}
+	}
+	return &version{levels: levels, refs: 1}
+}
+
+// ref adds a reference to the version.
+func (v *version) ref() {
+	atomic.AddInt32(&v.refs, 1)
+}
+
+// release drops a reference to the version. Releasing the last one drops the references of the version to its segments.
+func (v *version) release() {
+	if atomic.AddInt32(&v.refs, -1) > 0 {
+		return
+	}
+	for _, segs := range v.levels {
+		for _, seg := range segs {
+			seg.unref()
+		}
+	}
+}
+
+// cloneLevels returns a copy of the layout that can be modified to build the next version.
+func (v *version) cloneLevels() [][]*segment {
+	levels := make([][]*segment, len(v.levels))
+	for level, segs := range v.levels {
+		levels[level] = append([]*segment(nil), segs...)
+	}
+	return levels
+}
+
+// levelSize returns the total size of the segments of a level.
+func (v *version) levelSize(level int) int64 {
+	var size int64
+	for _, seg := range v.levels[level] {
+		size += seg.size
+	}
+	return size
+}
+
+// lookup searches level 0 segments from newest to oldest, then every deeper level in order;
+// below level 0 at most one segment per level can hold the key.
+// Newer segments and shallower levels only hold newer versions, so the first version found that seq can see wins.
+// Segments whose Bloom filter rules the key out are skipped without reading any block.
+// The version found is then checked against the range tombstones of every segment that may cover the key:
+// if a newer one covers it, a tombstone standing for the range tombstone is returned instead.
+func (v *version) lookup(key string, seq uint64) (*common.Chunk, error) {
+	chunk, err := v.lookupPoint(key, seq)
+	if err != nil {
+		return nil, err
+	}
+	if deletedAt := v.rangeTombstoneSeq(key, seq); deletedAt > 0 && (chunk == nil || chunk.Seq < deletedAt) {
+		return &common.Chunk{Key: key, Deleted: true, Seq: deletedAt}, nil
+	}
+	return chunk, nil
+}
+
+// lookupPoint returns the newest version of key whose sequence number is not greater than seq, ignoring range tombstones.
+func (v *version) lookupPoint(key string, seq uint64) (*common.Chunk, error) {
+	level0 := v.levels[0]
+	for i := len(level0) - 1; i >= 0; i-- {
+		chunk, err := level0[i].getAt(key, seq)
+		if err != nil || chunk != nil {
+			return chunk, err
+		}
+	}
+
+	for level := 1; level < len(v.levels); level++ {
+		seg := v.findSegment(level, key)
+		if seg == nil {
+			continue
+		}
+		chunk, err := seg.getAt(key, seq)
+		if err != nil || chunk != nil {
+			return chunk, err
+		}
+	}
+	return nil, nil
+}
+
+// rangeTombstoneSeq returns the sequence number of the newest range tombstone covering key that a read at seq can see,
+// or 0 if there is none. Below level 0 only the segment whose range contains the key can cover it.
+func (v *version) rangeTombstoneSeq(key string, seq uint64) uint64 {
+	var deletedAt uint64
+	for _, seg := range v.levels[0] {
+		if t := seg.rangeTombstoneSeq(key, seq); t > deletedAt {
+			deletedAt = t
+		}
+	}
+	for level := 1; level < len(v.levels); level++ {
+		if seg := v.findSegment(level, key); seg != nil {
+			if t := seg.rangeTombstoneSeq(key, seq); t > deletedAt {
+				deletedAt = t
+			}
+		}
+	}
+	return deletedAt
+}
+
+// findSegment returns the segment of a sorted level whose key range contains key, or nil if there is none.
+func (v *version) findSegment(level int, key string) *segment {
+	segs := v.levels[level]
+	i := sort.Search(len(segs), func(i int) bool {
+		return segs[i].maxKey() >= key
+	})
+	if i < len(segs) && segs[i].minKey() <= key {
+		return segs[i]
+	}
+	return nil
+}
+
+// isBaseLevelForKey reports whether no level deeper than level has a segment whose range contains key.
+func (v *version) isBaseLevelForKey(level int, key string) bool {
+	for deeper := level + 1; deeper < len(v.levels); deeper++ {
+		if v.findSegment(deeper, key) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// isBaseLevelForRange reports whether no level deeper than level has a segment whose range intersects [min, max].
+func (v *version) isBaseLevelForRange(level int, min, max string) bool {
+	for deeper := level + 1; deeper < len(v.levels); deeper++ {
+		for _, seg := range v.levels[deeper] {
+			if seg.overlaps(min, max) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// acquireVersion returns the current version, which the caller must release once done with it.
+func (s *SSTable) acquireVersion() *version {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	s.current.ref()
+	return s.current
+}
+
+// installVersion makes a version of the given layout current and releases the previous one.
+// The caller must hold the write lock.
+func (s *SSTable) installVersion(levels [][]*segment) {
+	previous := s.current
+	s.current = newVersion(levels)
+	if previous != nil {
+		previous.release()
+	}
+}
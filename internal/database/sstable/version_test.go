@@ -0,0 +1,50 @@
+package sstable
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersion_KeepsCompactedSegmentsUntilReleased(t *testing.T) {
+	sst := newStoppedSSTable(t, t.TempDir(), Level0CompactionTrigger(2))
+	defer sst.Close()
+
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{{Key: "a", Value: []byte("1")}}}))
+	assert.NoError(t, sst.Write(&MockScanner{data: []common.Chunk{{Key: "b", Value: []byte("2")}}}))
+	inputs := append([]*segment(nil), sst.current.levels[0]...)
+
+	iterators, _, release := sst.NewIterators()
+	done, err := sst.compact()
+	assert.NoError(t, err)
+	assert.True(t, done)
+	assert.Empty(t, sst.current.levels[0])
+
+	// 迭代器持有的旧版本仍引用被合并的段文件，文件保持可读
+	keys := make([]string, 0, 2)
+	for _, it := range iterators {
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			keys = append(keys, it.Chunk().Key)
+		}
+		assert.NoError(t, it.Error())
+	}
+	assert.ElementsMatch(t, []string{"a", "b"}, keys)
+	for _, seg := range inputs {
+		_, err := os.Stat(seg.filePath)
+		assert.NoError(t, err)
+	}
+
+	// 释放最后一个引用后段文件被删除，重复释放没有影响
+	release()
+	release()
+	for _, seg := range inputs {
+		_, err := os.Stat(seg.filePath)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	value, err := sst.Get("b")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), value)
+}
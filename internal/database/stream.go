@@ -0,0 +1,146 @@
+package database
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+// WriteStreamBuffer is how many batches a WriteStream holds for its reader before it falls behind.
+const WriteStreamBuffer = 4096
+
+var ErrStreamLagging = errors.New("write stream fell behind the writes")
+
+// WriteStream delivers the batches written to a database after a checkpoint, in the order they were written,
+// each with the sequence numbers it was given. Together with the checkpoint, it lets another database follow every
+// write of this one.
+// Writers never wait for the reader of a stream: a stream whose buffer of WriteStreamBuffer batches is full is
+// closed with ErrStreamLagging, and its reader must start over from a new checkpoint.
+type WriteStream struct {
+	db      *DB
+	seq     uint64
+	batches chan []common.Chunk
+	err     error
+	closed  bool
+}
+
+// writeStreams holds the open write streams of a database.
+type writeStreams struct {
+	lock    *sync.Mutex
+	streams map[*WriteStream]struct{}
+}
+
+func newWriteStreams() *writeStreams {
+	return &writeStreams{
+		lock:    &sync.Mutex{},
+		streams: make(map[*WriteStream]struct{}),
+	}
+}
+
+// StreamWrites writes a checkpoint of the database to dir, as Checkpoint does, and returns the stream of the batches
+// written after it: the checkpoint holds every write up to Seq, and the stream every write after it.
+// The stream must be closed once no longer read.
+func (db *DB) StreamWrites(dir string) (*WriteStream, error) {
+	stream := &WriteStream{
+		db:      db,
+		batches: make(chan []common.Chunk, WriteStreamBuffer),
+	}
+	err := db.checkpoint(dir, func() {
+		// 在冻结内存表时注册，之后的写入都进入流中，之前的写入都在检查点中
+		stream.seq = atomic.LoadUint64(&db.lastSeq)
+		db.writeStreams.add(stream)
+	})
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Seq returns the last sequence number held by the checkpoint the stream follows.
+func (s *WriteStream) Seq() uint64 {
+	return s.seq
+}
+
+// Batches returns the channel the batches of the stream are delivered on. It is closed when the stream is closed,
+// after which Err tells why.
+func (s *WriteStream) Batches() <-chan []common.Chunk {
+	return s.batches
+}
+
+// Err returns why the stream was closed: ErrStreamLagging if its reader fell behind, an error if the database shut
+// down, or nil if it was closed by Close. It must only be called once Batches is closed.
+func (s *WriteStream) Err() error {
+	return s.err
+}
+
+// Close stops the stream. Closing a stream that is already closed has no effect.
+func (s *WriteStream) Close() {
+	s.db.writeStreams.remove(s, nil)
+}
+
+// Apply writes a batch received from the WriteStream of another database, as Write does, giving its operations
+// sequence numbers of this database. The operations keep their column family ids, which must name the same column
+// families in both databases, as they do in a database opened from the checkpoint of the stream.
+// Returns ErrColumnFamilyDropped if one of them names no column family, in which case nothing is written.
+func (db *DB) Apply(chunks []common.Chunk) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+	return db.write(&WriteBatch{chunks: chunks}, nil)
+}
+
+// add starts delivering the batches written from now on to stream.
+func (w *writeStreams) add(stream *WriteStream) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.streams[stream] = struct{}{}
+}
+
+// remove closes stream for err, unless it is already closed.
+func (w *writeStreams) remove(stream *WriteStream, err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.removeLocked(stream, err)
+}
+
+// removeLocked is remove for a caller holding the lock.
+func (w *writeStreams) removeLocked(stream *WriteStream, err error) {
+	if stream.closed {
+		return
+	}
+	stream.closed = true
+	delete(w.streams, stream)
+	stream.err = err
+	close(stream.batches)
+}
+
+// publish delivers chunks, a batch that has just been logged, to every stream, closing those that are full.
+// The caller must hold the write lock, so that streams receive the batches in the order of their sequence numbers.
+func (w *writeStreams) publish(chunks []common.Chunk) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.streams) == 0 {
+		return
+	}
+	// 批次中的 chunk 可能被调用者复用，流中保存一份副本
+	batch := append([]common.Chunk(nil), chunks...)
+	for stream := range w.streams {
+		select {
+		case stream.batches <- batch:
+		default:
+			w.removeLocked(stream, ErrStreamLagging)
+		}
+	}
+}
+
+// closeAll closes every stream for err.
+func (w *writeStreams) closeAll(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for stream := range w.streams {
+		w.removeLocked(stream, err)
+	}
+}
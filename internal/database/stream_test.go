@@ -0,0 +1,74 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_StreamWrites(t *testing.T) {
+	db := newTestDB(t)
+	users, err := db.CreateColumnFamily("users")
+	assert.NoError(t, err)
+	assert.NoError(t, db.Set("a", []byte("1")))
+	assert.NoError(t, db.Set("b", []byte("1")))
+
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	stream, err := db.StreamWrites(dir)
+	assert.NoError(t, err)
+	defer stream.Close()
+	assert.Equal(t, atomic.LoadUint64(&db.lastSeq), stream.Seq())
+
+	assert.NoError(t, db.Set("a", []byte("2")))
+	assert.NoError(t, db.Del("b"))
+	assert.NoError(t, users.Set("u", []byte("user")))
+	batch := NewWriteBatch()
+	batch.Set("c", []byte("3"))
+	batch.DeleteRange("a", "b")
+	assert.NoError(t, db.Write(batch))
+
+	// 从检查点打开的数据库依次应用流中的批次后与原数据库一致
+	follower, err := NewDB(Dir(dir, filepath.Join(t.TempDir(), "wal")))
+	assert.NoError(t, err)
+	defer follower.Shutdown()
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, follower.Apply(<-stream.Batches()))
+	}
+	assert.Equal(t, atomic.LoadUint64(&db.lastSeq), follower.LastSequence())
+	for key, expected := range map[string][]byte{"a": nil, "b": nil, "c": []byte("3")} {
+		value, err := follower.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, value, key)
+	}
+	followerUsers, err := follower.ColumnFamily("users")
+	assert.NoError(t, err)
+	value, err := followerUsers.Get("u")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("user"), value)
+
+	stream.Close()
+	_, ok := <-stream.Batches()
+	assert.False(t, ok)
+	assert.NoError(t, stream.Err())
+}
+
+func TestDB_StreamWritesLagging(t *testing.T) {
+	db := newTestDB(t)
+	stream, err := db.StreamWrites(filepath.Join(t.TempDir(), "checkpoint"))
+	assert.NoError(t, err)
+
+	// 写入不等待读取方，缓冲区满时流被关闭
+	for i := 0; i <= WriteStreamBuffer; i++ {
+		assert.NoError(t, db.Set(fmt.Sprintf("k%d", i), []byte("v")))
+	}
+	received := 0
+	for range stream.Batches() {
+		received++
+	}
+	assert.Equal(t, WriteStreamBuffer, received)
+	assert.ErrorIs(t, stream.Err(), ErrStreamLagging)
+	stream.Close()
+}
@@ -0,0 +1,104 @@
+package database
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+// SetWithTTL stores the given value for the specified key in the default column family, expiring ttl from now.
+// Once expired the key reads as deleted, and compaction reclaims it.
+// Returns an error if the database is shutting down or the WAL write fails.
+func (db *DB) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	return db.defaultColumnFamily.SetWithTTL(key, value, ttl)
+}
+
+// SetWithTTL is DB.SetWithTTL on the column family.
+func (cf *ColumnFamily) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	batch := NewWriteBatch()
+	batch.SetWithTTLCF(cf, key, value, ttl)
+	return cf.db.Write(batch)
+}
+
+// TTL returns the time the key of the default column family has left to live and whether it exists.
+// The time left is 0 for a key that never expires.
+// Returns an error if the database is shutting down.
+func (db *DB) TTL(key string) (time.Duration, bool, error) {
+	return db.defaultColumnFamily.TTL(key)
+}
+
+// TTL is DB.TTL on the column family.
+func (cf *ColumnFamily) TTL(key string) (time.Duration, bool, error) {
+
+	if atomic.LoadInt32(&cf.db.isShutdonw) == 1 {
+		return 0, false, errors.New("database is shutting down")
+	}
+
+	cf.db.memoryTableLock.RLocker().Lock()
+	defer cf.db.memoryTableLock.RLocker().Unlock()
+
+	if cf.dropped {
+		return 0, false, ErrColumnFamilyDropped
+	}
+	// 与 Get 一样只读取已发布的序列号
+	chunk, err := cf.lookup(key, atomic.LoadUint64(&cf.db.lastSeq))
+	if err != nil || chunk == nil {
+		return 0, false, err
+	}
+	if chunk.ExpiresAt == 0 {
+		return 0, true, nil
+	}
+	return time.Duration(chunk.ExpiresAt-time.Now().UnixMilli()) * time.Millisecond, true, nil
+}
+
+// Expire makes the key of the default column family expire ttl from now, replacing any previous expiry;
+// a ttl that is not positive deletes the key. It reports whether the key exists.
+// Returns an error if the database is shutting down or the WAL write fails.
+func (db *DB) Expire(key string, ttl time.Duration) (bool, error) {
+	return db.defaultColumnFamily.Expire(key, ttl)
+}
+
+// Expire is DB.Expire on the column family.
+func (cf *ColumnFamily) Expire(key string, ttl time.Duration) (bool, error) {
+	return cf.updateExpiry(key, time.Now().Add(ttl).UnixMilli())
+}
+
+// Persist removes the expiry of the key of the default column family, so that it never expires.
+// It reports whether the key exists and had an expiry.
+// Returns an error if the database is shutting down or the WAL write fails.
+func (db *DB) Persist(key string) (bool, error) {
+	return db.defaultColumnFamily.Persist(key)
+}
+
+// Persist is DB.Persist on the column family.
+func (cf *ColumnFamily) Persist(key string) (bool, error) {
+	return cf.updateExpiry(key, 0)
+}
+
+// updateExpiry writes the current value of the key again with the expiry time expiresAt, in Unix milliseconds,
+// or a tombstone if that time has already passed. The value is read under the write lock, so that a concurrent
+// write to the key is never overwritten with an older value.
+// It reports whether the key was updated: a missing key never is, nor is a key without expiry when expiresAt is 0.
+func (cf *ColumnFamily) updateExpiry(key string, expiresAt int64) (bool, error) {
+	batch := NewWriteBatch()
+	err := cf.db.write(batch, func() error {
+		if cf.dropped {
+			return ErrColumnFamilyDropped
+		}
+		chunk, err := cf.lookup(key, atomic.LoadUint64(&cf.db.lastSeq))
+		if err != nil || chunk == nil {
+			return err
+		}
+		switch {
+		case expiresAt == 0 && chunk.ExpiresAt == 0:
+		case expiresAt != 0 && expiresAt <= time.Now().UnixMilli():
+			batch.DelCF(cf, key)
+		default:
+			batch.chunks = append(batch.chunks, common.Chunk{Key: key, Value: chunk.Value, ExpiresAt: expiresAt, ColumnFamily: cf.id})
+		}
+		return nil
+	})
+	return err == nil && batch.Len() > 0, err
+}
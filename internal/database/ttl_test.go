@@ -0,0 +1,97 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_SetWithTTL(t *testing.T) {
+	db := newTestDB(t)
+	assert.NoError(t, db.Set("old", []byte("v1")))
+	assert.NoError(t, db.SetWithTTL("old", []byte("v2"), 50*time.Millisecond))
+	assert.NoError(t, db.SetWithTTL("kept", []byte("v"), time.Hour))
+
+	value, err := db.Get("old")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), value)
+
+	time.Sleep(60 * time.Millisecond)
+	// 过期的版本等同于删除，不会让更旧的版本重新可见
+	value, err = db.Get("old")
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+	it, err := db.NewIterator("", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"kept"}, collectKeys(it, false))
+	it.SeekToLast()
+	assert.Equal(t, []string{"kept"}, collectKeys(it, true))
+
+	forceFlush(t, db)
+	value, err = db.Get("old")
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+	value, err = db.Get("kept")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), value)
+}
+
+func TestDB_ExpireTTLPersist(t *testing.T) {
+	dir := t.TempDir()
+	walDir := filepath.Join(dir, "wal")
+	db, err := NewDB(Dir(dir, walDir))
+	assert.NoError(t, err)
+
+	_, exists, err := db.TTL("missing")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	updated, err := db.Expire("missing", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, updated)
+
+	assert.NoError(t, db.Set("k", []byte("v")))
+	ttl, exists, err := db.TTL("k")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Zero(t, ttl)
+	updated, err = db.Persist("k")
+	assert.NoError(t, err)
+	assert.False(t, updated)
+
+	updated, err = db.Expire("k", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	ttl, _, err = db.TTL("k")
+	assert.NoError(t, err)
+	assert.InDelta(t, float64(time.Minute), float64(ttl), float64(time.Second))
+	db.Shutdown()
+
+	// 过期时间随记录持久化，重新打开后仍然有效
+	db, err = NewDB(Dir(dir, walDir))
+	assert.NoError(t, err)
+	defer db.Shutdown()
+	ttl, exists, err = db.TTL("k")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.InDelta(t, float64(time.Minute), float64(ttl), float64(time.Second))
+
+	updated, err = db.Persist("k")
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	ttl, exists, err = db.TTL("k")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Zero(t, ttl)
+	value, err := db.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), value)
+
+	updated, err = db.Expire("k", 0)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	_, exists, err = db.TTL("k")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
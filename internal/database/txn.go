@@ -0,0 +1,289 @@
+package database
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+// DefaultLockTimeout is how long a pessimistic transaction waits for the lock of a key by default.
+const DefaultLockTimeout = time.Second
+
+var (
+	ErrTxnConflict    = errors.New("transaction conflicts with a concurrent write")
+	ErrTxnDone        = errors.New("transaction has already been committed or rolled back")
+	ErrTxnLockTimeout = errors.New("timed out waiting for a key lock")
+)
+
+// Txn is a transaction: it reads from a snapshot taken when it begins, along with its own writes, and buffers its
+// writes until Commit applies them as a single WriteBatch, so that a committed transaction is recovered whole.
+// Commit fails with ErrTxnConflict if one of the keys the transaction read or wrote has been written since it began,
+// which gives snapshot isolation.
+// A pessimistic transaction also locks every key it writes or reads for update as it goes, waiting for the
+// transactions holding them to finish: conflicts with other transactions are then found when the lock is taken
+// rather than at commit, and a deadlock ends with ErrTxnLockTimeout once the lock timeout elapses. Writes made outside
+// transactions do not take the locks and are still only detected at commit.
+// A Txn is not safe for concurrent use, and every Txn must end with Commit or Rollback.
+type Txn struct {
+	db          *DB
+	snapshot    *Snapshot
+	batch       *WriteBatch
+	writes      map[txnKey]int
+	reads       map[txnKey]struct{}
+	pessimistic bool
+	lockTimeout time.Duration
+	locked      []txnKey
+	done        bool
+}
+
+// txnKey identifies a key across column families.
+type txnKey struct {
+	columnFamily uint32
+	key          string
+}
+
+// TxnOptions defines a function type that accepts a pointer to Txn and modifies its configuration.
+type TxnOptions func(txn *Txn)
+
+// Pessimistic makes the transaction lock the keys it writes or reads for update, waiting up to lockTimeout
+// for each lock. A non-positive lockTimeout selects DefaultLockTimeout.
+func Pessimistic(lockTimeout time.Duration) TxnOptions {
+	return func(txn *Txn) {
+		txn.pessimistic = true
+		if lockTimeout > 0 {
+			txn.lockTimeout = lockTimeout
+		}
+	}
+}
+
+// Begin starts a transaction reading the current state of the database. It is optimistic unless Pessimistic is given.
+func (db *DB) Begin(options ...TxnOptions) *Txn {
+	txn := &Txn{
+		db:          db,
+		batch:       NewWriteBatch(),
+		writes:      make(map[txnKey]int),
+		reads:       make(map[txnKey]struct{}),
+		lockTimeout: DefaultLockTimeout,
+	}
+	for _, option := range options {
+		option(txn)
+	}
+	txn.snapshot = db.GetSnapshot()
+	return txn
+}
+
+// Get returns the value of key in the default column family as the transaction sees it: its own last write of key,
+// or the value key had when the transaction began. It returns nil if the key does not exist.
+func (txn *Txn) Get(key string) ([]byte, error) {
+	return txn.GetCF(txn.db.defaultColumnFamily, key)
+}
+
+// GetCF is Get in the column family cf.
+func (txn *Txn) GetCF(cf *ColumnFamily, key string) ([]byte, error) {
+	if txn.done {
+		return nil, ErrTxnDone
+	}
+	k := txnKey{columnFamily: cf.id, key: key}
+	if i, ok := txn.writes[k]; ok {
+		return txn.batch.chunks[i].Value, nil
+	}
+	txn.reads[k] = struct{}{}
+	return cf.get(key, txn.snapshot.seq)
+}
+
+// GetForUpdate is Get, locking key first in a pessimistic transaction.
+func (txn *Txn) GetForUpdate(key string) ([]byte, error) {
+	return txn.GetForUpdateCF(txn.db.defaultColumnFamily, key)
+}
+
+// GetForUpdateCF is GetForUpdate in the column family cf.
+func (txn *Txn) GetForUpdateCF(cf *ColumnFamily, key string) ([]byte, error) {
+	if err := txn.lockKey(cf, key); err != nil {
+		return nil, err
+	}
+	return txn.GetCF(cf, key)
+}
+
+// Set stores value under key in the default column family when the transaction commits.
+func (txn *Txn) Set(key string, value []byte) error {
+	return txn.SetCF(txn.db.defaultColumnFamily, key, value)
+}
+
+// SetCF is Set in the column family cf.
+func (txn *Txn) SetCF(cf *ColumnFamily, key string, value []byte) error {
+	if err := txn.lockKey(cf, key); err != nil {
+		return err
+	}
+	txn.batch.SetCF(cf, key, value)
+	txn.writes[txnKey{columnFamily: cf.id, key: key}] = txn.batch.Len() - 1
+	return nil
+}
+
+// Del deletes key from the default column family when the transaction commits.
+func (txn *Txn) Del(key string) error {
+	return txn.DelCF(txn.db.defaultColumnFamily, key)
+}
+
+// DelCF is Del in the column family cf.
+func (txn *Txn) DelCF(cf *ColumnFamily, key string) error {
+	if err := txn.lockKey(cf, key); err != nil {
+		return err
+	}
+	txn.batch.DelCF(cf, key)
+	txn.writes[txnKey{columnFamily: cf.id, key: key}] = txn.batch.Len() - 1
+	return nil
+}
+
+// Commit checks that none of the keys the transaction read or wrote has been written since it began and applies its
+// writes atomically, as DB.Write does. Returns ErrTxnConflict if one has, in which case nothing is written, or the
+// error of the write. The transaction is over whatever the outcome.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	defer txn.finish()
+	if txn.batch.Len() == 0 {
+		// 只读事务读取的都是同一快照，无需检查冲突
+		return nil
+	}
+	return txn.db.write(txn.batch, txn.validate)
+}
+
+// Rollback discards the writes of the transaction. Rolling back a transaction that is over has no effect.
+func (txn *Txn) Rollback() {
+	if !txn.done {
+		txn.finish()
+	}
+}
+
+// validate returns ErrTxnConflict if one of the keys the transaction read or wrote has a version newer than its
+// snapshot. It runs under the write lock, so that no write can come between the check and the commit.
+func (txn *Txn) validate() error {
+	for k := range txn.reads {
+		if err := txn.checkKey(k); err != nil {
+			return err
+		}
+	}
+	for k := range txn.writes {
+		if err := txn.checkKey(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkKey returns ErrTxnConflict if k has been written since the transaction began.
+// The caller must hold the memory table lock.
+func (txn *Txn) checkKey(k txnKey) error {
+	cf, ok := txn.db.columnFamilies[k.columnFamily]
+	if !ok {
+		return ErrColumnFamilyDropped
+	}
+	chunk, err := cf.version(k.key, common.MaxSeq)
+	if err != nil {
+		return err
+	}
+	if chunk != nil && chunk.Seq > txn.snapshot.seq {
+		return ErrTxnConflict
+	}
+	return nil
+}
+
+// lockKey takes the lock of key in a pessimistic transaction, then checks that key has not been written since the
+// transaction began, which no later lock could prevent. It does nothing in an optimistic transaction.
+func (txn *Txn) lockKey(cf *ColumnFamily, key string) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	if !txn.pessimistic {
+		return nil
+	}
+	k := txnKey{columnFamily: cf.id, key: key}
+	acquired, err := txn.db.txnLocks.acquire(txn, k, txn.lockTimeout)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return nil
+	}
+	txn.locked = append(txn.locked, k)
+
+	txn.db.memoryTableLock.RLocker().Lock()
+	defer txn.db.memoryTableLock.RLocker().Unlock()
+	if cf.dropped {
+		return ErrColumnFamilyDropped
+	}
+	return txn.checkKey(k)
+}
+
+// finish releases the snapshot and the locks of the transaction.
+func (txn *Txn) finish() {
+	txn.done = true
+	txn.db.ReleaseSnapshot(txn.snapshot)
+	txn.db.txnLocks.release(txn, txn.locked)
+	txn.locked = nil
+}
+
+// lockManager holds the key locks of the pessimistic transactions.
+type lockManager struct {
+	lock  *sync.Mutex
+	locks map[txnKey]*keyLock
+}
+
+// keyLock is the lock of a key, whose released channel is closed when its owner releases it.
+type keyLock struct {
+	owner    *Txn
+	released chan struct{}
+}
+
+func newLockManager() *lockManager {
+	return &lockManager{
+		lock:  &sync.Mutex{},
+		locks: make(map[txnKey]*keyLock),
+	}
+}
+
+// acquire takes the lock of k for txn, waiting up to timeout for its owner to release it.
+// It reports false if txn already held the lock, and returns ErrTxnLockTimeout if the wait times out.
+func (m *lockManager) acquire(txn *Txn, k txnKey, timeout time.Duration) (bool, error) {
+	var timer *time.Timer
+	for {
+		m.lock.Lock()
+		l, ok := m.locks[k]
+		if !ok {
+			m.locks[k] = &keyLock{owner: txn, released: make(chan struct{})}
+			m.lock.Unlock()
+			return true, nil
+		}
+		if l.owner == txn {
+			m.lock.Unlock()
+			return false, nil
+		}
+		m.lock.Unlock()
+
+		// 等待持有者释放锁；死锁时双方都会在超时后失败
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+			defer timer.Stop()
+		}
+		select {
+		case <-l.released:
+		case <-timer.C:
+			return false, ErrTxnLockTimeout
+		}
+	}
+}
+
+// release releases the locks of keys held by txn and wakes up the transactions waiting for them.
+func (m *lockManager) release(txn *Txn, keys []txnKey) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, k := range keys {
+		if l, ok := m.locks[k]; ok && l.owner == txn {
+			delete(m.locks, k)
+			close(l.released)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxn_SnapshotIsolation(t *testing.T) {
+	db := newTestDB(t)
+	assert.NoError(t, db.Set("a", []byte("1")))
+	assert.NoError(t, db.Set("b", []byte("1")))
+
+	txn := db.Begin()
+	assert.NoError(t, db.Set("b", []byte("2")))
+
+	// 事务读取开始时的快照以及自己的写入
+	value, err := txn.Get("b")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), value)
+	assert.NoError(t, txn.Set("a", []byte("10")))
+	assert.NoError(t, txn.Del("c"))
+	value, err = txn.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("10"), value)
+	value, err = db.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), value)
+
+	// b 在事务开始之后被写入，提交失败且不写入任何内容
+	assert.ErrorIs(t, txn.Commit(), ErrTxnConflict)
+	value, err = db.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), value)
+	assert.ErrorIs(t, txn.Commit(), ErrTxnDone)
+	_, err = txn.Get("a")
+	assert.ErrorIs(t, err, ErrTxnDone)
+
+	// 未被并发修改的事务提交成功
+	txn = db.Begin()
+	value, err = txn.Get("b")
+	assert.NoError(t, err)
+	assert.NoError(t, txn.Set("b", append(value, '0')))
+	assert.NoError(t, txn.Commit())
+	value, err = db.Get("b")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("20"), value)
+	assert.Equal(t, 0, db.snapshots.Len())
+}
+
+func TestTxn_WriteWriteConflict(t *testing.T) {
+	db := newTestDB(t)
+	first := db.Begin()
+	second := db.Begin()
+	assert.NoError(t, first.Set("k", []byte("first")))
+	assert.NoError(t, second.Set("k", []byte("second")))
+
+	// 先提交者获胜
+	assert.NoError(t, first.Commit())
+	assert.ErrorIs(t, second.Commit(), ErrTxnConflict)
+	value, err := db.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), value)
+
+	// 回滚的事务不写入任何内容
+	txn := db.Begin()
+	assert.NoError(t, txn.Set("k", []byte("rolled back")))
+	txn.Rollback()
+	value, err = db.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), value)
+}
+
+func TestTxn_Pessimistic(t *testing.T) {
+	db := newTestDB(t)
+	assert.NoError(t, db.Set("counter", []byte("0")))
+
+	first := db.Begin(Pessimistic(time.Second))
+	_, err := first.GetForUpdate("counter")
+	assert.NoError(t, err)
+
+	// 第二个事务等待第一个事务释放锁，之后发现 counter 已在它开始后被写入
+	second := db.Begin(Pessimistic(time.Second))
+	done := make(chan error)
+	go func() {
+		_, err := second.GetForUpdate("counter")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("lock acquired while held: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.NoError(t, first.Set("counter", []byte("1")))
+	assert.NoError(t, first.Commit())
+	assert.ErrorIs(t, <-done, ErrTxnConflict)
+	second.Rollback()
+
+	// 死锁的双方在超时后失败
+	a := db.Begin(Pessimistic(50 * time.Millisecond))
+	b := db.Begin(Pessimistic(50 * time.Millisecond))
+	assert.NoError(t, a.Set("x", []byte("a")))
+	assert.NoError(t, b.Set("y", []byte("b")))
+	go func() {
+		done <- a.Set("y", []byte("a"))
+	}()
+	assert.ErrorIs(t, b.Set("x", []byte("b")), ErrTxnLockTimeout)
+	assert.ErrorIs(t, <-done, ErrTxnLockTimeout)
+	b.Rollback()
+	assert.NoError(t, a.Set("y", []byte("a")))
+	assert.NoError(t, a.Commit())
+	value, err := db.Get("y")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), value)
+	assert.Empty(t, db.txnLocks.locks)
+}
+
+func TestTxn_ColumnFamiliesRecoverFromWal(t *testing.T) {
+	dir := t.TempDir()
+	walDir := filepath.Join(dir, "wal")
+
+	// 不调用 Shutdown，模拟进程崩溃后已提交的事务只保存在 WAL 中
+	crashed, err := NewDB(Dir(dir, walDir))
+	assert.NoError(t, err)
+	users, err := crashed.CreateColumnFamily("users")
+	assert.NoError(t, err)
+	txn := crashed.Begin()
+	assert.NoError(t, txn.Set("k", []byte("default")))
+	assert.NoError(t, txn.SetCF(users, "k", []byte("users")))
+	assert.NoError(t, txn.Commit())
+
+	db, err := NewDB(Dir(dir, walDir))
+	assert.NoError(t, err)
+	defer db.Shutdown()
+	value, err := db.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("default"), value)
+	reopened, err := db.ColumnFamily("users")
+	assert.NoError(t, err)
+	value, err = reopened.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("users"), value)
+}
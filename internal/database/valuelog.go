@@ -0,0 +1,238 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+	"github.com/Jasonbourne723/platodb/internal/database/vlog"
+	"github.com/Jasonbourne723/platodb/internal/database/wal"
+)
+
+// relocateBatchSize is the amount of live values the garbage collector moves per write batch.
+const relocateBatchSize = 4 * common.MB
+
+// DefaultValueLogGCRatio is the share of garbage a value log file must reach before the background collector rewrites it.
+const DefaultValueLogGCRatio = 0.5
+
+// ErrNoRewrite is returned by RunValueLogGC when no value log file holds enough garbage to be rewritten.
+var ErrNoRewrite = errors.New("value log gc: no file to rewrite")
+
+// errPinned stops the walk of a value log file as soon as a snapshot is found to read one of its entries.
+var errPinned = errors.New("value log entry pinned by a snapshot")
+
+// valueLogEntry is an entry of the value log being moved by the garbage collector.
+type valueLogEntry struct {
+	key   string
+	value []byte
+	ptr   vlog.Pointer
+}
+
+// RunValueLogGC rewrites the oldest value log file whose share of garbage reaches discardRatio, then deletes it.
+// The value log only holds values of the default column family.
+// An entry is garbage unless the newest version of its key lives in a segment, points to it and has not expired. Live values are written
+// again through the Write-Ahead Log (WAL) and the memory table, and are separated into the head of the value log when
+// their memory table is flushed. The file is only deleted once the WAL holding the moved values is synced.
+// Files holding an entry that a live snapshot can still read are left alone until the snapshot is released.
+// Returns ErrNoRewrite if no file qualifies or the value log is not enabled.
+func (db *DB) RunValueLogGC(discardRatio float64) error {
+	if atomic.LoadInt32(&db.isShutdonw) == 1 {
+		return errors.New("database is shutting down")
+	}
+	if db.valueLog == nil {
+		return ErrNoRewrite
+	}
+
+	db.gcLock.Lock()
+	defer db.gcLock.Unlock()
+	for _, fileId := range db.valueLog.Files() {
+		var total, live int64
+		snapshots := db.snapshotSeqs()
+		pinned := false
+		err := db.valueLog.Walk(fileId, func(key string, value []byte, ptr vlog.Pointer) error {
+			total += ptr.Size
+			db.memoryTableLock.RLocker().Lock()
+			defer db.memoryTableLock.RLocker().Unlock()
+			isLive, err := db.isLiveValue(key, ptr)
+			if err != nil {
+				return err
+			}
+			if isLive {
+				live += ptr.Size
+			}
+			if !pinned {
+				pinned, err = db.isPinnedValue(key, ptr, snapshots)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if pinned || total > 0 && float64(total-live)/float64(total) < discardRatio {
+			continue
+		}
+		return db.rewriteValueLogFile(fileId)
+	}
+	return ErrNoRewrite
+}
+
+// rewriteValueLogFile moves the live values of a value log file back into the database, then deletes the file.
+func (db *DB) rewriteValueLogFile(fileId int64) error {
+	entries := make([]valueLogEntry, 0, 64)
+	var size int
+	err := db.valueLog.Walk(fileId, func(key string, value []byte, ptr vlog.Pointer) error {
+		// 复制 value，避免内存表引用整个文件的读取缓冲
+		entries = append(entries, valueLogEntry{key: key, value: append([]byte(nil), value...), ptr: ptr})
+		size += len(key) + len(value)
+		if size < relocateBatchSize {
+			return nil
+		}
+		err := db.relocate(entries)
+		entries, size = entries[:0], 0
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := db.relocate(entries); err != nil {
+		return err
+	}
+
+	// 扫描期间创建的快照可能仍读取被移动前的 value，此时保留文件，等待快照释放后再回收
+	snapshots := db.snapshotSeqs()
+	pinned := false
+	err = db.valueLog.Walk(fileId, func(key string, value []byte, ptr vlog.Pointer) error {
+		db.memoryTableLock.RLocker().Lock()
+		defer db.memoryTableLock.RLocker().Unlock()
+		var err error
+		pinned, err = db.isPinnedValue(key, ptr, snapshots)
+		if err == nil && pinned {
+			return errPinned
+		}
+		return err
+	})
+	if pinned {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// 持有内存表写锁删除文件，避免与仍在读取该文件的 Get 并发
+	db.memoryTableLock.Lock()
+	defer db.memoryTableLock.Unlock()
+	return db.valueLog.Remove(fileId)
+}
+
+// relocate writes the entries that are still live to the default column family as one batch, through the write
+// path, and syncs the WAL whatever its sync policy before returning.
+// Liveness is checked again under the write lock, so that a key written since the scan is never overwritten.
+func (db *DB) relocate(entries []valueLogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	batch := NewWriteBatch()
+	var walWriter wal.Writer
+	err := db.write(batch, func() error {
+		for _, entry := range entries {
+			version, err := db.referencingVersion(entry.key, common.MaxSeq, entry.ptr)
+			if err != nil {
+				return err
+			}
+			if version == nil {
+				continue
+			}
+			chunk := common.Chunk{Key: entry.key, Value: entry.value, ExpiresAt: version.ExpiresAt}
+			if version.Merge {
+				// 直接写回原值会遮盖更新的合并操作数，因此写入它们合并后的结果
+				merged, err := db.defaultColumnFamily.lookup(entry.key, common.MaxSeq)
+				if err != nil {
+					return err
+				}
+				if merged == nil {
+					continue
+				}
+				chunk.Value = merged.Value
+			}
+			batch.chunks = append(batch.chunks, chunk)
+		}
+		// 批次写入的 WAL，写入期间持有内存表锁，不会切换
+		walWriter = db.wals[len(db.wals)-1]
+		return nil
+	})
+	if err != nil || batch.Len() == 0 {
+		return err
+	}
+	// 内存表被刷盘时 WAL 会在关闭前完成同步，此时再次同步不会出错
+	return walWriter.Sync()
+}
+
+// isLiveValue reports whether the value log entry of key at ptr is still referenced by the newest version of key.
+// The caller must hold the memory table lock.
+func (db *DB) isLiveValue(key string, ptr vlog.Pointer) (bool, error) {
+	version, err := db.referencingVersion(key, common.MaxSeq, ptr)
+	return version != nil, err
+}
+
+// isPinnedValue reports whether a live snapshot, given by its sequence number, still reads the value log entry of key at ptr.
+// The caller must hold the memory table lock.
+func (db *DB) isPinnedValue(key string, ptr vlog.Pointer, snapshots []uint64) (bool, error) {
+	for _, seq := range snapshots {
+		if version, err := db.referencingVersion(key, seq, ptr); err != nil || version != nil {
+			return version != nil, err
+		}
+	}
+	return false, nil
+}
+
+// referencingVersion returns the version of key visible at seq if it points to the value log entry at ptr
+// and has not expired, or nil otherwise. Merge operands newer than that version do not hide it, as reading the key
+// applies them to its value: the newest of them is then returned instead.
+// Memory tables always hold whole values, so a version found in one of them never points to the value log, and a range
+// tombstone found in one of them deletes every version of the segments.
+// The caller must hold the memory table lock.
+func (db *DB) referencingVersion(key string, seq uint64, ptr vlog.Pointer) (*common.Chunk, error) {
+	cf := db.defaultColumnFamily
+	newest, err := cf.version(key, seq)
+	chunk := newest
+	for err == nil && chunk != nil && chunk.Merge && chunk.Seq > 0 {
+		chunk, err = cf.version(key, chunk.Seq-1)
+	}
+	if err != nil || chunk == nil || !chunk.ValuePointer || chunk.Expired(time.Now()) {
+		return nil, err
+	}
+	current, err := vlog.DecodePointer(chunk.Value)
+	if err != nil || current != ptr {
+		return nil, err
+	}
+	return newest, nil
+}
+
+// startValueLogGC runs the value log garbage collector every valueLogGCInterval until the database shuts down,
+// rewriting files as long as some of them reach the discard ratio.
+func (db *DB) startValueLogGC() {
+	defer close(db.gcStopped)
+	ticker := time.NewTicker(db.valueLogGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for db.ctx.Err() == nil {
+			err := db.RunValueLogGC(db.valueLogGCRatio)
+			if err == ErrNoRewrite {
+				break
+			}
+			if err != nil {
+				log.Println(fmt.Errorf("value log gc failed,%w", err))
+				break
+			}
+		}
+	}
+}
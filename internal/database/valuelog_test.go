@@ -0,0 +1,155 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+	"github.com/Jasonbourne723/platodb/internal/database/vlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_ValueSeparation(t *testing.T) {
+	dir := t.TempDir()
+	walDir := filepath.Join(dir, "wal")
+	large := bytes.Repeat([]byte("v"), 1024)
+
+	db, err := NewDB(Dir(dir, walDir), ValueThreshold(100))
+	assert.NoError(t, err)
+	assert.NoError(t, db.Set("large", large))
+	assert.NoError(t, db.Set("small", []byte("s")))
+	forceFlush(t, db)
+
+	// 段文件只保存指针，小 value 仍保存在段文件中
+	chunk, err := db.defaultColumnFamily.sstable.Lookup("large", common.MaxSeq)
+	assert.NoError(t, err)
+	assert.True(t, chunk.ValuePointer)
+	assert.Less(t, len(chunk.Value), 100)
+	chunk, err = db.defaultColumnFamily.sstable.Lookup("small", common.MaxSeq)
+	assert.NoError(t, err)
+	assert.False(t, chunk.ValuePointer)
+
+	value, err := db.Get("large")
+	assert.NoError(t, err)
+	assert.Equal(t, large, value)
+
+	it, err := db.NewIterator("", "")
+	assert.NoError(t, err)
+	assert.True(t, it.Valid())
+	assert.Equal(t, "large", it.Key())
+	assert.Equal(t, large, it.Value())
+	assert.NoError(t, it.Error())
+	db.Shutdown()
+
+	// 关闭键值分离后重新打开，已分离的 value 仍可读取
+	reopened, err := NewDB(Dir(dir, walDir))
+	assert.NoError(t, err)
+	defer reopened.Shutdown()
+	value, err = reopened.Get("large")
+	assert.NoError(t, err)
+	assert.Equal(t, large, value)
+}
+
+func TestDB_ValueLogGC(t *testing.T) {
+	db := newTestDB(t, ValueThreshold(10), ValueLogFileSize(1))
+	value := func(i, version int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%d-%d.", i, version)), 4096)
+	}
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Set(fmt.Sprintf("k%03d", i), value(i, 1)))
+	}
+	forceFlush(t, db)
+	// 覆盖大部分 key，使较早的 value log 文件主要由垃圾组成
+	for i := 0; i < 80; i++ {
+		assert.NoError(t, db.Set(fmt.Sprintf("k%03d", i), value(i, 2)))
+	}
+	forceFlush(t, db)
+
+	files := db.valueLog.Files()
+	assert.NotEmpty(t, files)
+	assert.NoError(t, db.RunValueLogGC(0.5))
+	assert.NotContains(t, db.valueLog.Files(), files[0])
+
+	for i := 0; i < 100; i++ {
+		version := 2
+		if i >= 80 {
+			version = 1
+		}
+		got, err := db.Get(fmt.Sprintf("k%03d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, value(i, version), got)
+	}
+
+	// 被移动的 value 刷盘后重新写入 value log 的头部
+	forceFlush(t, db)
+	for i := 80; i < 100; i++ {
+		got, err := db.Get(fmt.Sprintf("k%03d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, value(i, 1), got)
+	}
+}
+
+func TestDB_ValueLogGCStream(t *testing.T) {
+	db := newTestDB(t, ValueThreshold(10), ValueLogFileSize(1))
+	value := func(i, version int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%d-%d.", i, version)), 4096)
+	}
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, db.Set(fmt.Sprintf("k%03d", i), value(i, 1)))
+	}
+	forceFlush(t, db)
+	// 每 4 个 key 保留 1 个，回收时需要移动仍然有效的 value
+	for i := 0; i < 100; i++ {
+		if i%4 != 0 {
+			assert.NoError(t, db.Set(fmt.Sprintf("k%03d", i), value(i, 2)))
+		}
+	}
+	forceFlush(t, db)
+
+	stream, err := db.StreamWrites(filepath.Join(t.TempDir(), "checkpoint"))
+	assert.NoError(t, err)
+	defer stream.Close()
+	assert.NoError(t, db.RunValueLogGC(0.5))
+
+	// 回收时重写的 value 同样发送给流，副本与主库的序列号保持一致
+	select {
+	case batch := <-stream.Batches():
+		assert.NotEmpty(t, batch)
+		for _, chunk := range batch {
+			got, err := db.Get(chunk.Key)
+			assert.NoError(t, err)
+			assert.Equal(t, got, chunk.Value, chunk.Key)
+		}
+		assert.Equal(t, atomic.LoadUint64(&db.lastSeq), batch[len(batch)-1].Seq)
+	default:
+		t.Error("relocated values were not streamed")
+	}
+}
+
+func TestValueLog_PointerAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	l, err := vlog.Open(dir, 0)
+	assert.NoError(t, err)
+	ptr, err := l.Append("k", []byte("value"))
+	assert.NoError(t, err)
+
+	decoded, err := vlog.DecodePointer(ptr.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, ptr, decoded)
+	assert.NoError(t, l.Close())
+
+	reopened, err := vlog.Open(dir, 0)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	value, err := reopened.Read(ptr)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+
+	assert.NoError(t, reopened.Remove(ptr.FileId))
+	_, err = reopened.Read(ptr)
+	assert.ErrorIs(t, err, vlog.ErrFileDiscarded)
+}
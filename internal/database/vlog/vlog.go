@@ -0,0 +1,361 @@
+package vlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+const (
+	SUFFIX             = ".vlog"
+	DefaultMaxFileSize = 64 * common.MB
+	FileModePerm       = 0644
+)
+
+var (
+	ErrEntryCorrupted = errors.New("value log entry corrupted")
+	ErrFileDiscarded  = errors.New("value log file discarded")
+	ErrClosed         = errors.New("value log is closed")
+)
+
+// Pointer locates an entry of the value log: the file holding it, the offset it starts at and its length.
+type Pointer struct {
+	FileId int64
+	Offset int64
+	Size   int64
+}
+
+// Encode serializes the pointer as three uvarints, the form in which segments store it in place of the value.
+func (p Pointer) Encode() []byte {
+	buf := make([]byte, 0, 3*binary.MaxVarintLen64)
+	buf = binary.AppendUvarint(buf, uint64(p.FileId))
+	buf = binary.AppendUvarint(buf, uint64(p.Offset))
+	return binary.AppendUvarint(buf, uint64(p.Size))
+}
+
+// DecodePointer parses a pointer produced by Encode.
+func DecodePointer(data []byte) (Pointer, error) {
+	var fields [3]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return Pointer{}, ErrEntryCorrupted
+		}
+		fields[i] = v
+		data = data[n:]
+	}
+	if len(data) != 0 {
+		return Pointer{}, ErrEntryCorrupted
+	}
+	return Pointer{FileId: int64(fields[0]), Offset: int64(fields[1]), Size: int64(fields[2])}, nil
+}
+
+// ValueLog stores large values outside the segments, in append-only files named after increasing ids.
+// Every entry is framed as crc(4) | uvarint keyLen | key | uvarint valueLen | value, where crc covers everything after
+// itself. The key is kept so that the garbage collector can tell whether the entry is still referenced.
+// New entries always go to the head file, the one with the greatest id, which is replaced once it reaches maxFileSize.
+type ValueLog struct {
+	dir         string
+	maxFileSize int64
+	lock        *sync.RWMutex
+	files       map[int64]*os.File
+	headId      int64
+	headSize    int64
+	closed      bool
+}
+
+// Open loads the value log files of dir, creating the directory if needed, and starts a new head file.
+// Appending never resumes in an existing file, so that an entry torn by a crash stays at the end of its file.
+// A non-positive maxFileSize falls back to DefaultMaxFileSize.
+func Open(dir string, maxFileSize int64) (*ValueLog, error) {
+	if err := common.EnsureDirExists(dir); err != nil {
+		return nil, err
+	}
+	if maxFileSize <= 0 {
+		maxFileSize = DefaultMaxFileSize
+	}
+	l := &ValueLog{
+		dir:         dir,
+		maxFileSize: maxFileSize,
+		lock:        &sync.RWMutex{},
+		files:       make(map[int64]*os.File),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		id, ok := parseFileId(entry.Name())
+		if !ok {
+			continue
+		}
+		if id > l.headId {
+			l.headId = id
+		}
+		// 上次打开时创建但未写入的头文件直接删除
+		if info, err := entry.Info(); err == nil && info.Size() == 0 {
+			os.Remove(path.Join(dir, entry.Name()))
+			continue
+		}
+		file, err := os.OpenFile(path.Join(dir, entry.Name()), os.O_RDONLY, FileModePerm)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.files[id] = file
+	}
+	if err := l.rotate(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// parseFileId extracts the id from the name of a value log file.
+func parseFileId(name string) (int64, bool) {
+	if !strings.HasSuffix(name, SUFFIX) {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(strings.TrimSuffix(name, SUFFIX), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// filePath returns the path of the value log file with the given id.
+func (l *ValueLog) filePath(id int64) string {
+	return path.Join(l.dir, fmt.Sprintf("%06d%s", id, SUFFIX))
+}
+
+// rotate syncs the current head file and starts a new one. The caller must hold the write lock.
+func (l *ValueLog) rotate() error {
+	if head, ok := l.files[l.headId]; ok && l.headSize > 0 {
+		if err := head.Sync(); err != nil {
+			return err
+		}
+	}
+	id := l.headId + 1
+	file, err := os.OpenFile(l.filePath(id), os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_EXCL, FileModePerm)
+	if err != nil {
+		return fmt.Errorf("value log文件打开失败:%w", err)
+	}
+	l.files[id] = file
+	l.headId = id
+	l.headSize = 0
+	return nil
+}
+
+// Append writes the entry of key and value to the head file and returns its pointer.
+// The entry is not synced; Sync must be called before anything referencing it is made durable.
+func (l *ValueLog) Append(key string, value []byte) (Pointer, error) {
+	entry := make([]byte, 4, 4+2*binary.MaxVarintLen32+len(key)+len(value))
+	entry = binary.AppendUvarint(entry, uint64(len(key)))
+	entry = append(entry, key...)
+	entry = binary.AppendUvarint(entry, uint64(len(value)))
+	entry = append(entry, value...)
+	binary.BigEndian.PutUint32(entry[0:4], crc32.ChecksumIEEE(entry[4:]))
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return Pointer{}, ErrClosed
+	}
+	if l.headSize > 0 && l.headSize+int64(len(entry)) > l.maxFileSize {
+		if err := l.rotate(); err != nil {
+			return Pointer{}, err
+		}
+	}
+	n, err := l.files[l.headId].Write(entry)
+	ptr := Pointer{FileId: l.headId, Offset: l.headSize, Size: int64(len(entry))}
+	l.headSize += int64(n)
+	if err != nil {
+		return Pointer{}, err
+	}
+	return ptr, nil
+}
+
+// Sync flushes the head file to disk. Files replaced as head were synced when they were replaced.
+func (l *ValueLog) Sync() error {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.files[l.headId].Sync()
+}
+
+// Read returns the value of the entry located by ptr after verifying its checksum.
+// It returns ErrFileDiscarded if the file has been removed by the garbage collector.
+func (l *ValueLog) Read(ptr Pointer) ([]byte, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
+	file, ok := l.files[ptr.FileId]
+	if !ok {
+		return nil, fmt.Errorf("value log file %d: %w", ptr.FileId, ErrFileDiscarded)
+	}
+	buf := make([]byte, ptr.Size)
+	if _, err := file.ReadAt(buf, ptr.Offset); err != nil {
+		return nil, err
+	}
+	_, value, n, err := decodeEntry(buf)
+	if err != nil {
+		return nil, err
+	}
+	if int64(n) != ptr.Size {
+		return nil, ErrEntryCorrupted
+	}
+	return value, nil
+}
+
+// decodeEntry decodes the entry at the start of data and returns its key, its value and its length.
+// An entry cut short by the end of data yields io.ErrUnexpectedEOF.
+func decodeEntry(data []byte) (string, []byte, int, error) {
+	if len(data) < 4 {
+		return "", nil, 0, io.ErrUnexpectedEOF
+	}
+	pos := 4
+	var fields [2][]byte
+	for i := range fields {
+		length, n := binary.Uvarint(data[pos:])
+		if n == 0 {
+			return "", nil, 0, io.ErrUnexpectedEOF
+		}
+		if n < 0 {
+			return "", nil, 0, ErrEntryCorrupted
+		}
+		pos += n
+		if length > uint64(len(data)-pos) {
+			return "", nil, 0, io.ErrUnexpectedEOF
+		}
+		fields[i] = data[pos : pos+int(length)]
+		pos += int(length)
+	}
+	if binary.BigEndian.Uint32(data[0:4]) != crc32.ChecksumIEEE(data[4:pos]) {
+		return "", nil, 0, ErrEntryCorrupted
+	}
+	return string(fields[0]), fields[1], pos, nil
+}
+
+// Files returns the ids of every file but the head, from oldest to newest. These are the files the garbage collector
+// may rewrite; the head file is still being appended to.
+func (l *ValueLog) Files() []int64 {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	ids := make([]int64, 0, len(l.files))
+	for id := range l.files {
+		if id != l.headId {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Walk calls fn for every entry of the file with the given id, in the order they were appended,
+// and stops at the first error returned by fn. An entry torn by a crash ends the file.
+func (l *ValueLog) Walk(fileId int64, fn func(key string, value []byte, ptr Pointer) error) error {
+	l.lock.RLock()
+	file, ok := l.files[fileId]
+	l.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("value log file %d: %w", fileId, ErrFileDiscarded)
+	}
+
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		return err
+	}
+	for offset := 0; offset < len(data); {
+		key, value, n, err := decodeEntry(data[offset:])
+		if err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("value log file %d at %d: %w", fileId, offset, err)
+		}
+		if err := fn(key, value, Pointer{FileId: fileId, Offset: int64(offset), Size: int64(n)}); err != nil {
+			return err
+		}
+		offset += n
+	}
+	return nil
+}
+
+// Remove closes and deletes the file with the given id. The head file cannot be removed.
+// Reads of pointers into the file fail with ErrFileDiscarded afterwards.
+func (l *ValueLog) Remove(fileId int64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if fileId == l.headId {
+		return fmt.Errorf("value log file %d is the head file", fileId)
+	}
+	file, ok := l.files[fileId]
+	if !ok {
+		return nil
+	}
+	delete(l.files, fileId)
+	file.Close()
+	return os.Remove(l.filePath(fileId))
+}
+
+// Checkpoint writes a copy of the value log to dir, which must not hold one already. Files that are no longer
+// appended to are hard-linked into dir, or copied where they cannot be linked; the entries of the head file written
+// so far are copied, so that later appends do not show through the copy. Appends wait until the copy is done.
+func (l *ValueLog) Checkpoint(dir string) error {
+	if err := common.EnsureDirExists(dir); err != nil {
+		return err
+	}
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+	for id := range l.files {
+		dst := path.Join(dir, path.Base(l.filePath(id)))
+		var err error
+		if id != l.headId {
+			err = common.LinkFile(l.filePath(id), dst)
+		} else if l.headSize > 0 {
+			err = common.CopyFile(l.filePath(id), dst, l.headSize)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return common.SyncDir(dir)
+}
+
+// Close syncs the head file and closes every file of the value log.
+func (l *ValueLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+
+	var err error
+	if head, ok := l.files[l.headId]; ok {
+		err = head.Sync()
+	}
+	for id, file := range l.files {
+		file.Close()
+		delete(l.files, id)
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+package wal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultSyncInterval is the longest a record waits for its fsync in group commit mode when no interval is given.
+const DefaultSyncInterval = 10 * time.Millisecond
+
+// SyncMode selects when the Write-Ahead Log (WAL) is synced to disk.
+type SyncMode int
+
+const (
+	// SyncNone never syncs while writing and leaves flushing to the operating system;
+	// records are only synced when the log is closed. Acknowledged writes can be lost on power failure.
+	SyncNone SyncMode = iota
+	// SyncAlways syncs before every write is acknowledged. Writers arriving while a sync is running
+	// wait for it to finish and then share the next one.
+	SyncAlways
+	// SyncGroup syncs at most once per interval, or as soon as the given number of bytes is waiting,
+	// and acknowledges every writer covered by the sync at once.
+	SyncGroup
+)
+
+// SyncPolicy describes how the Write-Ahead Log (WAL) trades latency for durability.
+type SyncPolicy struct {
+	Mode     SyncMode
+	Interval time.Duration
+	Bytes    int64
+}
+
+// NoSync returns the policy that never syncs before acknowledging a write.
+func NoSync() SyncPolicy {
+	return SyncPolicy{Mode: SyncNone}
+}
+
+// SyncEveryWrite returns the policy that syncs before acknowledging every write.
+func SyncEveryWrite() SyncPolicy {
+	return SyncPolicy{Mode: SyncAlways}
+}
+
+// GroupCommit returns the policy that syncs every interval, or as soon as bytes are waiting to be synced.
+// A non-positive interval falls back to DefaultSyncInterval; a non-positive bytes limit disables the size trigger.
+func GroupCommit(interval time.Duration, bytes int64) SyncPolicy {
+	if interval <= 0 {
+		interval = DefaultSyncInterval
+	}
+	return SyncPolicy{Mode: SyncGroup, Interval: interval, Bytes: bytes}
+}
+
+// ParseSyncPolicy builds a policy from its configuration: mode is one of "none", "always" or "group",
+// and interval and bytes only apply to "group". An empty mode means "none".
+func ParseSyncPolicy(mode string, interval time.Duration, bytes int64) (SyncPolicy, error) {
+	switch strings.ToLower(mode) {
+	case "", "none":
+		return NoSync(), nil
+	case "always":
+		return SyncEveryWrite(), nil
+	case "group":
+		return GroupCommit(interval, bytes), nil
+	default:
+		return SyncPolicy{}, fmt.Errorf("unknown wal sync mode %q", mode)
+	}
+}
+
+// WaitDurable blocks until the record ending at offset is durable under the sync policy of the log.
+// With SyncNone it returns at once. Otherwise the first waiter to find no sync running syncs everything written so far,
+// while the others wait for that sync, so that concurrent writers share a single fsync.
+// A failed sync is sticky: since the kernel may have dropped the dirty pages, every later wait fails too.
+func (w *Wal) WaitDurable(offset int64) error {
+	if w.policy.Mode == SyncNone {
+		return nil
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.policy.Mode == SyncAlways {
+		return w.syncTo(offset)
+	}
+
+	for w.synced < offset {
+		if w.syncErr != nil {
+			return w.syncErr
+		}
+		// 等待的数据量达到阈值时由当前写入者发起同步，否则等待定时同步
+		if !w.syncing && w.policy.Bytes > 0 && w.written-w.synced >= w.policy.Bytes {
+			w.syncOnce()
+			continue
+		}
+		w.cond.Wait()
+	}
+	return nil
+}
+
+// syncTo blocks until everything up to offset is synced, syncing itself when no other sync is running.
+// The caller must hold the lock.
+func (w *Wal) syncTo(offset int64) error {
+	for w.synced < offset {
+		if w.syncErr != nil {
+			return w.syncErr
+		}
+		if w.syncing {
+			w.cond.Wait()
+			continue
+		}
+		w.syncOnce()
+	}
+	return w.syncErr
+}
+
+// syncOnce syncs everything written so far and wakes every waiter.
+// The lock is released during the fsync so that other writers can keep appending in the meantime.
+// The caller must hold the lock and no other sync may be running.
+func (w *Wal) syncOnce() {
+	w.syncing = true
+	target := w.written
+	w.lock.Unlock()
+	err := w.file.Sync()
+	w.lock.Lock()
+	w.syncing = false
+	if err != nil {
+		w.syncErr = fmt.Errorf("failed to sync WAL file: %w", err)
+	} else if target > w.synced {
+		w.synced = target
+	}
+	w.cond.Broadcast()
+}
+
+// startSyncer syncs the log every interval while records are waiting, until the log is closed.
+func (w *Wal) startSyncer() {
+	defer close(w.stopped)
+	ticker := time.NewTicker(w.policy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+		w.lock.Lock()
+		if !w.syncing && w.syncErr == nil && w.written > w.synced {
+			w.syncOnce()
+		}
+		w.lock.Unlock()
+	}
+}
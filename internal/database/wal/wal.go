@@ -2,6 +2,7 @@ package wal
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"io"
 	"os"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/Jasonbourne723/platodb/internal/database/common"
@@ -18,6 +20,19 @@ const (
 	SUFFIX = ".log"
 )
 
+// batchRecord marks a record holding a whole write batch, and timedBatchRecord one that also holds the time it was
+// written at, which is how batches are written now.
+// Records written before batches existed start with the tombstone byte of their only chunk, which is 0 or 1.
+const (
+	batchRecord      byte = 2
+	timedBatchRecord byte = 3
+)
+
+var (
+	ErrIncompleteRecord = errors.New("incomplete wal record")
+	ErrClosed           = errors.New("wal is closed")
+)
+
 type WriterCloser interface {
 	Writer
 	Closer
@@ -29,159 +44,332 @@ type ReaderCloser interface {
 }
 
 type Reader interface {
-	Read() (*common.Chunk, error)
+	ReadBatch() ([]common.Chunk, error)
+	ReadRecord() (*Record, error)
 }
 
+// Record is a batch read back from the log, along with the time it was written at.
+// Time is zero for records written before the log kept it.
+type Record struct {
+	Time   time.Time
+	Chunks []common.Chunk
+}
+
+// Writer appends batches to the log. WriteBatch returns the offset at which the record ends,
+// which WaitDurable takes to block until the record is durable under the sync policy of the log.
+// Splitting the two lets callers append under their own lock and wait for the fsync after releasing it,
+// so that concurrent writers can share a single fsync. Sync makes every record durable whatever the policy.
 type Writer interface {
-	Write(*common.Chunk) error
+	WriteBatch(chunks []common.Chunk) (int64, error)
+	WaitDurable(offset int64) error
+	Sync() error
 }
 
 type Closer interface {
 	Close() error
 }
 
+// logFile is the file a log is written to.
+type logFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
 type Wal struct {
-	file     *os.File
-	filePath string
-	utils    *common.Utils
-	reader   *bufio.Reader
+	file       logFile
+	filePath   string
+	archiveDir string
+	keep       bool
+	reader     *bufio.Reader
+	policy     SyncPolicy
+	lock       *sync.Mutex
+	cond       *sync.Cond
+	written    int64
+	synced     int64
+	syncing    bool
+	syncErr    error
+	writeErr   error
+	closed     bool
+	stop       chan struct{}
+	stopped    chan struct{}
+}
+
+// Options defines a function type that accepts a pointer to Wal and modifies its configuration.
+type Options func(w *Wal)
+
+// Archive makes Close move the log into dir, which must exist, instead of deleting it, so that the writes it holds
+// can be replayed later on top of a checkpoint. The log keeps its name, so archived logs sort in the order they were
+// created.
+func Archive(dir string) Options {
+	return func(w *Wal) {
+		w.archiveDir = dir
+	}
 }
 
 // NewReaderCloser creates and returns a new WalReaderCloser instance initialized with the provided file path.
 // It opens the file in read-write mode and wraps it into a Wal struct which implements ReaderCloser interface.
 // If the file cannot be opened, an error is returned.
 // The WalReaderCloser allows reading from and closing the Write-Ahead Log (WAL) file.
-func NewReaderCloser(filepath string) (ReaderCloser, error) {
+func NewReaderCloser(filepath string, options ...Options) (ReaderCloser, error) {
 
 	walFile, err := os.OpenFile(filepath, os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
 	}
-	return &Wal{
-		file:     walFile,
-		filePath: filepath,
-		utils:    common.NewUtils(),
-		reader:   bufio.NewReader(walFile),
-	}, nil
+	wal := newWal(walFile, filepath, NoSync(), options)
+	wal.reader = bufio.NewReader(walFile)
+	return wal, nil
+}
+
+// NewReader opens the Write-Ahead Log (WAL) file at filepath for reading only. Unlike with NewReaderCloser,
+// closing it leaves the file in place, which suits reading archived logs.
+func NewReader(filepath string) (ReaderCloser, error) {
+	walFile, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	wal := newWal(walFile, filepath, NoSync(), nil)
+	wal.reader = bufio.NewReader(walFile)
+	wal.keep = true
+	return wal, nil
 }
 
 // NewWriterCloser creates and returns a new WriterCloser instance initialized with a Write-Ahead Log (WAL) file located in the specified directory.
-// The filename is generated based on the current time and appended with a predefined suffix.
-// It opens the file for writing, creating it if necessary, and wraps it within a Wal structure.
+// The filename is generated based on the current time with nanosecond precision and appended with a predefined suffix,
+// so that the names sort in creation order and logs created in quick succession never share a file.
+// It opens the file for writing, creating it exclusively, and wraps it within a Wal structure that syncs according to policy.
 // Returns a WriterCloser interface and an error if the file operation fails.
-func NewWriterCloser(walDir string) (WriterCloser, error) {
-	filePath := path.Join(walDir, time.Now().Format("20060102150405")+SUFFIX)
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE, 0644)
+func NewWriterCloser(walDir string, policy SyncPolicy, options ...Options) (WriterCloser, error) {
+	var (
+		file     *os.File
+		filePath string
+		err      error
+	)
+	for {
+		filePath = path.Join(walDir, time.Now().Format("20060102150405.000000000")+SUFFIX)
+		file, err = os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) {
+			break
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
+	wal := newWal(file, filePath, policy, options)
+	if wal.policy.Mode == SyncGroup {
+		wal.stop = make(chan struct{})
+		wal.stopped = make(chan struct{})
+		go wal.startSyncer()
+	}
+	return wal, nil
+}
+
+// newWal wraps an open log file.
+func newWal(file *os.File, filePath string, policy SyncPolicy, options []Options) *Wal {
 	wal := &Wal{
 		file:     file,
 		filePath: filePath,
-		utils:    common.NewUtils(),
+		policy:   policy,
+		lock:     &sync.Mutex{},
 	}
-	return wal, nil
+	wal.cond = sync.NewCond(wal.lock)
+	for _, option := range options {
+		option(wal)
+	}
+	return wal
 }
 
-// Read decodes the next chunk from the Write-Ahead Log (WAL), verifying its integrity using CRC checksum.
-// It returns a pointer to a Chunk which includes the key-value pair, and a boolean indicating deletion.
-// If the chunk is marked as deleted, the value will be nil.
-// It returns an error if any read operation fails or if the checksum does not match.
-func (w *Wal) Read() (*common.Chunk, error) {
-
-	deletedByte, err := w.reader.ReadByte()
+// ReadBatch decodes the next record from the Write-Ahead Log (WAL) and returns the chunks it holds.
+// A batch record yields every chunk of the batch; a single-chunk record written by older versions yields one chunk.
+// It returns io.EOF once every record has been read, and ErrIncompleteRecord when the log ends with a record that
+// was only partly written, in which case none of the chunks of that record must be applied.
+// Any other error means the log is corrupted.
+func (w *Wal) ReadBatch() ([]common.Chunk, error) {
+	record, err := w.ReadRecord()
 	if err != nil {
 		return nil, err
 	}
-	deleted := deletedByte == 1
+	return record.Chunks, nil
+}
+
+// ReadRecord is ReadBatch, also returning the time the record was written at.
+func (w *Wal) ReadRecord() (*Record, error) {
 
-	// 读取 CRC 校验
-	crcBytes := make([]byte, 4)
-	_, err = io.ReadFull(w.reader, crcBytes)
+	recordType, err := w.reader.ReadByte()
 	if err != nil {
 		return nil, err
 	}
-	crc := binary.BigEndian.Uint32(crcBytes)
+	if recordType != batchRecord && recordType != timedBatchRecord {
+		chunk, err := common.ReadChunk(w.reader, recordType)
+		if err != nil {
+			return nil, incomplete(err)
+		}
+		return &Record{Chunks: []common.Chunk{*chunk}}, nil
+	}
 
-	// 读取 key 的长度
-	keyLenByte, err := w.reader.ReadByte()
-	if err != nil {
+	// 读取 CRC 校验和负载长度
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(w.reader, header); err != nil {
+		return nil, incomplete(err)
+	}
+	crc := binary.BigEndian.Uint32(header[0:4])
+	payload := make([]byte, binary.BigEndian.Uint32(header[4:8]))
+	if _, err := io.ReadFull(w.reader, payload); err != nil {
+		return nil, incomplete(err)
+	}
+	if crc != crc32.ChecksumIEEE(payload) {
+		// 日志末尾写了一半的记录可能包含垃圾数据
+		if _, err := w.reader.Peek(1); err == io.EOF {
+			return nil, ErrIncompleteRecord
+		}
+		return nil, errors.New("crc check failed")
+	}
+	record := &Record{}
+	if recordType == timedBatchRecord {
+		if len(payload) < 8 {
+			return nil, errors.New("batch record too short")
+		}
+		record.Time = time.Unix(0, int64(binary.BigEndian.Uint64(payload[:8])))
+		payload = payload[8:]
+	}
+	if record.Chunks, err = decodeBatch(payload); err != nil {
 		return nil, err
 	}
-	keyLen := int(keyLenByte)
+	return record, nil
+}
+
+// WriteBatch writes the chunks as a single record protected by a single CRC, so that on recovery either all of them
+// or none of them are read back, along with the current time, so that archived logs can be replayed up to a time.
+// Layout: type(1) | crc(4) | length(4) | time(8) | count(4) | encoded chunks, where time is in Unix nanoseconds,
+// and crc and length cover everything after length.
+// It returns the offset at which the record ends, to be passed to WaitDurable; the record is not yet synced.
+// Returns an error if writing to the file encounters an issue, in which case the part of the record that was written
+// is cut off; if that fails too, every later write fails, rather than append records recovery would not reach.
+func (w *Wal) WriteBatch(chunks []common.Chunk) (int64, error) {
+
+	payload := make([]byte, 12, 64)
+	binary.BigEndian.PutUint64(payload[0:8], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(len(chunks)))
+	for i := range chunks {
+		payload = common.AppendChunk(payload, &chunks[i])
+	}
+
+	record := make([]byte, 9, 9+len(payload))
+	record[0] = timedBatchRecord
+	binary.BigEndian.PutUint32(record[1:5], crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint32(record[5:9], uint32(len(payload)))
+	record = append(record, payload...)
 
-	// 读取 key
-	keyBytes := make([]byte, keyLen)
-	_, err = io.ReadFull(w.reader, keyBytes)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if w.writeErr != nil {
+		return 0, w.writeErr
+	}
+	n, err := w.file.Write(record)
 	if err != nil {
-		return nil, err
+		// 截掉写了一半的记录，否则恢复时读到它就会停下，之后追加的记录全部丢失
+		if n > 0 {
+			if truncateErr := w.file.Truncate(w.written); truncateErr != nil {
+				w.writeErr = fmt.Errorf("wal ends with a torn record: %w", truncateErr)
+			}
+		}
+		return 0, err
 	}
-	key := string(keyBytes)
+	w.written += int64(n)
+	return w.written, nil
+}
 
-	// 读取 value 的长度并读取 value
-	var value []byte
-	if !deleted {
-		valueLenBytes := make([]byte, 2)
-		_, err = io.ReadFull(w.reader, valueLenBytes)
+// decodeBatch decodes the chunks held by the payload of a batch record.
+func decodeBatch(payload []byte) ([]common.Chunk, error) {
+	if len(payload) < 4 {
+		return nil, errors.New("batch record too short")
+	}
+	count := binary.BigEndian.Uint32(payload[:4])
+	reader := bytes.NewReader(payload[4:])
+	chunks := make([]common.Chunk, 0, count)
+	for i := uint32(0); i < count; i++ {
+		first, err := reader.ReadByte()
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("batch record truncated: %w", err)
 		}
-		valueLen := int(binary.BigEndian.Uint16(valueLenBytes))
-
-		// 读取 value
-		value = make([]byte, valueLen)
-		_, err = io.ReadFull(w.reader, value)
+		chunk, err := common.ReadChunk(reader, first)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("batch record truncated: %w", err)
 		}
+		chunks = append(chunks, *chunk)
 	}
-
-	// 验证 CRC
-	if crc != crc32.ChecksumIEEE(append(keyBytes, value...)) {
-		return nil, errors.New("crc check failed")
-	}
-
-	// 将解码后的数据添加到 chunks
-	return &common.Chunk{
-		Key:     key,
-		Value:   value,
-		Deleted: deleted,
-	}, nil
+	return chunks, nil
 }
 
-// Write encodes the provided chunk using the utility encoder, then writes the encoded bytes to the WAL file.
-// Returns an error if encoding fails or writing to the file encounters an issue.
-func (w *Wal) Write(chunk *common.Chunk) error {
-
-	bytes, err := w.utils.Encode(chunk)
-	if err != nil {
-		return err
-	}
-	_, err = w.file.Write(bytes)
-	if err != nil {
-		return err
+// incomplete maps the errors of a read that ran out of data in the middle of a record to ErrIncompleteRecord.
+func incomplete(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrIncompleteRecord
 	}
-	return nil
+	return err
 }
 
-// Sync ensures that any buffered data in the Write-Ahead Log (WAL) is written to the disk and flushed.
-// It returns an error if the synchronization operation fails.
+// Sync ensures that everything written to the Write-Ahead Log (WAL) so far is flushed to disk,
+// whatever the sync policy of the log. It returns an error if the synchronization operation fails.
 func (w *Wal) Sync() error {
-	return w.file.Sync()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.syncTo(w.written)
 }
 
-// Close synchronously flushes any unwritten data to disk, closes the WAL file, and removes the file from the filesystem.
+// Close synchronously flushes any unwritten data to disk, closes the WAL file, and removes the file from the filesystem,
+// or moves it to the archive directory when the log was opened with Archive. A log opened with NewReader is left in place.
+// Writers still waiting for their records to become durable are released once the final sync completes.
 // Returns an error if any of these operations fail.
 func (w *Wal) Close() error {
-	var err error
-	if err = w.file.Sync(); err != nil {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.stopped
+	}
+
+	w.lock.Lock()
+	err := w.syncTo(w.written)
+	w.closed = true
+	w.cond.Broadcast()
+	w.lock.Unlock()
+	if err != nil {
 		return fmt.Errorf("failed to sync WAL file: %w", err)
 	}
+
 	if err = w.file.Close(); err != nil {
 		return fmt.Errorf("failed to close WAL file: %w", err)
 	}
+	if w.keep {
+		return nil
+	}
+	if w.archiveDir != "" {
+		if err = w.archive(); err != nil {
+			return fmt.Errorf("failed to archive WAL file: %w", err)
+		}
+		return nil
+	}
 	if err = os.Remove(w.filePath); err != nil {
 		return fmt.Errorf("failed to remove WAL file: %w", err)
 	}
 	return nil
 }
+
+// archive moves the closed log file into the archive directory, copying it when it cannot be renamed there,
+// such as across file systems.
+func (w *Wal) archive() error {
+	archivePath := path.Join(w.archiveDir, path.Base(w.filePath))
+	if err := os.Rename(w.filePath, archivePath); err != nil {
+		if err := common.CopyFile(w.filePath, archivePath, -1); err != nil {
+			return err
+		}
+		if err := os.Remove(w.filePath); err != nil {
+			return err
+		}
+	}
+	return common.SyncDir(w.archiveDir)
+}
@@ -0,0 +1,98 @@
+package wal
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+	"github.com/stretchr/testify/assert"
+)
+
+var errWriteFailed = errors.New("write failed")
+
+// failingFile is a log file whose writes write only part of the record and fail while fail is set, and whose
+// truncation fails while failTruncate is set.
+type failingFile struct {
+	*os.File
+	fail         bool
+	failTruncate bool
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if f.fail {
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, errWriteFailed
+	}
+	return f.File.Write(p)
+}
+
+func (f *failingFile) Truncate(size int64) error {
+	if f.failTruncate {
+		return errWriteFailed
+	}
+	return f.File.Truncate(size)
+}
+
+// newFailingWal returns a log written through a failingFile, which is kept when closed.
+func newFailingWal(t *testing.T) (*Wal, *failingFile) {
+	writer, err := NewWriterCloser(t.TempDir(), NoSync())
+	assert.NoError(t, err)
+	w := writer.(*Wal)
+	file := &failingFile{File: w.file.(*os.File)}
+	w.file = file
+	w.keep = true
+	t.Cleanup(func() { w.Close() })
+	return w, file
+}
+
+func batch(key string) []common.Chunk {
+	return []common.Chunk{{Key: key, Value: []byte("v")}}
+}
+
+// readKeys reads back the keys of every record of the log at filePath, stopping at a torn record at its end as
+// recovery does.
+func readKeys(t *testing.T, filePath string) []string {
+	reader, err := NewReader(filePath)
+	assert.NoError(t, err)
+	defer reader.Close()
+	var keys []string
+	for {
+		chunks, err := reader.ReadBatch()
+		if err == io.EOF || err == ErrIncompleteRecord {
+			return keys
+		}
+		if !assert.NoError(t, err) {
+			return keys
+		}
+		keys = append(keys, chunks[0].Key)
+	}
+}
+
+func TestWal_WriteBatchFailure(t *testing.T) {
+	w, file := newFailingWal(t)
+	_, err := w.WriteBatch(batch("a"))
+	assert.NoError(t, err)
+
+	// 写了一半的记录被截掉，之后的记录仍能恢复
+	file.fail = true
+	_, err = w.WriteBatch(batch("b"))
+	assert.ErrorIs(t, err, errWriteFailed)
+	file.fail = false
+	offset, err := w.WriteBatch(batch("c"))
+	assert.NoError(t, err)
+	info, err := os.Stat(w.filePath)
+	assert.NoError(t, err)
+	assert.Equal(t, info.Size(), offset)
+	assert.Equal(t, []string{"a", "c"}, readKeys(t, w.filePath))
+
+	// 无法截掉时之后的写入都失败
+	file.fail, file.failTruncate = true, true
+	_, err = w.WriteBatch(batch("d"))
+	assert.ErrorIs(t, err, errWriteFailed)
+	file.fail, file.failTruncate = false, false
+	_, err = w.WriteBatch(batch("e"))
+	assert.Error(t, err)
+	assert.Equal(t, []string{"a", "c"}, readKeys(t, w.filePath))
+}
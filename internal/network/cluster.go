@@ -0,0 +1,211 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Jasonbourne723/platodb/internal/raft"
+)
+
+// clusterTimeout bounds how long a write or a change of the servers waits to be committed by the cluster.
+const clusterTimeout = 10 * time.Second
+
+// clusterDisabledReply is the reply to CLUSTER on a server that is not in a cluster.
+const clusterDisabledReply = "-ERR This instance has cluster support disabled\r\n"
+
+// raftStateMachine applies the write commands committed by the cluster to the database of the processor, and
+// snapshots it with checkpoints.
+type raftStateMachine struct {
+	processor *CommandProcessor
+}
+
+// StartRaft makes the server the server id of a Raft cluster, keeping the log in dir and reaching the other servers
+// through transport. From then on, the write commands outside MULTI are proposed to the cluster and run once
+// committed, on every server in the same order; only the leader accepts them. Reads are served by every server from
+// its own database, which may lag behind the leader. Expiration times are counted from when each server runs the
+// write.
+// A server that already has state in dir resumes from it. Otherwise, a server given bootstrap, every server of the
+// cluster with itself among them, starts a new cluster whose first snapshot is its data, while a server given none
+// starts empty, to be added to an existing cluster, and refuses to start if its database has been written to rather
+// than drop its data. It needs DatabaseOpener, and dir must be outside the data directory, on the same file system.
+func (processor *CommandProcessor) StartRaft(id string, dir string, transport raft.Transport, bootstrap []raft.Server,
+	options ...raft.Options) error {
+	if processor.open == nil {
+		return errors.New("raft needs a database opener")
+	}
+	if processor.replica.Load() != nil {
+		return errors.New("a replica cannot join a raft cluster")
+	}
+	dataDir, err := filepath.Abs(processor.database().DataDir())
+	if err != nil {
+		return err
+	}
+	raftDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(dataDir, raftDir); err == nil && filepath.IsLocal(rel) {
+		return errors.New("raft directory must be outside the data directory")
+	}
+	if len(bootstrap) == 0 {
+		hasState, err := raft.HasState(dir)
+		if err != nil {
+			return err
+		}
+		if !hasState && processor.database().LastSequence() > 0 {
+			return errors.New("a server joining a raft cluster must start with an empty database, or bootstrap the cluster")
+		}
+	}
+
+	options = append(append([]raft.Options(nil), options...), raft.Bootstrap(bootstrap...))
+	r, err := raft.NewRaft(id, dir, &raftStateMachine{processor: processor}, transport, options...)
+	if err != nil {
+		return err
+	}
+	processor.raft = r
+	return nil
+}
+
+// Apply runs a write command committed by the cluster against the database, returning its reply.
+func (m *raftStateMachine) Apply(index uint64, command []byte) interface{} {
+	name, cfName, args, err := decodeClusterCommand(command)
+	if err != nil {
+		return "-ERR " + err.Error() + "\r\n"
+	}
+	processor := m.processor
+	processor.lock.RLock()
+	defer processor.lock.RUnlock()
+	cf, err := processor.db.ColumnFamily(cfName)
+	if err != nil {
+		return "-ERR " + err.Error() + "\r\n"
+	}
+	handler, ok := processor.commands[name]
+	if !ok {
+		return "-ERR unknown command\r\n"
+	}
+	return handler(&Session{authenticated: true, db: processor.db, columnFamily: cf}, args)
+}
+
+// Snapshot writes a checkpoint of the database to dir.
+func (m *raftStateMachine) Snapshot(dir string) error {
+	m.processor.lock.RLock()
+	defer m.processor.lock.RUnlock()
+	return m.processor.db.Checkpoint(dir)
+}
+
+// Restore replaces the database with the checkpoint in dir.
+func (m *raftStateMachine) Restore(dir string) error {
+	return m.processor.installCheckpoint(dir)
+}
+
+// propose proposes a write command of the session to the cluster and returns its reply once committed and run.
+func (processor *CommandProcessor) propose(session *Session, command string, args []string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), clusterTimeout)
+	defer cancel()
+	reply, err := processor.raft.Apply(ctx, encodeClusterCommand(command, session.columnFamily.Name(), args))
+	if err != nil {
+		return processor.clusterErrorReply(err)
+	}
+	return reply.(string)
+}
+
+// clusterErrorReply returns the reply to a command the cluster failed to commit. A server that is not the leader
+// names the leader, if it knows it, as -NOTLEADER id address.
+func (processor *CommandProcessor) clusterErrorReply(err error) string {
+	if !errors.Is(err, raft.ErrNotLeader) {
+		return "-ERR " + err.Error() + "\r\n"
+	}
+	status := processor.raft.Status()
+	for _, server := range status.Servers {
+		if server.ID == status.Leader {
+			return fmt.Sprintf("-NOTLEADER %s %s\r\n", server.ID, server.Address)
+		}
+	}
+	return "-CLUSTERDOWN The cluster has no leader\r\n"
+}
+
+// clusterCommand manages the Raft cluster of the server:
+//
+//	CLUSTER ADD id address   adds the server id, reached at address, to the cluster
+//	CLUSTER REMOVE id        removes the server id from the cluster
+//	CLUSTER NODES            lists the servers of the cluster as id address role, marking the server itself
+//	CLUSTER INFO             describes the state of the server in the cluster
+//
+// ADD and REMOVE must be sent to the leader, and reply once the change is committed.
+func (processor *CommandProcessor) clusterCommand(session *Session, args []string) string {
+	if processor.raft == nil {
+		return clusterDisabledReply
+	}
+	if len(args) == 0 {
+		return "-ERR wrong number of arguments for 'CLUSTER' command\r\n"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clusterTimeout)
+	defer cancel()
+	switch strings.ToUpper(args[0]) {
+	case "ADD":
+		if len(args) != 3 {
+			return "-ERR wrong number of arguments for 'CLUSTER ADD' command\r\n"
+		}
+		if err := processor.raft.AddServer(ctx, raft.Server{ID: args[1], Address: args[2]}); err != nil {
+			return processor.clusterErrorReply(err)
+		}
+		return "+OK\r\n"
+	case "REMOVE":
+		if len(args) != 2 {
+			return "-ERR wrong number of arguments for 'CLUSTER REMOVE' command\r\n"
+		}
+		if err := processor.raft.RemoveServer(ctx, args[1]); err != nil {
+			return processor.clusterErrorReply(err)
+		}
+		return "+OK\r\n"
+	case "NODES":
+		status := processor.raft.Status()
+		var nodes strings.Builder
+		for _, server := range status.Servers {
+			role := "follower"
+			if server.ID == status.Leader {
+				role = "leader"
+			}
+			fmt.Fprintf(&nodes, "%s %s %s", server.ID, server.Address, role)
+			if server.ID == status.ID {
+				nodes.WriteString(" myself")
+			}
+			nodes.WriteString("\n")
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", nodes.Len(), nodes.String())
+	case "INFO":
+		status := processor.raft.Status()
+		info := fmt.Sprintf("raft_state:%s\r\nraft_term:%d\r\nraft_leader:%s\r\nraft_servers:%d\r\n"+
+			"raft_commit_index:%d\r\nraft_applied_index:%d\r\n",
+			status.State, status.Term, status.Leader, len(status.Servers), status.CommitIndex, status.AppliedIndex)
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(info), info)
+	default:
+		return "-ERR unknown subcommand for 'CLUSTER' command\r\n"
+	}
+}
+
+// encodeClusterCommand encodes a write command run on the column family cfName as a RESP array of the command
+// name, cfName and args.
+func encodeClusterCommand(command string, cfName string, args []string) []byte {
+	var buf bytes.Buffer
+	writeFrame(&buf, append([]string{command, cfName}, args...)...)
+	return buf.Bytes()
+}
+
+// decodeClusterCommand decodes a command encoded by encodeClusterCommand.
+func decodeClusterCommand(data []byte) (string, string, []string, error) {
+	command, args, err := parseRESP(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return "", "", nil, err
+	}
+	if len(args) == 0 {
+		return "", "", nil, errors.New("invalid cluster command")
+	}
+	return command, args[0], args[1:], nil
+}
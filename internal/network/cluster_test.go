@@ -0,0 +1,150 @@
+package network
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Jasonbourne723/platodb/internal/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+var testRaftOptions = []raft.Options{
+	raft.ElectionTimeout(100 * time.Millisecond),
+	raft.HeartbeatInterval(20 * time.Millisecond),
+	raft.SnapshotThreshold(20),
+}
+
+// startClusterServer starts a server in the cluster of network, bootstrapping it with servers, if any.
+func startClusterServer(t *testing.T, network *raft.InmemNetwork, server raft.Server, servers ...raft.Server) *testClient {
+	dir := t.TempDir()
+	processor := newTestProcessor(t, filepath.Join(dir, "data"))
+	assert.NoError(t, processor.StartRaft(server.ID, filepath.Join(dir, "raft"), network.Transport(server.Address), servers, testRaftOptions...))
+	return newTestClient(t, serveTestProcessor(t, processor))
+}
+
+// clusterInfoField returns the value of a field of CLUSTER INFO.
+func (c *testClient) clusterInfoField(field string) string {
+	for _, line := range strings.Split(c.do("CLUSTER", "INFO"), "\r\n") {
+		if value, ok := strings.CutPrefix(line, field+":"); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// waitValue waits until every client reads value for key.
+func waitValue(t *testing.T, clients []*testClient, key string, value string) {
+	for _, c := range clients {
+		assert.Eventually(t, func() bool { return c.do("GET", key) == value }, 5*time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	network := raft.NewInmemNetwork()
+	var servers []raft.Server
+	for i := 1; i <= 3; i++ {
+		servers = append(servers, raft.Server{ID: fmt.Sprintf("node%d", i), Address: fmt.Sprintf("addr%d", i)})
+	}
+	var clients []*testClient
+	for _, server := range servers {
+		clients = append(clients, startClusterServer(t, network, server, servers...))
+	}
+
+	var leader *testClient
+	var leaderID string
+	assert.Eventually(t, func() bool {
+		for i, c := range clients {
+			if c.clusterInfoField("raft_state") == "leader" {
+				leader, leaderID = c, servers[i].ID
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	if leader == nil {
+		t.FailNow()
+	}
+
+	// 写入经领导者提交后在每个服务器上执行
+	assert.Equal(t, "+OK", leader.do("SET", "a", "1"))
+	assert.Equal(t, ":11", leader.do("INCRBY", "a", "10"))
+	assert.Equal(t, "+OK", leader.do("SET", "b", "2"))
+	assert.Equal(t, "+OK", leader.do("DEL", "b"))
+	waitValue(t, clients, "a", "11")
+	waitValue(t, clients, "b", "")
+
+	// 跟随者拒绝写入并指出领导者，事务中不能写入
+	for _, c := range clients {
+		if c != leader {
+			assert.Equal(t, "-NOTLEADER "+leaderID+" "+addressOf(servers, leaderID), c.do("SET", "a", "2"))
+		}
+	}
+	assert.Equal(t, "+OK", leader.do("MULTI"))
+	assert.True(t, strings.HasPrefix(leader.do("SET", "a", "2"), "-ERR"))
+	assert.True(t, strings.HasPrefix(leader.do("EXEC"), "-EXECABORT"))
+	assert.True(t, strings.HasPrefix(leader.do("REPLICAOF", "127.0.0.1", "6399"), "-ERR"))
+	assert.Equal(t, "3", leader.clusterInfoField("raft_servers"))
+
+	// 日志压缩后新加入的服务器从数据库快照开始同步
+	for i := 0; i < 50; i++ {
+		assert.Equal(t, "+OK", leader.do("SET", fmt.Sprintf("k%d", i), fmt.Sprint(i)))
+	}
+	fourth := raft.Server{ID: "node4", Address: "addr4"}
+	joined := startClusterServer(t, network, fourth)
+	assert.Equal(t, "+OK", leader.do("CLUSTER", "ADD", fourth.ID, fourth.Address))
+	assert.Equal(t, "+OK", leader.do("SET", "after", "1"))
+	waitValue(t, append(clients, joined), "after", "1")
+	assert.Equal(t, "49", joined.do("GET", "k49"))
+	assert.Equal(t, "11", joined.do("GET", "a"))
+	nodes := leader.do("CLUSTER", "NODES")
+	assert.Len(t, strings.Split(strings.TrimSpace(nodes), "\n"), 4)
+	assert.Contains(t, nodes, leaderID+" "+addressOf(servers, leaderID)+" leader myself\n")
+	assert.Contains(t, nodes, "node4 addr4 follower\n")
+
+	assert.Equal(t, "+OK", leader.do("CLUSTER", "REMOVE", fourth.ID))
+	assert.Equal(t, "3", leader.clusterInfoField("raft_servers"))
+	assert.True(t, strings.HasPrefix(leader.do("CLUSTER", "REMOVE", fourth.ID), "-ERR"))
+	assert.True(t, strings.HasPrefix(leader.do("CLUSTER", "FAILOVER"), "-ERR"))
+
+	srv := startTestServer(t)
+	assert.Equal(t, strings.TrimSuffix(clusterDisabledReply, "\r\n"), newTestClient(t, srv).do("CLUSTER", "INFO"))
+}
+
+func TestStartRaft_WrittenDatabase(t *testing.T) {
+	dir := t.TempDir()
+	dataDir, raftDir := filepath.Join(dir, "data"), filepath.Join(dir, "raft")
+	server := raft.Server{ID: "node1", Address: "addr1"}
+	network := raft.NewInmemNetwork()
+	processor := newTestProcessor(t, dataDir)
+	assert.NoError(t, processor.database().Set("a", []byte("1")))
+
+	// 未初始化集群也没有集群状态时，不清空已写入的数据库
+	assert.Error(t, processor.StartRaft(server.ID, raftDir, network.Transport(server.Address), nil, testRaftOptions...))
+	value, err := processor.database().Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), value)
+
+	// 初始化集群后重启时从集群状态恢复
+	assert.NoError(t, processor.StartRaft(server.ID, raftDir, network.Transport(server.Address),
+		[]raft.Server{server}, testRaftOptions...))
+	processor.flush()
+	processor = newTestProcessor(t, dataDir)
+	defer processor.flush()
+	assert.NoError(t, processor.StartRaft(server.ID, raftDir, network.Transport(server.Address), nil, testRaftOptions...))
+	value, err = processor.database().Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), value)
+}
+
+// addressOf returns the address of the server id.
+func addressOf(servers []raft.Server, id string) string {
+	for _, server := range servers {
+		if server.ID == id {
+			return server.Address
+		}
+	}
+	return ""
+}
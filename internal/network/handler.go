@@ -2,40 +2,87 @@ package network
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Jasonbourne723/platodb/internal/database"
+	"github.com/Jasonbourne723/platodb/internal/raft"
 )
 
 const (
 	requeiredPass = "123"
 )
 
-type commandHandler func(args []string) string
+type commandHandler func(session *Session, args []string) string
 
+// CommandProcessor runs the commands of the connections against the database. A replica replaces the database with
+// a checkpoint of its primary on every full sync, and a member of a Raft cluster with a snapshot of the cluster:
+// lock guards db, which commands read under the read lock. raft is set once, by StartRaft, before serving commands.
 type CommandProcessor struct {
-	db       *database.DB
-	commands map[string]commandHandler
+	db              *database.DB
+	commands        map[string]commandHandler
+	lock            *sync.RWMutex
+	open            func() (*database.DB, error)
+	replicationLock *sync.Mutex
+	replica         atomic.Pointer[replica]
+	replicas        int32
+	raft            *raft.Raft
+}
+
+// ProcessorOptions defines a function type that accepts a pointer to CommandProcessor and modifies its configuration.
+type ProcessorOptions func(processor *CommandProcessor)
+
+// DatabaseOpener sets how the database is opened again once a replica has replaced its data directory with the
+// checkpoint of its primary. It must open the database at the same data directory. Without it, REPLICAOF is refused.
+func DatabaseOpener(open func() (*database.DB, error)) ProcessorOptions {
+	return func(processor *CommandProcessor) {
+		processor.open = open
+	}
 }
 
 // NewCommandProcessor initializes and returns a new CommandProcessor instance.
-// It sets up the initial command handlers for "ping", "get", "set", and "del" commands.
+// It sets up the initial command handlers for "ping", "get", "set", "del", "delrange", "expire", "ttl", "persist",
+// "incrby", "append", "select", "watch", "multi", "exec", "discard", "backup", "replicaof", "info" and "cluster"
+// commands; INCRBY and APPEND need the database to be opened with MergeOperator, and REPLICAOF needs DatabaseOpener.
 // The provided database instance is used to execute the corresponding database operations.
 // Parameters:
 // - db (*database.DB): The database connection instance to be used by the CommandProcessor.
 // Returns:
 // - *CommandProcessor: A newly configured CommandProcessor instance ready to process commands.
-func NewCommandProcessor(db *database.DB) *CommandProcessor {
+func NewCommandProcessor(db *database.DB, options ...ProcessorOptions) *CommandProcessor {
 
 	processor := &CommandProcessor{
-		db:       db,
-		commands: make(map[string]commandHandler),
+		db:              db,
+		commands:        make(map[string]commandHandler),
+		lock:            &sync.RWMutex{},
+		replicationLock: &sync.Mutex{},
+	}
+	for _, option := range options {
+		option(processor)
 	}
 
 	processor.RegisterCommand("ping", processor.pingCommand)
 	processor.RegisterCommand("get", processor.getCommand)
 	processor.RegisterCommand("set", processor.setCommand)
 	processor.RegisterCommand("del", processor.delCommand)
+	processor.RegisterCommand("delrange", processor.delRangeCommand)
+	processor.RegisterCommand("expire", processor.expireCommand)
+	processor.RegisterCommand("ttl", processor.ttlCommand)
+	processor.RegisterCommand("persist", processor.persistCommand)
+	processor.RegisterCommand("incrby", processor.incrByCommand)
+	processor.RegisterCommand("append", processor.appendCommand)
+	processor.RegisterCommand("select", processor.selectCommand)
+	processor.RegisterCommand("watch", processor.watchCommand)
+	processor.RegisterCommand("multi", processor.multiCommand)
+	processor.RegisterCommand("exec", processor.execCommand)
+	processor.RegisterCommand("discard", processor.discardCommand)
+	processor.RegisterCommand("backup", processor.backupCommand)
+	processor.RegisterCommand("replicaof", processor.replicaOfCommand)
+	processor.RegisterCommand("info", processor.infoCommand)
+	processor.RegisterCommand("cluster", processor.clusterCommand)
 
 	return processor
 }
@@ -50,24 +97,50 @@ func (processor *CommandProcessor) RegisterCommand(command string, handler comma
 	processor.commands[strings.ToUpper(command)] = handler
 }
 
-// flush shuts down the database connection associated with the CommandProcessor instance.
+// flush stops following the primary, if the server is a replica, leaves the Raft cluster, if it is in one, and shuts
+// down the database.
 func (processor *CommandProcessor) flush() {
+	processor.stopReplication()
+	if processor.raft != nil {
+		processor.raft.Shutdown()
+	}
+	processor.lock.Lock()
+	defer processor.lock.Unlock()
 	processor.db.Shutdown()
 }
 
 // pingCommand responds to the "PING" command with a "+PONG\r\n" message, indicating service availability.
-func (processor *CommandProcessor) pingCommand(args []string) string {
+func (processor *CommandProcessor) pingCommand(session *Session, args []string) string {
 	return "+PONG\r\n"
 }
 
-// setCommand sets a key-value pair in the database if provided with exactly two arguments.
-// Returns an error message if the number of arguments is incorrect or if the database operation fails.
+// setCommand sets a key-value pair in the database, given as SET key value [EX seconds|PX milliseconds].
+// The EX and PX options make the key expire after the given time; without them the key never expires.
+// Returns an error message if the arguments are incorrect or if the database operation fails.
 // Otherwise, confirms successful operation.
-func (processor *CommandProcessor) setCommand(args []string) string {
-	if len(args) != 2 {
+func (processor *CommandProcessor) setCommand(session *Session, args []string) string {
+	if len(args) != 2 && len(args) != 4 {
 		return "-ERR wrong number of arguments for 'SET' command\r\n"
 	}
-	err := processor.db.Set(args[0], []byte(args[1]))
+	var err error
+	if len(args) == 4 {
+		var unit time.Duration
+		switch strings.ToUpper(args[2]) {
+		case "EX":
+			unit = time.Second
+		case "PX":
+			unit = time.Millisecond
+		default:
+			return "-ERR syntax error\r\n"
+		}
+		ttl, parseErr := strconv.ParseInt(args[3], 10, 64)
+		if parseErr != nil || ttl <= 0 {
+			return "-ERR invalid expire time in 'SET' command\r\n"
+		}
+		err = session.columnFamily.SetWithTTL(args[0], []byte(args[1]), time.Duration(ttl)*unit)
+	} else {
+		err = session.columnFamily.Set(args[0], []byte(args[1]))
+	}
 	if err != nil {
 		return "-ERR " + err.Error()
 	}
@@ -79,13 +152,13 @@ func (processor *CommandProcessor) setCommand(args []string) string {
 // it returns an error message. If the key is not found in the database,
 // it returns a special response indicating a nil value. Otherwise, it returns
 // the value prefixed with its length in bytes.
-func (processor *CommandProcessor) getCommand(args []string) string {
+func (processor *CommandProcessor) getCommand(session *Session, args []string) string {
 	if len(args) != 1 {
 		return "-ERR wrong number of arguments for 'GET' command\r\n"
 	}
-	value, err := processor.db.Get(args[0])
+	value, err := session.columnFamily.Get(args[0])
 	if err != nil {
-		return "$-1\r\n"
+		return "-ERR " + err.Error() + "\r\n"
 	}
 	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
 }
@@ -93,13 +166,174 @@ func (processor *CommandProcessor) getCommand(args []string) string {
 // delCommand deletes a key from the database if provided with exactly one argument.
 // Returns an error message if the number of arguments is incorrect or if the deletion fails.
 // Otherwise, confirms successful operation with "+OK\r\n".
-func (processor *CommandProcessor) delCommand(args []string) string {
+func (processor *CommandProcessor) delCommand(session *Session, args []string) string {
 	if len(args) != 1 {
 		return "-ERR wrong number of arguments for 'GET' command\r\n"
 	}
-	err := processor.db.Del(args[0])
+	err := session.columnFamily.Del(args[0])
 	if err != nil {
 		return "-ERR " + err.Error()
 	}
 	return "+OK\r\n"
 }
+
+// delRangeCommand deletes every key in [start, end) from the database, given as DELRANGE start end.
+// Returns an error message if the arguments are incorrect or if the deletion fails.
+// Otherwise, confirms successful operation with "+OK\r\n".
+func (processor *CommandProcessor) delRangeCommand(session *Session, args []string) string {
+	if len(args) != 2 {
+		return "-ERR wrong number of arguments for 'DELRANGE' command\r\n"
+	}
+	if err := session.columnFamily.DeleteRange(args[0], args[1]); err != nil {
+		return "-ERR " + err.Error() + "\r\n"
+	}
+	return "+OK\r\n"
+}
+
+// expireCommand sets a timeout in seconds on a key, given as EXPIRE key seconds.
+// A timeout that is not positive deletes the key.
+// Replies with 1 if the timeout was set and 0 if the key does not exist.
+func (processor *CommandProcessor) expireCommand(session *Session, args []string) string {
+	if len(args) != 2 {
+		return "-ERR wrong number of arguments for 'EXPIRE' command\r\n"
+	}
+	seconds, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return "-ERR value is not an integer or out of range\r\n"
+	}
+	updated, err := session.columnFamily.Expire(args[0], time.Duration(seconds)*time.Second)
+	if err != nil {
+		return "-ERR " + err.Error() + "\r\n"
+	}
+	return integerReply(updated)
+}
+
+// ttlCommand returns the remaining time to live of a key in seconds, given as TTL key.
+// Replies with -2 if the key does not exist and -1 if it exists but never expires.
+func (processor *CommandProcessor) ttlCommand(session *Session, args []string) string {
+	if len(args) != 1 {
+		return "-ERR wrong number of arguments for 'TTL' command\r\n"
+	}
+	ttl, exists, err := session.columnFamily.TTL(args[0])
+	if err != nil {
+		return "-ERR " + err.Error() + "\r\n"
+	}
+	switch {
+	case !exists:
+		return ":-2\r\n"
+	case ttl == 0:
+		return ":-1\r\n"
+	}
+	// 与 Redis 一致，剩余时间按秒四舍五入
+	return fmt.Sprintf(":%d\r\n", (ttl+500*time.Millisecond)/time.Second)
+}
+
+// persistCommand removes the timeout of a key, given as PERSIST key.
+// Replies with 1 if the timeout was removed and 0 if the key does not exist or has no timeout.
+func (processor *CommandProcessor) persistCommand(session *Session, args []string) string {
+	if len(args) != 1 {
+		return "-ERR wrong number of arguments for 'PERSIST' command\r\n"
+	}
+	updated, err := session.columnFamily.Persist(args[0])
+	if err != nil {
+		return "-ERR " + err.Error() + "\r\n"
+	}
+	return integerReply(updated)
+}
+
+// incrByCommand adds an integer to the value of a key, given as INCRBY key increment, a missing key counting as 0.
+// The increment is applied to the current value under the write lock and the reply is the resulting value.
+// Returns an error message if the arguments are incorrect, or if the value is not an integer, in which case
+// nothing is written.
+func (processor *CommandProcessor) incrByCommand(session *Session, args []string) string {
+	if len(args) != 2 {
+		return "-ERR wrong number of arguments for 'INCRBY' command\r\n"
+	}
+	increment, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return "-ERR value is not an integer or out of range\r\n"
+	}
+	operand := strconv.AppendInt([]byte{incrByOperand}, increment, 10)
+	value, err := session.columnFamily.MergeChecked(args[0], operand)
+	if err != nil {
+		return "-ERR " + err.Error() + "\r\n"
+	}
+	return fmt.Sprintf(":%s\r\n", value)
+}
+
+// appendCommand appends a value to the value of a key, given as APPEND key value, a missing key counting as empty.
+// The value is merged without reading the key first; the reply is the length of the value read once it is written.
+// Returns an error message if the arguments are incorrect or if the database operation fails.
+func (processor *CommandProcessor) appendCommand(session *Session, args []string) string {
+	if len(args) != 2 {
+		return "-ERR wrong number of arguments for 'APPEND' command\r\n"
+	}
+	operand := append([]byte{appendOperand}, args[1]...)
+	if err := session.columnFamily.Merge(args[0], operand); err != nil {
+		return "-ERR " + err.Error() + "\r\n"
+	}
+	value, err := session.columnFamily.Get(args[0])
+	if err != nil {
+		return "-ERR " + err.Error() + "\r\n"
+	}
+	return fmt.Sprintf(":%d\r\n", len(value))
+}
+
+// selectCommand chooses the column family the following commands of the connection operate on, given as SELECT name.
+// Connections start on the default column family; the others are created at startup from column_families in the
+// configuration.
+// Returns an error message if the arguments are incorrect or if the column family does not exist.
+func (processor *CommandProcessor) selectCommand(session *Session, args []string) string {
+	if len(args) != 1 {
+		return "-ERR wrong number of arguments for 'SELECT' command\r\n"
+	}
+	cf, err := processor.db.ColumnFamily(args[0])
+	if err != nil {
+		return "-ERR " + err.Error() + "\r\n"
+	}
+	session.columnFamily = cf
+	return "+OK\r\n"
+}
+
+// backupCommand writes a consistent copy of the whole database to a directory of the server, given as BACKUP dir.
+// The directory must not exist or be empty; the copy opens as a database of its own.
+// Replies once the copy is complete, or with an error message if it failed.
+func (processor *CommandProcessor) backupCommand(session *Session, args []string) string {
+	if len(args) != 1 {
+		return "-ERR wrong number of arguments for 'BACKUP' command\r\n"
+	}
+	if err := processor.db.Checkpoint(args[0]); err != nil {
+		return "-ERR " + err.Error() + "\r\n"
+	}
+	return "+OK\r\n"
+}
+
+// newSession returns the state of a new connection, authenticated or not, on the default column family.
+func (processor *CommandProcessor) newSession() *Session {
+	db := processor.database()
+	return &Session{db: db, columnFamily: db.DefaultColumnFamily()}
+}
+
+// refreshSession moves the session to the current database of the processor once a full sync has replaced the one
+// it was using, keeping its column family by name. A transaction it had open is rolled back.
+// The caller must hold the read lock.
+func (processor *CommandProcessor) refreshSession(session *Session) {
+	if session.db == processor.db {
+		return
+	}
+	session.close()
+	cf, err := processor.db.ColumnFamily(session.columnFamily.Name())
+	if err != nil {
+		cf = processor.db.DefaultColumnFamily()
+	}
+	session.db = processor.db
+	session.columnFamily = cf
+}
+
+// integerReply encodes a boolean as the RESP integer 1 or 0.
+func integerReply(ok bool) string {
+	if ok {
+		return ":1\r\n"
+	}
+	return ":0\r\n"
+}
@@ -0,0 +1,43 @@
+package network
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectCommand(t *testing.T) {
+	srv := startTestServer(t)
+	_, err := srv.processor.database().CreateColumnFamily("users")
+	assert.NoError(t, err)
+	c := newTestClient(t, srv)
+	other := newTestClient(t, srv)
+
+	// 各列族的键互不影响，每个连接各自选择列族
+	assert.Equal(t, "+OK", c.do("SET", "k", "default"))
+	assert.Equal(t, "+OK", c.do("SELECT", "users"))
+	assert.Equal(t, "", c.do("GET", "k"))
+	assert.Equal(t, "+OK", c.do("SET", "k", "users"))
+	assert.Equal(t, "users", c.do("GET", "k"))
+	assert.Equal(t, "default", other.do("GET", "k"))
+	assert.Equal(t, "+OK", other.do("DEL", "k"))
+	assert.Equal(t, "users", c.do("GET", "k"))
+
+	assert.Equal(t, "+OK", c.do("SELECT", "default"))
+	assert.Equal(t, "", c.do("GET", "k"))
+	assert.True(t, strings.HasPrefix(c.do("SELECT", "missing"), "-ERR"))
+}
+
+func TestIncrByCommand(t *testing.T) {
+	c := newTestClient(t, startTestServer(t))
+	assert.Equal(t, ":5", c.do("INCRBY", "n", "5"))
+	assert.Equal(t, ":3", c.do("INCRBY", "n", "-2"))
+
+	// 值不是整数时不写入，键仍可读写
+	assert.Equal(t, "+OK", c.do("SET", "k", "abc"))
+	assert.True(t, strings.HasPrefix(c.do("INCRBY", "k", "3"), "-ERR"))
+	assert.Equal(t, "abc", c.do("GET", "k"))
+	assert.Equal(t, ":4", c.do("APPEND", "k", "x"))
+	assert.Equal(t, "abcx", c.do("GET", "k"))
+}
@@ -0,0 +1,82 @@
+package network
+
+import (
+	"errors"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+// Operands merged by the commands start with the byte naming the built-in operator they are for,
+// so that INCRBY and APPEND can both be used in the same column family.
+const (
+	incrByOperand byte = '+'
+	appendOperand byte = 'a'
+)
+
+var errUnknownOperand = errors.New("unknown merge operand")
+
+// commandOperators maps the first byte of an operand to the built-in operator it is applied with.
+var commandOperators = map[byte]common.MergeOperator{
+	incrByOperand: common.Int64Add{},
+	appendOperand: common.StringAppend{},
+}
+
+// MergeOperator returns the merge operator the INCRBY and APPEND commands rely on, which the database must be opened with.
+func MergeOperator() common.MergeOperator {
+	return commandMergeOperator{}
+}
+
+// commandMergeOperator applies every run of consecutive operands of the same command with the built-in operator
+// of that command, in order.
+type commandMergeOperator struct{}
+
+// Name implements common.MergeOperator.
+func (commandMergeOperator) Name() string {
+	return "resp"
+}
+
+// FullMerge implements common.MergeOperator.
+func (commandMergeOperator) FullMerge(key string, existing []byte, operands [][]byte) ([]byte, error) {
+	value := existing
+	for start := 0; start < len(operands); {
+		operator, run, err := operandRun(operands[start:])
+		if err != nil {
+			return nil, err
+		}
+		if value, err = operator.FullMerge(key, value, run); err != nil {
+			return nil, err
+		}
+		start += len(run)
+	}
+	return value, nil
+}
+
+// PartialMerge implements common.MergeOperator. Only operands of the same command are combined.
+func (commandMergeOperator) PartialMerge(key string, operands [][]byte) ([]byte, bool) {
+	operator, run, err := operandRun(operands)
+	if err != nil || len(run) != len(operands) {
+		return nil, false
+	}
+	operand, ok := operator.PartialMerge(key, run)
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{operands[0][0]}, operand...), true
+}
+
+// operandRun returns the operator of the first operand and the operands that follow it for the same command,
+// without their first byte.
+func operandRun(operands [][]byte) (common.MergeOperator, [][]byte, error) {
+	if len(operands[0]) == 0 || commandOperators[operands[0][0]] == nil {
+		return nil, nil, errUnknownOperand
+	}
+	kind := operands[0][0]
+	run := make([][]byte, 0, len(operands))
+	for _, operand := range operands {
+		if len(operand) == 0 || operand[0] != kind {
+			break
+		}
+		run = append(run, operand[1:])
+	}
+	return commandOperators[kind], run, nil
+}
@@ -0,0 +1,606 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jasonbourne723/platodb/internal/database"
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+// Replication runs over the RESP port. A replica authenticates with AUTH and sends SYNC; the primary replies with
+// +FULLRESYNC seq, sends the files of a checkpoint holding every write up to seq as FILE path data frames, then END,
+// and from then on streams every batch written after seq as a BATCH seq payload frame, where seq is the last sequence
+// number of the batch and payload its encoded operations. PING frames keep an idle link alive.
+// Every frame is a RESP array of bulk strings.
+const (
+	replicaPingInterval  = time.Second
+	replicaTimeout       = 10 * time.Second
+	replicaRetryInterval = time.Second
+	replicaSyncSuffix    = ".sync"
+)
+
+// writeCommands are the commands a read-only replica refuses.
+var writeCommands = map[string]struct{}{
+	"SET":      {},
+	"DEL":      {},
+	"DELRANGE": {},
+	"EXPIRE":   {},
+	"PERSIST":  {},
+	"INCRBY":   {},
+	"APPEND":   {},
+}
+
+// readOnlyReply is the reply of a replica to a write command.
+const readOnlyReply = "-READONLY You can't write against a read only replica.\r\n"
+
+// replica follows a primary: it replaces the database of the processor with a checkpoint of the primary, then applies
+// the batches the primary streams after it. Whenever the link breaks, it connects again and starts over from a new
+// checkpoint.
+type replica struct {
+	processor *CommandProcessor
+	address   string
+	offset    uint64
+	linkUp    int32
+	cancel    context.CancelFunc
+	stopped   chan struct{}
+}
+
+// startReplica starts following the primary at address.
+func startReplica(processor *CommandProcessor, address string) *replica {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &replica{
+		processor: processor,
+		address:   address,
+		cancel:    cancel,
+		stopped:   make(chan struct{}),
+	}
+	go r.run(ctx)
+	return r
+}
+
+// stop stops following the primary and waits for the batch being applied, if any.
+func (r *replica) stop() {
+	r.cancel()
+	<-r.stopped
+}
+
+// run follows the primary until ctx is cancelled, reconnecting after replicaRetryInterval whenever the link breaks.
+func (r *replica) run(ctx context.Context) {
+	defer close(r.stopped)
+	for {
+		err := r.follow(ctx)
+		atomic.StoreInt32(&r.linkUp, 0)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("replication from %s interrupted: %v\n", r.address, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(replicaRetryInterval):
+		}
+	}
+}
+
+// follow connects to the primary, loads its checkpoint and applies the batches it streams until the link breaks.
+func (r *replica) follow(ctx context.Context) error {
+	conn, err := net.DialTimeout("tcp", r.address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// 停止复制时关闭连接以中断阻塞的读取
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	reader := bufio.NewReader(conn)
+	if err := writeFrame(conn, "AUTH", requeiredPass); err != nil {
+		return err
+	}
+	if line, err := reader.ReadString('\n'); err != nil || line != "+OK\r\n" {
+		return fmt.Errorf("authentication failed: %q %v", line, err)
+	}
+	if err := writeFrame(conn, "SYNC"); err != nil {
+		return err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "+FULLRESYNC ") {
+		return fmt.Errorf("unexpected reply to SYNC: %q", strings.TrimSpace(line))
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "+FULLRESYNC ")), 10, 64)
+	if err != nil {
+		return fmt.Errorf("unexpected reply to SYNC: %q", strings.TrimSpace(line))
+	}
+
+	dir := r.processor.database().DataDir() + replicaSyncSuffix
+	if err := receiveCheckpoint(reader, dir); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("检查点接收失败:%w", err)
+	}
+	if err := r.processor.installCheckpoint(dir); err != nil {
+		return fmt.Errorf("检查点加载失败:%w", err)
+	}
+	atomic.StoreUint64(&r.offset, seq)
+	atomic.StoreInt32(&r.linkUp, 1)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(replicaTimeout))
+		name, count, err := readFrameHeader(reader)
+		if err != nil {
+			return err
+		}
+		switch {
+		case name == "PING" && count == 0:
+		case name == "BATCH" && count == 2:
+			seqArg, err := readBulk(reader)
+			if err != nil {
+				return err
+			}
+			payload, err := readBulk(reader)
+			if err != nil {
+				return err
+			}
+			seq, err := strconv.ParseUint(string(seqArg), 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid batch sequence number %q", seqArg)
+			}
+			chunks, err := decodeBatch(payload)
+			if err != nil {
+				return err
+			}
+			// 列族在检查点之后创建时无法应用，重新全量同步
+			if err := r.processor.apply(chunks); err != nil {
+				return fmt.Errorf("batch %d failed to apply: %w", seq, err)
+			}
+			atomic.StoreUint64(&r.offset, seq)
+		default:
+			return fmt.Errorf("unexpected replication frame %s", name)
+		}
+	}
+}
+
+// receiveCheckpoint writes the files of the checkpoint read from reader to dir, up to the END frame.
+func receiveCheckpoint(reader *bufio.Reader, dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := common.EnsureDirExists(dir); err != nil {
+		return err
+	}
+	for {
+		name, count, err := readFrameHeader(reader)
+		if err != nil {
+			return err
+		}
+		if name == "END" && count == 0 {
+			return common.SyncDir(dir)
+		}
+		if name != "FILE" || count != 2 {
+			return fmt.Errorf("unexpected checkpoint frame %s", name)
+		}
+		rel, err := readBulk(reader)
+		if err != nil {
+			return err
+		}
+		filePath := filepath.Join(dir, filepath.FromSlash(string(rel)))
+		if !strings.HasPrefix(filePath, filepath.Clean(dir)+string(filepath.Separator)) {
+			return fmt.Errorf("invalid checkpoint file %q", rel)
+		}
+		if err := receiveFile(reader, filePath); err != nil {
+			return err
+		}
+	}
+}
+
+// receiveFile writes the bulk string read from reader to a new file at filePath and syncs it.
+func receiveFile(reader *bufio.Reader, filePath string) error {
+	size, err := readBulkHeader(reader)
+	if err != nil {
+		return err
+	}
+	if err := common.EnsureDirExists(filepath.Dir(filePath)); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := io.CopyN(file, reader, int64(size)); err != nil {
+		return err
+	}
+	if _, err := reader.Discard(2); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// syncReplica serves a replica that sent SYNC on conn: it sends a checkpoint of the database, then streams the
+// batches written after it until the replica goes away, the stream falls behind or ctx is cancelled.
+func (processor *CommandProcessor) syncReplica(ctx context.Context, conn net.Conn) error {
+	dir, err := os.MkdirTemp("", "platodb-sync")
+	if err != nil {
+		conn.Write([]byte("-ERR " + err.Error() + "\r\n"))
+		return err
+	}
+	defer os.RemoveAll(dir)
+	stream, err := processor.database().StreamWrites(dir)
+	if err != nil {
+		conn.Write([]byte("-ERR " + err.Error() + "\r\n"))
+		return err
+	}
+	defer stream.Close()
+	atomic.AddInt32(&processor.replicas, 1)
+	defer atomic.AddInt32(&processor.replicas, -1)
+
+	writer := bufio.NewWriter(conn)
+	fmt.Fprintf(writer, "+FULLRESYNC %d\r\n", stream.Seq())
+	if err := sendCheckpoint(writer, dir); err != nil {
+		return err
+	}
+	if err := flushFrames(conn, writer); err != nil {
+		return err
+	}
+	os.RemoveAll(dir)
+
+	ticker := time.NewTicker(replicaPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := writeFrame(writer, "PING"); err != nil {
+				return err
+			}
+			if err := flushFrames(conn, writer); err != nil {
+				return err
+			}
+		case chunks, ok := <-stream.Batches():
+			if !ok {
+				return stream.Err()
+			}
+			seq := strconv.FormatUint(chunks[len(chunks)-1].Seq, 10)
+			if err := writeFrame(writer, "BATCH", seq, string(encodeBatch(chunks))); err != nil {
+				return err
+			}
+			// 还有待发送的批次时继续写入缓冲区，减少系统调用
+			if len(stream.Batches()) == 0 {
+				if err := flushFrames(conn, writer); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// sendCheckpoint writes every file under dir as a FILE frame, followed by the END frame.
+func sendCheckpoint(writer *bufio.Writer, dir string) error {
+	err := filepath.WalkDir(dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+		return sendFile(writer, filepath.ToSlash(rel), filePath)
+	})
+	if err != nil {
+		return err
+	}
+	return writeFrame(writer, "END")
+}
+
+// sendFile writes the file at filePath as a FILE frame naming it rel.
+func sendFile(writer *bufio.Writer, rel string, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(writer, "*3\r\n$4\r\nFILE\r\n$%d\r\n%s\r\n$%d\r\n", len(rel), rel, info.Size())
+	if _, err := io.CopyN(writer, file, info.Size()); err != nil {
+		return err
+	}
+	_, err = writer.WriteString("\r\n")
+	return err
+}
+
+// flushFrames sends the buffered frames, giving up once the replica has not read them for replicaTimeout.
+func flushFrames(conn net.Conn, writer *bufio.Writer) error {
+	conn.SetWriteDeadline(time.Now().Add(replicaTimeout))
+	return writer.Flush()
+}
+
+// checkpointBackupSuffix names the directory the data directory is moved to while a checkpoint is installed.
+const checkpointBackupSuffix = ".backup"
+
+// installCheckpoint replaces the database of the processor with the checkpoint in dir: the database is shut down,
+// its data directory moved aside and dir moved in its place, and the database opened again. The WAL and WAL archive
+// directories nested in the data directory are kept out of the swap. If the checkpoint cannot be moved in or opened,
+// the old data directory is put back and opened again; it is deleted once the new database is open.
+// Commands wait meanwhile.
+func (processor *CommandProcessor) installCheckpoint(dir string) error {
+	processor.lock.Lock()
+	defer processor.lock.Unlock()
+	dataDir := processor.db.DataDir()
+	kept := nestedDirs(dataDir, processor.db.WalDir(), processor.db.WalArchiveDir())
+	processor.db.Shutdown()
+
+	backupDir := dataDir + checkpointBackupSuffix
+	if err := os.RemoveAll(backupDir); err != nil {
+		return processor.reopen(err)
+	}
+	if err := os.Rename(dataDir, backupDir); err != nil {
+		return processor.reopen(err)
+	}
+	err := os.Rename(dir, dataDir)
+	if err == nil {
+		err = moveDirs(backupDir, dataDir, kept)
+	}
+	var db *database.DB
+	if err == nil {
+		db, err = processor.open()
+	}
+	if err != nil {
+		// 新数据库无法打开时恢复原数据目录
+		moveDirs(dataDir, backupDir, kept)
+		if removeErr := os.RemoveAll(dataDir); removeErr != nil {
+			return fmt.Errorf("%w, and the data directory cannot be restored from %s: %v", err, backupDir, removeErr)
+		}
+		if renameErr := os.Rename(backupDir, dataDir); renameErr != nil {
+			return fmt.Errorf("%w, and the data directory cannot be restored from %s: %v", err, backupDir, renameErr)
+		}
+		return processor.reopen(err)
+	}
+	processor.db = db
+	if err := os.RemoveAll(backupDir); err != nil {
+		log.Printf("删除原数据目录 %s 失败:%v", backupDir, err)
+	}
+	return nil
+}
+
+// reopen opens the database again after a checkpoint failed to install for err, which it returns, along with the
+// error of opening the database, if any; the processor keeps the closed database then. The caller must hold the lock.
+func (processor *CommandProcessor) reopen(err error) error {
+	db, openErr := processor.open()
+	if openErr != nil {
+		return fmt.Errorf("%w, and the database cannot be opened again: %v", err, openErr)
+	}
+	processor.db = db
+	return err
+}
+
+// nestedDirs returns the paths, relative to dataDir, of the dirs nested in dataDir, each after those it is nested in.
+func nestedDirs(dataDir string, dirs ...string) []string {
+	var nested []string
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		if rel, err := filepath.Rel(dataDir, dir); err == nil && rel != "." && filepath.IsLocal(rel) {
+			nested = append(nested, rel)
+		}
+	}
+	sort.Slice(nested, func(i, j int) bool { return len(nested[i]) < len(nested[j]) })
+	return nested
+}
+
+// moveDirs moves the dirs, relative paths, from the directory from to the directory to, replacing empty ones.
+// A dir missing from from, such as one moved along with its parent, is skipped.
+func moveDirs(from string, to string, dirs []string) error {
+	for _, dir := range dirs {
+		src, dst := filepath.Join(from, dir), filepath.Join(to, dir)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply writes a batch received from the primary to the database.
+func (processor *CommandProcessor) apply(chunks []common.Chunk) error {
+	processor.lock.RLock()
+	defer processor.lock.RUnlock()
+	return processor.db.Apply(chunks)
+}
+
+// replicaOfCommand makes the server a read-only replica of the primary at host port, given as REPLICAOF host port,
+// dropping its data for that of the primary, or a primary again, keeping its data, given as REPLICAOF NO ONE.
+func (processor *CommandProcessor) replicaOfCommand(session *Session, args []string) string {
+	if len(args) != 2 {
+		return "-ERR wrong number of arguments for 'REPLICAOF' command\r\n"
+	}
+	noOne := strings.EqualFold(args[0], "NO") && strings.EqualFold(args[1], "ONE")
+	if !noOne {
+		if processor.raft != nil {
+			return "-ERR a server in a raft cluster cannot be a replica\r\n"
+		}
+		if processor.open == nil {
+			return "-ERR replication is not enabled\r\n"
+		}
+		if port, err := strconv.Atoi(args[1]); err != nil || port <= 0 || port > 65535 {
+			return "-ERR invalid port\r\n"
+		}
+	}
+
+	processor.replicationLock.Lock()
+	defer processor.replicationLock.Unlock()
+	if r := processor.replica.Swap(nil); r != nil {
+		r.stop()
+	}
+	if !noOne {
+		processor.replica.Store(startReplica(processor, net.JoinHostPort(args[0], args[1])))
+	}
+	return "+OK\r\n"
+}
+
+// stopReplication stops following the primary, if the server is a replica.
+func (processor *CommandProcessor) stopReplication() {
+	processor.replicationLock.Lock()
+	defer processor.replicationLock.Unlock()
+	if r := processor.replica.Swap(nil); r != nil {
+		r.stop()
+	}
+}
+
+// infoCommand reports the state of the server, given as INFO [section]. Only the replication section exists:
+// the role of the server and, for a primary, its replicas and the last sequence number written, which is its
+// replication offset, or for a replica, its primary, whether the link is up and the last sequence number of the
+// primary it applied.
+func (processor *CommandProcessor) infoCommand(session *Session, args []string) string {
+	if len(args) > 1 {
+		return "-ERR wrong number of arguments for 'INFO' command\r\n"
+	}
+	if len(args) == 1 && !strings.EqualFold(args[0], "replication") {
+		return "$0\r\n\r\n"
+	}
+
+	var info strings.Builder
+	info.WriteString("# Replication\r\n")
+	if r := processor.replica.Load(); r != nil {
+		host, port, _ := net.SplitHostPort(r.address)
+		status := "down"
+		if atomic.LoadInt32(&r.linkUp) == 1 {
+			status = "up"
+		}
+		fmt.Fprintf(&info, "role:slave\r\nmaster_host:%s\r\nmaster_port:%s\r\nmaster_link_status:%s\r\nslave_repl_offset:%d\r\n",
+			host, port, status, atomic.LoadUint64(&r.offset))
+	} else {
+		fmt.Fprintf(&info, "role:master\r\nconnected_slaves:%d\r\nmaster_repl_offset:%d\r\n",
+			atomic.LoadInt32(&processor.replicas), processor.db.LastSequence())
+	}
+	return fmt.Sprintf("$%d\r\n%s\r\n", info.Len(), info.String())
+}
+
+// encodeBatch encodes the operations of a batch as count(4) | records, in the record format of common.AppendChunk.
+func encodeBatch(chunks []common.Chunk) []byte {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(len(chunks)))
+	for i := range chunks {
+		payload = common.AppendChunk(payload, &chunks[i])
+	}
+	return payload
+}
+
+// decodeBatch decodes a batch encoded by encodeBatch.
+func decodeBatch(payload []byte) ([]common.Chunk, error) {
+	if len(payload) < 4 {
+		return nil, errors.New("batch too short")
+	}
+	count := binary.BigEndian.Uint32(payload[:4])
+	reader := bytes.NewReader(payload[4:])
+	chunks := make([]common.Chunk, 0, count)
+	for i := uint32(0); i < count; i++ {
+		first, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("batch truncated: %w", err)
+		}
+		chunk, err := common.ReadChunk(reader, first)
+		if err != nil {
+			return nil, fmt.Errorf("batch truncated: %w", err)
+		}
+		chunks = append(chunks, *chunk)
+	}
+	return chunks, nil
+}
+
+// writeFrame writes a RESP array of the bulk strings args to w.
+func writeFrame(w io.Writer, args ...string) error {
+	var frame strings.Builder
+	fmt.Fprintf(&frame, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&frame, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(w, frame.String())
+	return err
+}
+
+// readFrameHeader reads the header of a RESP array and its first bulk string, the name of the frame.
+// It returns the name and the number of bulk strings that follow it.
+func readFrameHeader(reader *bufio.Reader) (string, int, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", 0, err
+	}
+	if line[0] != '*' {
+		return "", 0, fmt.Errorf("invalid protocol")
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || count < 1 {
+		return "", 0, fmt.Errorf("invalid argument count")
+	}
+	name, err := readBulk(reader)
+	if err != nil {
+		return "", 0, err
+	}
+	return string(name), count - 1, nil
+}
+
+// readBulkHeader reads the header of a RESP bulk string and returns its length.
+func readBulkHeader(reader *bufio.Reader) (int, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	if line[0] != '$' {
+		return 0, fmt.Errorf("invalid bulk string")
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || length < 0 {
+		return 0, fmt.Errorf("invalid argument length")
+	}
+	return length, nil
+}
+
+// readBulk reads a whole RESP bulk string.
+func readBulk(reader *bufio.Reader) ([]byte, error) {
+	length, err := readBulkHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, length+2)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	return data[:length], nil
+}
+
+// database returns the current database of the processor, which a replica replaces on every full sync.
+func (processor *CommandProcessor) database() *database.DB {
+	processor.lock.RLock()
+	defer processor.lock.RUnlock()
+	return processor.db
+}
@@ -0,0 +1,210 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Jasonbourne723/platodb/internal/database"
+	"github.com/stretchr/testify/assert"
+)
+
+// startTestServer starts a server on a loopback port over a database in a temporary directory.
+func startTestServer(t *testing.T) *Server {
+	return serveTestProcessor(t, newTestProcessor(t, filepath.Join(t.TempDir(), "data")))
+}
+
+// newTestProcessor returns a processor over a database in dataDir.
+func newTestProcessor(t *testing.T, dataDir string) *CommandProcessor {
+	options := []database.Options{
+		database.Dir(dataDir, filepath.Join(dataDir, "wal")),
+		database.MergeOperator(MergeOperator()),
+	}
+	db, err := database.NewDB(options...)
+	assert.NoError(t, err)
+	return NewCommandProcessor(db, DatabaseOpener(func() (*database.DB, error) {
+		return database.NewDB(options...)
+	}))
+}
+
+// serveTestProcessor starts a server for processor on a loopback port.
+func serveTestProcessor(t *testing.T, processor *CommandProcessor) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	srv, err := NewServer(ctx, processor)
+	assert.NoError(t, err)
+	srv.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go srv.serve()
+	t.Cleanup(func() {
+		cancel()
+		srv.Shutdown(context.Background())
+	})
+	return srv
+}
+
+// testClient sends commands to a server and returns its replies.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newTestClient(t *testing.T, srv *Server) *testClient {
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	c := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	assert.Equal(t, "+OK", c.do("AUTH", requeiredPass))
+	return c
+}
+
+// do sends a command and returns its reply without the trailing CRLF, or the content of a bulk string reply, which
+// is empty for a missing key.
+func (c *testClient) do(args ...string) string {
+	assert.NoError(c.t, writeFrame(c.conn, args...))
+	line, err := c.reader.ReadString('\n')
+	assert.NoError(c.t, err)
+	if strings.HasPrefix(line, "$") && line != "$-1\r\n" {
+		length, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		assert.NoError(c.t, err)
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(c.reader, data)
+		assert.NoError(c.t, err)
+		return string(data[:length])
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// infoField returns the value of a field of INFO replication.
+func (c *testClient) infoField(field string) string {
+	for _, line := range strings.Split(c.do("INFO", "replication"), "\r\n") {
+		if value, ok := strings.CutPrefix(line, field+":"); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// waitInSync waits until the replica is linked to the primary and has applied every write of it.
+func waitInSync(t *testing.T, primary, replica *testClient) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if replica.infoField("master_link_status") == "up" &&
+			replica.infoField("slave_repl_offset") == primary.infoField("master_repl_offset") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("replica did not catch up: %q", replica.do("INFO"))
+}
+
+func TestReplication(t *testing.T) {
+	primarySrv := startTestServer(t)
+	replicaSrv := startTestServer(t)
+	primary := newTestClient(t, primarySrv)
+	replica := newTestClient(t, replicaSrv)
+
+	// 全量同步：副本原有的数据被主节点的检查点取代
+	assert.Equal(t, "+OK", primary.do("SET", "a", "1"))
+	assert.Equal(t, "+OK", primary.do("SET", "b", "2"))
+	assert.Equal(t, "+OK", primary.do("DEL", "b"))
+	assert.Equal(t, "+OK", replica.do("SET", "z", "0"))
+	_, port, _ := net.SplitHostPort(primarySrv.listener.Addr().String())
+	assert.Equal(t, "+OK", replica.do("REPLICAOF", "127.0.0.1", port))
+	waitInSync(t, primary, replica)
+	assert.Equal(t, "slave", replica.infoField("role"))
+	assert.Equal(t, "1", primary.infoField("connected_slaves"))
+	assert.Equal(t, "1", replica.do("GET", "a"))
+	assert.Equal(t, "", replica.do("GET", "b"))
+	assert.Equal(t, "", replica.do("GET", "z"))
+
+	// 增量同步：之后的写入按顺序应用到副本
+	assert.Equal(t, ":5", primary.do("INCRBY", "counter", "5"))
+	assert.Equal(t, ":7", primary.do("INCRBY", "counter", "2"))
+	assert.Equal(t, "+OK", primary.do("MULTI"))
+	assert.Equal(t, "+QUEUED", primary.do("SET", "c", "3"))
+	assert.Equal(t, "+QUEUED", primary.do("DEL", "a"))
+	assert.Equal(t, "*2", primary.do("EXEC"))
+	primary.reader.Discard(len("+OK\r\n+OK\r\n"))
+	assert.Equal(t, "+OK", primary.do("SET", "n", "4"))
+	assert.Equal(t, "+OK", primary.do("DELRANGE", "m", "o"))
+	waitInSync(t, primary, replica)
+	assert.Equal(t, "3", replica.do("GET", "c"))
+	assert.Equal(t, "7", replica.do("GET", "counter"))
+	assert.Equal(t, "", replica.do("GET", "a"))
+	assert.Equal(t, "", replica.do("GET", "n"))
+
+	// 副本只读
+	assert.True(t, strings.HasPrefix(replica.do("SET", "x", "1"), "-READONLY"))
+	assert.Equal(t, "+OK", replica.do("MULTI"))
+	assert.True(t, strings.HasPrefix(replica.do("DEL", "c"), "-READONLY"))
+	assert.True(t, strings.HasPrefix(replica.do("EXEC"), "-EXECABORT"))
+
+	// 停止复制后副本保留数据并可写
+	assert.Equal(t, "+OK", replica.do("REPLICAOF", "NO", "ONE"))
+	assert.Equal(t, "master", replica.infoField("role"))
+	assert.Equal(t, "+OK", replica.do("SET", "x", "1"))
+	assert.Equal(t, "3", replica.do("GET", "c"))
+	assert.Equal(t, "+OK", primary.do("SET", "c", "4"))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "3", replica.do("GET", "c"))
+}
+
+func TestInstallCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	dataDir := filepath.Join(dir, "data")
+	archiveDir := filepath.Join(dataDir, "archive")
+	options := []database.Options{database.Dir(dataDir, filepath.Join(dataDir, "wal")), database.WalArchive(archiveDir)}
+	db, err := database.NewDB(options...)
+	assert.NoError(t, err)
+	failOpen := false
+	processor := NewCommandProcessor(db, DatabaseOpener(func() (*database.DB, error) {
+		if failOpen {
+			failOpen = false
+			return nil, errors.New("open failed")
+		}
+		return database.NewDB(options...)
+	}))
+	defer processor.flush()
+	assert.NoError(t, db.Set("a", []byte("1")))
+	assert.NoError(t, os.WriteFile(filepath.Join(archiveDir, "archived.log"), []byte("log"), 0644))
+
+	checkpoint := func(name string) string {
+		source, err := database.NewDB(database.Dir(filepath.Join(dir, name), filepath.Join(dir, name+"-wal")))
+		assert.NoError(t, err)
+		defer source.Shutdown()
+		assert.NoError(t, source.Set("b", []byte("2")))
+		checkpointDir := filepath.Join(dir, name+"-checkpoint")
+		assert.NoError(t, source.Checkpoint(checkpointDir))
+		return checkpointDir
+	}
+	get := func(key string) []byte {
+		value, err := processor.database().Get(key)
+		assert.NoError(t, err)
+		return value
+	}
+
+	// 检查点无法打开时恢复并继续使用原数据
+	failOpen = true
+	assert.Error(t, processor.installCheckpoint(checkpoint("first")))
+	assert.Equal(t, []byte("1"), get("a"))
+	assert.Nil(t, get("b"))
+	assert.FileExists(t, filepath.Join(archiveDir, "archived.log"))
+	assert.NoDirExists(t, dataDir+checkpointBackupSuffix)
+
+	// 替换数据目录时保留其中的 WAL 归档目录
+	assert.NoError(t, processor.installCheckpoint(checkpoint("second")))
+	assert.Nil(t, get("a"))
+	assert.Equal(t, []byte("2"), get("b"))
+	assert.FileExists(t, filepath.Join(archiveDir, "archived.log"))
+	assert.NoDirExists(t, dataDir+checkpointBackupSuffix)
+	assert.NoError(t, processor.database().Set("c", []byte("3")))
+}
@@ -10,6 +10,8 @@ import (
 	"net"
 	"strconv"
 	"strings"
+
+	"github.com/Jasonbourne723/platodb/internal/database"
 )
 
 type Options func(s *Server)
@@ -43,8 +45,17 @@ type Server struct {
 	ctx       context.Context
 }
 
+// Session is the state of a connection. columnFamily belongs to db, the database of the processor when the session
+// last ran a command. Between WATCH or MULTI and EXEC or DISCARD, txn is the transaction of the connection, and after
+// MULTI its commands are queued until EXEC.
 type Session struct {
 	authenticated bool
+	db            *database.DB
+	columnFamily  *database.ColumnFamily
+	txn           *database.Txn
+	multi         bool
+	multiFailed   bool
+	queued        []queuedCommand
 }
 
 // Listen starts the TCP server to accept incoming connections.
@@ -58,8 +69,13 @@ func (s *Server) Listen() (err error) {
 	if err != nil {
 		return err
 	}
-	defer s.listener.Close()
 	fmt.Println("TCP server listening on port 6399")
+	return s.serve()
+}
+
+// serve accepts connections on the listener of the server until it is closed.
+func (s *Server) serve() error {
+	defer s.listener.Close()
 
 	for {
 
@@ -117,13 +133,14 @@ func (s *Server) HandleConnection(conn net.Conn) {
 	defer conn.Close()
 
 	reader := bufio.NewReader(conn)
-	session := &Session{authenticated: false} // 每个连接有独立的会话
+	session := s.processor.newSession() // 每个连接有独立的会话
+	defer session.close()
 
 	for {
 		command, args, err := parseRESP(reader)
 		if err != nil {
 			var opErr *net.OpError
-			if errors.As(err, &opErr) {
+			if errors.As(err, &opErr) || errors.Is(err, io.EOF) {
 				break
 			}
 			conn.Write([]byte("-ERR " + err.Error() + "\r\n"))
@@ -145,13 +162,15 @@ func (s *Server) HandleConnection(conn net.Conn) {
 			continue
 		}
 
-		if handler, ok := s.processor.commands[command]; ok {
-			rep := handler(args)
-			conn.Write([]byte(rep))
-			continue
-		} else {
-			conn.Write([]byte("-ERR unknown command\r\n"))
+		// 副本请求同步后，连接只用于向它发送检查点和之后的写入
+		if command == "SYNC" {
+			if err := s.processor.syncReplica(s.ctx, conn); err != nil {
+				log.Printf("replica %s disconnected: %v\n", conn.RemoteAddr(), err)
+			}
+			return
 		}
+
+		conn.Write([]byte(s.processor.execute(session, command, args)))
 	}
 
 }
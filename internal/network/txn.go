@@ -0,0 +1,193 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Jasonbourne723/platodb/internal/database"
+)
+
+// txnCommandHandler runs a command queued by MULTI within the transaction EXEC commits.
+type txnCommandHandler func(txn *database.Txn, cf *database.ColumnFamily, args []string) string
+
+// queuedCommand is a command queued between MULTI and EXEC.
+type queuedCommand struct {
+	name string
+	args []string
+}
+
+// txnCommands are the commands that can be queued between MULTI and EXEC.
+var txnCommands = map[string]txnCommandHandler{
+	"GET": txnGetCommand,
+	"SET": txnSetCommand,
+	"DEL": txnDelCommand,
+}
+
+// execute runs a command for the session. Between MULTI and EXEC, the commands other than EXEC, DISCARD, MULTI and
+// WATCH are queued instead; a command that cannot be queued is rejected and makes EXEC discard the transaction.
+// A replica refuses write commands, and a member of a Raft cluster proposes them to the cluster, refusing them
+// between MULTI and EXEC. Commands run under the read lock, except for REPLICAOF, which waits for the replica it
+// stops, and for the commands that wait for the cluster, as applying a snapshot takes the lock.
+func (processor *CommandProcessor) execute(session *Session, command string, args []string) string {
+	handler, ok := processor.commands[command]
+	_, write := writeCommands[command]
+	if !session.multi {
+		switch {
+		case command == "REPLICAOF" || command == "CLUSTER":
+			return handler(session, args)
+		case write && processor.raft != nil:
+			return processor.propose(session, command, args)
+		}
+	}
+	processor.lock.RLock()
+	defer processor.lock.RUnlock()
+	processor.refreshSession(session)
+
+	readOnly := write && processor.replica.Load() != nil
+	if session.multi && command != "EXEC" && command != "DISCARD" && command != "MULTI" && command != "WATCH" {
+		if readOnly {
+			session.multiFailed = true
+			return readOnlyReply
+		}
+		if write && processor.raft != nil {
+			session.multiFailed = true
+			return fmt.Sprintf("-ERR command '%s' cannot be used inside MULTI in a raft cluster\r\n", strings.ToLower(command))
+		}
+		if _, ok := txnCommands[command]; !ok {
+			session.multiFailed = true
+			return fmt.Sprintf("-ERR command '%s' cannot be used inside MULTI\r\n", strings.ToLower(command))
+		}
+		session.queued = append(session.queued, queuedCommand{name: command, args: args})
+		return "+QUEUED\r\n"
+	}
+	if !ok {
+		return "-ERR unknown command\r\n"
+	}
+	if readOnly {
+		return readOnlyReply
+	}
+	return handler(session, args)
+}
+
+// watchCommand marks keys of the selected column family, given as WATCH key [key ...], so that EXEC fails if any of
+// them is written before it. Watching starts the transaction of the connection, whose snapshot the keys are
+// compared against.
+func (processor *CommandProcessor) watchCommand(session *Session, args []string) string {
+	if len(args) == 0 {
+		return "-ERR wrong number of arguments for 'WATCH' command\r\n"
+	}
+	if session.multi {
+		return "-ERR WATCH inside MULTI is not allowed\r\n"
+	}
+	if session.txn == nil {
+		session.txn = processor.db.Begin()
+	}
+	for _, key := range args {
+		// 读取的 key 进入事务的读集合，提交时检查是否被修改
+		if _, err := session.txn.GetCF(session.columnFamily, key); err != nil {
+			return "-ERR " + err.Error() + "\r\n"
+		}
+	}
+	return "+OK\r\n"
+}
+
+// multiCommand starts queuing the commands of the connection until EXEC or DISCARD.
+func (processor *CommandProcessor) multiCommand(session *Session, args []string) string {
+	if session.multi {
+		return "-ERR MULTI calls can not be nested\r\n"
+	}
+	if session.txn == nil {
+		session.txn = processor.db.Begin()
+	}
+	session.multi = true
+	return "+OK\r\n"
+}
+
+// execCommand runs the queued commands in the transaction of the connection and commits it.
+// Replies with the array of their replies, or with a null array if a watched or read key has been written since
+// the transaction began, in which case none of the commands takes effect.
+func (processor *CommandProcessor) execCommand(session *Session, args []string) string {
+	if !session.multi {
+		return "-ERR EXEC without MULTI\r\n"
+	}
+	txn, queued, failed := session.txn, session.queued, session.multiFailed
+	session.endTransaction()
+	if failed {
+		txn.Rollback()
+		return "-EXECABORT Transaction discarded because of previous errors.\r\n"
+	}
+
+	var reply strings.Builder
+	fmt.Fprintf(&reply, "*%d\r\n", len(queued))
+	for _, command := range queued {
+		reply.WriteString(txnCommands[command.name](txn, session.columnFamily, command.args))
+	}
+	if err := txn.Commit(); err != nil {
+		if errors.Is(err, database.ErrTxnConflict) {
+			return "*-1\r\n"
+		}
+		return "-ERR " + err.Error() + "\r\n"
+	}
+	return reply.String()
+}
+
+// discardCommand drops the queued commands and the watched keys of the connection.
+func (processor *CommandProcessor) discardCommand(session *Session, args []string) string {
+	if !session.multi {
+		return "-ERR DISCARD without MULTI\r\n"
+	}
+	session.txn.Rollback()
+	session.endTransaction()
+	return "+OK\r\n"
+}
+
+// endTransaction clears the transaction state of the session, leaving the transaction itself to the caller.
+func (session *Session) endTransaction() {
+	session.txn = nil
+	session.multi = false
+	session.multiFailed = false
+	session.queued = nil
+}
+
+// close rolls back the transaction the connection leaves unfinished.
+func (session *Session) close() {
+	if session.txn != nil {
+		session.txn.Rollback()
+		session.endTransaction()
+	}
+}
+
+// txnGetCommand is GET within a transaction.
+func txnGetCommand(txn *database.Txn, cf *database.ColumnFamily, args []string) string {
+	if len(args) != 1 {
+		return "-ERR wrong number of arguments for 'GET' command\r\n"
+	}
+	value, err := txn.GetCF(cf, args[0])
+	if err != nil {
+		return "$-1\r\n"
+	}
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+// txnSetCommand is SET within a transaction, without expiry options.
+func txnSetCommand(txn *database.Txn, cf *database.ColumnFamily, args []string) string {
+	if len(args) != 2 {
+		return "-ERR wrong number of arguments for 'SET' command\r\n"
+	}
+	if err := txn.SetCF(cf, args[0], []byte(args[1])); err != nil {
+		return "-ERR " + err.Error() + "\r\n"
+	}
+	return "+OK\r\n"
+}
+
+// txnDelCommand is DEL within a transaction.
+func txnDelCommand(txn *database.Txn, cf *database.ColumnFamily, args []string) string {
+	if len(args) != 1 {
+		return "-ERR wrong number of arguments for 'DEL' command\r\n"
+	}
+	if err := txn.DelCF(cf, args[0]); err != nil {
+		return "-ERR " + err.Error() + "\r\n"
+	}
+	return "+OK\r\n"
+}
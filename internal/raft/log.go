@@ -0,0 +1,338 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Jasonbourne723/platodb/internal/database/common"
+)
+
+const (
+	logFileName   = "raft.log"
+	stateFileName = "STATE"
+)
+
+// EntryType tells what an entry of the log holds.
+type EntryType uint8
+
+const (
+	// EntryCommand holds a command for the state machine.
+	EntryCommand EntryType = iota + 1
+	// EntryConfiguration holds the servers of the cluster from its index on.
+	EntryConfiguration
+	// EntryNoop is appended by every new leader, so that it commits the entries left by the leaders before it.
+	EntryNoop
+)
+
+// Entry is an entry of the replicated log.
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  EntryType
+	Data  []byte
+}
+
+// Records of the log file: every record is crc32(4) | length(4) | payload, the payload starting with its kind.
+const (
+	// entryRecord appends an entry: uvarint index | uvarint term | type(1) | data.
+	entryRecord byte = 1
+	// truncateRecord drops the entries from an index on: uvarint index.
+	truncateRecord byte = 2
+	// baseRecord starts the log after the last entry a snapshot holds: uvarint index | uvarint term.
+	baseRecord byte = 3
+)
+
+var (
+	ErrLogCorrupt   = errors.New("raft log is corrupt")
+	ErrStateCorrupt = errors.New("raft state is corrupt")
+)
+
+// raftLog is the part of the replicated log that follows the last snapshot, kept in memory and appended to a file
+// that is synced before any change is acknowledged. Entries are only dropped by appending a record saying so, and
+// the file is rewritten whenever a snapshot compacts the log.
+type raftLog struct {
+	path      string
+	file      *os.File
+	baseIndex uint64
+	baseTerm  uint64
+	entries   []Entry
+}
+
+// openLog loads the log file of dir, creating it if missing. A record cut short by a crash, which can only be the
+// last one as every change is synced, is dropped.
+func openLog(dir string) (*raftLog, error) {
+	l := &raftLog{path: filepath.Join(dir, logFileName)}
+	data, err := os.ReadFile(l.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	offset := 0
+	for offset < len(data) {
+		payload, ok := readLogRecord(data[offset:])
+		if !ok {
+			break
+		}
+		if err := l.replay(payload); err != nil {
+			return nil, err
+		}
+		offset += 8 + len(payload)
+	}
+
+	l.file, err = os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.file.Truncate(int64(offset)); err != nil {
+		l.file.Close()
+		return nil, err
+	}
+	if _, err := l.file.Seek(int64(offset), io.SeekStart); err != nil {
+		l.file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// readLogRecord returns the payload of the record data starts with, or false if it is incomplete or damaged.
+func readLogRecord(data []byte) ([]byte, bool) {
+	if len(data) < 8 {
+		return nil, false
+	}
+	length := binary.BigEndian.Uint32(data[4:8])
+	if uint64(length) > uint64(len(data)-8) || length == 0 {
+		return nil, false
+	}
+	payload := data[8 : 8+length]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[:4]) {
+		return nil, false
+	}
+	return payload, true
+}
+
+// replay applies a record read back from the log file.
+func (l *raftLog) replay(payload []byte) error {
+	reader := bytes.NewReader(payload[1:])
+	switch payload[0] {
+	case entryRecord:
+		index, err1 := binary.ReadUvarint(reader)
+		term, err2 := binary.ReadUvarint(reader)
+		entryType, err3 := reader.ReadByte()
+		if err1 != nil || err2 != nil || err3 != nil || index != l.lastIndex()+1 {
+			return ErrLogCorrupt
+		}
+		data := make([]byte, reader.Len())
+		reader.Read(data)
+		l.entries = append(l.entries, Entry{Index: index, Term: term, Type: EntryType(entryType), Data: data})
+	case truncateRecord:
+		index, err := binary.ReadUvarint(reader)
+		if err != nil || index <= l.baseIndex {
+			return ErrLogCorrupt
+		}
+		l.dropFrom(index)
+	case baseRecord:
+		index, err1 := binary.ReadUvarint(reader)
+		term, err2 := binary.ReadUvarint(reader)
+		if err1 != nil || err2 != nil {
+			return ErrLogCorrupt
+		}
+		l.baseIndex, l.baseTerm, l.entries = index, term, nil
+	default:
+		return ErrLogCorrupt
+	}
+	return nil
+}
+
+// lastIndex returns the index of the last entry, or of the last entry of the snapshot if the log is empty.
+func (l *raftLog) lastIndex() uint64 {
+	return l.baseIndex + uint64(len(l.entries))
+}
+
+// lastTerm returns the term of the entry at lastIndex.
+func (l *raftLog) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.baseTerm
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+// term returns the term of the entry at index, or false if the log no longer or does not yet hold it.
+func (l *raftLog) term(index uint64) (uint64, bool) {
+	if index == l.baseIndex {
+		return l.baseTerm, true
+	}
+	if index < l.baseIndex || index > l.lastIndex() {
+		return 0, false
+	}
+	return l.entries[index-l.baseIndex-1].Term, true
+}
+
+// entry returns the entry at index, which must be held by the log.
+func (l *raftLog) entry(index uint64) *Entry {
+	return &l.entries[index-l.baseIndex-1]
+}
+
+// slice returns a copy of the entries from index from to index to, both included.
+func (l *raftLog) slice(from, to uint64) []Entry {
+	if from > to {
+		return nil
+	}
+	return append([]Entry(nil), l.entries[from-l.baseIndex-1:to-l.baseIndex]...)
+}
+
+// append adds entries, which must follow the last one, to the log.
+func (l *raftLog) append(entries ...Entry) error {
+	var buf []byte
+	for _, entry := range entries {
+		payload := []byte{entryRecord}
+		payload = binary.AppendUvarint(payload, entry.Index)
+		payload = binary.AppendUvarint(payload, entry.Term)
+		payload = append(payload, byte(entry.Type))
+		payload = append(payload, entry.Data...)
+		buf = appendLogRecord(buf, payload)
+	}
+	if err := l.write(buf); err != nil {
+		return err
+	}
+	l.entries = append(l.entries, entries...)
+	return nil
+}
+
+// truncate drops the entries from index on.
+func (l *raftLog) truncate(index uint64) error {
+	if index > l.lastIndex() {
+		return nil
+	}
+	payload := binary.AppendUvarint([]byte{truncateRecord}, index)
+	if err := l.write(appendLogRecord(nil, payload)); err != nil {
+		return err
+	}
+	l.dropFrom(index)
+	return nil
+}
+
+// dropFrom drops the entries from index on from memory.
+func (l *raftLog) dropFrom(index uint64) {
+	if index <= l.lastIndex() {
+		// 截断后的追加不能覆盖仍被引用的切片
+		l.entries = append([]Entry(nil), l.entries[:index-l.baseIndex-1]...)
+	}
+}
+
+// compact drops the entries up to index, which a snapshot holds along with term, the term of its last entry.
+// The entries after index are kept if the log holds index with the same term, and dropped otherwise, as they
+// conflict with the snapshot. The log file is rewritten with the entries left.
+func (l *raftLog) compact(index, term uint64) error {
+	var entries []Entry
+	if t, ok := l.term(index); ok && t == term {
+		entries = l.slice(index+1, l.lastIndex())
+	}
+	buf := appendLogRecord(nil, binary.AppendUvarint(binary.AppendUvarint([]byte{baseRecord}, index), term))
+
+	tmpPath := l.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	rewritten := &raftLog{path: l.path, file: file, baseIndex: index, baseTerm: term}
+	err = rewritten.write(buf)
+	if err == nil && len(entries) > 0 {
+		err = rewritten.append(entries...)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, l.path)
+	}
+	if err == nil {
+		err = common.SyncDir(filepath.Dir(l.path))
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	l.file.Close()
+	*l = *rewritten
+	return nil
+}
+
+// write appends records to the log file and syncs it.
+func (l *raftLog) write(buf []byte) error {
+	if _, err := l.file.Write(buf); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// close closes the log file.
+func (l *raftLog) close() error {
+	return l.file.Close()
+}
+
+// appendLogRecord appends the record of payload to buf.
+func appendLogRecord(buf []byte, payload []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(payload))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+// saveState writes the current term and the vote cast in it to the state file of dir:
+//
+//	uvarint term | uvarint votedForLen | votedFor | crc32(4)
+func saveState(dir string, term uint64, votedFor string) error {
+	buf := binary.AppendUvarint(nil, term)
+	buf = binary.AppendUvarint(buf, uint64(len(votedFor)))
+	buf = append(buf, votedFor...)
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	return writeFileAtomic(filepath.Join(dir, stateFileName), buf)
+}
+
+// readState reads the state file of dir, a missing file meaning that no term has started yet.
+func readState(dir string) (uint64, string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, stateFileName))
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if len(data) < 4 || crc32.ChecksumIEEE(data[:len(data)-4]) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return 0, "", ErrStateCorrupt
+	}
+	reader := bytes.NewReader(data[:len(data)-4])
+	term, err1 := binary.ReadUvarint(reader)
+	length, err2 := binary.ReadUvarint(reader)
+	if err1 != nil || err2 != nil || length != uint64(reader.Len()) {
+		return 0, "", ErrStateCorrupt
+	}
+	votedFor := make([]byte, length)
+	reader.Read(votedFor)
+	return term, string(votedFor), nil
+}
+
+// writeFileAtomic replaces the file at path with data, so that a crash leaves either the old or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return common.SyncDir(filepath.Dir(path))
+}
@@ -0,0 +1,79 @@
+package raft
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRaftLog(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openLog(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), l.lastIndex())
+
+	var entries []Entry
+	for i := uint64(1); i <= 5; i++ {
+		entries = append(entries, Entry{Index: i, Term: 1 + i/3, Type: EntryCommand, Data: []byte{byte(i)}})
+	}
+	assert.NoError(t, l.append(entries...))
+	assert.NoError(t, l.truncate(4))
+	assert.NoError(t, l.append(Entry{Index: 4, Term: 3, Type: EntryNoop}))
+	assert.NoError(t, l.close())
+
+	// 重新打开后日志与关闭前一致
+	l, err = openLog(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), l.lastIndex())
+	assert.Equal(t, uint64(3), l.lastTerm())
+	assert.Equal(t, entries[:3], l.slice(1, 3))
+
+	// 压缩保留快照之后的日志
+	assert.NoError(t, l.compact(2, 1))
+	term, ok := l.term(2)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), term)
+	_, ok = l.term(1)
+	assert.False(t, ok)
+	assert.Equal(t, entries[2:3], l.slice(3, 3))
+	assert.NoError(t, l.append(Entry{Index: 5, Term: 3, Type: EntryCommand, Data: []byte("x")}))
+	assert.NoError(t, l.close())
+
+	// 末尾不完整的记录被丢弃
+	file, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	file.Write(appendLogRecord(nil, []byte{entryRecord, 6, 3, 1})[:6])
+	file.Close()
+	l, err = openLog(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), l.baseIndex)
+	assert.Equal(t, uint64(5), l.lastIndex())
+	assert.Equal(t, []byte("x"), l.entry(5).Data)
+	assert.NoError(t, l.append(Entry{Index: 6, Term: 3, Type: EntryNoop}))
+
+	// 与快照冲突的日志被全部丢弃
+	assert.NoError(t, l.compact(5, 4))
+	assert.Equal(t, uint64(5), l.lastIndex())
+	assert.Equal(t, uint64(4), l.lastTerm())
+	assert.NoError(t, l.close())
+}
+
+func TestRaftState(t *testing.T) {
+	dir := t.TempDir()
+	term, votedFor, err := readState(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), term)
+	assert.Equal(t, "", votedFor)
+
+	assert.NoError(t, saveState(dir, 7, "node2"))
+	term, votedFor, err = readState(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), term)
+	assert.Equal(t, "node2", votedFor)
+
+	os.WriteFile(filepath.Join(dir, stateFileName), []byte{1, 2, 3, 4, 5}, 0644)
+	_, _, err = readState(dir)
+	assert.ErrorIs(t, err, ErrStateCorrupt)
+}
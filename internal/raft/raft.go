@@ -0,0 +1,789 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxEntriesPerRequest is how many entries an AppendEntries request carries at most.
+	maxEntriesPerRequest = 256
+	// maxApplyBatch is how many committed entries are taken from the log at once to be applied.
+	maxApplyBatch = 256
+)
+
+var (
+	ErrNotLeader         = errors.New("raft server is not the leader")
+	ErrLeadershipLost    = errors.New("raft leadership lost before the entry was committed")
+	ErrShutdown          = errors.New("raft server is shut down")
+	ErrConfigurationBusy = errors.New("raft configuration change in progress")
+	ErrServerExists      = errors.New("raft server is already in the cluster with another address")
+	ErrUnknownServer     = errors.New("raft server is not in the cluster")
+	ErrLastServer        = errors.New("raft cluster cannot remove its last server")
+)
+
+// State is the role of a server in its cluster.
+type State int32
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	default:
+		return "follower"
+	}
+}
+
+// Server is a member of a cluster: its id, unique in the cluster, and the address its transport reaches it at.
+type Server struct {
+	ID      string
+	Address string
+}
+
+// ParseServers parses servers given as id=address.
+func ParseServers(specs []string) ([]Server, error) {
+	servers := make([]Server, 0, len(specs))
+	for _, spec := range specs {
+		id, address, ok := strings.Cut(spec, "=")
+		if !ok || id == "" || address == "" {
+			return nil, fmt.Errorf("invalid raft server %q, expected id=address", spec)
+		}
+		servers = append(servers, Server{ID: id, Address: address})
+	}
+	return servers, nil
+}
+
+// StateMachine is the state the replicated log builds. Apply is called with every committed command, in the order
+// of the log and once per server; what it returns is handed to the caller of Raft.Apply on the leader.
+// Snapshot writes the state, holding every command applied so far, to dir, which does not exist yet.
+// Restore replaces the state with that of a snapshot extracted to dir, which it may take over, or with the empty
+// state if dir is empty. Apply, Snapshot and Restore are never called concurrently.
+type StateMachine interface {
+	Apply(index uint64, command []byte) interface{}
+	Snapshot(dir string) error
+	Restore(dir string) error
+}
+
+type Options func(r *Raft)
+
+// ElectionTimeout sets how long a follower waits without hearing from a leader before it starts an election.
+// Elections start after a random time between it and twice it, and a leader that has not heard from a majority of
+// the cluster for that long steps down.
+func ElectionTimeout(timeout time.Duration) Options {
+	return func(r *Raft) {
+		r.electionTimeout = timeout
+	}
+}
+
+// HeartbeatInterval sets how often an idle leader sends its followers an empty AppendEntries request. It must be
+// well below the election timeout.
+func HeartbeatInterval(interval time.Duration) Options {
+	return func(r *Raft) {
+		r.heartbeatInterval = interval
+	}
+}
+
+// SnapshotThreshold sets how many entries are applied after the last snapshot before a new one is taken and the
+// log compacted. 0 disables snapshots.
+func SnapshotThreshold(entries uint64) Options {
+	return func(r *Raft) {
+		r.snapshotThreshold = entries
+	}
+}
+
+// Bootstrap starts a new cluster of servers, if the server has no state yet: the current state of the state
+// machine becomes the first snapshot, with servers as its configuration. Every server bootstrapped with the same
+// servers must start with the same state, empty in general; otherwise bootstrap a single server and add the others
+// with AddServer. Servers that join an existing cluster are started without Bootstrap.
+func Bootstrap(servers ...Server) Options {
+	return func(r *Raft) {
+		r.bootstrap = servers
+	}
+}
+
+// Status describes a server and what it knows of its cluster.
+type Status struct {
+	ID           string
+	State        State
+	Term         uint64
+	Leader       string
+	CommitIndex  uint64
+	AppliedIndex uint64
+	Servers      []Server
+}
+
+// proposal is an entry the leader appended, waiting to be applied.
+type proposal struct {
+	term uint64
+	done chan proposalResult
+}
+
+type proposalResult struct {
+	value interface{}
+	err   error
+}
+
+// peer is what a leader knows of the replication of its log to another server.
+type peer struct {
+	server      Server
+	nextIndex   uint64
+	matchIndex  uint64
+	lastContact time.Time
+	trigger     chan struct{}
+	stop        chan struct{}
+}
+
+// Raft replicates a log of commands to the servers of a cluster and applies every committed command to a state
+// machine, so that every server goes through the same states. The log is kept in a directory of its own, along with
+// the snapshots of the state machine it is compacted with.
+// lock guards the state of the server; applyLock serializes the calls to the state machine and is taken before lock.
+type Raft struct {
+	id                string
+	dir               string
+	fsm               StateMachine
+	transport         Transport
+	electionTimeout   time.Duration
+	heartbeatInterval time.Duration
+	snapshotThreshold uint64
+	bootstrap         []Server
+
+	lock             *sync.Mutex
+	applyLock        *sync.Mutex
+	state            State
+	currentTerm      uint64
+	votedFor         string
+	leader           string
+	lastContact      time.Time
+	electionDeadline time.Time
+	log              *raftLog
+	snapshot         *snapshotMeta
+	servers          []Server
+	serversIndex     uint64
+	commitIndex      uint64
+	lastApplied      uint64
+	leaderStartIndex uint64
+	peers            map[string]*peer
+	proposals        map[uint64]*proposal
+	applyCh          chan struct{}
+	shutdownCh       chan struct{}
+	isShutdown       bool
+	done             *sync.WaitGroup
+}
+
+// NewRaft starts the server id of a cluster, keeping its log and snapshots in dir and reaching the other servers
+// through transport. The state machine is restored from the latest snapshot, or emptied if there is none, and the
+// committed entries of the log are applied to it again as the server learns they are committed.
+func NewRaft(id string, dir string, fsm StateMachine, transport Transport, options ...Options) (*Raft, error) {
+	r := &Raft{
+		id:                id,
+		dir:               dir,
+		fsm:               fsm,
+		transport:         transport,
+		electionTimeout:   time.Second,
+		heartbeatInterval: 100 * time.Millisecond,
+		snapshotThreshold: 8192,
+		lock:              &sync.Mutex{},
+		applyLock:         &sync.Mutex{},
+		proposals:         make(map[uint64]*proposal),
+		applyCh:           make(chan struct{}, 1),
+		shutdownCh:        make(chan struct{}),
+		done:              &sync.WaitGroup{},
+	}
+	for _, option := range options {
+		option(r)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var err error
+	if r.currentTerm, r.votedFor, err = readState(dir); err != nil {
+		return nil, err
+	}
+	if r.snapshot, err = readSnapshotMeta(dir); err != nil {
+		return nil, err
+	}
+	if r.log, err = openLog(dir); err != nil {
+		return nil, err
+	}
+	if err := r.load(); err != nil {
+		r.log.close()
+		return nil, err
+	}
+
+	r.resetElectionTimer()
+	transport.Serve(r)
+	r.done.Add(2)
+	go r.run()
+	go r.runApply()
+	return r, nil
+}
+
+// HasState reports whether dir holds the state of a server that has already started, from which NewRaft resumes,
+// ignoring Bootstrap. A server without state starts from the state machine as it is if it bootstraps a cluster, and
+// from an empty one otherwise.
+func HasState(dir string) (bool, error) {
+	term, _, err := readState(dir)
+	if err != nil || term > 0 {
+		return term > 0, err
+	}
+	meta, err := readSnapshotMeta(dir)
+	if err != nil || meta.Index > 0 {
+		return meta != nil && meta.Index > 0, err
+	}
+	info, err := os.Stat(filepath.Join(dir, logFileName))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info.Size() > 0, nil
+}
+
+// load brings the state machine to the latest snapshot, taking the first one if the server bootstraps a cluster.
+func (r *Raft) load() error {
+	os.Remove(filepath.Join(r.dir, receivingFileName))
+	removeStaleSnapshots(r.dir, r.snapshot)
+	// 保存快照后、压缩日志前崩溃
+	if r.log.baseIndex < r.snapshot.Index {
+		if err := r.log.compact(r.snapshot.Index, r.snapshot.Term); err != nil {
+			return err
+		}
+	}
+
+	if len(r.bootstrap) > 0 && r.currentTerm == 0 && r.snapshot.Index == 0 && r.log.lastIndex() == 0 {
+		meta := &snapshotMeta{Index: 1, Servers: r.bootstrap}
+		if err := r.writeSnapshot(meta); err != nil {
+			return fmt.Errorf("bootstrap snapshot failed: %w", err)
+		}
+		if err := r.log.compact(meta.Index, meta.Term); err != nil {
+			return err
+		}
+		r.snapshot = meta
+	} else if err := r.restoreSnapshot(r.snapshot); err != nil {
+		return fmt.Errorf("restore snapshot failed: %w", err)
+	}
+	r.commitIndex = r.snapshot.Index
+	r.lastApplied = r.snapshot.Index
+	r.servers, r.serversIndex = r.latestServers()
+	return nil
+}
+
+// Apply proposes command to the cluster and waits until it is committed and applied to the state machine of the
+// leader, returning what the state machine returned for it. Only the leader accepts commands; the others return
+// ErrNotLeader. If ctx is done or the leadership is lost first, the command may still be committed later.
+func (r *Raft) Apply(ctx context.Context, command []byte) (interface{}, error) {
+	r.lock.Lock()
+	p, err := r.appendEntry(EntryCommand, command)
+	r.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return r.wait(ctx, p)
+}
+
+// AddServer adds server to the cluster, once it has been started without Bootstrap, and waits until the change is
+// committed. The cluster changes one server at a time: a change made while another is in progress returns
+// ErrConfigurationBusy. Adding a server that is already in the cluster has no effect.
+func (r *Raft) AddServer(ctx context.Context, server Server) error {
+	r.lock.Lock()
+	if err := r.checkConfigurationChange(); err != nil {
+		r.lock.Unlock()
+		return err
+	}
+	for _, s := range r.servers {
+		if s.ID == server.ID {
+			r.lock.Unlock()
+			if s.Address != server.Address {
+				return ErrServerExists
+			}
+			return nil
+		}
+	}
+	servers := append(append([]Server(nil), r.servers...), server)
+	p, err := r.appendEntry(EntryConfiguration, encodeServers(servers))
+	r.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	_, err = r.wait(ctx, p)
+	return err
+}
+
+// RemoveServer removes the server id from the cluster and waits until the change is committed, as AddServer does.
+// A leader that removes itself steps down once the change is committed.
+func (r *Raft) RemoveServer(ctx context.Context, id string) error {
+	r.lock.Lock()
+	if err := r.checkConfigurationChange(); err != nil {
+		r.lock.Unlock()
+		return err
+	}
+	servers := make([]Server, 0, len(r.servers))
+	for _, s := range r.servers {
+		if s.ID != id {
+			servers = append(servers, s)
+		}
+	}
+	var err error
+	switch {
+	case len(servers) == len(r.servers):
+		err = ErrUnknownServer
+	case len(servers) == 0:
+		err = ErrLastServer
+	}
+	var p *proposal
+	if err == nil {
+		p, err = r.appendEntry(EntryConfiguration, encodeServers(servers))
+	}
+	r.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	_, err = r.wait(ctx, p)
+	return err
+}
+
+// checkConfigurationChange returns why the servers of the cluster cannot change now, if they cannot: only the
+// leader changes them, one at a time, and only once it has committed an entry of its own term.
+// The caller must hold the lock.
+func (r *Raft) checkConfigurationChange() error {
+	if r.isShutdown {
+		return ErrShutdown
+	}
+	if r.state != Leader {
+		return ErrNotLeader
+	}
+	if r.serversIndex > r.commitIndex || r.leaderStartIndex > r.commitIndex {
+		return ErrConfigurationBusy
+	}
+	return nil
+}
+
+// Status returns the state of the server and what it knows of its cluster.
+func (r *Raft) Status() Status {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return Status{
+		ID:           r.id,
+		State:        r.state,
+		Term:         r.currentTerm,
+		Leader:       r.leader,
+		CommitIndex:  r.commitIndex,
+		AppliedIndex: r.lastApplied,
+		Servers:      append([]Server(nil), r.servers...),
+	}
+}
+
+// Shutdown stops the server, failing the commands waiting to be committed, and closes its transport. The entries
+// being applied are applied first.
+func (r *Raft) Shutdown() error {
+	r.lock.Lock()
+	if r.isShutdown {
+		r.lock.Unlock()
+		return nil
+	}
+	r.isShutdown = true
+	close(r.shutdownCh)
+	r.stopLeading(ErrShutdown)
+	r.lock.Unlock()
+
+	err := r.transport.Close()
+	r.done.Wait()
+	// 等待正在安装的快照
+	r.applyLock.Lock()
+	defer r.applyLock.Unlock()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if closeErr := r.log.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// appendEntry appends an entry of the current term to the log of the leader and returns the proposal waiting for
+// it to be applied. A configuration entry takes effect at once. The caller must hold the lock.
+func (r *Raft) appendEntry(entryType EntryType, data []byte) (*proposal, error) {
+	if r.isShutdown {
+		return nil, ErrShutdown
+	}
+	if r.state != Leader {
+		return nil, ErrNotLeader
+	}
+	entry := Entry{Index: r.log.lastIndex() + 1, Term: r.currentTerm, Type: entryType, Data: data}
+	if err := r.log.append(entry); err != nil {
+		return nil, err
+	}
+	p := &proposal{term: entry.Term, done: make(chan proposalResult, 1)}
+	r.proposals[entry.Index] = p
+	if entryType == EntryConfiguration {
+		r.servers, _ = decodeServers(data)
+		r.serversIndex = entry.Index
+		r.updatePeers()
+	}
+	for _, peer := range r.peers {
+		trigger(peer)
+	}
+	r.advanceCommit()
+	return p, nil
+}
+
+// wait waits until the entry of p is applied.
+func (r *Raft) wait(ctx context.Context, p *proposal) (interface{}, error) {
+	select {
+	case result := <-p.done:
+		return result.value, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.shutdownCh:
+		return nil, ErrShutdown
+	}
+}
+
+// run starts elections when no leader is heard from, and makes a leader that no longer hears from a majority of
+// the cluster step down.
+func (r *Raft) run() {
+	defer r.done.Done()
+	ticker := time.NewTicker(r.electionTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.shutdownCh:
+			return
+		case <-ticker.C:
+		}
+		r.lock.Lock()
+		if r.state == Leader {
+			r.checkQuorum()
+		} else if time.Now().After(r.electionDeadline) {
+			r.startElection()
+		}
+		r.lock.Unlock()
+	}
+}
+
+// resetElectionTimer sets the time an election starts at if no leader is heard from until then to a random time
+// between one and two election timeouts from now. The caller must hold the lock.
+func (r *Raft) resetElectionTimer() {
+	r.electionDeadline = time.Now().Add(r.electionTimeout + time.Duration(rand.Int63n(int64(r.electionTimeout))))
+}
+
+// startElection makes the server a candidate of a new term and asks the other servers for their votes.
+// A server that is not in the cluster never starts an election. The caller must hold the lock.
+func (r *Raft) startElection() {
+	r.resetElectionTimer()
+	if !r.isVoter(r.id) {
+		return
+	}
+	if err := r.setTerm(r.currentTerm+1, r.id); err != nil {
+		log.Printf("raft 保存状态失败:%v\n", err)
+		return
+	}
+	r.state = Candidate
+	r.leader = ""
+	term := r.currentTerm
+	req := &RequestVoteRequest{
+		Term:         term,
+		CandidateID:  r.id,
+		LastLogIndex: r.log.lastIndex(),
+		LastLogTerm:  r.log.lastTerm(),
+	}
+	votes := 1
+	if votes >= r.quorum() {
+		r.becomeLeader()
+		return
+	}
+	for _, server := range r.servers {
+		if server.ID == r.id {
+			continue
+		}
+		server := server
+		r.goroutine(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), r.electionTimeout)
+			defer cancel()
+			resp, err := r.transport.RequestVote(ctx, server.Address, req)
+			if err != nil {
+				return
+			}
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if resp.Term > r.currentTerm {
+				r.becomeFollower(resp.Term)
+				return
+			}
+			if r.state != Candidate || r.currentTerm != term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes == r.quorum() {
+				r.becomeLeader()
+			}
+		})
+	}
+}
+
+// becomeLeader makes the candidate the leader of its term: it appends an entry of its term, which commits the
+// entries left by the leaders before it, and starts replicating its log to the other servers.
+// The caller must hold the lock.
+func (r *Raft) becomeLeader() {
+	r.state = Leader
+	r.leader = r.id
+	r.peers = make(map[string]*peer)
+	entry := Entry{Index: r.log.lastIndex() + 1, Term: r.currentTerm, Type: EntryNoop}
+	if err := r.log.append(entry); err != nil {
+		log.Printf("raft 追加日志失败:%v\n", err)
+		r.becomeFollower(r.currentTerm)
+		return
+	}
+	r.leaderStartIndex = entry.Index
+	r.updatePeers()
+	r.advanceCommit()
+}
+
+// becomeFollower makes the server a follower in term, which is at least its current term.
+// The caller must hold the lock.
+func (r *Raft) becomeFollower(term uint64) {
+	if term > r.currentTerm {
+		if err := r.setTerm(term, ""); err != nil {
+			log.Printf("raft 保存状态失败:%v\n", err)
+		}
+		r.leader = ""
+	}
+	r.stopLeading(ErrLeadershipLost)
+	r.state = Follower
+}
+
+// followLeader makes the server a follower of leader in term, which is at least its current term, as it hears
+// from it. The caller must hold the lock.
+func (r *Raft) followLeader(term uint64, leader string) {
+	if term > r.currentTerm || r.state != Follower {
+		r.becomeFollower(term)
+	}
+	r.leader = leader
+	r.lastContact = time.Now()
+	r.resetElectionTimer()
+}
+
+// stopLeading stops the replication of a leader and fails the entries waiting to be applied with err, except for
+// those already committed, which are applied anyway unless the server is shut down. The caller must hold the lock.
+func (r *Raft) stopLeading(err error) {
+	for _, peer := range r.peers {
+		close(peer.stop)
+	}
+	r.peers = nil
+	for index, p := range r.proposals {
+		if index <= r.commitIndex && err != ErrShutdown {
+			continue
+		}
+		p.done <- proposalResult{err: err}
+		delete(r.proposals, index)
+	}
+}
+
+// setTerm saves term and the vote cast in it before making them current. The caller must hold the lock.
+func (r *Raft) setTerm(term uint64, votedFor string) error {
+	if err := saveState(r.dir, term, votedFor); err != nil {
+		return err
+	}
+	r.currentTerm, r.votedFor = term, votedFor
+	return nil
+}
+
+// checkQuorum makes a leader that has not heard from a majority of the cluster for an election timeout step down,
+// as another leader may have been elected without it. The caller must hold the lock.
+func (r *Raft) checkQuorum() {
+	contacts := 0
+	for _, server := range r.servers {
+		if server.ID == r.id {
+			contacts++
+		} else if p := r.peers[server.ID]; p != nil && time.Since(p.lastContact) < r.electionTimeout {
+			contacts++
+		}
+	}
+	if contacts < r.quorum() {
+		log.Printf("raft %s 失去多数派，不再是领导者\n", r.id)
+		r.becomeFollower(r.currentTerm)
+	}
+}
+
+// isVoter reports whether the server id is in the cluster. The caller must hold the lock.
+func (r *Raft) isVoter(id string) bool {
+	for _, server := range r.servers {
+		if server.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// quorum returns how many servers of the cluster make a majority. The caller must hold the lock.
+func (r *Raft) quorum() int {
+	return len(r.servers)/2 + 1
+}
+
+// latestServers returns the servers of the latest configuration in the log, or of the snapshot if the log holds
+// none, along with the index it was set at. The caller must hold the lock.
+func (r *Raft) latestServers() ([]Server, uint64) {
+	return r.serversAt(r.log.lastIndex())
+}
+
+// serversAt returns the servers of the cluster as of index, along with the index they were set at.
+// The caller must hold the lock.
+func (r *Raft) serversAt(index uint64) ([]Server, uint64) {
+	for i := index; i > r.log.baseIndex; i-- {
+		if entry := r.log.entry(i); entry.Type == EntryConfiguration {
+			servers, _ := decodeServers(entry.Data)
+			return servers, i
+		}
+	}
+	return r.snapshot.Servers, r.snapshot.Index
+}
+
+// goroutine runs f in a goroutine Shutdown waits for, unless the server is shut down.
+// The caller must hold the lock.
+func (r *Raft) goroutine(f func()) {
+	if r.isShutdown {
+		return
+	}
+	r.done.Add(1)
+	go func() {
+		defer r.done.Done()
+		f()
+	}()
+}
+
+// notifyApply wakes the goroutine applying the committed entries. The caller must hold the lock.
+func (r *Raft) notifyApply() {
+	select {
+	case r.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// runApply applies the committed entries to the state machine as they are committed.
+func (r *Raft) runApply() {
+	defer r.done.Done()
+	for {
+		select {
+		case <-r.shutdownCh:
+			return
+		case <-r.applyCh:
+		}
+		r.applyCommitted()
+	}
+}
+
+// applyCommitted applies the entries committed since the last one applied, hands their results to the proposals
+// waiting for them, and takes a snapshot once enough entries have been applied since the last one.
+func (r *Raft) applyCommitted() {
+	r.applyLock.Lock()
+	defer r.applyLock.Unlock()
+	for {
+		r.lock.Lock()
+		if r.lastApplied >= r.commitIndex || r.isShutdown {
+			r.lock.Unlock()
+			break
+		}
+		entries := r.log.slice(r.lastApplied+1, min(r.commitIndex, r.lastApplied+maxApplyBatch))
+		r.lock.Unlock()
+
+		for i := range entries {
+			entry := &entries[i]
+			var value interface{}
+			if entry.Type == EntryCommand {
+				value = r.fsm.Apply(entry.Index, entry.Data)
+			}
+			r.lock.Lock()
+			r.lastApplied = entry.Index
+			p := r.proposals[entry.Index]
+			delete(r.proposals, entry.Index)
+			r.lock.Unlock()
+			if p == nil {
+				continue
+			}
+			if p.term == entry.Term {
+				p.done <- proposalResult{value: value}
+			} else {
+				p.done <- proposalResult{err: ErrLeadershipLost}
+			}
+		}
+	}
+
+	r.lock.Lock()
+	due := r.snapshotThreshold > 0 && r.lastApplied-r.snapshot.Index >= r.snapshotThreshold
+	r.lock.Unlock()
+	if due {
+		if err := r.takeSnapshot(); err != nil {
+			log.Printf("raft 快照失败:%v\n", err)
+		}
+	}
+}
+
+// takeSnapshot snapshots the state machine as of the last entry applied and compacts the log up to it.
+// The caller must hold the apply lock.
+func (r *Raft) takeSnapshot() error {
+	r.lock.Lock()
+	meta := &snapshotMeta{Index: r.lastApplied}
+	meta.Term, _ = r.log.term(meta.Index)
+	meta.Servers, _ = r.serversAt(meta.Index)
+	r.lock.Unlock()
+
+	if err := r.writeSnapshot(meta); err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.snapshot = meta
+	return r.log.compact(meta.Index, meta.Term)
+}
+
+// writeSnapshot has the state machine write its state to the data of the snapshot meta, then makes it the latest
+// snapshot. The caller must hold the apply lock.
+func (r *Raft) writeSnapshot(meta *snapshotMeta) error {
+	dir := filepath.Join(r.dir, "snapshot.tmp")
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := r.fsm.Snapshot(dir); err != nil {
+		return err
+	}
+	if err := packDir(dir, filepath.Join(r.dir, meta.dataFile())); err != nil {
+		return err
+	}
+	return saveSnapshotMeta(r.dir, meta)
+}
+
+// restoreSnapshot replaces the state of the state machine with the snapshot meta, or with the empty state if meta
+// describes no snapshot. The caller must hold the apply lock.
+func (r *Raft) restoreSnapshot(meta *snapshotMeta) error {
+	dir := filepath.Join(r.dir, "snapshot.restore")
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if meta.Index == 0 {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	} else if err := unpackDir(filepath.Join(r.dir, meta.dataFile()), dir); err != nil {
+		return err
+	}
+	return r.fsm.Restore(dir)
+}
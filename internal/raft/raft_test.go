@@ -0,0 +1,342 @@
+package raft
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testStateMachine is a map of strings set by commands given as key=value.
+type testStateMachine struct {
+	lock *sync.Mutex
+	data map[string]string
+}
+
+func newTestStateMachine() *testStateMachine {
+	return &testStateMachine{lock: &sync.Mutex{}, data: make(map[string]string)}
+}
+
+func (m *testStateMachine) Apply(index uint64, command []byte) interface{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key, value, _ := strings.Cut(string(command), "=")
+	m.data[key] = value
+	return len(m.data)
+}
+
+func (m *testStateMachine) Snapshot(dir string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var lines []string
+	for key, value := range m.data {
+		lines = append(lines, key+"="+value+"\n")
+	}
+	sort.Strings(lines)
+	return os.WriteFile(filepath.Join(dir, "data"), []byte(strings.Join(lines, "")), 0644)
+}
+
+func (m *testStateMachine) Restore(dir string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.data = make(map[string]string)
+	file, err := os.Open(filepath.Join(dir, "data"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		m.data[key] = value
+	}
+	return scanner.Err()
+}
+
+func (m *testStateMachine) get(key string) string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.data[key]
+}
+
+func (m *testStateMachine) size() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.data)
+}
+
+type testNode struct {
+	server Server
+	dir    string
+	fsm    *testStateMachine
+	raft   *Raft
+}
+
+// testCluster runs servers in one process over an in-memory network.
+type testCluster struct {
+	t       *testing.T
+	network *InmemNetwork
+	nodes   []*testNode
+}
+
+var testOptions = []Options{ElectionTimeout(100 * time.Millisecond), HeartbeatInterval(20 * time.Millisecond)}
+
+// newTestCluster bootstraps a cluster of n servers.
+func newTestCluster(t *testing.T, n int, options ...Options) *testCluster {
+	c := &testCluster{t: t, network: NewInmemNetwork()}
+	var servers []Server
+	for i := 1; i <= n; i++ {
+		servers = append(servers, Server{ID: fmt.Sprintf("node%d", i), Address: fmt.Sprintf("addr%d", i)})
+	}
+	for _, server := range servers {
+		c.start(server, append(options, Bootstrap(servers...))...)
+	}
+	return c
+}
+
+// start starts a server with a state of its own.
+func (c *testCluster) start(server Server, options ...Options) *testNode {
+	node := &testNode{server: server, dir: filepath.Join(c.t.TempDir(), server.ID), fsm: newTestStateMachine()}
+	c.nodes = append(c.nodes, node)
+	c.restart(node, options...)
+	return node
+}
+
+// restart starts a server again from its directory.
+func (c *testCluster) restart(node *testNode, options ...Options) {
+	r, err := NewRaft(node.server.ID, node.dir, node.fsm, c.network.Transport(node.server.Address),
+		append(append([]Options(nil), testOptions...), options...)...)
+	if !assert.NoError(c.t, err) {
+		c.t.FailNow()
+	}
+	node.raft = r
+	c.t.Cleanup(func() { r.Shutdown() })
+}
+
+// leader waits until a single server of nodes is the leader and returns it.
+func (c *testCluster) leader(nodes ...*testNode) *testNode {
+	if len(nodes) == 0 {
+		nodes = c.nodes
+	}
+	var leader *testNode
+	assert.Eventually(c.t, func() bool {
+		leader = nil
+		for _, node := range nodes {
+			if node.raft.Status().State == Leader {
+				if leader != nil {
+					return false
+				}
+				leader = node
+			}
+		}
+		return leader != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	if leader == nil {
+		c.t.FailNow()
+	}
+	return leader
+}
+
+// apply applies command through the leader of nodes, retrying while leadership changes.
+func (c *testCluster) apply(command string, nodes ...*testNode) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := c.leader(nodes...).raft.Apply(ctx, []byte(command))
+		cancel()
+		if err == nil {
+			return
+		}
+	}
+	c.t.Fatalf("failed to apply %s", command)
+}
+
+// waitConverged waits until every server of nodes has applied what the first one has applied.
+func (c *testCluster) waitConverged(nodes ...*testNode) {
+	if len(nodes) == 0 {
+		nodes = c.nodes
+	}
+	assert.Eventually(c.t, func() bool {
+		applied := nodes[0].raft.Status().AppliedIndex
+		for _, node := range nodes {
+			if status := node.raft.Status(); status.AppliedIndex != applied || status.CommitIndex != applied {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, node := range nodes[1:] {
+		node.fsm.lock.Lock()
+		assert.Equal(c.t, nodes[0].fsm.data, node.fsm.data, node.server.ID)
+		node.fsm.lock.Unlock()
+	}
+}
+
+func TestRaft_Replication(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader()
+
+	for i := 0; i < 50; i++ {
+		value, err := leader.raft.Apply(context.Background(), []byte(fmt.Sprintf("k%d=%d", i, i)))
+		assert.NoError(t, err)
+		assert.Equal(t, i+1, value)
+	}
+	c.waitConverged()
+	for _, node := range c.nodes {
+		assert.Equal(t, "49", node.fsm.get("k49"))
+		if node != leader {
+			_, err := node.raft.Apply(context.Background(), []byte("x=1"))
+			assert.ErrorIs(t, err, ErrNotLeader)
+			assert.Equal(t, leader.server.ID, node.raft.Status().Leader)
+		}
+	}
+}
+
+func TestRaft_LeaderFailover(t *testing.T) {
+	c := newTestCluster(t, 3)
+	old := c.leader()
+	c.apply("a=1")
+	c.waitConverged()
+
+	// 旧领导者与集群隔离，写入无法提交
+	c.network.Disconnect(old.server.Address)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	_, err := old.raft.Apply(ctx, []byte("a=lost"))
+	cancel()
+	assert.Error(t, err)
+
+	var others []*testNode
+	for _, node := range c.nodes {
+		if node != old {
+			others = append(others, node)
+		}
+	}
+	c.leader(others...)
+	c.apply("a=2", others...)
+	c.apply("b=2", others...)
+	assert.Eventually(t, func() bool { return old.raft.Status().State != Leader }, time.Second, 10*time.Millisecond)
+
+	// 重新连接后旧领导者未提交的日志被覆盖
+	c.network.Reconnect(old.server.Address)
+	c.apply("c=3")
+	c.waitConverged()
+	assert.Equal(t, "2", old.fsm.get("a"))
+	assert.Equal(t, "3", old.fsm.get("c"))
+}
+
+func TestRaft_Snapshot(t *testing.T) {
+	c := newTestCluster(t, 3, SnapshotThreshold(10))
+	leader := c.leader()
+	var lagging *testNode
+	for _, node := range c.nodes {
+		if node != leader {
+			lagging = node
+			break
+		}
+	}
+
+	// 落后的跟随者需要的日志已被压缩，领导者发送快照
+	c.network.Disconnect(lagging.server.Address)
+	for i := 0; i < 35; i++ {
+		c.apply(fmt.Sprintf("k%d=%d", i, i))
+	}
+	assert.Eventually(t, func() bool {
+		return leader.raft.Status().AppliedIndex >= 35
+	}, time.Second, 10*time.Millisecond)
+	leader.raft.lock.Lock()
+	assert.Greater(t, leader.raft.log.baseIndex, uint64(1))
+	leader.raft.lock.Unlock()
+	c.network.Reconnect(lagging.server.Address)
+	c.apply("after=1")
+	c.waitConverged()
+	assert.Equal(t, 36, lagging.fsm.size())
+
+	// 重启后状态机从快照恢复，之后的日志重新应用
+	for _, node := range c.nodes {
+		assert.NoError(t, node.raft.Shutdown())
+		node.fsm.Restore(t.TempDir())
+	}
+	for _, node := range c.nodes {
+		c.restart(node, SnapshotThreshold(10))
+	}
+	c.apply("restarted=1")
+	c.waitConverged()
+	for _, node := range c.nodes {
+		assert.Equal(t, 37, node.fsm.size(), node.server.ID)
+		assert.Equal(t, "34", node.fsm.get("k34"))
+	}
+}
+
+func TestRaft_Membership(t *testing.T) {
+	c := newTestCluster(t, 1)
+	first := c.leader()
+	c.apply("a=1")
+
+	// 新服务器不带 Bootstrap 启动，由领导者加入集群
+	second := c.start(Server{ID: "node2", Address: "addr2"})
+	third := c.start(Server{ID: "node3", Address: "addr3"})
+	ctx := context.Background()
+	assert.NoError(t, first.raft.AddServer(ctx, second.server))
+	assert.NoError(t, first.raft.AddServer(ctx, third.server))
+	assert.NoError(t, first.raft.AddServer(ctx, third.server))
+	assert.ErrorIs(t, first.raft.AddServer(ctx, Server{ID: "node3", Address: "other"}), ErrServerExists)
+	assert.ErrorIs(t, first.raft.RemoveServer(ctx, "node4"), ErrUnknownServer)
+	_, err := second.raft.Apply(ctx, []byte("x=1"))
+	assert.ErrorIs(t, err, ErrNotLeader)
+	assert.ErrorIs(t, second.raft.AddServer(ctx, Server{ID: "node4", Address: "addr4"}), ErrNotLeader)
+	c.apply("b=2")
+	c.waitConverged()
+	assert.Len(t, third.raft.Status().Servers, 3)
+	assert.Equal(t, "1", third.fsm.get("a"))
+
+	// 领导者移除自己后退位，其余服务器选出新的领导者
+	assert.NoError(t, first.raft.RemoveServer(ctx, first.server.ID))
+	assert.Eventually(t, func() bool { return first.raft.Status().State == Follower }, time.Second, 10*time.Millisecond)
+	leader := c.leader(second, third)
+	assert.Len(t, leader.raft.Status().Servers, 2)
+	c.apply("c=3", second, third)
+	c.waitConverged(second, third)
+	assert.Equal(t, Follower, first.raft.Status().State)
+	other := second
+	if leader == second {
+		other = third
+	}
+	assert.NoError(t, leader.raft.RemoveServer(ctx, other.server.ID))
+	assert.ErrorIs(t, leader.raft.RemoveServer(ctx, leader.server.ID), ErrLastServer)
+}
+
+func TestParseServers(t *testing.T) {
+	servers, err := ParseServers([]string{"a=127.0.0.1:1", "b=host:2"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Server{{ID: "a", Address: "127.0.0.1:1"}, {ID: "b", Address: "host:2"}}, servers)
+	_, err = ParseServers([]string{"a"})
+	assert.Error(t, err)
+}
+
+func TestHasState(t *testing.T) {
+	c := newTestCluster(t, 1)
+	node := c.nodes[0]
+	hasState, err := HasState(t.TempDir())
+	assert.NoError(t, err)
+	assert.False(t, hasState)
+
+	c.leader()
+	assert.NoError(t, node.raft.Shutdown())
+	hasState, err = HasState(node.dir)
+	assert.NoError(t, err)
+	assert.True(t, hasState)
+}
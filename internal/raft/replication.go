@@ -0,0 +1,227 @@
+package raft
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// updatePeers starts replicating the log of the leader to the servers of its configuration, and stops replicating
+// it to those no longer in it. The caller must hold the lock.
+func (r *Raft) updatePeers() {
+	servers := make(map[string]Server, len(r.servers))
+	for _, server := range r.servers {
+		if server.ID != r.id {
+			servers[server.ID] = server
+		}
+	}
+	for id, p := range r.peers {
+		if _, ok := servers[id]; !ok {
+			close(p.stop)
+			delete(r.peers, id)
+		}
+	}
+	for id, server := range servers {
+		if _, ok := r.peers[id]; ok {
+			continue
+		}
+		p := &peer{
+			server:      server,
+			nextIndex:   r.log.lastIndex() + 1,
+			lastContact: time.Now(),
+			trigger:     make(chan struct{}, 1),
+			stop:        make(chan struct{}),
+		}
+		r.peers[id] = p
+		term := r.currentTerm
+		r.goroutine(func() { r.replicate(p, term) })
+	}
+}
+
+// trigger wakes the goroutine replicating the log to p.
+func trigger(p *peer) {
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// replicate sends the log of the leader of term to p until it steps down or stops replicating to p: the entries p
+// lacks as soon as they are appended, or an empty request every heartbeat interval.
+func (r *Raft) replicate(p *peer, term uint64) {
+	for {
+		more := r.sendAppendEntries(p, term)
+		select {
+		case <-p.stop:
+			return
+		case <-r.shutdownCh:
+			return
+		default:
+		}
+		if more {
+			continue
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-r.shutdownCh:
+			return
+		case <-p.trigger:
+		case <-time.After(r.heartbeatInterval):
+		}
+	}
+}
+
+// sendAppendEntries sends p the entries it lacks, or the snapshot of the leader if the log no longer holds them,
+// and reports whether there is more to send.
+func (r *Raft) sendAppendEntries(p *peer, term uint64) bool {
+	r.lock.Lock()
+	if r.state != Leader || r.currentTerm != term {
+		r.lock.Unlock()
+		return false
+	}
+	if p.nextIndex <= r.log.baseIndex {
+		r.lock.Unlock()
+		return r.sendSnapshot(p, term)
+	}
+	prevIndex := p.nextIndex - 1
+	prevTerm, _ := r.log.term(prevIndex)
+	req := &AppendEntriesRequest{
+		Term:         term,
+		LeaderID:     r.id,
+		PrevLogIndex: prevIndex,
+		PrevLogTerm:  prevTerm,
+		Entries:      r.log.slice(p.nextIndex, min(r.log.lastIndex(), prevIndex+maxEntriesPerRequest)),
+		LeaderCommit: r.commitIndex,
+	}
+	r.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.electionTimeout)
+	defer cancel()
+	resp, err := r.transport.AppendEntries(ctx, p.server.Address, req)
+	if err != nil {
+		return false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if resp.Term > r.currentTerm {
+		r.becomeFollower(resp.Term)
+		return false
+	}
+	if r.state != Leader || r.currentTerm != term {
+		return false
+	}
+	p.lastContact = time.Now()
+	if resp.Success {
+		match := prevIndex + uint64(len(req.Entries))
+		if match > p.matchIndex {
+			p.matchIndex = match
+		}
+		p.nextIndex = match + 1
+		r.advanceCommit()
+	} else {
+		// 跟随者的日志在 prevIndex 处不一致，从它可能一致的位置重新发送
+		p.nextIndex = max(1, min(p.nextIndex-1, resp.LastIndex+1))
+	}
+	return p.nextIndex <= r.log.lastIndex()
+}
+
+// sendSnapshot sends p the latest snapshot of the leader, in chunks, and reports whether there is more to send.
+func (r *Raft) sendSnapshot(p *peer, term uint64) bool {
+	r.lock.Lock()
+	meta := r.snapshot
+	r.lock.Unlock()
+	file, err := os.Open(filepath.Join(r.dir, meta.dataFile()))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	for offset := int64(0); ; {
+		data := make([]byte, snapshotChunkSize)
+		n, err := io.ReadFull(file, data)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return false
+		}
+		req := &InstallSnapshotRequest{
+			Term:      term,
+			LeaderID:  r.id,
+			LastIndex: meta.Index,
+			LastTerm:  meta.Term,
+			Servers:   meta.Servers,
+			Offset:    offset,
+			Data:      data[:n],
+			Done:      n < snapshotChunkSize,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*r.electionTimeout)
+		resp, err := r.transport.InstallSnapshot(ctx, p.server.Address, req)
+		cancel()
+		if err != nil {
+			return false
+		}
+
+		r.lock.Lock()
+		if resp.Term > r.currentTerm {
+			r.becomeFollower(resp.Term)
+		}
+		if r.state != Leader || r.currentTerm != term {
+			r.lock.Unlock()
+			return false
+		}
+		p.lastContact = time.Now()
+		if req.Done {
+			if meta.Index > p.matchIndex {
+				p.matchIndex = meta.Index
+			}
+			p.nextIndex = meta.Index + 1
+			r.advanceCommit()
+			more := p.nextIndex <= r.log.lastIndex()
+			r.lock.Unlock()
+			return more
+		}
+		r.lock.Unlock()
+		offset += int64(n)
+	}
+}
+
+// advanceCommit commits the entries of the current term stored by a majority of the cluster, along with those
+// before them. A leader no longer in the cluster steps down once that is committed.
+// The caller must hold the lock.
+func (r *Raft) advanceCommit() {
+	for index := r.log.lastIndex(); index > r.commitIndex; index-- {
+		// 只按多数派提交当前任期的日志，之前任期的日志随之提交
+		if term, _ := r.log.term(index); term != r.currentTerm {
+			return
+		}
+		if r.replicas(index) < r.quorum() {
+			continue
+		}
+		r.commitIndex = index
+		r.notifyApply()
+		for _, p := range r.peers {
+			trigger(p)
+		}
+		if r.serversIndex <= index && !r.isVoter(r.id) {
+			r.becomeFollower(r.currentTerm)
+		}
+		return
+	}
+}
+
+// replicas returns how many servers of the cluster store the entry at index. The caller must hold the lock.
+func (r *Raft) replicas(index uint64) int {
+	count := 0
+	for _, server := range r.servers {
+		if server.ID == r.id {
+			if r.log.lastIndex() >= index {
+				count++
+			}
+		} else if p := r.peers[server.ID]; p != nil && p.matchIndex >= index {
+			count++
+		}
+	}
+	return count
+}
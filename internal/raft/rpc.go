@@ -0,0 +1,197 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// HandleRequestVote grants the vote of the server to a candidate whose log is at least as up to date as its own,
+// unless it has voted for another candidate in the term. A server that has heard from a leader within the election
+// timeout ignores candidates, so that a server removed from the cluster cannot disrupt it.
+func (r *Raft) HandleRequestVote(req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.isShutdown {
+		return nil, ErrShutdown
+	}
+	resp := &RequestVoteResponse{Term: r.currentTerm}
+	if req.Term < r.currentTerm {
+		return resp, nil
+	}
+	if r.state == Leader || (r.leader != "" && time.Since(r.lastContact) < r.electionTimeout) {
+		return resp, nil
+	}
+	if req.Term > r.currentTerm {
+		r.becomeFollower(req.Term)
+		resp.Term = r.currentTerm
+	}
+	if r.votedFor != "" && r.votedFor != req.CandidateID {
+		return resp, nil
+	}
+	lastTerm := r.log.lastTerm()
+	if req.LastLogTerm < lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex < r.log.lastIndex()) {
+		return resp, nil
+	}
+	if err := r.setTerm(r.currentTerm, req.CandidateID); err != nil {
+		return nil, err
+	}
+	resp.Granted = true
+	r.resetElectionTimer()
+	return resp, nil
+}
+
+// HandleAppendEntries stores the entries sent by the leader, once the log of the server agrees with that of the
+// leader up to the entry before them, dropping the entries of the server that conflict with them.
+func (r *Raft) HandleAppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.isShutdown {
+		return nil, ErrShutdown
+	}
+	resp := &AppendEntriesResponse{Term: r.currentTerm}
+	if req.Term < r.currentTerm {
+		return resp, nil
+	}
+	r.followLeader(req.Term, req.LeaderID)
+	resp.Term = r.currentTerm
+
+	if req.PrevLogIndex > r.log.lastIndex() {
+		resp.LastIndex = r.log.lastIndex()
+		return resp, nil
+	}
+	entries := req.Entries
+	if req.PrevLogIndex < r.log.baseIndex {
+		// 快照中的日志都已提交，必然与领导者一致
+		skip := r.log.baseIndex - req.PrevLogIndex
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		entries = entries[skip:]
+	} else if term, _ := r.log.term(req.PrevLogIndex); term != req.PrevLogTerm {
+		resp.LastIndex = req.PrevLogIndex - 1
+		return resp, nil
+	}
+
+	for i, entry := range entries {
+		if entry.Index <= r.log.lastIndex() {
+			if term, _ := r.log.term(entry.Index); term == entry.Term {
+				continue
+			}
+			if err := r.log.truncate(entry.Index); err != nil {
+				return nil, err
+			}
+			r.servers, r.serversIndex = r.latestServers()
+		}
+		if err := r.log.append(entries[i:]...); err != nil {
+			return nil, err
+		}
+		for _, appended := range entries[i:] {
+			if appended.Type == EntryConfiguration {
+				r.servers, _ = decodeServers(appended.Data)
+				r.serversIndex = appended.Index
+			}
+		}
+		break
+	}
+
+	lastNew := req.PrevLogIndex + uint64(len(req.Entries))
+	if commit := min(req.LeaderCommit, lastNew); commit > r.commitIndex {
+		r.commitIndex = commit
+		r.notifyApply()
+	}
+	resp.Success = true
+	resp.LastIndex = lastNew
+	return resp, nil
+}
+
+// HandleInstallSnapshot stores a chunk of the snapshot sent by the leader. Once the last chunk is stored, the
+// snapshot replaces the log of the server up to its last entry, and the state of the state machine, unless the
+// server has already applied that entry.
+func (r *Raft) HandleInstallSnapshot(req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	r.applyLock.Lock()
+	defer r.applyLock.Unlock()
+	r.lock.Lock()
+	if r.isShutdown {
+		r.lock.Unlock()
+		return nil, ErrShutdown
+	}
+	resp := &InstallSnapshotResponse{Term: r.currentTerm}
+	if req.Term < r.currentTerm {
+		r.lock.Unlock()
+		return resp, nil
+	}
+	r.followLeader(req.Term, req.LeaderID)
+	resp.Term = r.currentTerm
+
+	path := filepath.Join(r.dir, receivingFileName)
+	if err := writeChunk(path, req.Offset, req.Data, req.Done); err != nil {
+		r.lock.Unlock()
+		return nil, err
+	}
+	if !req.Done || req.LastIndex <= r.lastApplied {
+		r.lock.Unlock()
+		return resp, nil
+	}
+
+	meta := &snapshotMeta{Index: req.LastIndex, Term: req.LastTerm, Servers: req.Servers}
+	err := os.Rename(path, filepath.Join(r.dir, meta.dataFile()))
+	if err == nil {
+		err = saveSnapshotMeta(r.dir, meta)
+	}
+	if err == nil {
+		r.snapshot = meta
+		err = r.log.compact(meta.Index, meta.Term)
+	}
+	if err != nil {
+		r.lock.Unlock()
+		return nil, err
+	}
+	r.servers, r.serversIndex = r.latestServers()
+	if meta.Index > r.commitIndex {
+		r.commitIndex = meta.Index
+	}
+	r.lock.Unlock()
+
+	err = r.restoreSnapshot(meta)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lastApplied = meta.Index
+	// 恢复状态机期间没有处理心跳
+	r.resetElectionTimer()
+	r.notifyApply()
+	if err != nil {
+		return nil, fmt.Errorf("restore snapshot failed: %w", err)
+	}
+	return resp, nil
+}
+
+// writeChunk writes the chunk at offset of a snapshot to the file at path, which the first chunk creates, and
+// syncs the file after the last one.
+func writeChunk(path string, offset int64, data []byte, last bool) error {
+	flag := os.O_WRONLY
+	if offset == 0 {
+		flag |= os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != offset {
+		return errors.New("unexpected snapshot chunk offset")
+	}
+	if _, err := file.WriteAt(data, offset); err != nil {
+		return err
+	}
+	if last {
+		return file.Sync()
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package raft
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// snapshotFileName is the file describing the latest snapshot, whose data is in the file named after its term
+	// and index.
+	snapshotFileName = "SNAPSHOT"
+	// receivingFileName is the file the chunks of a snapshot sent by the leader are written to.
+	receivingFileName = "snapshot.receiving"
+	// snapshotChunkSize is the size of the chunks a snapshot is sent in.
+	snapshotChunkSize = 1 << 20
+)
+
+var ErrSnapshotCorrupt = errors.New("raft snapshot is corrupt")
+
+// snapshotMeta describes a snapshot: the index and term of the last entry it holds, and the servers of the cluster
+// as of that entry. A zero Index means there is no snapshot.
+type snapshotMeta struct {
+	Index   uint64
+	Term    uint64
+	Servers []Server
+}
+
+// dataFile returns the name of the file holding the data of the snapshot.
+func (meta *snapshotMeta) dataFile() string {
+	return fmt.Sprintf("snapshot-%d-%d.tar", meta.Term, meta.Index)
+}
+
+// saveSnapshotMeta makes meta the latest snapshot of dir:
+//
+//	uvarint index | uvarint term | servers | crc32(4)
+//
+// and removes the data of the snapshots before it.
+func saveSnapshotMeta(dir string, meta *snapshotMeta) error {
+	buf := binary.AppendUvarint(nil, meta.Index)
+	buf = binary.AppendUvarint(buf, meta.Term)
+	buf = appendServers(buf, meta.Servers)
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	if err := writeFileAtomic(filepath.Join(dir, snapshotFileName), buf); err != nil {
+		return err
+	}
+	removeStaleSnapshots(dir, meta)
+	return nil
+}
+
+// readSnapshotMeta reads the latest snapshot of dir, which has a zero Index if there is none.
+func readSnapshotMeta(dir string) (*snapshotMeta, error) {
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return &snapshotMeta{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 || crc32.ChecksumIEEE(data[:len(data)-4]) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return nil, ErrSnapshotCorrupt
+	}
+	reader := bytes.NewReader(data[:len(data)-4])
+	meta := &snapshotMeta{}
+	var err1, err2 error
+	meta.Index, err1 = binary.ReadUvarint(reader)
+	meta.Term, err2 = binary.ReadUvarint(reader)
+	if err1 != nil || err2 != nil {
+		return nil, ErrSnapshotCorrupt
+	}
+	if meta.Servers, err = readServers(reader); err != nil || reader.Len() > 0 {
+		return nil, ErrSnapshotCorrupt
+	}
+	return meta, nil
+}
+
+// removeStaleSnapshots removes the data of the snapshots other than meta, left behind by a crash or replaced.
+func removeStaleSnapshots(dir string, meta *snapshotMeta) {
+	stale, _ := filepath.Glob(filepath.Join(dir, "snapshot-*.tar"))
+	for _, path := range stale {
+		if filepath.Base(path) != meta.dataFile() {
+			os.Remove(path)
+		}
+	}
+}
+
+// appendServers appends servers to buf as uvarint count | (uvarint idLen | id | uvarint addressLen | address)...
+func appendServers(buf []byte, servers []Server) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(servers)))
+	for _, server := range servers {
+		buf = binary.AppendUvarint(buf, uint64(len(server.ID)))
+		buf = append(buf, server.ID...)
+		buf = binary.AppendUvarint(buf, uint64(len(server.Address)))
+		buf = append(buf, server.Address...)
+	}
+	return buf
+}
+
+// readServers reads servers encoded by appendServers.
+func readServers(reader *bytes.Reader) ([]Server, error) {
+	readString := func() (string, error) {
+		length, err := binary.ReadUvarint(reader)
+		if err != nil || length > uint64(reader.Len()) {
+			return "", io.ErrUnexpectedEOF
+		}
+		s := make([]byte, length)
+		reader.Read(s)
+		return string(s), nil
+	}
+	count, err := binary.ReadUvarint(reader)
+	if err != nil || count > uint64(reader.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	servers := make([]Server, 0, count)
+	for i := uint64(0); i < count; i++ {
+		id, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		address, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, Server{ID: id, Address: address})
+	}
+	return servers, nil
+}
+
+// encodeServers encodes servers as the data of a configuration entry.
+func encodeServers(servers []Server) []byte {
+	return appendServers(nil, servers)
+}
+
+// decodeServers decodes the data of a configuration entry.
+func decodeServers(data []byte) ([]Server, error) {
+	return readServers(bytes.NewReader(data))
+}
+
+// packDir writes the files under dir to path as a tar archive, and syncs it.
+func packDir(dir string, path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := tar.NewWriter(file)
+	err = filepath.WalkDir(dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || filePath == dir {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := writer.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		src, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(writer, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// unpackDir extracts the tar archive at path, written by packDir, to dir.
+func unpackDir(path string, dir string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// 快照来自其他服务器，文件不能写到目录之外
+		name := filepath.FromSlash(header.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("%w: invalid file name %s", ErrSnapshotCorrupt, header.Name)
+		}
+		target := filepath.Join(dir, name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			dst, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(dst, reader)
+			if closeErr := dst.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: unsupported file %s", ErrSnapshotCorrupt, header.Name)
+		}
+	}
+}
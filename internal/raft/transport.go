@@ -0,0 +1,350 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+var ErrUnreachable = errors.New("raft server unreachable")
+
+// RequestVoteRequest asks a server for its vote in the election of a candidate.
+type RequestVoteRequest struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+// RequestVoteResponse tells a candidate whether it got the vote of a server.
+type RequestVoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+// AppendEntriesRequest replicates the entries following PrevLogIndex from the leader; it carries no entries when
+// it only keeps the leadership alive.
+type AppendEntriesRequest struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+// AppendEntriesResponse tells the leader whether a follower holds the entries up to LastIndex. When it does not,
+// LastIndex is where the log of the follower may last agree with that of the leader.
+type AppendEntriesResponse struct {
+	Term      uint64
+	Success   bool
+	LastIndex uint64
+}
+
+// InstallSnapshotRequest sends the chunk at Offset of the snapshot the leader replaces the log of a follower with,
+// once the follower is behind the entries the leader still holds. Done marks the last chunk.
+type InstallSnapshotRequest struct {
+	Term      uint64
+	LeaderID  string
+	LastIndex uint64
+	LastTerm  uint64
+	Servers   []Server
+	Offset    int64
+	Data      []byte
+	Done      bool
+}
+
+// InstallSnapshotResponse acknowledges a chunk of a snapshot.
+type InstallSnapshotResponse struct {
+	Term uint64
+}
+
+// Handler serves the requests a server receives from the other servers of its cluster. Raft implements it.
+type Handler interface {
+	HandleRequestVote(req *RequestVoteRequest) (*RequestVoteResponse, error)
+	HandleAppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	HandleInstallSnapshot(req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+}
+
+// Transport carries the requests of Raft between the servers of a cluster, which it reaches by their address.
+// Serve starts delivering the requests sent to the server to handler, and Close stops it.
+type Transport interface {
+	Serve(handler Handler)
+	RequestVote(ctx context.Context, address string, req *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(ctx context.Context, address string, req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	InstallSnapshot(ctx context.Context, address string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+	Close() error
+}
+
+// InmemNetwork connects the servers of a cluster running in one process, such as in tests. Each server gets its
+// transport from Transport, and servers can be cut off from the others and connected again to simulate partitions.
+type InmemNetwork struct {
+	lock         *sync.RWMutex
+	handlers     map[string]Handler
+	disconnected map[string]bool
+}
+
+// NewInmemNetwork returns a network without servers.
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{
+		lock:         &sync.RWMutex{},
+		handlers:     make(map[string]Handler),
+		disconnected: make(map[string]bool),
+	}
+}
+
+// Transport returns the transport of the server at address.
+func (n *InmemNetwork) Transport(address string) Transport {
+	return &inmemTransport{network: n, address: address}
+}
+
+// Disconnect cuts the server at address off from the others until Reconnect: the requests it sends and those sent
+// to it fail with ErrUnreachable.
+func (n *InmemNetwork) Disconnect(address string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.disconnected[address] = true
+}
+
+// Reconnect connects the server at address to the others again.
+func (n *InmemNetwork) Reconnect(address string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.disconnected, address)
+}
+
+// handler returns the handler of the server at to, if a request from the server at from can reach it.
+func (n *InmemNetwork) handler(from, to string) (Handler, error) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	handler, ok := n.handlers[to]
+	if !ok || n.disconnected[from] || n.disconnected[to] {
+		return nil, ErrUnreachable
+	}
+	return handler, nil
+}
+
+// inmemTransport is the transport of a server of an InmemNetwork, calling the handlers of the others directly.
+type inmemTransport struct {
+	network *InmemNetwork
+	address string
+}
+
+func (t *inmemTransport) Serve(handler Handler) {
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+	t.network.handlers[t.address] = handler
+}
+
+func (t *inmemTransport) RequestVote(ctx context.Context, address string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	handler, err := t.network.handler(t.address, address)
+	if err != nil {
+		return nil, err
+	}
+	return handler.HandleRequestVote(req)
+}
+
+func (t *inmemTransport) AppendEntries(ctx context.Context, address string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	handler, err := t.network.handler(t.address, address)
+	if err != nil {
+		return nil, err
+	}
+	return handler.HandleAppendEntries(req)
+}
+
+func (t *inmemTransport) InstallSnapshot(ctx context.Context, address string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	handler, err := t.network.handler(t.address, address)
+	if err != nil {
+		return nil, err
+	}
+	return handler.HandleInstallSnapshot(req)
+}
+
+func (t *inmemTransport) Close() error {
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+	delete(t.network.handlers, t.address)
+	return nil
+}
+
+// NetTransport carries the requests of Raft over TCP with net/rpc, keeping one connection to each server it sends
+// requests to.
+type NetTransport struct {
+	listener net.Listener
+	lock     *sync.Mutex
+	clients  map[string]*rpc.Client
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// NewNetTransport listens for the requests of the other servers at address.
+func NewNetTransport(address string) (*NetTransport, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &NetTransport{
+		listener: listener,
+		lock:     &sync.Mutex{},
+		clients:  make(map[string]*rpc.Client),
+		conns:    make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Addr returns the address the transport listens at.
+func (t *NetTransport) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// rpcHandler exposes a Handler to net/rpc.
+type rpcHandler struct {
+	handler Handler
+}
+
+func (h *rpcHandler) RequestVote(req *RequestVoteRequest, resp *RequestVoteResponse) error {
+	r, err := h.handler.HandleRequestVote(req)
+	if err == nil {
+		*resp = *r
+	}
+	return err
+}
+
+func (h *rpcHandler) AppendEntries(req *AppendEntriesRequest, resp *AppendEntriesResponse) error {
+	r, err := h.handler.HandleAppendEntries(req)
+	if err == nil {
+		*resp = *r
+	}
+	return err
+}
+
+func (h *rpcHandler) InstallSnapshot(req *InstallSnapshotRequest, resp *InstallSnapshotResponse) error {
+	r, err := h.handler.HandleInstallSnapshot(req)
+	if err == nil {
+		*resp = *r
+	}
+	return err
+}
+
+func (t *NetTransport) Serve(handler Handler) {
+	server := rpc.NewServer()
+	server.RegisterName("Raft", &rpcHandler{handler: handler})
+	go func() {
+		for {
+			conn, err := t.listener.Accept()
+			if err != nil {
+				return
+			}
+			t.lock.Lock()
+			if t.closed {
+				t.lock.Unlock()
+				conn.Close()
+				return
+			}
+			t.conns[conn] = struct{}{}
+			t.lock.Unlock()
+			go func() {
+				server.ServeConn(conn)
+				t.lock.Lock()
+				delete(t.conns, conn)
+				t.lock.Unlock()
+			}()
+		}
+	}()
+}
+
+func (t *NetTransport) RequestVote(ctx context.Context, address string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	resp := &RequestVoteResponse{}
+	return resp, t.call(ctx, address, "Raft.RequestVote", req, resp)
+}
+
+func (t *NetTransport) AppendEntries(ctx context.Context, address string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	resp := &AppendEntriesResponse{}
+	return resp, t.call(ctx, address, "Raft.AppendEntries", req, resp)
+}
+
+func (t *NetTransport) InstallSnapshot(ctx context.Context, address string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	resp := &InstallSnapshotResponse{}
+	return resp, t.call(ctx, address, "Raft.InstallSnapshot", req, resp)
+}
+
+// call sends a request to the server at address and waits for its response until ctx is done.
+// A connection that failed is dropped, and the next request connects again.
+func (t *NetTransport) call(ctx context.Context, address string, method string, req interface{}, resp interface{}) error {
+	client, err := t.client(ctx, address)
+	if err != nil {
+		return err
+	}
+	call := client.Go(method, req, resp, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		// 连接上可能还有未完成的请求，关闭后重新建立
+		t.dropClient(address, client)
+		return ctx.Err()
+	}
+	if _, ok := call.Error.(rpc.ServerError); call.Error != nil && !ok {
+		t.dropClient(address, client)
+	}
+	return call.Error
+}
+
+// client returns the connection to the server at address, connecting to it if needed.
+func (t *NetTransport) client(ctx context.Context, address string) (*rpc.Client, error) {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return nil, ErrShutdown
+	}
+	client, ok := t.clients[address]
+	t.lock.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	client = rpc.NewClient(conn)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		client.Close()
+		return nil, ErrShutdown
+	}
+	if existing, ok := t.clients[address]; ok {
+		client.Close()
+		return existing, nil
+	}
+	t.clients[address] = client
+	return client, nil
+}
+
+// dropClient closes the connection to the server at address, unless it has already been replaced.
+func (t *NetTransport) dropClient(address string, client *rpc.Client) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.clients[address] == client {
+		delete(t.clients, address)
+	}
+	client.Close()
+}
+
+func (t *NetTransport) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	for _, client := range t.clients {
+		client.Close()
+	}
+	for conn := range t.conns {
+		conn.Close()
+	}
+	return t.listener.Close()
+}
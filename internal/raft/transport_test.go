@@ -0,0 +1,58 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetTransport(t *testing.T) {
+	var transports []*NetTransport
+	var servers []Server
+	for i := 1; i <= 3; i++ {
+		transport, err := NewNetTransport("127.0.0.1:0")
+		assert.NoError(t, err)
+		transports = append(transports, transport)
+		servers = append(servers, Server{ID: fmt.Sprintf("node%d", i), Address: transport.Addr().String()})
+	}
+	var nodes []*testNode
+	for i, server := range servers {
+		node := &testNode{server: server, dir: filepath.Join(t.TempDir(), server.ID), fsm: newTestStateMachine()}
+		r, err := NewRaft(server.ID, node.dir, node.fsm, transports[i],
+			append(append([]Options(nil), testOptions...), Bootstrap(servers...))...)
+		assert.NoError(t, err)
+		node.raft = r
+		t.Cleanup(func() { r.Shutdown() })
+		nodes = append(nodes, node)
+	}
+
+	c := &testCluster{t: t, nodes: nodes}
+	for i := 0; i < 10; i++ {
+		c.apply(fmt.Sprintf("k%d=%d", i, i))
+	}
+	c.waitConverged()
+
+	// 关闭领导者后其余服务器选出新的领导者
+	leader := c.leader()
+	assert.NoError(t, leader.raft.Shutdown())
+	var others []*testNode
+	for _, node := range nodes {
+		if node != leader {
+			others = append(others, node)
+		}
+	}
+	c.apply("after=1", others...)
+	c.waitConverged(others...)
+	assert.Equal(t, "1", others[1].fsm.get("after"))
+
+	_, err := transports[0].AppendEntries(context.Background(), "127.0.0.1:1", &AppendEntriesRequest{})
+	assert.Error(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = leader.raft.transport.RequestVote(ctx, others[0].server.Address, &RequestVoteRequest{})
+	assert.ErrorIs(t, err, ErrShutdown)
+}